@@ -17,6 +17,8 @@ import (
 	"github.com/eycorsican/go-tun2socks/common/dns"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	_ "github.com/eycorsican/go-tun2socks/common/log/simple" // Register a simple logger.
+	"github.com/eycorsican/go-tun2socks/common/proc"
+	"github.com/eycorsican/go-tun2socks/common/shaping"
 	"github.com/eycorsican/go-tun2socks/core"
 	"github.com/eycorsican/go-tun2socks/filter"
 	"github.com/eycorsican/go-tun2socks/tun"
@@ -53,6 +55,8 @@ type CmdArgs struct {
 	ProxyPassword         *string
 	DelayICMP             *int
 	RelayICMP             *bool
+	ICMPEcho              *string
+	ICMPProbePort         *int
 	UdpTimeout            *time.Duration
 	DisableDnsCache       *bool
 	DnsFallback           *bool
@@ -67,6 +71,27 @@ type CmdArgs struct {
 	Stats                 *bool
 	SendThrough           *string
 	RpcPort               *int
+	UdpSessionMode        *string
+	UdpEIF                *bool
+	Mtu                   *int
+	TcpWindow             *int
+	TcpSendBuffer         *int
+	TcpConnectFirst       *bool
+	MaxTcpConns           *int
+	MaxTcpConnsPerSource  *int
+	MaxUdpConns           *int
+	MaxUdpConnsPerSource  *int
+	ResolveProcess        *bool
+	Capture               *string
+	CaptureListen         *string
+	CaptureFilter         *string
+	CaptureSnapLen        *int
+	CaptureMaxSize        *int
+	CaptureMaxFiles       *int
+	FilterRules           *string
+	Traceroute            *bool
+	TracerouteHops        *string
+	Shaping               *string
 }
 
 type cmdFlag uint
@@ -101,13 +126,22 @@ var args = new(CmdArgs)
 
 var lwipWriter io.Writer
 
+var capture *filter.Capture
+
+var filterChain *filter.Chain
+
+var icmpRelay io.Closer
+
 var dnsCache dns.DnsCache
 
 var fakeDns dns.FakeDns
 
-const (
-	MTU = 1500
-)
+// Whether processes of connections are resolved, it's set by handler
+// creaters which need them as well as by -resolveProcess.
+var resolveProcess bool
+
+// Maximum number of packets copied from TUN to the stack in a batch.
+const batchSize = 64
 
 func main() {
 	args.Version = flag.Bool("version", false, "Print version")
@@ -119,9 +153,32 @@ func main() {
 	args.ProxyType = flag.String("proxyType", "socks", "Proxy handler type")
 	args.DelayICMP = flag.Int("delayICMP", 10, "Delay ICMP packets for a short period of time, in milliseconds")
 	args.RelayICMP = flag.Bool("relayICMP", false, "Relay ICMP packets")
+	args.ICMPEcho = flag.String("icmpEcho", "filter", "How echo requests are answered if not relayed. (filter: delayed by delayICMP before the stack answers, delay: answered by the stack after delayICMP, probe: answered once the proxy has connected to the destination)")
+	args.ICMPProbePort = flag.Int("icmpProbePort", 443, "Port connected to for answering echo requests in probe mode")
 	args.LogLevel = flag.String("loglevel", "info", "Logging level. (debug, info, warn, error, none)")
 	args.SendThrough = flag.String("sendThrough", "192.168.0.100", "Send through address.")
 	args.RpcPort = flag.Int("rpcPort", 6002, "Management RPC port.")
+	args.UdpSessionMode = flag.String("udpSessionMode", "fullcone", "UDP session mode. (fullcone, symmetric)")
+	args.UdpEIF = flag.Bool("udpEndpointIndependentFiltering", true, "Accept UDP packets from any remote address, not only from those have been sent to")
+	args.Mtu = flag.Int("mtu", 1500, "MTU of the TUN interface, it should match the MTU configured on the device")
+	args.TcpWindow = flag.Int("tcpWindow", 0, "TCP receive window in bytes, 0 for the default, windows larger than 65535 bytes need window scaling")
+	args.TcpSendBuffer = flag.Int("tcpSendBuffer", 0, "TCP send buffer size in bytes, 0 for the default")
+	args.TcpConnectFirst = flag.Bool("tcpConnectBeforeAccept", false, "Accept TCP connections only after the proxy has connected to the target, failed ones are refused")
+	args.MaxTcpConns = flag.Int("maxTcpConns", 0, "Maximum number of concurrent TCP connections, 0 for no limit")
+	args.MaxTcpConnsPerSource = flag.Int("maxTcpConnsPerSource", 0, "Maximum number of concurrent TCP connections per source IP, 0 for no limit")
+	args.MaxUdpConns = flag.Int("maxUdpConns", 0, "Maximum number of concurrent UDP sessions, 0 for no limit")
+	args.MaxUdpConnsPerSource = flag.Int("maxUdpConnsPerSource", 0, "Maximum number of concurrent UDP sessions per source IP, 0 for no limit")
+	args.ResolveProcess = flag.Bool("resolveProcess", false, "Look up the processes and user IDs owning connections for proxy handlers")
+	args.Capture = flag.String("capture", "", "Capture packets between the TUN device and the stack to a pcapng file")
+	args.CaptureListen = flag.String("captureListen", "", "Stream captured packets in pcapng format to clients of a local address, a TCP address or unix:PATH")
+	args.CaptureFilter = flag.String("captureFilter", "", "Capture only packets matching the expression, e.g. \"tcp port 443 or icmp\"")
+	args.CaptureSnapLen = flag.Int("captureSnapLen", 65535, "Number of bytes of each packet to capture")
+	args.CaptureMaxSize = flag.Int("captureMaxSize", 0, "Rotate the capture file once it is larger than this size in MB, 0 for no rotation")
+	args.CaptureMaxFiles = flag.Int("captureMaxFiles", 1, "Number of rotated capture files to keep")
+	args.Traceroute = flag.Bool("traceroute", false, "Answer traceroute probes, with the TUN gateway and the proxy server as the hops to any destination")
+	args.TracerouteHops = flag.String("tracerouteHops", "", "Comma-separated addresses of the hops answering traceroute probes, instead of the TUN gateway and the proxy server")
+	args.Shaping = flag.String("shaping", "", "JSON file of upload and download limits in bytes per second, global, per source IP and per process name")
+	args.FilterRules = flag.String("filterRules", "", "JSON file of rules accepting, dropping, rejecting, mirroring or rate-limiting packets from the TUN device")
 
 	flag.Parse()
 
@@ -161,7 +218,49 @@ func main() {
 	}
 
 	// Setup TCP/IP stack.
-	lwipWriter := core.NewLWIPStack().(io.Writer)
+	icmpEcho := core.ICMPEchoDefault
+	if !*args.RelayICMP {
+		switch strings.ToLower(*args.ICMPEcho) {
+		case "filter":
+		case "delay":
+			icmpEcho = core.ICMPEchoDelay
+		case "probe":
+			icmpEcho = core.ICMPEchoProbe
+		default:
+			log.Fatalf("unsupported ICMP echo mode")
+		}
+	}
+	lwipStack, err := core.NewLWIPStackWithOptions(core.StackOptions{
+		Name:                *args.TunName,
+		MTU:                 *args.Mtu,
+		TCPWindow:           *args.TcpWindow,
+		TCPSendBuffer:       *args.TcpSendBuffer,
+		ConnectBeforeAccept: *args.TcpConnectFirst,
+
+		MaxTCPConns:          *args.MaxTcpConns,
+		MaxTCPConnsPerSource: *args.MaxTcpConnsPerSource,
+		MaxUDPConns:          *args.MaxUdpConns,
+		MaxUDPConnsPerSource: *args.MaxUdpConnsPerSource,
+
+		ICMPEcho:      icmpEcho,
+		ICMPEchoDelay: time.Duration(*args.DelayICMP) * time.Millisecond,
+		ICMPProbePort: *args.ICMPProbePort,
+	})
+	if err != nil {
+		log.Fatalf("failed to create stack: %v", err)
+	}
+	switch strings.ToLower(*args.UdpSessionMode) {
+	case "fullcone":
+		lwipStack.SetUDPSessionMode(core.UDPFullCone, *args.UdpEIF)
+	case "symmetric":
+		lwipStack.SetUDPSessionMode(core.UDPSymmetric, *args.UdpEIF)
+	default:
+		log.Fatalf("unsupported UDP session mode")
+	}
+	if args.UdpTimeout != nil {
+		lwipStack.SetUDPTimeout(*args.UdpTimeout)
+	}
+	lwipWriter := lwipStack.(io.Writer)
 
 	// Apply ICMP filters.
 	if *args.RelayICMP {
@@ -170,7 +269,11 @@ func main() {
 		if runtime.GOOS == "windows" || runtime.GOOS == "linux" {
 			privileged = true
 		}
-		lwipWriter = filter.NewICMPRelayFilter(lwipWriter, tunDev, *args.SendThrough, privileged).(io.Writer)
+		relay := filter.NewICMPRelayFilter(lwipWriter, tunDev, *args.SendThrough, privileged)
+		icmpRelay = relay.(io.Closer)
+		lwipWriter = relay.(io.Writer)
+	} else if icmpEcho != core.ICMPEchoDefault {
+		log.Infof("ICMP echo requests will be answered in %v mode", icmpEcho)
 	} else {
 		if *args.DelayICMP > 0 {
 			log.Infof("ICMP packets will be delayed for %dms", *args.DelayICMP)
@@ -178,6 +281,73 @@ func main() {
 		}
 	}
 
+	// Capture packets from TUN before they are filtered.
+	if *args.Capture != "" || *args.CaptureListen != "" {
+		capture, err = filter.NewCapture(filter.CaptureOptions{
+			Path:        *args.Capture,
+			MaxFileSize: int64(*args.CaptureMaxSize) << 20,
+			MaxFiles:    *args.CaptureMaxFiles,
+			Listen:      *args.CaptureListen,
+			Match:       *args.CaptureFilter,
+			SnapLen:     *args.CaptureSnapLen,
+			Name:        *args.TunName,
+		})
+		if err != nil {
+			log.Fatalf("failed to start capture: %v", err)
+		}
+		log.Infof("Capturing packets to file %q, listening on %q", *args.Capture, *args.CaptureListen)
+	}
+
+	// Output function writing packets output from lwip stack to tun device.
+	outputFn := func(data []byte) (int, error) {
+		return tunDev.Write(data)
+	}
+	if capture != nil {
+		outputFn = capture.Output(outputFn)
+	}
+
+	// Answer traceroute probes before relaying or delaying ICMP packets.
+	if *args.Traceroute {
+		hops := tracerouteHops()
+		log.Infof("Answering traceroute probes with hops %v", hops)
+		lwipWriter = filter.NewTracerouteFilter(lwipWriter, outputFn, hops).(io.Writer)
+	}
+
+	// Shape TCP connections, and drop other packets over the limits.
+	stackOutputFn := outputFn
+	if *args.Shaping != "" {
+		opts, err := shaping.LoadOptions(*args.Shaping)
+		if err != nil {
+			log.Fatalf("failed to load shaping options: %v", err)
+		}
+		shaper, err := shaping.New(*opts)
+		if err != nil {
+			log.Fatalf("invalid shaping options: %v", err)
+		}
+		log.Infof("Shaping traffic with limits from %v", *args.Shaping)
+		lwipStack.RegisterTCPConnWrapper(shaper.WrapTCPConn)
+		lwipWriter = filter.NewShapingFilter(lwipWriter, shaper).(io.Writer)
+		stackOutputFn = filter.NewShapingOutput(outputFn, shaper)
+	}
+
+	// Apply filter rules, rejecting packets through the output function.
+	if *args.FilterRules != "" {
+		cfg, err := filter.LoadChainConfig(*args.FilterRules)
+		if err != nil {
+			log.Fatalf("failed to load filter rules: %v", err)
+		}
+		filterChain, err = filter.NewChainFromConfig(lwipWriter, outputFn, cfg)
+		if err != nil {
+			log.Fatalf("invalid filter rules: %v", err)
+		}
+		log.Infof("Filtering packets with %d rules from %v", len(cfg.Rules), *args.FilterRules)
+		lwipWriter = filterChain
+	}
+
+	if capture != nil {
+		lwipWriter = filter.NewCaptureFilter(lwipWriter, capture).(io.Writer)
+	}
+
 	// Register TCP and UDP handlers to handle accepted connections.
 	if creater, found := handlerCreater[*args.ProxyType]; found {
 		creater()
@@ -185,6 +355,32 @@ func main() {
 		log.Fatalf("unsupported proxy type")
 	}
 
+	// Resolve metadata of connections once for all handlers.
+	if fakeDns != nil {
+		lwipStack.RegisterMetadataResolver(func(meta *core.Metadata) {
+			if ip := metadataIP(meta.Destination); ip != nil && fakeDns.IsFakeIP(ip) {
+				meta.Domain = fakeDns.QueryDomain(ip)
+			}
+		})
+	}
+	if *args.ResolveProcess || resolveProcess {
+		lwipStack.RegisterMetadataResolver(func(meta *core.Metadata) {
+			if ip := metadataIP(meta.Source); ip != nil {
+				_, port, _ := net.SplitHostPort(meta.Source.String())
+				p, _ := strconv.Atoi(port)
+				meta.Process, _ = proc.GetProcessesBySocket(meta.Network, ip.String(), uint16(p))
+				if uid, err := proc.GetUIDBySocket(meta.Network, ip.String(), uint16(p)); err == nil {
+					meta.UID = uid
+				}
+			}
+		})
+	}
+	if *args.TcpConnectFirst {
+		if _, ok := core.DefaultTCPConnHandler().(core.TCPConnectHandler); !ok {
+			log.Fatalf("proxy type %v does not support connecting before accepting TCP connections", *args.ProxyType)
+		}
+	}
+
 	if args.DnsFallback != nil && *args.DnsFallback {
 		// Override the UDP handler with a DNS-over-TCP (fallback) UDP handler.
 		if creater, found := handlerCreater["dnsfallback"]; found {
@@ -194,17 +390,15 @@ func main() {
 		}
 	}
 
-	// Register an output callback to write packets output from lwip stack to tun
-	// device, output function should be set before input any packets.
-	core.RegisterOutputFn(func(data []byte) (int, error) {
-		return tunDev.Write(data)
-	})
+	// Register the output callback, output function should be set before
+	// input any packets.
+	core.RegisterOutputFn(stackOutputFn)
 
 	// Copy packets from tun device to lwip stack, it's the main loop.
 	go func() {
-		_, err := io.CopyBuffer(lwipWriter, tunDev, make([]byte, MTU))
+		err := core.CopyBatch(lwipWriter, tunDev, *args.Mtu, batchSize)
 		if err != nil {
-			log.Fatalf("copying data failed: %v", err)
+			log.Fatalf("reading packets from tun device failed: %v", err)
 		}
 	}()
 
@@ -221,6 +415,47 @@ func main() {
 	}
 }
 
+// tracerouteHops returns the addresses of the hops answering traceroute
+// probes, those of -tracerouteHops, or the TUN gateway and the proxy server.
+func tracerouteHops() []net.IP {
+	var hops []net.IP
+	if *args.TracerouteHops != "" {
+		for _, s := range strings.Split(*args.TracerouteHops, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("invalid traceroute hop %q", s)
+			}
+			hops = append(hops, ip)
+		}
+		return hops
+	}
+	if ip := net.ParseIP(*args.TunGw); ip != nil {
+		hops = append(hops, ip)
+	}
+	if args.ProxyServer != nil {
+		host, _, err := net.SplitHostPort(*args.ProxyServer)
+		if err == nil {
+			if addr, err := net.ResolveIPAddr("ip", host); err == nil {
+				hops = append(hops, addr.IP)
+			} else {
+				log.Warnf("failed to resolve the proxy server as a traceroute hop: %v", err)
+			}
+		}
+	}
+	return hops
+}
+
+// metadataIP returns the IP of an address in core.Metadata, or nil.
+func metadataIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
 func handleRpc() {
 	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(*args.RpcPort)))
 	if err != nil {
@@ -253,6 +488,19 @@ func handleRpc() {
 }
 
 func stop() {
+	if icmpRelay != nil {
+		icmpRelay.Close()
+	}
+	if filterChain != nil {
+		if err := filterChain.Close(); err != nil {
+			log.Errorf("Error stopping filter rules: %v", err)
+		}
+	}
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			log.Errorf("Error stopping capture: %v", err)
+		}
+	}
 	if fakeDns != nil {
 		err := fakeDns.Stop()
 		if err != nil {
@@ -30,6 +30,8 @@ func init() {
 		proxyHost := proxyAddr.IP.String()
 		proxyPort := uint16(proxyAddr.Port)
 
+		// Exception apps are told apart by the processes of connections.
+		resolveProcess = true
 		proxyTCPHandler := socks.NewTCPHandler(proxyHost, proxyPort, fakeDns, sessionStater)
 		proxyUDPHandler := socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout, dnsCache, fakeDns, sessionStater)
 
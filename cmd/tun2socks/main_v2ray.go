@@ -190,6 +190,7 @@ func init() {
 			sniffingConfig.Enabled = false
 		}
 
+		resolveProcess = true
 		core.RegisterTCPConnHandler(v2ray.NewTCPHandler(v, sniffingConfig, fakeDns))
 		core.RegisterUDPConnHandler(v2ray.NewUDPHandler(v, sniffingConfig, *args.UdpTimeout, fakeDns))
 	})
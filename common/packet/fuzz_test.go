@@ -0,0 +1,24 @@
+// +build go1.18
+
+package packet
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func FuzzPeek(f *testing.F) {
+	// A TCP SYN.
+	syn, _ := hex.DecodeString("4500003000004000400600000a0000010a000002303900500000000100000000700200ff000000000204230001030307")
+	f.Add(syn)
+	f.Add(syn[:22])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		PeekIPVersion(data)
+		PeekProtocol(data)
+		PeekSourceAddress(data)
+		PeekDestinationAddress(data)
+		PeekSourcePort(data)
+		PeekDestinationPort(data)
+		IsSYNSegment(data)
+	})
+}
@@ -14,11 +14,21 @@ const (
 	PROTOCOL_UDP  = 17
 )
 
+// The helpers below peek into IPv4 packets, they never panic on malformed
+// packets but return zero values, e.g. 0 for ports of a packet too short
+// to carry them.
+
 func PeekIPVersion(data []byte) uint8 {
+	if len(data) < 1 {
+		return 0
+	}
 	return uint8((data[0] & 0xf0) >> 4)
 }
 
 func PeekProtocol(data []byte) string {
+	if len(data) < 20 {
+		return "unknown"
+	}
 	switch uint8(data[9]) {
 	case PROTOCOL_ICMP:
 		return "icmp"
@@ -32,28 +42,52 @@ func PeekProtocol(data []byte) string {
 }
 
 func PeekSourceAddress(data []byte) net.IP {
+	if len(data) < 20 {
+		return nil
+	}
 	return net.IP(data[12:16])
 }
 
+// transportHeader returns the header of the transport layer, which is at
+// least n bytes long, or nil.
+func transportHeader(data []byte, n int) []byte {
+	if len(data) < 20 {
+		return nil
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || ihl+n > len(data) {
+		return nil
+	}
+	return data[ihl:]
+}
+
 func PeekSourcePort(data []byte) uint16 {
-	ihl := uint8(data[0] & 0x0f)
-	return binary.BigEndian.Uint16(data[ihl*4 : ihl*4+2])
+	h := transportHeader(data, 4)
+	if h == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(h[0:2])
 }
 
 func PeekDestinationAddress(data []byte) net.IP {
+	if len(data) < 20 {
+		return nil
+	}
 	return net.IP(data[16:20])
 }
 
 func PeekDestinationPort(data []byte) uint16 {
-	ihl := uint8(data[0] & 0x0f)
-	return binary.BigEndian.Uint16(data[ihl*4+2 : ihl*4+4])
+	h := transportHeader(data, 4)
+	if h == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(h[2:4])
 }
 
 func IsSYNSegment(data []byte) bool {
-	ihl := uint8(data[0] & 0x0f)
-	if uint8(data[ihl*4+13]&(1<<1)) == 0 {
+	h := transportHeader(data, 14)
+	if h == nil {
 		return false
-	} else {
-		return true
 	}
+	return h[13]&(1<<1) != 0
 }
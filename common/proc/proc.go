@@ -0,0 +1,14 @@
+package proc
+
+import (
+	"net"
+	"strconv"
+)
+
+// GetProcessesByAddr is GetProcessesBySocket for the local socket bound to
+// addr, e.g. the source address of a connection from TUN.
+func GetProcessesByAddr(addr net.Addr) ([]string, error) {
+	host, portStr, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.Atoi(portStr)
+	return GetProcessesBySocket(addr.Network(), host, uint16(port))
+}
@@ -210,6 +210,25 @@ func GetPidBySocket(network string, addr string, port uint16) (int, error) {
 	return 0, errors.New("not found")
 }
 
+// GetUIDBySocket returns the user ID of the process owning the socket.
+func GetUIDBySocket(network string, addr string, port uint16) (int, error) {
+	pid, err := GetPidBySocket(network, addr, port)
+	if err != nil {
+		return 0, err
+	}
+	var tai C.struct_proc_taskallinfo
+	bufUsed := int(C.proc_pidinfo(
+		C.int(pid),
+		C.PROC_PIDTASKALLINFO,
+		0,
+		unsafe.Pointer(&tai),
+		C.int(unsafe.Sizeof(tai))))
+	if bufUsed <= 0 {
+		return 0, errors.New("proc_pidinfo() failed")
+	}
+	return int(tai.pbsd.pbi_uid), nil
+}
+
 func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
 	pattern := ""
 	switch network {
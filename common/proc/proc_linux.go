@@ -172,6 +172,34 @@ func GetProcessesBySocket(network string, addr string, port uint16) ([]string, e
 // 3. Walk through /proc/[pid]/fd, find the matching inode and return the owning pid
 //
 func GetPidBySocket(network, addr string, port uint16) (int, error) {
+	fields, err := findSocket(network, port)
+	if err != nil {
+		return 0, err
+	}
+	inode, err := strconv.Atoi(fields[9])
+	if err != nil {
+		return 0, fmt.Errorf("parse inode failed: %v", err)
+	}
+	return getPidByIno(inode)
+}
+
+// GetUIDBySocket returns the user ID owning the socket, it's read from the
+// /proc/net/[tcp/udp] table as well.
+func GetUIDBySocket(network, addr string, port uint16) (int, error) {
+	fields, err := findSocket(network, port)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.Atoi(fields[7])
+	if err != nil {
+		return 0, fmt.Errorf("parse uid failed: %v", err)
+	}
+	return uid, nil
+}
+
+// findSocket returns the fields of the socket bound to port in the
+// /proc/net/[tcp/udp] table according to network.
+func findSocket(network string, port uint16) ([]string, error) {
 	var table string
 
 	switch network {
@@ -180,13 +208,14 @@ func GetPidBySocket(network, addr string, port uint16) (int, error) {
 	case "udp":
 		table = "/proc/net/udp"
 	default:
-		return 0, errors.New("invalid network")
+		return nil, errors.New("invalid network")
 	}
 
 	file, err := os.Open(table)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer file.Close()
 
 	// cat /proc/net/tcp
 	//  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
@@ -218,22 +247,14 @@ func GetPidBySocket(network, addr string, port uint16) (int, error) {
 
 		port2, err := strconv.ParseInt(tmp[1], 16, 32)
 		if err != nil {
-			return 0, fmt.Errorf("parse port failed: %v", err)
+			return nil, fmt.Errorf("parse port failed: %v", err)
 		}
 
 		if /* addr == ip.String() && */ port == uint16(port2) {
-			inode, err := strconv.Atoi(fields[9])
-			if err != nil {
-				return 0, fmt.Errorf("parse inode failed: %v", err)
-			}
-			pid, err := getPidByIno(inode)
-			if err != nil {
-				return 0, err
-			}
-			return pid, nil
+			return fields, nil
 		}
 	}
-	return 0, errors.New("not found")
+	return nil, errors.New("not found")
 }
 
 func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
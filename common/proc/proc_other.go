@@ -9,3 +9,11 @@ import (
 func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
 	return "", errors.New("not implemented")
 }
+
+func GetProcessesBySocket(network string, addr string, port uint16) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func GetUIDBySocket(network string, addr string, port uint16) (int, error) {
+	return 0, errors.New("not implemented")
+}
@@ -111,6 +111,23 @@ func GetPidBySocket(network string, addr string, port uint16) (int, error) {
 	return 0, errors.New("not found")
 }
 
+// GetUIDBySocket returns the user ID of the process owning the socket.
+func GetUIDBySocket(network string, addr string, port uint16) (int, error) {
+	pid, err := GetPidBySocket(network, addr, port)
+	if err != nil {
+		return 0, err
+	}
+	out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "uid=").Output()
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	return uid, nil
+}
+
 func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
 	pattern := ""
 	switch network {
@@ -47,6 +47,11 @@ func GetPidBySocket(network string, addr string, port uint16) (int, error) {
 	}
 }
 
+// GetUIDBySocket is not supported, Windows identifies users by SIDs.
+func GetUIDBySocket(network string, addr string, port uint16) (int, error) {
+	return 0, errors.New("not supported")
+}
+
 func GetProcessesBySocket(network string, addr string, port uint16) ([]string, error) {
 	var processes []string
 	var err error
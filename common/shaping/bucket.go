@@ -0,0 +1,68 @@
+package shaping
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, tokens are added at a rate per second up to a
+// burst. Tokens may be taken ahead by Reserve, then takers wait for them in
+// turn.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full Bucket, burst is the rate rounded up by default,
+// and at least 1.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+		if b < 1 {
+			b = 1
+		}
+	}
+	return &Bucket{rate: rate, burst: b, tokens: b}
+}
+
+// refill adds the tokens due at now. Caller is required to hold b.mu.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// Allow takes n tokens if they are left at now, and reports whether it did.
+func (b *Bucket) Allow(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Reserve takes n tokens, even if they are not left at now, and returns how
+// long to wait for them.
+func (b *Bucket) Reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,64 @@
+package shaping
+
+import (
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Data is read and written in chunks of at most this size, so that slow
+// connections are delayed smoothly.
+const maxChunk = 16 * 1024
+
+// shapedConn delays reads, data uploaded by the local client, and writes,
+// data downloaded, to keep them within the limits.
+type shapedConn struct {
+	core.TCPConn
+	shaper    *Shaper
+	ip        net.IP
+	processes []string
+}
+
+// WrapTCPConn is a core.TCPConnWrapper shaping the connections of the local
+// clients, see core.LWIPStack.RegisterTCPConnWrapper. The process of a
+// connection is looked up unless resolved in meta.
+func (s *Shaper) WrapTCPConn(conn core.TCPConn, meta *core.Metadata) core.TCPConn {
+	var ip net.IP
+	var port int
+	if addr, ok := meta.Source.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	processes := meta.Process
+	if processes == nil && ip != nil && s.limitsProcesses() {
+		processes, _ = s.lookup("tcp", ip.String(), uint16(port))
+	}
+	return &shapedConn{TCPConn: conn, shaper: s, ip: ip, processes: processes}
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+	n, err := c.TCPConn.Read(b)
+	if n > 0 {
+		c.shaper.wait(Upload, c.ip, c.processes, n)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		c.shaper.wait(Download, c.ip, c.processes, len(chunk))
+		n, err := c.TCPConn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,270 @@
+// Package shaping limits the bandwidth of the local clients with token
+// buckets, globally, per source IP and per process name.
+package shaping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/proc"
+)
+
+const (
+	// How long sources and flows are remembered once idle.
+	idleTimeout = time.Minute
+
+	// Maximum number of flows whose processes are remembered.
+	maxFlows = 4096
+)
+
+// Direction is the direction of traffic, seen from the local clients.
+type Direction int
+
+const (
+	Upload Direction = iota
+	Download
+)
+
+// Limits are rates in bytes per second, zero for no limit. Bursts of up to
+// a second of traffic at the rates are allowed.
+type Limits struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+func (l Limits) valid() bool {
+	return l.Upload >= 0 && l.Download >= 0
+}
+
+// Options configures a Shaper, traffic is limited by all the limits which
+// apply to it, e.g.
+//
+//	{
+//		"global": {"upload": 1048576, "download": 4194304},
+//		"perSource": {"upload": 524288},
+//		"processes": {"dropbox": {"upload": 65536, "download": 262144}}
+//	}
+type Options struct {
+	// Global limits are shared by all the local clients.
+	Global Limits `json:"global"`
+
+	// PerSource limits apply to each source IP of the local clients.
+	PerSource Limits `json:"perSource"`
+
+	// Processes limits are shared by the processes of each name, they
+	// apply to the first name among those of a process and its ancestors
+	// which has limits.
+	Processes map[string]Limits `json:"processes"`
+}
+
+// LoadOptions reads Options from a JSON file.
+func LoadOptions(path string) (*Options, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opts := new(Options)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(opts); err != nil {
+		return nil, fmt.Errorf("invalid shaping options %v: %v", path, err)
+	}
+	return opts, nil
+}
+
+// buckets are the buckets of limits by direction, nil if unlimited.
+type buckets [2]*Bucket
+
+func newBuckets(l Limits) *buckets {
+	var b buckets
+	if l.Upload > 0 {
+		b[Upload] = NewBucket(float64(l.Upload), 0)
+	}
+	if l.Download > 0 {
+		b[Download] = NewBucket(float64(l.Download), 0)
+	}
+	return &b
+}
+
+type source struct {
+	buckets  *buckets
+	lastUsed time.Time
+}
+
+type flowKey struct {
+	network string
+	ip      string
+	port    uint16
+}
+
+type flow struct {
+	processes []string // Nil until looked up
+	lastUsed  time.Time
+}
+
+// Shaper limits traffic between the local clients and the proxy. TCP
+// connections are shaped, i.e. delayed, once wrapped by WrapTCPConn, while
+// packets are policed by AllowPacket, i.e. dropped over the limits.
+type Shaper struct {
+	perSource Limits
+	global    *buckets
+	processes map[string]*buckets
+
+	// lookup returns the processes owning a socket, proc.GetProcessesBySocket
+	// but in tests.
+	lookup func(network, addr string, port uint16) ([]string, error)
+
+	mu        sync.Mutex
+	sources   map[string]*source
+	flows     map[flowKey]*flow
+	lastSweep time.Time
+}
+
+// New creates a Shaper.
+func New(opts Options) (*Shaper, error) {
+	if !opts.Global.valid() || !opts.PerSource.valid() {
+		return nil, errors.New("negative limits")
+	}
+	s := &Shaper{
+		perSource: opts.PerSource,
+		global:    newBuckets(opts.Global),
+		processes: make(map[string]*buckets),
+		lookup:    proc.GetProcessesBySocket,
+		sources:   make(map[string]*source),
+		flows:     make(map[flowKey]*flow),
+	}
+	for name, l := range opts.Processes {
+		if !l.valid() {
+			return nil, fmt.Errorf("negative limits of process %v", name)
+		}
+		s.processes[name] = newBuckets(l)
+	}
+	return s, nil
+}
+
+// limitsProcesses reports whether there are limits per process name.
+func (s *Shaper) limitsProcesses() bool {
+	return len(s.processes) > 0
+}
+
+// appendBuckets appends the buckets limiting traffic of a direction from or
+// to ip, and processes, which may be nil, to bs.
+func (s *Shaper) appendBuckets(bs []*Bucket, dir Direction, ip net.IP, processes []string, now time.Time) []*Bucket {
+	if b := s.global[dir]; b != nil {
+		bs = append(bs, b)
+	}
+	if ip != nil && (s.perSource.Upload > 0 || s.perSource.Download > 0) {
+		s.mu.Lock()
+		s.sweep(now)
+		src := s.sources[string(ip.To16())]
+		if src == nil {
+			src = &source{buckets: newBuckets(s.perSource)}
+			s.sources[string(ip.To16())] = src
+		}
+		src.lastUsed = now
+		s.mu.Unlock()
+		if b := src.buckets[dir]; b != nil {
+			bs = append(bs, b)
+		}
+	}
+	for _, name := range processes {
+		if p, ok := s.processes[name]; ok {
+			if b := p[dir]; b != nil {
+				bs = append(bs, b)
+			}
+			break
+		}
+	}
+	return bs
+}
+
+// sweep forgets sources and flows idle for long, at most once in a while.
+// Caller is required to hold s.mu.
+func (s *Shaper) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idleTimeout {
+		return
+	}
+	s.lastSweep = now
+	for ip, src := range s.sources {
+		if now.Sub(src.lastUsed) > idleTimeout {
+			delete(s.sources, ip)
+		}
+	}
+	for k, f := range s.flows {
+		if now.Sub(f.lastUsed) > idleTimeout {
+			delete(s.flows, k)
+		}
+	}
+}
+
+// flowProcesses returns the processes owning the socket of a local client,
+// or nil until they have been looked up in the background.
+func (s *Shaper) flowProcesses(network string, ip net.IP, port uint16, now time.Time) []string {
+	k := flowKey{network, string(ip.To16()), port}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	if f, ok := s.flows[k]; ok {
+		f.lastUsed = now
+		return f.processes
+	}
+	if len(s.flows) >= maxFlows {
+		return nil
+	}
+	f := &flow{lastUsed: now}
+	s.flows[k] = f
+	go func() {
+		processes, err := s.lookup(network, ip.String(), port)
+		if err != nil {
+			log.Debugf("failed to look up the process of %v:%v: %v", ip, port, err)
+			return
+		}
+		s.mu.Lock()
+		f.processes = processes
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// AllowPacket reports whether a packet of n bytes from or to a local client
+// is within the limits, taking tokens if so. The client is at ip, and port
+// of network "udp" or "tcp", or zero for other protocols, its process is
+// looked up in the background, so the first packets of a flow are only
+// limited globally and per source.
+func (s *Shaper) AllowPacket(dir Direction, network string, ip net.IP, port uint16, n int) bool {
+	now := time.Now()
+	var processes []string
+	if port != 0 && s.limitsProcesses() {
+		processes = s.flowProcesses(network, ip, port, now)
+	}
+	var bs [3]*Bucket
+	for _, b := range s.appendBuckets(bs[:0], dir, ip, processes, now) {
+		if !b.Allow(now, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// wait waits for n bytes of a direction through the buckets of ip and
+// processes.
+func (s *Shaper) wait(dir Direction, ip net.IP, processes []string, n int) {
+	now := time.Now()
+	var bs [3]*Bucket
+	var d time.Duration
+	for _, b := range s.appendBuckets(bs[:0], dir, ip, processes, now) {
+		if w := b.Reserve(now, n); w > d {
+			d = w
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
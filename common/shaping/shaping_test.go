@@ -0,0 +1,128 @@
+package shaping
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(1000, 0)
+	if !b.Allow(now, 600) || b.Allow(now, 600) {
+		t.Error("Expected a burst of 1000 tokens")
+	}
+	if !b.Allow(now.Add(200*time.Millisecond), 600) {
+		t.Error("Expected 600 tokens after 200ms")
+	}
+	// The bucket is empty, 100 tokens are taken ahead.
+	if d := b.Reserve(now.Add(200*time.Millisecond), 100); d.Round(time.Millisecond) != 100*time.Millisecond {
+		t.Errorf("Waiting %v for 100 tokens, expected 100ms", d)
+	}
+	if d := b.Reserve(now.Add(250*time.Millisecond), 100); d.Round(time.Millisecond) != 150*time.Millisecond {
+		t.Errorf("Waiting %v for 100 more tokens, expected 150ms", d)
+	}
+	// Never more than a burst after a long time.
+	if !b.Allow(now.Add(time.Hour), 1000) || b.Allow(now.Add(time.Hour), 1) {
+		t.Error("Expected a burst of 1000 tokens")
+	}
+}
+
+// newShaper creates a Shaper looking up processes by port.
+func newShaper(t *testing.T, opts Options, processes map[uint16][]string) *Shaper {
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lookup = func(network, addr string, port uint16) ([]string, error) {
+		return processes[port], nil
+	}
+	return s
+}
+
+// Packets should be dropped over the limits of each source and process.
+func TestAllowPacket(t *testing.T) {
+	s := newShaper(t, Options{
+		Global:    Limits{Download: 3000},
+		PerSource: Limits{Upload: 1000},
+		Processes: map[string]Limits{"sync": {Upload: 500}},
+	}, map[uint16][]string{
+		1: {"sync", "launchd"},
+		2: {"helper", "sync"},
+	})
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	if !s.AllowPacket(Upload, "udp", a, 1, 800) || s.AllowPacket(Upload, "udp", a, 3, 800) {
+		t.Error("Expected the first packet of a source only")
+	}
+	if !s.AllowPacket(Upload, "udp", b, 1, 800) {
+		t.Error("Expected the first packet of another source")
+	}
+	if !s.AllowPacket(Download, "", a, 0, 1500) || !s.AllowPacket(Download, "", b, 0, 1500) || s.AllowPacket(Download, "", b, 0, 1500) {
+		t.Error("Expected 2 packets within the global limit")
+	}
+
+	// The processes of both flows are sync or its children, once looked up.
+	s = newShaper(t, Options{Processes: map[string]Limits{"sync": {Upload: 500}}}, map[uint16][]string{
+		1: {"sync", "launchd"},
+		2: {"helper", "sync"},
+	})
+	s.AllowPacket(Upload, "udp", a, 1, 1)
+	s.AllowPacket(Upload, "udp", a, 2, 1)
+	time.Sleep(50 * time.Millisecond)
+	if !s.AllowPacket(Upload, "udp", a, 1, 400) || s.AllowPacket(Upload, "udp", a, 2, 400) {
+		t.Error("Expected the first packet of the process only")
+	}
+	if !s.AllowPacket(Upload, "udp", a, 3, 400) {
+		t.Error("Expected the packet of another process")
+	}
+}
+
+// fakeConn reads and writes unlimited data.
+type fakeConn struct {
+	core.TCPConn
+	written bytes.Buffer
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+// Reads and writes of connections should be delayed to keep within the
+// limits.
+func TestWrapTCPConn(t *testing.T) {
+	s := newShaper(t, Options{PerSource: Limits{Upload: 200000, Download: 100000}}, nil)
+	meta := &core.Metadata{Source: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}}
+	fake := &fakeConn{}
+	conn := s.WrapTCPConn(fake, meta)
+
+	// A burst, then 100000 bytes at the rate.
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 200000))
+	if n != 200000 || err != nil || fake.written.Len() != n {
+		t.Fatalf("Wrote %v bytes, %v", n, err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Wrote in %v, expected about a second", d)
+	}
+
+	start = time.Now()
+	b := make([]byte, 100000)
+	read := 0
+	for read < 300000 {
+		n, _ := conn.Read(b)
+		if n > maxChunk {
+			t.Fatalf("Read %v bytes at once", n)
+		}
+		read += n
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Read in %v, expected about half a second", d)
+	}
+}
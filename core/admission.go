@@ -0,0 +1,163 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a rejected connection is remembered, so that its
+	// retransmitted SYNs or further datagrams are not counted as
+	// rejections again. SYNs are retransmitted for about 2 minutes.
+	rejectedTTL = 2 * time.Minute
+
+	// Maximum number of rejected connections remembered.
+	maxRejected = 1024
+)
+
+// admission enforces the limits of concurrent connections of a protocol,
+// see StackOptions. A nil admission admits any connection.
+type admission struct {
+	mu           sync.Mutex
+	max          int // Zero means no limit
+	maxPerSource int // Zero means no limit
+	total        int
+	perSource    map[string]int // Keyed by the 16-byte source IP
+	rejected     uint64
+	recent       map[interface{}]time.Time // Rejected connections, see reject
+}
+
+func newAdmission(max, maxPerSource int) *admission {
+	if max == 0 && maxPerSource == 0 {
+		return nil
+	}
+	return &admission{
+		max:          max,
+		maxPerSource: maxPerSource,
+		perSource:    make(map[string]int),
+		recent:       make(map[interface{}]time.Time),
+	}
+}
+
+func (a *admission) full(key string) bool {
+	return (a.max > 0 && a.total >= a.max) ||
+		(a.maxPerSource > 0 && a.perSource[key] >= a.maxPerSource)
+}
+
+// check reports whether a new connection from src would be admitted, see
+// reject.
+func (a *admission) check(src net.IP) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !a.full(string(src.To16()))
+}
+
+// reject counts the connection identified by id as rejected after check
+// or acquire, unless it has been rejected lately, e.g. its SYN is
+// retransmitted.
+func (a *admission) reject(id interface{}) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t, ok := a.recent[id]; ok && now.Sub(t) < rejectedTTL {
+		return
+	}
+	if len(a.recent) >= maxRejected {
+		for k, t := range a.recent {
+			if now.Sub(t) >= rejectedTTL || len(a.recent) >= maxRejected {
+				delete(a.recent, k)
+			}
+		}
+	}
+	a.recent[id] = now
+	a.rejected++
+}
+
+// acquire counts a new connection from src, it returns false if it's over
+// the limits, see reject.
+func (a *admission) acquire(src net.IP) bool {
+	if a == nil {
+		return true
+	}
+	key := string(src.To16())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.full(key) {
+		return false
+	}
+	a.total++
+	a.perSource[key]++
+	return true
+}
+
+// release uncounts a connection from src which has been acquired.
+func (a *admission) release(src net.IP) {
+	if a == nil {
+		return
+	}
+	key := string(src.To16())
+	a.mu.Lock()
+	a.total--
+	if a.perSource[key]--; a.perSource[key] <= 0 {
+		delete(a.perSource, key)
+	}
+	a.mu.Unlock()
+}
+
+// admitSYN is called with the stack lock held when a SYN opening a new TCP
+// connection arrives, it answers SYNs over the TCP limits with RST so that
+// no resources are allocated for them. SYNs of pending connections are left
+// to holdSYN, they are written again once the handler has connected.
+func (s *stackBase) admitSYN(syn []byte) bool {
+	if s.tcpAdmission == nil {
+		return true
+	}
+	local, target, ok := parseSYNAddrs(syn)
+	if !ok {
+		return true
+	}
+	id := newTCPConnID(local, target)
+	if _, ok := s.pendingConns[id]; ok || s.tcpAdmission.check(local.IP) {
+		return true
+	}
+	s.tcpAdmission.reject(id)
+	if rst := buildTCPReset(syn); rst != nil {
+		s.getOutputFn()(rst)
+	}
+	return false
+}
+
+// admitTCPConn counts a TCP connection from local to target once it's
+// accepted, the limits may have been reached since its SYN was admitted. A
+// pending connection has been counted since its SYN, the accepted one takes
+// it over. A connection over the limits is not handed over to the handler,
+// so its pending connection, if any, is dropped. Caller is required to hold
+// the stack lock.
+func (s *stackBase) admitTCPConn(local, target *net.TCPAddr) bool {
+	if p, ok := s.pendingConns[newTCPConnID(local, target)]; ok && p.admitted {
+		p.admitted = false
+		return true
+	}
+	if s.tcpAdmission.acquire(local.IP) {
+		return true
+	}
+	s.tcpAdmission.reject(newTCPConnID(local, target))
+	if p := s.takePendingConn(local, target); p != nil {
+		p.upstream.Close()
+	}
+	return false
+}
+
+// rejections returns the number of connections rejected.
+func (a *admission) rejections() uint64 {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rejected
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"io"
+)
+
+// BatchWriter is implemented by writers accepting multiple IP packets in a
+// single call, e.g. stacks and filters.
+type BatchWriter interface {
+	// WriteBatch writes packets in order, it stops at the first packet
+	// failed to write and returns the number of packets written. Packets
+	// are not retained after the call returns.
+	WriteBatch(pkts [][]byte) (int, error)
+}
+
+// WriteBatch writes packets to w, in a single call if w is a BatchWriter,
+// or one by one otherwise.
+func WriteBatch(w io.Writer, pkts [][]byte) (int, error) {
+	if bw, ok := w.(BatchWriter); ok {
+		return bw.WriteBatch(pkts)
+	}
+	for i, pkt := range pkts {
+		if _, err := w.Write(pkt); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// CopyBatch copies packets from src to dst until EOF or a read error occurs,
+// each read from src is expected to return a single packet not larger than
+// mtu bytes.
+//
+// Packets are read in a separate goroutine, those queued up while dst is
+// busy are written in batches of up to batchSize packets. Packets dst fails
+// to write are skipped, they are counted by stacks, see Stats.InputErrors.
+func CopyBatch(dst io.Writer, src io.Reader, mtu, batchSize int) error {
+	free := make(chan []byte, batchSize)
+	pkts := make(chan []byte, batchSize)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	for i := 0; i < batchSize; i++ {
+		free <- make([]byte, mtu)
+	}
+
+	go func() {
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := src.Read(buf)
+			if n > 0 {
+				// Never blocks, there are only batchSize buffers.
+				pkts <- buf[:n]
+			} else {
+				free <- buf
+			}
+			if err != nil {
+				errc <- err
+				close(pkts)
+				return
+			}
+		}
+	}()
+
+	batch := make([][]byte, 0, batchSize)
+	for {
+		pkt, ok := <-pkts
+		if !ok {
+			if err := <-errc; err != io.EOF {
+				return err
+			}
+			return nil
+		}
+		batch = append(batch[:0], pkt)
+
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case pkt, ok := <-pkts:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, pkt)
+			default:
+				break drain
+			}
+		}
+
+		for pkts := batch; len(pkts) > 0; {
+			n, err := WriteBatch(dst, pkts)
+			if err == nil || n >= len(pkts) {
+				break
+			}
+			pkts = pkts[n+1:]
+		}
+		for _, pkt := range batch {
+			free <- pkt[:cap(pkt)]
+		}
+	}
+}
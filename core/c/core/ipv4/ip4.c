@@ -153,8 +153,11 @@ ip4_route(const ip4_addr_t *dest)
 {
 #if TUN2SOCKS
   // go-tun2socks logic
-  // no routing and just use the default netif, netif_list[0], i.e., the loopif
-  // enable loopif by setting LWIP_HAVE_LOOPIF = 1 in lwipopts.h
+  // no routing, reply on the netif the current packet came from, otherwise
+  // just use the first netif, netif_list[0]
+  if (ip_current_input_netif() != NULL) {
+    return ip_current_input_netif();
+  }
   return netif_list;
 #endif /* TUN2SOCKS */
 
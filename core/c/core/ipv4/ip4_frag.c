@@ -151,6 +151,18 @@ ip_reass_tmr(void)
   }
 }
 
+#if TUN2SOCKS
+/* go-tun2socks logic
+ * Reports whether datagrams are being reassembled, ip_reass_tmr() has
+ * nothing to do otherwise.
+ */
+int
+ip_reass_pending(void)
+{
+  return reassdatagrams != NULL;
+}
+#endif /* TUN2SOCKS */
+
 /**
  * Free a datagram (struct ip_reassdata) and all its pbufs.
  * Updates the total count of enqueued pbufs (ip_reass_pbufcount),
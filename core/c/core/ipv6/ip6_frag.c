@@ -137,6 +137,18 @@ ip6_reass_tmr(void)
    }
 }
 
+#if TUN2SOCKS
+/* go-tun2socks logic
+ * Reports whether datagrams are being reassembled, ip6_reass_tmr() has
+ * nothing to do otherwise.
+ */
+int
+ip6_reass_pending(void)
+{
+  return reassdatagrams != NULL;
+}
+#endif /* TUN2SOCKS */
+
 /**
  * Free a datagram (struct ip6_reassdata) and all its pbufs.
  * Updates the total count of enqueued pbufs (ip6_reass_pbufcount),
@@ -889,7 +889,13 @@ tcp_listen_with_backlog_and_err(struct tcp_pcb *pcb, u8_t backlog, err_t *err)
   lpcb->state = LISTEN;
   lpcb->prio = pcb->prio;
   lpcb->so_options = pcb->so_options;
+#if TUN2SOCKS
+  // go-tun2socks logic
+  // keep the netif binding so that each stack only accepts its own connections
+  lpcb->netif_idx = pcb->netif_idx;
+#else
   lpcb->netif_idx = NETIF_NO_INDEX;
+#endif /* TUN2SOCKS */
   lpcb->ttl = pcb->ttl;
   lpcb->tos = pcb->tos;
 #if LWIP_IPV4 && LWIP_IPV6
@@ -907,6 +913,9 @@ tcp_listen_with_backlog_and_err(struct tcp_pcb *pcb, u8_t backlog, err_t *err)
 #if LWIP_CALLBACK_API
   lpcb->accept = tcp_accept_null;
 #endif /* LWIP_CALLBACK_API */
+#if TUN2SOCKS
+  lpcb->syn = NULL;
+#endif /* TUN2SOCKS */
 #if TCP_LISTEN_BACKLOG
   lpcb->accepts_pending = 0;
   tcp_backlog_set(lpcb, backlog);
@@ -934,7 +943,11 @@ tcp_update_rcv_ann_wnd(struct tcp_pcb *pcb)
   LWIP_ASSERT("tcp_update_rcv_ann_wnd: invalid pcb", pcb != NULL);
   new_right_edge = pcb->rcv_nxt + pcb->rcv_wnd;
 
+#if TUN2SOCKS
+  if (TCP_SEQ_GEQ(new_right_edge, pcb->rcv_ann_right_edge + LWIP_MIN((pcb->rcv_wnd_max / 2), pcb->mss))) {
+#else
   if (TCP_SEQ_GEQ(new_right_edge, pcb->rcv_ann_right_edge + LWIP_MIN((TCP_WND / 2), pcb->mss))) {
+#endif /* TUN2SOCKS */
     /* we can advertise more window */
     pcb->rcv_ann_wnd = pcb->rcv_wnd;
     return new_right_edge - pcb->rcv_ann_right_edge;
@@ -993,7 +1006,13 @@ tcp_recved(struct tcp_pcb *pcb, u16_t len)
    * watermark is TCP_WND/4), then send an explicit update now.
    * Otherwise wait for a packet to be sent in the normal course of
    * events (or more window to be available later) */
+#if TUN2SOCKS
+  // go-tun2socks logic
+  // The window may be configured per interface, so is the threshold.
+  if (wnd_inflation >= LWIP_MIN((pcb->rcv_wnd_max / 4), (pcb->mss * 4))) {
+#else
   if (wnd_inflation >= TCP_WND_UPDATE_THRESHOLD) {
+#endif /* TUN2SOCKS */
     tcp_ack_now(pcb);
     tcp_output(pcb);
   }
@@ -1893,6 +1912,9 @@ tcp_alloc(u8_t prio)
     /* Start with a window that does not need scaling. When window scaling is
        enabled and used, the window is enlarged when both sides agree on scaling. */
     pcb->rcv_wnd = pcb->rcv_ann_wnd = TCPWND_MIN16(TCP_WND);
+#if TUN2SOCKS
+    pcb->rcv_wnd_max = TCP_WND;
+#endif /* TUN2SOCKS */
     pcb->ttl = TCP_TTL;
     /* As initial send MSS, we use TCP_MSS but limit it to 536.
        The send MSS is updated when an MSS option is received. */
@@ -2083,6 +2105,27 @@ tcp_accept(struct tcp_pcb *pcb, tcp_accept_fn accept)
 }
 #endif /* LWIP_CALLBACK_API */
 
+#if TUN2SOCKS
+/**
+ * go-tun2socks logic
+ * Used for specifying the function that should be called when a SYN for a
+ * new connection arrives on a LISTENing pcb, the callback may drop the SYN
+ * to hold the connection.
+ *
+ * @param pcb tcp_pcb to set the SYN callback
+ * @param syn callback function to call for this pcb when a SYN arrives
+ */
+void
+tcp_syn(struct tcp_pcb *pcb, tcp_syn_fn syn)
+{
+  LWIP_ASSERT_CORE_LOCKED();
+  if ((pcb != NULL) && (pcb->state == LISTEN)) {
+    struct tcp_pcb_listen *lpcb = (struct tcp_pcb_listen *)pcb;
+    lpcb->syn = syn;
+  }
+}
+#endif /* TUN2SOCKS */
+
 
 /**
  * @ingroup tcp_raw
@@ -318,8 +318,13 @@ tcp_input(struct pbuf *p, struct netif *inp)
     for (lpcb = tcp_listen_pcbs.listen_pcbs; lpcb != NULL; lpcb = lpcb->next) {
 #if TUN2SOCKS
       // go-tun2socks logic
-      // use the first one, and it should be set to the loopif
-      break;
+      // use the first one bound to the input netif (or not bound to any netif)
+      if ((lpcb->netif_idx == NETIF_NO_INDEX) ||
+          (lpcb->netif_idx == netif_get_index(ip_data.current_input_netif))) {
+        break;
+      }
+      prev = (struct tcp_pcb *)lpcb;
+      continue;
 #endif /* TUN2SOCKS */
 
       /* check if PCB is bound to specific netif */
@@ -638,6 +643,9 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
   struct tcp_pcb *npcb;
   u32_t iss;
   err_t rc;
+#if TUN2SOCKS
+  struct netif *inp;
+#endif /* TUN2SOCKS */
 
   if (flags & TCP_RST) {
     /* An incoming RST should be ignored. Return. */
@@ -662,6 +670,14 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
       return;
     }
 #endif /* TCP_LISTEN_BACKLOG */
+#if TUN2SOCKS
+    // go-tun2socks logic
+    // The SYN may be held until the application has connected to the
+    // target of the connection.
+    if (pcb->syn != NULL && !pcb->syn(pcb->callback_arg)) {
+      return;
+    }
+#endif /* TUN2SOCKS */
     npcb = tcp_alloc(pcb->prio);
     /* If a new PCB could not be created (probably due to lack of memory),
        we don't do anything, but rely on the sender will retransmit the
@@ -709,6 +725,23 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
     /* inherit socket options */
     npcb->so_options = pcb->so_options & SOF_INHERITED;
     npcb->netif_idx = pcb->netif_idx;
+
+#if TUN2SOCKS
+    // go-tun2socks logic
+    // Apply the TCP settings of the interface the connection comes from,
+    // this must be done before parsing options, as the receive window is
+    // enlarged if window scaling is agreed.
+    inp = ip_current_input_netif();
+    if (inp->tcp_wnd != 0) {
+      npcb->rcv_wnd_max = inp->tcp_wnd;
+      npcb->rcv_wnd = npcb->rcv_ann_wnd = TCPWND_MIN16(inp->tcp_wnd);
+    }
+    if (inp->tcp_snd_buf != 0) {
+      npcb->snd_buf = inp->tcp_snd_buf;
+      npcb->ssthresh = inp->tcp_snd_buf;
+    }
+#endif /* TUN2SOCKS */
+
     /* Register the new PCB so that we can begin receiving segments
        for it. */
     TCP_REG_ACTIVE(npcb);
@@ -721,6 +754,11 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
 #if TCP_CALCULATE_EFF_SEND_MSS
     npcb->mss = tcp_eff_send_mss(npcb->mss, &npcb->local_ip, &npcb->remote_ip);
 #endif /* TCP_CALCULATE_EFF_SEND_MSS */
+#if TUN2SOCKS
+    if (inp->tcp_mss != 0 && npcb->mss > inp->tcp_mss) {
+      npcb->mss = inp->tcp_mss;
+    }
+#endif /* TUN2SOCKS */
 
     MIB2_STATS_INC(mib2.tcppassiveopens);
 
@@ -1978,9 +2016,15 @@ tcp_parseopt(struct tcp_pcb *pcb)
             pcb->rcv_scale = TCP_RCV_SCALE;
             tcp_set_flags(pcb, TF_WND_SCALE);
             /* window scaling is enabled, we can use the full receive window */
+#if TUN2SOCKS
+            LWIP_ASSERT("window not at default value", pcb->rcv_wnd == TCPWND_MIN16(pcb->rcv_wnd_max));
+            LWIP_ASSERT("window not at default value", pcb->rcv_ann_wnd == TCPWND_MIN16(pcb->rcv_wnd_max));
+            pcb->rcv_wnd = pcb->rcv_ann_wnd = pcb->rcv_wnd_max;
+#else
             LWIP_ASSERT("window not at default value", pcb->rcv_wnd == TCPWND_MIN16(TCP_WND));
             LWIP_ASSERT("window not at default value", pcb->rcv_ann_wnd == TCPWND_MIN16(TCP_WND));
             pcb->rcv_wnd = pcb->rcv_ann_wnd = TCP_WND;
+#endif /* TUN2SOCKS */
           }
           break;
 #endif /* LWIP_WND_SCALE */
@@ -1498,6 +1498,11 @@ tcp_output_segment(struct tcp_seg *seg, struct tcp_pcb *pcb, struct netif *netif
     u16_t mss;
 #if TCP_CALCULATE_EFF_SEND_MSS
     mss = tcp_eff_send_mss_netif(TCP_MSS, netif, &pcb->remote_ip);
+#if TUN2SOCKS
+    if (netif->tcp_mss != 0 && mss > netif->tcp_mss) {
+      mss = netif->tcp_mss;
+    }
+#endif /* TUN2SOCKS */
 #else /* TCP_CALCULATE_EFF_SEND_MSS */
     mss = TCP_MSS;
 #endif /* TCP_CALCULATE_EFF_SEND_MSS */
@@ -254,8 +254,13 @@ udp_input(struct pbuf *p, struct netif *inp)
 
 #if TUN2SOCKS
 	// go-tun2socks logic
-	// take the first one, library users are responsible for creating that pcb
-	break;
+	// take the first one bound to the input netif (or not bound to any netif),
+	// library users are responsible for creating that pcb
+	if ((pcb->netif_idx == NETIF_NO_INDEX) || (pcb->netif_idx == netif_get_index(inp))) {
+	  break;
+	}
+	prev = pcb;
+	continue;
 #endif /* TUN2SOCKS */
 
     /* print the PCB local and remote address */
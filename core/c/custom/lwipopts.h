@@ -81,10 +81,26 @@
 #define LWIP_TCP_TIMESTAMPS 1
 */
 
-#define TCP_MSS 1460
-#define TCP_WND 32 * 1024
+// TCP_MSS, TCP_WND and TCP_SND_BUF are the defaults of connections, each
+// stack may configure its own, see core.StackOptions. TCP_MSS also caps the
+// MSS of all stacks, the actual MSS is derived from the MTU of the stack.
+#define TCP_MSS 8960
+#define TCP_WND (32 * 1024)
 #define TCP_SND_BUF (TCP_WND)
 
+// The send buffer limits memory used by a connection, don't let the queue
+// length limit it further, it's derived from TCP_SND_BUF and TCP_MSS by
+// default.
+#define TCP_SND_QUEUELEN 0xFFF0
+
+// Allow receive windows up to (0xFFFF << TCP_RCV_SCALE) bytes.
+#define LWIP_WND_SCALE 1
+#define TCP_RCV_SCALE 8
+
+// Inputted packets are copied into pool pbufs, keep them sized for the
+// common 1500-byte MTU rather than TCP_MSS, larger packets are chained.
+#define PBUF_POOL_BUFSIZE LWIP_MEM_ALIGN_SIZE(1500)
+
 #define MEM_LIBC_MALLOC 1
 #define MEMP_MEM_MALLOC 1
 #define MEM_SIZE 128 * 1024
@@ -110,7 +126,13 @@
 #define TCPIP_DEBUG LWIP_DBG_ON
 #define IP6_DEBUG LWIP_DBG_ON
 
-#define LWIP_STATS 0
+// Statistics are exposed by LWIPStack.Stats(), 32-bit counters are used so
+// they don't wrap too soon. Pool stats work with MEMP_MEM_MALLOC except the
+// number of available elements, MIB2 stats provide TCP retransmissions.
+#define LWIP_STATS 1
+#define LWIP_STATS_LARGE 1
+#define MEMP_STATS 1
+#define MIB2_STATS 1
 #define LWIP_STATS_DISPLAY 0
 #define LWIP_PERF 0
 
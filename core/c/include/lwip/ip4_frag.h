@@ -69,6 +69,9 @@ struct ip_reassdata {
 
 void ip_reass_init(void);
 void ip_reass_tmr(void);
+#if TUN2SOCKS
+int ip_reass_pending(void);
+#endif /* TUN2SOCKS */
 struct pbuf * ip4_reass(struct pbuf *p);
 #endif /* IP_REASSEMBLY */
 
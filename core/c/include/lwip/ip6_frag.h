@@ -113,6 +113,9 @@ struct ip6_reassdata {
 
 #define ip6_reass_init() /* Compatibility define */
 void ip6_reass_tmr(void);
+#if TUN2SOCKS
+int ip6_reass_pending(void);
+#endif /* TUN2SOCKS */
 struct pbuf *ip6_reass(struct pbuf *p);
 
 #endif /* LWIP_IPV6 && LWIP_IPV6_REASS */
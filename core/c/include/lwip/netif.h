@@ -337,6 +337,13 @@ struct netif {
   /** maximum transfer unit (in bytes), updated by RA */
   u16_t mtu6;
 #endif /* LWIP_IPV6 && LWIP_ND6_ALLOW_RA_UPDATES */
+#if TUN2SOCKS
+  /** TCP settings for connections accepted on this interface, zero values
+   * take the compile-time defaults, i.e. TCP_MSS, TCP_WND and TCP_SND_BUF */
+  u16_t tcp_mss;
+  u32_t tcp_wnd;
+  u32_t tcp_snd_buf;
+#endif /* TUN2SOCKS */
   /** link level hardware address of this interface */
   u8_t hwaddr[NETIF_MAX_HWADDR_LEN];
   /** number of bytes used in hwaddr */
@@ -69,6 +69,17 @@ struct tcp_pcb_listen;
  */
 typedef err_t (*tcp_accept_fn)(void *arg, struct tcp_pcb *newpcb, err_t err);
 
+#if TUN2SOCKS
+/** go-tun2socks logic
+ * Function prototype for tcp SYN callback functions. Called when a SYN for a
+ * new connection arrives on a listening pcb, before a pcb is allocated for it.
+ *
+ * @param arg Additional argument to pass to the callback function (@see tcp_arg())
+ * @return 0 to drop the SYN, otherwise the connection is accepted as usual
+ */
+typedef u8_t (*tcp_syn_fn)(void *arg);
+#endif /* TUN2SOCKS */
+
 /** Function prototype for tcp receive callback functions. Called when data has
  * been received.
  *
@@ -137,7 +148,11 @@ typedef err_t (*tcp_connected_fn)(void *arg, struct tcp_pcb *tpcb, err_t err);
 #define RCV_WND_SCALE(pcb, wnd) (((wnd) >> (pcb)->rcv_scale))
 #define SND_WND_SCALE(pcb, wnd) (((wnd) << (pcb)->snd_scale))
 #define TCPWND16(x)             ((u16_t)LWIP_MIN((x), 0xFFFF))
+#if TUN2SOCKS
+#define TCP_WND_MAX(pcb)        ((tcpwnd_size_t)(((pcb)->flags & TF_WND_SCALE) ? (pcb)->rcv_wnd_max : TCPWND16((pcb)->rcv_wnd_max)))
+#else
 #define TCP_WND_MAX(pcb)        ((tcpwnd_size_t)(((pcb)->flags & TF_WND_SCALE) ? TCP_WND : TCPWND16(TCP_WND)))
+#endif /* TUN2SOCKS */
 #else
 #define RCV_WND_SCALE(pcb, wnd) (wnd)
 #define SND_WND_SCALE(pcb, wnd) (wnd)
@@ -231,6 +246,11 @@ struct tcp_pcb_listen {
   tcp_accept_fn accept;
 #endif /* LWIP_CALLBACK_API */
 
+#if TUN2SOCKS
+  /* Function to call when a SYN for a new connection arrives. */
+  tcp_syn_fn syn;
+#endif /* TUN2SOCKS */
+
 #if TCP_LISTEN_BACKLOG
   u8_t backlog;
   u8_t accepts_pending;
@@ -284,6 +304,9 @@ struct tcp_pcb {
   tcpwnd_size_t rcv_wnd;   /* receiver window available */
   tcpwnd_size_t rcv_ann_wnd; /* receiver window to announce */
   u32_t rcv_ann_right_edge; /* announced right edge of window */
+#if TUN2SOCKS
+  tcpwnd_size_t rcv_wnd_max; /* configured receiver window, replaces TCP_WND */
+#endif /* TUN2SOCKS */
 
 #if LWIP_TCP_SACK_OUT
   /* SACK ranges to include in ACK packets (entry is invalid if left==right) */
@@ -417,6 +440,9 @@ void             tcp_recv    (struct tcp_pcb *pcb, tcp_recv_fn recv);
 void             tcp_sent    (struct tcp_pcb *pcb, tcp_sent_fn sent);
 void             tcp_err     (struct tcp_pcb *pcb, tcp_err_fn err);
 void             tcp_accept  (struct tcp_pcb *pcb, tcp_accept_fn accept);
+#if TUN2SOCKS
+void             tcp_syn     (struct tcp_pcb *pcb, tcp_syn_fn syn);
+#endif /* TUN2SOCKS */
 #endif /* LWIP_CALLBACK_API */
 void             tcp_poll    (struct tcp_pcb *pcb, tcp_poll_fn poll, u8_t interval);
 
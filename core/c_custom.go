@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
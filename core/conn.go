@@ -34,10 +34,9 @@ type TCPConn interface {
 	// LocalAddr returns the local client network address.
 	LocalAddr() net.Addr
 
-	// Read reads data comming from TUN, note that it reads from an
-	// underlying pipe that the writer writes in the lwip thread,
-	// write op blocks until previous written data is consumed, one
-	// should read out all data as soon as possible.
+	// Read reads data comming from TUN. Data is buffered up to the
+	// receive window of the connection, the window is opened again as
+	// data is read, so the local client is throttled by slow readers.
 	Read(data []byte) (int, error)
 
 	// Write writes data to TUN.
@@ -58,8 +57,14 @@ type TCPConn interface {
 	// Abort aborts the connection by sending a RST segment.
 	Abort()
 
+	// SetDeadline sets the read and write deadlines, blocked Read and
+	// Write calls return a timeout error once the deadline is exceeded.
 	SetDeadline(t time.Time) error
+
+	// SetReadDeadline sets the deadline for Read calls.
 	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets the deadline for Write calls.
 	SetWriteDeadline(t time.Time) error
 }
 
@@ -69,12 +74,19 @@ type UDPConn interface {
 	// LocalAddr returns the local client network address.
 	LocalAddr() *net.UDPAddr
 
+	// SessionMode returns the session mode in effect for this connection.
+	// In UDPSymmetric mode, a connection only carries packets between
+	// LocalAddr and the target passed to UDPConnHandler.Connect.
+	SessionMode() UDPSessionMode
+
 	// ReceiveTo will be called when data arrives from TUN, and the received
 	// data should be sent to addr.
 	ReceiveTo(data []byte, addr *net.UDPAddr) error
 
 	// WriteFrom writes data to TUN, addr will be set as source address of
-	// UDP packets that output to TUN.
+	// UDP packets that output to TUN. Without endpoint-independent
+	// filtering, data from an address the local client has never sent
+	// packets to is silently dropped.
 	WriteFrom(data []byte, addr *net.UDPAddr) (int, error)
 
 	// Close closes the connection.
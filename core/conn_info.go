@@ -0,0 +1,100 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// ConnInfo describes a connection of a stack, see LWIPStack.ListConnections.
+type ConnInfo struct {
+	// ID identifies the connection, it's the same as Metadata.ID.
+	ID uint64
+
+	// Network is "tcp" or "udp".
+	Network string
+
+	// State is the state of the connection, e.g. "connected", names of
+	// TCP states differ between backends.
+	State string
+
+	// Source is the address of the local client, Destination is the target
+	// address, the destination of the first packet for UDP connections.
+	Source      net.Addr
+	Destination net.Addr
+
+	// Age is how long the connection has existed.
+	Age time.Duration
+
+	// RecvBuffered is the number of bytes received from the local client
+	// but not yet read by the handler, SendBuffered is the number of bytes
+	// written by the handler but not yet acknowledged by the local client.
+	RecvBuffered int
+	SendBuffered int
+}
+
+// ErrConnNotFound is returned by LWIPStack.CloseConnection if the stack has
+// no connection with the ID, e.g. it has already been closed.
+var ErrConnNotFound = errors.New("connection not found")
+
+// sortConnInfos sorts infos by ID, i.e. by creation order.
+func sortConnInfos(infos []ConnInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+}
+
+func (st udpConnState) String() string {
+	switch st {
+	case udpConnecting:
+		return "connecting"
+	case udpConnected:
+		return "connected"
+	case udpClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// udpConnInfos appends infos of the UDP connections to infos.
+func (s *stackBase) udpConnInfos(infos []ConnInfo) []ConnInfo {
+	now := time.Now()
+	s.udpConns.Range(func(_, c interface{}) bool {
+		conn := c.(*udpConn)
+		conn.Lock()
+		info := ConnInfo{
+			ID:           conn.connID,
+			Network:      "udp",
+			State:        conn.state.String(),
+			Source:       conn.localAddr,
+			Age:          now.Sub(conn.created),
+			RecvBuffered: conn.pendingBytes,
+		}
+		conn.Unlock()
+		if conn.target != nil {
+			info.Destination = conn.target
+		}
+		infos = append(infos, info)
+		return true
+	})
+	return infos
+}
+
+// closeUDPConn closes the UDP connection with the ID, it returns false if
+// there is no such connection.
+func (s *stackBase) closeUDPConn(id uint64) bool {
+	var found *udpConn
+	s.udpConns.Range(func(_, c interface{}) bool {
+		if c.(*udpConn).connID == id {
+			found = c.(*udpConn)
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return false
+	}
+	found.Close()
+	return true
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// tcpConnID identifies a TCP connection by the addresses of the local client
+// (src) and the target (dst).
+type tcpConnID struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+}
+
+func newTCPConnID(local, target *net.TCPAddr) tcpConnID {
+	id := tcpConnID{srcPort: uint16(local.Port), dstPort: uint16(target.Port)}
+	copy(id.src[:], local.IP.To16())
+	copy(id.dst[:], target.IP.To16())
+	return id
+}
+
+// How long a connection is waited to be accepted after the handler has
+// connected to its target, e.g. the client may have given up meanwhile.
+const connectAcceptTimeout = 30 * time.Second
+
+// pendingTCPConn is a connection whose SYN is held until the handler has
+// connected to the target.
+type pendingTCPConn struct {
+	handler  TCPConnectContextHandler
+	ctx      context.Context
+	meta     *Metadata
+	upstream net.Conn // Nil while connecting
+	timer    *time.Timer
+	admitted bool // Counted by the TCP admission, see admitTCPConn
+}
+
+// holdSYN is called with the stack lock held when a SYN opening a new TCP
+// connection arrives, it returns whether the connection is accepted.
+//
+// With connect-before-accept, the SYN is dropped while the handler connects
+// to the target, and written to the stack again once connected, so that the
+// connection is accepted this time. Retransmitted SYNs are dropped meanwhile.
+// If the handler fails to connect, the SYN is answered with RST or ICMP
+// unreachable. Pending connections count against the TCP limits.
+func (s *stackBase) holdSYN(syn []byte) bool {
+	if !s.connectBeforeAccept {
+		return true
+	}
+	h, ok := s.getTCPConnHandler().(TCPConnectHandler)
+	if !ok {
+		return true
+	}
+	local, target, ok := parseSYNAddrs(syn)
+	if !ok {
+		return true
+	}
+	id := newTCPConnID(local, target)
+	if p, ok := s.pendingConns[id]; ok {
+		return p.upstream != nil
+	}
+
+	// Admitted by admitSYN already.
+	if !s.tcpAdmission.acquire(local.IP) {
+		s.tcpAdmission.reject(id)
+		return false
+	}
+	p := &pendingTCPConn{handler: tcpConnectContextHandler(h), admitted: true}
+	s.pendingConns[id] = p
+	syn = append([]byte(nil), syn...)
+	go func() {
+		ctx, meta := s.newMetadata(0, "tcp", local, target)
+		upstream, err := p.handler.ConnectContext(ctx, meta)
+
+		s.mu.Lock()
+		if s.pendingConns[id] != p {
+			// The stack has been closed.
+			s.mu.Unlock()
+			if upstream != nil {
+				upstream.Close()
+			}
+			return
+		}
+		if err != nil {
+			s.dropPendingConn(id, p)
+			s.rejectSYN(syn, err)
+			s.mu.Unlock()
+			return
+		}
+		p.ctx, p.meta, p.upstream = ctx, meta, upstream
+		p.timer = time.AfterFunc(connectAcceptTimeout, func() {
+			s.mu.Lock()
+			expired := s.pendingConns[id] == p
+			if expired {
+				s.dropPendingConn(id, p)
+			}
+			s.mu.Unlock()
+			if expired {
+				upstream.Close()
+			}
+		})
+		s.mu.Unlock()
+
+		s.write(syn)
+	}()
+	return false
+}
+
+// dropPendingConn removes a pending connection which is not going to be
+// accepted, caller is required to hold the stack lock.
+func (s *stackBase) dropPendingConn(id tcpConnID, p *pendingTCPConn) {
+	delete(s.pendingConns, id)
+	if p.admitted {
+		p.admitted = false
+		s.tcpAdmission.release(net.IP(id.src[:]))
+	}
+}
+
+// takePendingConn returns the pending connection of an accepted connection,
+// or nil if it's not connected before accepted. Caller is required to hold
+// the stack lock.
+func (s *stackBase) takePendingConn(local, target *net.TCPAddr) *pendingTCPConn {
+	id := newTCPConnID(local, target)
+	p, ok := s.pendingConns[id]
+	if !ok || p.upstream == nil {
+		return nil
+	}
+	delete(s.pendingConns, id)
+	p.timer.Stop()
+	return p
+}
+
+// closePendingConns closes upstream connections of pending connections, it's
+// called when the stack is closed. Caller is required to hold the stack lock.
+func (s *stackBase) closePendingConns() {
+	for id, p := range s.pendingConns {
+		if p.upstream != nil {
+			p.timer.Stop()
+			p.upstream.Close()
+		}
+		s.dropPendingConn(id, p)
+	}
+}
+
+// handleTCPConn hands an accepted connection over to the handler, wrapped
+// by the registered wrappers, it's called in a new goroutine.
+func (s *stackBase) handleTCPConn(id uint64, h TCPConnHandler, p *pendingTCPConn, conn TCPConn, target *net.TCPAddr) error {
+	var ctx context.Context
+	var meta *Metadata
+	if p != nil {
+		ctx, meta = p.ctx, p.meta
+		meta.ID = id
+	} else {
+		ctx, meta = s.newMetadata(id, "tcp", conn.LocalAddr(), target)
+	}
+	s.mu.Lock()
+	ws := s.wrappers
+	s.mu.Unlock()
+	for _, w := range ws {
+		conn = w(conn, meta)
+	}
+	if p != nil {
+		return p.handler.HandleConnectedContext(ctx, conn, p.upstream, meta)
+	}
+	return tcpContextHandler(h).HandleContext(ctx, conn, meta)
+}
+
+// rejectSYN answers a SYN the handler failed to connect for. Caller is
+// required to hold the stack lock.
+func (s *stackBase) rejectSYN(syn []byte, err error) {
+	var pkt []byte
+	if code, ok := unreachableCodeOf(err); ok && code != PortUnreachable {
+		pkt = buildICMPUnreachable(syn, code)
+	} else {
+		// RST is the port unreachable of TCP.
+		pkt = buildTCPReset(syn)
+	}
+	if pkt != nil {
+		s.getOutputFn()(pkt)
+	}
+}
+
+// parseTCPPacket returns the addresses and the TCP segment of an
+// unfragmented IP packet, IPv6 extension headers are skipped.
+func parseTCPPacket(pkt []byte) (src, dst net.IP, seg []byte, ok bool) {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	switch ipv {
+	case ipv4:
+		if len(pkt) < ipv4HeaderLen || proto(pkt[9]) != proto_tcp || moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0 {
+			return nil, nil, nil, false
+		}
+		hl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if hl < ipv4HeaderLen || total < hl || total > len(pkt) {
+			return nil, nil, nil, false
+		}
+		src = append(net.IP(nil), pkt[12:16]...)
+		dst = append(net.IP(nil), pkt[16:20]...)
+		seg = pkt[hl:total]
+	case ipv6:
+		if len(pkt) < ipv6HeaderLen || hasIPv4Mapped(pkt) {
+			return nil, nil, nil, false
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if total > len(pkt) {
+			return nil, nil, nil, false
+		}
+		var p proto
+		if p, seg, ok = ipv6UpperLayer(pkt[:total]); !ok || p != proto_tcp {
+			return nil, nil, nil, false
+		}
+		src = append(net.IP(nil), pkt[8:24]...)
+		dst = append(net.IP(nil), pkt[24:40]...)
+	default:
+		return nil, nil, nil, false
+	}
+	if len(seg) < tcpHeaderLen {
+		return nil, nil, nil, false
+	}
+	return src, dst, seg, true
+}
+
+// parseTCPSYN is like parseTCPPacket, but only accepts a SYN.
+func parseTCPSYN(pkt []byte) (src, dst net.IP, seg []byte, ok bool) {
+	src, dst, seg, ok = parseTCPPacket(pkt)
+	if !ok || seg[13]&(tcpSYN|tcpACK) != tcpSYN {
+		return nil, nil, nil, false
+	}
+	return src, dst, seg, true
+}
+
+// parseSYNAddrs returns the addresses of the local client and the target
+// of a SYN, see parseTCPSYN.
+func parseSYNAddrs(syn []byte) (local, target *net.TCPAddr, ok bool) {
+	src, dst, seg, ok := parseTCPSYN(syn)
+	if !ok {
+		return nil, nil, false
+	}
+	local = &net.TCPAddr{IP: src, Port: int(binary.BigEndian.Uint16(seg[0:2]))}
+	target = &net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(seg[2:4]))}
+	return local, target, true
+}
+
+// buildTCPReset builds a RST answering a TCP segment as RFC 793 suggests,
+// e.g. a SYN. It returns nil if the segment is a RST itself, or must not be
+// answered, see answerable.
+func buildTCPReset(pkt []byte) []byte {
+	src, dst, seg, ok := parseTCPPacket(pkt)
+	if !ok || seg[13]&tcpRST != 0 || !answerable(src, dst) {
+		return nil
+	}
+	hl := int(seg[12]>>4) * 4
+	if hl < tcpHeaderLen || hl > len(seg) {
+		return nil
+	}
+	var seq, ack uint32
+	flags := byte(tcpRST)
+	if seg[13]&tcpACK != 0 {
+		seq = binary.BigEndian.Uint32(seg[8:12])
+	} else {
+		// SYN and FIN take a sequence number each.
+		ack = binary.BigEndian.Uint32(seg[4:8]) + uint32(len(seg)-hl)
+		if seg[13]&tcpSYN != 0 {
+			ack++
+		}
+		if seg[13]&tcpFIN != 0 {
+			ack++
+		}
+		flags |= tcpACK
+	}
+
+	ipHL := ipHeaderLen(dst)
+	reply := make([]byte, ipHL+tcpHeaderLen)
+	rst := reply[ipHL:]
+	copy(rst[0:2], seg[2:4])
+	copy(rst[2:4], seg[0:2])
+	binary.BigEndian.PutUint32(rst[4:], seq)
+	binary.BigEndian.PutUint32(rst[8:], ack)
+	rst[12] = tcpHeaderLen / 4 << 4
+	rst[13] = flags
+	binary.BigEndian.PutUint16(rst[16:], transportChecksum(dst, src, proto_tcp, rst))
+	writeIPHeader(reply, dst, src, proto_tcp, tcpHeaderLen)
+	return reply
+}
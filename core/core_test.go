@@ -2,10 +2,16 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"net"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -18,7 +24,18 @@ const (
 	frag2Hex = "450003a00001007d40119b8a646a41005db8d822c726296a575ed8996bdad7392375d166d9894a6f0c0c08e4ae1ae9e55ae13a9f206b15cf74a43bff8f579f85344b972e7298f8c56d6a23081c19a369488a1b680af5f2e96e7d650261ac937ac709b74f45d15aa053b734cea3f5cbf400379a0e30e49bf696640a61a86076d867834cb79e7bcb798d129a28a8d81f47448ddc38b6040bd45607013d839c9198daabf8ae2f2994908e8b5d04f3194fe2def74e95e52aaf313119b9cef0bde9232fb7a95003e5fdcb9d8b759cf52d570c75f885333b600348b93fe8d0ccaa113465e37f20ce72b432ecc9c8a25809c2b2ed201a88d39b7f47023651ed6841e50b8fb298ef703888d603cd02438ac2ca563ae1ee273da555c3929a6221467f122a60bdb6484bd99d22fd4f4f3bfc41fd39e49c090acf33f46544c0705dbeb03b7249d90a398eacfbf239bcbb279e2596b06d25cfb9c6e247c34a57d55a272797f27df4fd2fc0fb23623f7c4890e05133ab2fa4f02cdd44eecabb3a49d7abae7dcb95f1429c82a685c4f69901cf22e355e31916bd20d038efc66dc37387d63a4330c516d03b6a2dd23bb9228d94c225723487792ae62888282a41e8c1c834d68ae58b4db92243671fd171157439282cfbab316439224dfb522f304a788f91c52715dc6588f0e1055455f159a28865d97292a7af670ec78afb229fcfa7cb97590d51d7fc8eb40edef005b19c8fb235f41b3bb5f6f7923b7534bf8ca8437ef93f40fabeb49b9eb9c5e8de9ad27ad8de282cea26adf3ddbd5b3ea4537535e2ddb864b125e73d330bf25d923e3df41be562b8de3bb3ce969defb159bc77cacb2337b07ac5204d8f1a39520089932ca6649a742f63c7e5e2ab25dc4bbed75faf68796dd5d521aee6452fbecc6af63623a1c55ad02de7c727c265ef8a4cdd109d41a7be9a5597dc69c3803e77340f2dff5608817b9c6d7c340c351e451401599a6ede93a0a897bd9bfe2dba1bfc7b61683ee9ff266a8a49fbec63ea60e4a58473c3705404cd3b3ff96415fcc92672a045555f48418a7125f0f4bda7b2df2d367af6d0e9d27a1f3895148c002b1503c6b83efa2a1e93def67fa07937d355b04a193465094e16128f33017e892d0bd154b9b87985eb6571d074d6011863b5af1395972d9415b21bd83d971cf5f3f67cc73dc0ab057aad3c83af4f6b10d5a6d8102ee3fe9f25929a14306871bf579e56dfd69cf45dd1472bbfcb1f0ab7fbb3972e27e2aba98273383b50700872d73f5c2ecf6ce3ea384ec08c4818fcfe0ed86513d617025f52"
 )
 
+const (
+	ipv6Header = 40 // Length of the IPv6 header in bytes.
+	fragHeader = 8  // Length of the IPv6 Fragment header in bytes.
+	// A small DNS query packet over IPv6 (UDP)
+	udp6Hex = "6000000000301140fd000000000000000000000000000001fd000000000000000000000000000002cf08003500306da229f88512004af0bfa30b8bfa65d33062872dd9ab2fb9d180e3306495311766b8f9630eb97ddc9bb6"
+	// Two fragments of a large UDP packet over IPv6.
+	frag6_1Hex = "6000000004d82c40fd000000000000000000000000000001fd0000000000000000000000000000021100000112345678d431003505e4effe3d2d653b899f64c2f772466b06605608aa9cbfc1c79440fa1b5ed8cb31e17d2de4e4c227daf19bd12b6288e7f958090b3f80b86083e7a882d2d7f889f3f5fb48c1fe9cefa5bb53c088a3cbf9509403e61d5d0f39bdb9fe1f624f8907d8fb26f07633bdb94a7ca24913313517f4ec230f412a5287e7ff0a4660e1f5e1e48df42095ba92b8112a8d8f8cf2dce3be102b7f7a1058acbd101a6bddaf27503acc45edfd264125b30f5f4c5e904dc6727140d653a27b02c560a6c3e104cb4577be8b5e4c5444c4261f0614f11e3a33bc101e73d073962ff1271e56e03d395b190fd99282e376676d8e0682a92f10b9bb3b730eb8aedf1ab0470f05ac22f801ed872c8b754340d65d7cc4dbf58a8146991062e5355a3701523d4dc9f2f8f06ec64fea05acd580a34492bdb972029c5a2ad0762d63c2d2404b19f9baa8c78b22854315384f3a2c2c3f6eb3ad517d595e7340f5ea3845e964be4aaa86228c001f0ff5e9a21f058c33c4ac34bf484bbdf0cf094d35e4bf0641f58724f43dcc6557e0a982b1968be7177f01fd825712a4076b9b614e8e1d8b9abf6f57012eb65eb35df471f3c4b73e2cdc1b68e089701cf78188b899dabd30d4538e1fa21d28391fe0dc2e5a86b40020889eb1c6ce273a90fde4839e7b071ac24e7096063686453c0fcc83fa6c238d59454e320c6fa7d6f3f9e7a5e8625a397147c872b4ee8c62730dd07ccb3d11a1baff81dfc09bb8be1dd25c9c94f17b35eb52bbdbefa724e8ddf8063721f6de1e0db3b9525bf524cf3a0fb1778087c5b801b0d69959fcb413086803160ff334d4f7a7f06769bf49386c197289d570b6f3bd4cbd8f611c6666cd17d90c27293c6232f6a95fe16b0470a76d974c030e9535cf6e6ad3ff2ddd57466690d799cd10e06e649877dcb918a1b9b7cfdcb7d1924e8365ee58034c217282ed066c9c1d14fac73fb3a54694018a4289a42cb33d007c9c6a6b23dc0db4a167d0c31b1e5f787f9556835ab7b49272512440e71c3a2914b7bee4cf8d7ad5d8a7e4c37e192fd9c836e6aa583325326069fe7c02b75f1611c90390e23c66f6510107f2b47d4ae2c1d479a76e3bcced186e978b368373a8bb9c8ccddda1e5b2663bd4892977b215273a5007ae09d8164062063b8c576c71356e05a5cb240cb950e54bde8e1ac499f00099954b006c98384101beb63a66b1d0a53862813deadb3ca9b97b06d4853e580b100706a226e11b4e8c8d987e707fa98b501a2d7bee3bcaf9c4aa43254b8c7d1570a20cc3b2ab5ae86c3aa15448624f2a5bf67dd206e2e8103dab04a0f1ef7f22d6cb08f04908ee1c003c2e23556e6763fc7f2e30b73e37f00baa785e38f48375a7336ddd14ac293e3db33f34c120cd4395e6510d77055b39469bdfd02bb1268f7b8cd9be6ea58cbe3cc4975380d10a59a9d79006d9926e906673f5000fd85de479d9baf8bd656a0d394bea6c47fcbc8d76f14e7c2b651694cf9f685d9b31fe896efd7317772d19dad98d84726936ede378f1e717ddb5629167f652919a9e57ea7f8117aae2adbe457790fb3d2d2421c7b7f62b51901a7a05d61b03e294a2168fc8075e748d0a03ed625fe942855704f6ff4c0c70773cd6513a1662c84e5ffa351d8f2c679876864bbf3899ff76623f9daf01c9fc5dc3dc7fdf09d90ae81fbd1744f3e5f7ace6563625efeaa8b678d8f4d761814aadc4f03b6e1f44f26f4fc2059a88a900"
+	frag6_2Hex = "60000000011c2c40fd000000000000000000000000000001fd000000000000000000000000000002110004d012345678c14a9bb3b3249a69f829496ed36a601b0c08e7629ced8301b3225520e6ee1e6f50c609cb746a2edd55329e2cade16b5c5a38c1633256e6063a1968d324eea04abdb455ea45bf26ae9aa4962dd931f8b8e075c57b3d67dd5857c76d0ed9132e1ee4a3233844143498010163a8572e0153ffab19897e7501e8cfe97827b10e3e8ae06693b7cfb3ae0e5f7c8e783ad4fa8864b6230d818372fa9ffc4f20460aac51f4e9524ad4ee7c64cbad0600e3a798317ffcd327b395a54f29ad3d18bc13b5c169ea01d27d8b1630c657b8456aa8067430a8c6cc0561d533523e16d7d1d028c35069c82eab64ac1d8bb7d244e2da9364e2eb24aa8a5763f19daad225dfeffdfa4bf18214379a8fea009b32969e19b835372f9d79"
+)
+
 var ntp, ntpPayload, frag1, frag2, fragPayload []byte
+var udp6, udp6Payload, frag6_1, frag6_2, frag6Payload []byte
 
 func decode(s string) []byte {
 	b, err := hex.DecodeString(s)
@@ -51,16 +68,20 @@ func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
 	frag2 = decode(frag2Hex)
 	fragPayload = append([]byte(nil), frag1[ipv4Header+udpHeader:]...)
 	fragPayload = append(fragPayload, frag2[ipv4Header:]...)
+	udp6 = decode(udp6Hex)
+	udp6Payload = udp6[ipv6Header+udpHeader:]
+	frag6_1 = decode(frag6_1Hex)
+	frag6_2 = decode(frag6_2Hex)
+	frag6Payload = append([]byte(nil), frag6_1[ipv6Header+fragHeader+udpHeader:]...)
+	frag6Payload = append(frag6Payload, frag6_2[ipv6Header+fragHeader:]...)
 
-	// Reset the set of known UDP connections to empty before each test.  Otherwise, the
-	// tests will interfere with each other.
-	udpConns = sync.Map{}
-
+	// Each test uses a new stack, which has its own set of known UDP connections, so
+	// the tests will not interfere with each other.
 	s := NewLWIPStack()
 	// This channel is buffered because the first Write->ReceiveTo can either be synchronous or
 	// asynchronous, depending on the results of a race during "connection".
 	h := &fakeUDPHandler{packets: make(chan []byte, 1)}
-	RegisterUDPConnHandler(h)
+	s.RegisterUDPConnHandler(h)
 	return s, h
 }
 
@@ -132,3 +153,1500 @@ func TestUDPFragmentationMemoryAndReordering(t *testing.T) {
 
 	assertEqual(<-h.packets, fragPayload, t)
 }
+
+// Basic test for sending a single UDP packet over IPv6.
+func TestUDP6(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, udp6, t)
+	assertEqual(<-h.packets, udp6Payload, t)
+}
+
+// This UDP handler echoes datagrams back to the local client.
+type echoUDPHandler struct{}
+
+func (echoUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (echoUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	go conn.WriteFrom(data, addr)
+	return nil
+}
+
+// Replies should be written to IPv6 clients, the UDP pcb is bound to any
+// address type.
+func TestUDP6Reply(t *testing.T) {
+	s, _ := setupUDP(t)
+	defer s.Close()
+	s.RegisterUDPConnHandler(echoUDPHandler{})
+	out := make(chan []byte, 1)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, udp6, t)
+	select {
+	case b := <-out:
+		if b[0]>>4 != 6 || !bytes.Equal(b[8:24], udp6[24:40]) || !bytes.Equal(b[24:40], udp6[8:24]) {
+			t.Fatalf("Unexpected reply % x", b)
+		}
+		assertEqual(b[ipv6Header+udpHeader:], udp6Payload, t)
+	case <-time.After(time.Second):
+		t.Fatal("No reply written")
+	}
+}
+
+// Send a fragmented UDP packet over IPv6.
+func TestUDP6Fragmentation(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, frag6_1, t)
+	write(s, frag6_2, t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// Write IPv6 UDP fragments out of order, reusing the same buffer.
+func TestUDP6FragmentReorderingMemory(t *testing.T) {
+	s, h := setupUDP(t)
+	buf := make([]byte, len(frag6_1))
+
+	checkedCopy(buf, frag6_2, t)
+	write(s, buf[:len(frag6_2)], t)
+
+	checkedCopy(buf, frag6_1, t)
+	write(s, buf[:len(frag6_1)], t)
+
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// withIPv6Options inserts an empty extension header of type nh after the
+// fixed header of an IPv6 packet.
+func withIPv6Options(pkt []byte, nh byte) []byte {
+	b := append([]byte(nil), pkt[:ipv6Header]...)
+	b[6] = nh
+	binary.BigEndian.PutUint16(b[4:], uint16(len(pkt)-ipv6Header+8))
+	b = append(b, pkt[6], 0, 1, 4, 0, 0, 0, 0)
+	return append(b, pkt[ipv6Header:]...)
+}
+
+// Fragments with extension headers before the Fragment header should be
+// copied for reassembly, and other packets with them passed.
+func TestUDP6FragmentOptionsMemory(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, withIPv6Options(udp6, ipv6HopByHop), t)
+	assertEqual(<-h.packets, udp6Payload, t)
+
+	frag1 := withIPv6Options(frag6_1, ipv6DstOpts)
+	frag2 := withIPv6Options(frag6_2, ipv6DstOpts)
+	buf := make([]byte, len(frag1))
+	checkedCopy(buf, frag2, t)
+	write(s, buf[:len(frag2)], t)
+	checkedCopy(buf, frag1, t)
+	write(s, buf[:len(frag1)], t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// Fragment headers should be found after other extension headers.
+func TestIPv6FragHeader(t *testing.T) {
+	setupUDP(t)
+
+	// Insert an empty Hop-by-Hop Options header before the Fragment
+	// header of the second fragment.
+	hbh := append([]byte(nil), frag6_2[:ipv6Header]...)
+	hbh[6] = ipv6HopByHop
+	binary.BigEndian.PutUint16(hbh[4:], uint16(len(frag6_2)-ipv6Header+8))
+	hbh = append(hbh, ipv6Fragment, 0, 1, 4, 0, 0, 0, 0)
+	hbh = append(hbh, frag6_2[ipv6Header:]...)
+
+	for _, c := range []struct {
+		pkt    []byte
+		more   bool
+		offset uint16
+	}{
+		{udp6, false, 0},
+		{frag6_1, true, 0},
+		{frag6_2, false, 154},
+		{hbh, false, 154},
+	} {
+		if more := moreFrags(ipv6, c.pkt); more != c.more {
+			t.Errorf("Expected more fragments %v, got %v", c.more, more)
+		}
+		if offset := fragOffset(ipv6, c.pkt); offset != c.offset {
+			t.Errorf("Expected fragment offset %v, got %v", c.offset, offset)
+		}
+	}
+}
+
+// Packets shorter than the fixed IP header should be failed, IPv6 packets
+// with IPv4-mapped addresses dropped.
+func TestMalformedPackets(t *testing.T) {
+	s, h := setupUDP(t)
+	defer s.Close()
+	for _, pkt := range [][]byte{{0x50}, ntp[:10], ntp[:ipv4Header-1], udp6[:7], udp6[:ipv6Header-1]} {
+		if _, err := s.Write(pkt); err == nil {
+			t.Errorf("Expected a %v-byte packet to fail", len(pkt))
+		}
+	}
+
+	mapped := append([]byte(nil), udp6...)
+	copy(mapped[24:40], net.IPv4(1, 2, 3, 4))
+	write(s, mapped, t)
+	select {
+	case <-h.packets:
+		t.Error("Expected the packet to be dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Stacks running side by side should deliver packets to their own handlers.
+func TestMultipleStacks(t *testing.T) {
+	s1, h1 := setupUDP(t)
+	s2, h2 := setupUDP(t)
+	write(s1, ntp, t)
+	assertEqual(<-h1.packets, ntpPayload, t)
+	write(s2, ntp, t)
+	assertEqual(<-h2.packets, ntpPayload, t)
+	select {
+	case <-h1.packets:
+		t.Error("Packet delivered to the wrong stack")
+	default:
+	}
+}
+
+// This UDP handler records the targets of new connections.
+type connectUDPHandler struct {
+	fakeUDPHandler
+	targets chan *net.UDPAddr
+}
+
+func (h *connectUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	if conn.SessionMode() != UDPSymmetric {
+		return errors.New("unexpected session mode")
+	}
+	h.targets <- target
+	return nil
+}
+
+// In symmetric mode, each destination should get its own connection.
+func TestUDPSymmetric(t *testing.T) {
+	s, _ := setupUDP(t)
+	s.SetUDPSessionMode(UDPSymmetric, false)
+	h := &connectUDPHandler{fakeUDPHandler{packets: make(chan []byte, 3)}, make(chan *net.UDPAddr, 2)}
+	s.RegisterUDPConnHandler(h)
+
+	other := append([]byte(nil), ntp...)
+	other[ipv4Header+3]++ // Increase the destination port.
+
+	write(s, ntp, t)
+	write(s, other, t)
+	write(s, ntp, t)
+	if a, b := <-h.targets, <-h.targets; a.Port == b.Port {
+		t.Errorf("Expected different targets, got %v and %v", a, b)
+	}
+	select {
+	case target := <-h.targets:
+		t.Errorf("Unexpected connection for %v", target)
+	default:
+	}
+}
+
+// This UDP handler sends the session modes of new connections to modes.
+type modeUDPHandler struct {
+	fakeUDPHandler
+	modes chan UDPSessionMode
+}
+
+func (h *modeUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	h.modes <- conn.SessionMode()
+	return nil
+}
+
+// Changing the session mode should only affect new sessions.
+func TestUDPSessionModeChange(t *testing.T) {
+	s, _ := setupUDP(t)
+	h := &modeUDPHandler{fakeUDPHandler{packets: make(chan []byte, 5)}, make(chan UDPSessionMode, 3)}
+	s.RegisterUDPConnHandler(h)
+
+	other := append([]byte(nil), ntp...)
+	other[ipv4Header+3]++ // Increase the destination port.
+
+	s.SetUDPSessionMode(UDPSymmetric, false)
+	write(s, ntp, t)
+	s.SetUDPSessionMode(UDPFullCone, false)
+	write(s, ntp, t)
+	write(s, other, t)
+	s.SetUDPSessionMode(UDPSymmetric, false)
+	write(s, other, t)
+	write(s, ntp, t)
+	for i := 0; i < 5; i++ {
+		<-h.packets
+	}
+	// Handlers are connected concurrently.
+	if a, b := <-h.modes, <-h.modes; a == b {
+		t.Errorf("Unexpected connections in %v and %v modes", a, b)
+	}
+	select {
+	case mode := <-h.modes:
+		t.Errorf("Unexpected connection in %v mode", mode)
+	default:
+	}
+}
+
+// This UDP handler is notified when connections are closed.
+type closeUDPHandler struct {
+	fakeUDPHandler
+	closed chan UDPConn
+}
+
+func (h *closeUDPHandler) Closed(conn UDPConn) {
+	h.closed <- conn
+}
+
+// Idle connections should be closed and the handler should be notified.
+func TestUDPTimeout(t *testing.T) {
+	s, _ := setupUDP(t)
+	s.SetUDPTimeout(10 * time.Millisecond)
+	h := &closeUDPHandler{fakeUDPHandler{packets: make(chan []byte, 1)}, make(chan UDPConn, 1)}
+	s.RegisterUDPConnHandler(h)
+
+	write(s, ntp, t)
+	assertEqual(<-h.packets, ntpPayload, t)
+	select {
+	case <-h.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Idle connection not closed")
+	}
+}
+
+// A SYN to port 80 advertising an MSS of 8960 and a window scale of 7.
+const synHex = "4500003000004000400600000a0000010a000002303900500000000100000000700200ff000000000204230001030307"
+
+// Invalid options should be rejected.
+func TestStackOptionsInvalid(t *testing.T) {
+	for _, opts := range []StackOptions{
+		{MTU: 100},
+		{TCPMSS: 100000},
+		{TCPWindow: 100},
+		{TCPSendBuffer: maxTCPWindow + 1},
+		{MaxUDPConnsPerSource: -1},
+		{ICMPEcho: ICMPEchoProbe + 1},
+		{ICMPEcho: ICMPEchoDelay, ICMPEchoDelay: -time.Second},
+	} {
+		if _, err := NewLWIPStackWithOptions(opts); err == nil {
+			t.Errorf("Expected error for %+v", opts)
+		}
+	}
+}
+
+// The MSS and window scale in the SYN-ACK should follow the options.
+func TestStackOptionsMSS(t *testing.T) {
+	for _, c := range []struct {
+		opts StackOptions
+		mss  uint16
+	}{
+		{StackOptions{}, 1460},
+		{StackOptions{MTU: 9000, TCPWindow: 1 << 20}, 8960},
+		{StackOptions{MTU: 9000, TCPMSS: 1200}, 1200},
+		{StackOptions{MTU: 1280}, 1240},
+	} {
+		s, err := NewLWIPStackWithOptions(c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(chan []byte, 1)
+		s.RegisterOutputFn(func(b []byte) (int, error) {
+			out <- append([]byte(nil), b...)
+			return len(b), nil
+		})
+		write(s, decode(synHex), t)
+		synack := <-out
+		s.Close()
+
+		opts := synack[ipv4Header+20 : ipv4Header+int(synack[ipv4Header+12]>>4)*4]
+		var mss uint16
+		scale := -1
+		for i := 0; i < len(opts) && opts[i] != 0; {
+			switch opts[i] {
+			case 1:
+				i++
+				continue
+			case 2:
+				mss = uint16(opts[i+2])<<8 | uint16(opts[i+3])
+			case 3:
+				scale = int(opts[i+2])
+			}
+			i += int(opts[i+1])
+		}
+		if mss != c.mss {
+			t.Errorf("Expected MSS %v for %+v, got %v", c.mss, c.opts, mss)
+		}
+		if scale != 8 {
+			t.Errorf("Expected window scale 8 for %+v, got %v", c.opts, scale)
+		}
+	}
+}
+
+// All packets in a batch should be inputted.
+func TestWriteBatch(t *testing.T) {
+	s, _ := setupUDP(t)
+	h := &fakeUDPHandler{packets: make(chan []byte, 2)}
+	s.RegisterUDPConnHandler(h)
+	if n, err := s.WriteBatch([][]byte{ntp, frag1, frag2}); n != 3 || err != nil {
+		t.Fatalf("WriteBatch returned %v, %v", n, err)
+	}
+	// The packets belong to different connections, which may be
+	// connected in any order.
+	a, b := <-h.packets, <-h.packets
+	if len(a) != len(ntpPayload) {
+		a, b = b, a
+	}
+	assertEqual(a, ntpPayload, t)
+	assertEqual(b, fragPayload, t)
+}
+
+// This reader returns a packet on each read.
+type packetReader struct {
+	pkts [][]byte
+}
+
+func (r *packetReader) Read(b []byte) (int, error) {
+	if len(r.pkts) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.pkts[0])
+	r.pkts = r.pkts[1:]
+	return n, nil
+}
+
+// This writer records packets written in batches.
+type batchRecorder struct {
+	pkts [][]byte
+}
+
+func (w *batchRecorder) Write(b []byte) (int, error) {
+	return 0, errors.New("not batched")
+}
+
+func (w *batchRecorder) WriteBatch(pkts [][]byte) (int, error) {
+	for _, pkt := range pkts {
+		w.pkts = append(w.pkts, append([]byte(nil), pkt...))
+	}
+	return len(pkts), nil
+}
+
+// All packets should be copied in order, with buffers reused.
+func TestCopyBatch(t *testing.T) {
+	var pkts [][]byte
+	for i := 0; i < 100; i++ {
+		pkts = append(pkts, []byte{byte(i), byte(i)})
+	}
+	w := &batchRecorder{}
+	if err := CopyBatch(w, &packetReader{pkts: pkts}, 1500, 8); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pkts) != len(pkts) {
+		t.Fatalf("Expected %v packets, got %v", len(pkts), len(w.pkts))
+	}
+	for i := range pkts {
+		assertEqual(w.pkts[i], pkts[i], t)
+	}
+}
+
+// This TCP handler echoes data back, and closes the connection on EOF.
+type echoTCPHandler struct{}
+
+func (echoTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	go func() {
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	return nil
+}
+
+// tcpPacket returns a segment of the connection opened by synHex.
+func tcpPacket(flags byte, seq, ack uint32, payload []byte) []byte {
+	b := append(decode(synHex)[:ipv4Header+20], payload...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	tcp := b[ipv4Header:]
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	return b
+}
+
+type testSegment struct {
+	flags    byte
+	seq, ack uint32
+	payload  []byte
+}
+
+func parseTestSegment(b []byte) testSegment {
+	tcp := b[ipv4Header:]
+	return testSegment{
+		flags:   tcp[13],
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		ack:     binary.BigEndian.Uint32(tcp[8:]),
+		payload: tcp[int(tcp[12]>>4)*4:],
+	}
+}
+
+// This writer fails packets starting with a multiple of 10, and records
+// the others.
+type failingBatchWriter struct {
+	batchRecorder
+}
+
+func (w *failingBatchWriter) WriteBatch(pkts [][]byte) (int, error) {
+	for i, pkt := range pkts {
+		if pkt[0]%10 == 0 {
+			return i, errors.New("malformed packet")
+		}
+		w.pkts = append(w.pkts, append([]byte(nil), pkt...))
+	}
+	return len(pkts), nil
+}
+
+// Packets failed to write should be skipped, with the rest of their batches
+// still written.
+func TestCopyBatchWriteErrors(t *testing.T) {
+	var pkts, expected [][]byte
+	for i := 0; i < 100; i++ {
+		pkts = append(pkts, []byte{byte(i), byte(i)})
+		if i%10 != 0 {
+			expected = append(expected, pkts[i])
+		}
+	}
+	w := &failingBatchWriter{}
+	if err := CopyBatch(w, &packetReader{pkts: pkts}, 1500, 8); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pkts) != len(expected) {
+		t.Fatalf("Expected %v packets, got %v", len(expected), len(w.pkts))
+	}
+	for i := range expected {
+		assertEqual(w.pkts[i], expected[i], t)
+	}
+}
+
+// Data should be echoed back through the stack, followed by FIN once the
+// client closes its side.
+func TestTCPEcho(t *testing.T) {
+	const fin, syn, psh, ack = 0x01, 0x02, 0x08, 0x10
+
+	s, err := NewLWIPStackWithOptions(StackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RegisterTCPConnHandler(echoTCPHandler{})
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, decode(synHex), t)
+	synack := parseTestSegment(<-out)
+	if synack.flags != syn|ack || synack.ack != 2 {
+		t.Fatalf("Expected SYN-ACK, got flags %x ack %v", synack.flags, synack.ack)
+	}
+	seq, rcvNxt := uint32(2), synack.seq+1
+	write(s, tcpPacket(ack, seq, rcvNxt, nil), t)
+	write(s, tcpPacket(psh|ack, seq, rcvNxt, []byte("hello")), t)
+	seq += 5
+	write(s, tcpPacket(fin|ack, seq, rcvNxt, nil), t)
+	seq++
+
+	var echoed []byte
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case b := <-out:
+			seg := parseTestSegment(b)
+			if seg.seq != rcvNxt {
+				continue
+			}
+			echoed = append(echoed, seg.payload...)
+			rcvNxt += uint32(len(seg.payload))
+			if seg.flags&fin != 0 {
+				rcvNxt++
+				closed = true
+			}
+			write(s, tcpPacket(ack, seq, rcvNxt, nil), t)
+		case <-time.After(200 * time.Millisecond):
+			// Segments may be dropped while data is refused by
+			// the handler, retransmit FIN as a client would do.
+			write(s, tcpPacket(fin|ack, seq-1, rcvNxt, nil), t)
+		case <-timeout:
+			t.Fatal("Connection not closed")
+		}
+	}
+	assertEqual(echoed, []byte("hello"), t)
+}
+
+// Counters should follow inputted packets, lwIP counters are shared by
+// stacks so only increases are checked.
+func TestStats(t *testing.T) {
+	s, h := setupUDP(t)
+	defer s.Close()
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		return len(b), nil
+	})
+	before := s.Stats()
+	write(s, ntp, t)
+	<-h.packets
+	write(s, decode(synHex), t)
+	if _, err := s.Write([]byte{0x70}); err == nil {
+		t.Fatal("Expected error for invalid packet")
+	}
+	after := s.Stats()
+
+	if after.IP.Received-before.IP.Received < 2 {
+		t.Errorf("Expected 2 IP packets received, got %v", after.IP.Received-before.IP.Received)
+	}
+	if after.UDP.Received == before.UDP.Received {
+		t.Error("UDP packet not counted")
+	}
+	if after.TCP.Received == before.TCP.Received || after.TCP.Sent == before.TCP.Sent {
+		t.Error("TCP segments not counted")
+	}
+	if after.UDPConns != 1 {
+		t.Errorf("Expected 1 UDP connection, got %v", after.UDPConns)
+	}
+	if after.InputErrors != 1 {
+		t.Errorf("Expected 1 input error, got %v", after.InputErrors)
+	}
+}
+
+// This handler connects with results sent to connects.
+type connectTCPHandler struct {
+	connects  chan error
+	connected chan net.Conn
+}
+
+func (h *connectTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return errors.New("not connected before accepted")
+}
+
+func (h *connectTCPHandler) Connect(target *net.TCPAddr) (net.Conn, error) {
+	if err := <-h.connects; err != nil {
+		return nil, err
+	}
+	upstream, _ := net.Pipe()
+	return upstream, nil
+}
+
+func (h *connectTCPHandler) HandleConnected(conn net.Conn, upstream net.Conn) error {
+	h.connected <- upstream
+	return nil
+}
+
+func setupConnectTCP(t *testing.T) (LWIPStack, *connectTCPHandler, chan []byte) {
+	s, err := NewLWIPStackWithOptions(StackOptions{ConnectBeforeAccept: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &connectTCPHandler{connects: make(chan error), connected: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+	return s, h, out
+}
+
+// The SYN should be answered only after the handler has connected.
+func TestConnectBeforeAccept(t *testing.T) {
+	const syn, ack = 0x02, 0x10
+
+	s, h, out := setupConnectTCP(t)
+	defer s.Close()
+
+	write(s, decode(synHex), t)
+	write(s, decode(synHex), t) // Retransmitted
+	select {
+	case <-out:
+		t.Fatal("SYN answered before connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	h.connects <- nil
+	synack := parseTestSegment(<-out)
+	if synack.flags != syn|ack || synack.ack != 2 {
+		t.Fatalf("Expected SYN-ACK, got flags %x ack %v", synack.flags, synack.ack)
+	}
+	write(s, tcpPacket(ack, 2, synack.seq+1, nil), t)
+	select {
+	case <-h.connected:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not handled")
+	}
+}
+
+// syn6WithOptions returns a SYN over IPv6 with a Hop-by-Hop Options header.
+func syn6WithOptions() []byte {
+	tcp := decode(synHex)[ipv4Header:]
+	b := make([]byte, ipv6Header+8, ipv6Header+8+len(tcp))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(tcp)))
+	b[6], b[7] = 0, 64
+	copy(b[8:], net.ParseIP("fd00::1"))
+	copy(b[24:], net.ParseIP("fd00::2"))
+	// Next header TCP, then a PadN option filling the header.
+	copy(b[ipv6Header:], []byte{6, 0, 1, 4})
+	return append(b, tcp...)
+}
+
+// SYNs with IPv6 extension headers should be held too.
+func TestConnectBeforeAcceptIPv6Options(t *testing.T) {
+	const rst, ack = 0x04, 0x10
+
+	s, h, out := setupConnectTCP(t)
+	defer s.Close()
+
+	write(s, syn6WithOptions(), t)
+	select {
+	case h.connects <- syscall.ECONNREFUSED:
+	case b := <-out:
+		t.Fatalf("SYN answered before connected, % x", b)
+	case <-time.After(time.Second):
+		t.Fatal("SYN not held")
+	}
+	b := <-out
+	if b[0]>>4 != 6 || b[6] != 6 || b[ipv6Header+13] != rst|ack {
+		t.Errorf("Expected RST, got % x", b)
+	}
+}
+
+// SYNs should be answered with RST or ICMP unreachable if the handler
+// failed to connect.
+func TestConnectBeforeAcceptRejected(t *testing.T) {
+	const rst, ack = 0x04, 0x10
+
+	s, h, out := setupConnectTCP(t)
+	defer s.Close()
+
+	write(s, decode(synHex), t)
+	h.connects <- syscall.ECONNREFUSED
+	seg := parseTestSegment(<-out)
+	if seg.flags != rst|ack || seg.ack != 2 {
+		t.Errorf("Expected RST, got flags %x ack %v", seg.flags, seg.ack)
+	}
+
+	write(s, decode(synHex), t)
+	h.connects <- &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}
+	icmp := <-out
+	if icmp[9] != 1 || icmp[ipv4Header] != 3 || icmp[ipv4Header+1] != 1 {
+		t.Errorf("Expected ICMP host unreachable, got % x", icmp[:ipv4Header+2])
+	}
+	if !bytes.Equal(icmp[ipv4Header+8:], decode(synHex)) {
+		t.Error("ICMP message does not carry the SYN")
+	}
+}
+
+// This handler connects sources once the channels of their ports are
+// closed, it sends the ports dialed to dials and the ports of upstreams
+// closed to closed.
+type portConnectTCPHandler struct {
+	connectTCPHandler
+	mu     sync.Mutex
+	ports  map[int]chan struct{}
+	dials  chan int
+	closed chan int
+}
+
+func newPortConnectTCPHandler() *portConnectTCPHandler {
+	return &portConnectTCPHandler{
+		connectTCPHandler: connectTCPHandler{connected: make(chan net.Conn, 4)},
+		ports:             make(map[int]chan struct{}),
+		dials:             make(chan int, 4),
+		closed:            make(chan int, 4),
+	}
+}
+
+func (h *portConnectTCPHandler) port(port int) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ports[port] == nil {
+		h.ports[port] = make(chan struct{})
+	}
+	return h.ports[port]
+}
+
+func (h *portConnectTCPHandler) ConnectContext(ctx context.Context, meta *Metadata) (net.Conn, error) {
+	port := meta.Source.(*net.TCPAddr).Port
+	h.dials <- port
+	<-h.port(port)
+	upstream, _ := net.Pipe()
+	return closeNotifyConn{upstream, port, h.closed}, nil
+}
+
+func (h *portConnectTCPHandler) HandleConnectedContext(ctx context.Context, conn net.Conn, upstream net.Conn, meta *Metadata) error {
+	return h.HandleConnected(conn, upstream)
+}
+
+// closeNotifyConn sends its port to closed when closed.
+type closeNotifyConn struct {
+	net.Conn
+	port   int
+	closed chan int
+}
+
+func (c closeNotifyConn) Close() error {
+	c.closed <- c.port
+	return c.Conn.Close()
+}
+
+// synFrom returns synHex sent from port.
+func synFrom(port uint16) []byte {
+	syn := decode(synHex)
+	binary.BigEndian.PutUint16(syn[ipv4Header:], port)
+	return syn
+}
+
+// Pending connections should count against the limits, so that the handler
+// never connects for SYNs over the limits. SYNs written again once connected
+// should be admitted, and retransmitted SYNs rejected should count once.
+func TestConnectBeforeAcceptLimits(t *testing.T) {
+	const syn, rst, ack = 0x02, 0x04, 0x10
+
+	s, err := NewLWIPStackWithOptions(StackOptions{ConnectBeforeAccept: true, MaxTCPConnsPerSource: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := newPortConnectTCPHandler()
+	s.RegisterTCPConnHandler(h)
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, synFrom(12345), t)
+	if port := <-h.dials; port != 12345 {
+		t.Fatalf("Dialed for %v", port)
+	}
+	for i := 0; i < 2; i++ {
+		write(s, synFrom(12346), t)
+		select {
+		case b := <-out:
+			if seg := parseTestSegment(b); seg.flags != rst|ack {
+				t.Fatalf("Expected RST over the limit, got flags %x", seg.flags)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("SYN over the limit not rejected")
+		}
+	}
+	if st := s.Stats(); st.TCPConnsRejected != 1 {
+		t.Errorf("Expected 1 rejection, got %v", st.TCPConnsRejected)
+	}
+
+	close(h.port(12345))
+	synack := parseTestSegment(<-out)
+	if synack.flags != syn|ack {
+		t.Fatalf("Expected SYN-ACK, got flags %x", synack.flags)
+	}
+	write(s, tcpPacket(ack, 2, synack.seq+1, nil), t)
+	select {
+	case <-h.connected:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not handled")
+	}
+	select {
+	case port := <-h.dials:
+		t.Errorf("Dialed for %v over the limit", port)
+	case port := <-h.closed:
+		t.Errorf("Upstream of %v closed", port)
+	default:
+	}
+}
+
+// This UDP handler fails to connect with err.
+type failUDPHandler struct {
+	err error
+}
+
+func (h failUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return h.err
+}
+
+func (h failUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	return errors.New("not connected")
+}
+
+// Packets should be answered with ICMP unreachable if the handler failed to
+// connect, with the code selected by the error.
+func TestUDPConnectUnreachable(t *testing.T) {
+	setupUDP(t)
+	for _, c := range []struct {
+		pkt       []byte
+		hl        int
+		err       error
+		proto     byte
+		typ, code byte
+	}{
+		{ntp, ipv4Header, errors.New("rejected"), 1, 3, 3},
+		{ntp, ipv4Header, &UnreachableError{Code: HostUnreachable}, 1, 3, 1},
+		{udp6, ipv6Header, errors.New("rejected"), 58, 1, 4},
+		{udp6, ipv6Header, &net.OpError{Op: "dial", Net: "udp", Err: syscall.ENETUNREACH}, 58, 1, 0},
+	} {
+		s := NewLWIPStack()
+		s.RegisterUDPConnHandler(failUDPHandler{c.err})
+		out := make(chan []byte, 1)
+		s.RegisterOutputFn(func(b []byte) (int, error) {
+			out <- append([]byte(nil), b...)
+			return len(b), nil
+		})
+		write(s, c.pkt, t)
+		var reply []byte
+		select {
+		case reply = <-out:
+		case <-time.After(time.Second):
+			t.Fatalf("No reply for %v", c.err)
+		}
+		s.Close()
+
+		proto := reply[9]
+		if c.hl == ipv6Header {
+			proto = reply[6]
+		}
+		msg := reply[c.hl:]
+		if proto != c.proto || msg[0] != c.typ || msg[1] != c.code {
+			t.Errorf("Expected ICMP type %v code %v for %v, got proto %v type %v code %v", c.typ, c.code, c.err, proto, msg[0], msg[1])
+			continue
+		}
+		// The quoted packet should carry the ports.
+		quoted := msg[8+c.hl:]
+		if !bytes.Equal(quoted[:4], c.pkt[c.hl:c.hl+4]) {
+			t.Errorf("Quoted ports % x, expected % x", quoted[:4], c.pkt[c.hl:c.hl+4])
+		}
+	}
+}
+
+// TCP segments should be rejected with a RST as RFC 793 suggests, other
+// packets with ICMP unreachable, but errors and RSTs never be answered.
+func TestBuildReject(t *testing.T) {
+	for _, c := range []struct {
+		pkt   []byte
+		reply testSegment
+	}{
+		{decode(synHex), testSegment{flags: tcpRST | tcpACK, seq: 0, ack: 2}},
+		{tcpPacket(tcpACK|tcpPSH, 100, 200, []byte("data")), testSegment{flags: tcpRST, seq: 200}},
+		{tcpPacket(tcpFIN, 100, 0, []byte("data")), testSegment{flags: tcpRST | tcpACK, ack: 105}},
+	} {
+		reply := BuildReject(c.pkt, AdminProhibited)
+		if reply == nil {
+			t.Errorf("No reply to %x", c.pkt)
+			continue
+		}
+		seg := parseTestSegment(reply)
+		if seg.flags != c.reply.flags || seg.seq != c.reply.seq || seg.ack != c.reply.ack || len(seg.payload) != 0 {
+			t.Errorf("Expected %+v, got %+v", c.reply, seg)
+		}
+	}
+
+	src, dst := net.ParseIP("fd00::1"), net.ParseIP("2001:db8::1")
+	echo := echoRequestPacket(src, dst, 1)
+	reply := BuildReject(echo, AdminProhibited)
+	if len(reply) <= ipv6Header || proto(reply[6]) != proto_icmpv6 || reply[ipv6Header] != 1 {
+		t.Errorf("Expected ICMPv6 unreachable, got %x", reply)
+	}
+	for _, pkt := range [][]byte{
+		tcpPacket(tcpRST, 100, 0, nil),
+		reply,
+		buildICMPUnreachable(decode(ntpHex), PortUnreachable),
+		decode(frag2Hex),
+		decode(ntpHex)[:ipv4Header-2],
+	} {
+		if r := BuildReject(pkt, AdminProhibited); r != nil {
+			t.Errorf("Unexpected reply %x to %x", r, pkt)
+		}
+	}
+}
+
+// Time exceeded messages should come from the hop, quoting the packet.
+func TestBuildTimeExceeded(t *testing.T) {
+	pkt := decode(ntpHex)
+	hop := net.IPv4(10, 255, 0, 1)
+	reply := BuildTimeExceeded(pkt, hop)
+	if len(reply) != ipv4Header+8+len(pkt) || !net.IP(reply[12:16]).Equal(hop) || !bytes.Equal(reply[16:20], pkt[12:16]) {
+		t.Fatalf("Unexpected reply %x", reply)
+	}
+	msg := reply[ipv4Header:]
+	if msg[0] != 11 || msg[1] != 0 || checksum(0, msg) != 0xffff || !bytes.Equal(msg[8:], pkt) {
+		t.Errorf("Unexpected message %x", msg)
+	}
+
+	pkt = decode(udp6Hex)
+	hop = net.ParseIP("fd00::ff")
+	reply = BuildTimeExceeded(pkt, hop)
+	if len(reply) != ipv6Header+8+len(pkt) || !net.IP(reply[8:24]).Equal(hop) || proto(reply[6]) != proto_icmpv6 {
+		t.Fatalf("Unexpected reply %x", reply)
+	}
+	if msg := reply[ipv6Header:]; msg[0] != 3 || msg[1] != 0 || transportChecksum(hop, net.IP(pkt[8:24]), proto_icmpv6, msg) != 0 {
+		t.Errorf("Unexpected message %x", msg)
+	}
+
+	if reply := BuildTimeExceeded(pkt, net.IPv4(10, 255, 0, 1)); reply != nil {
+		t.Errorf("Unexpected reply %x from an IPv4 hop", reply)
+	}
+}
+
+// Packets to multicast or broadcast addresses, or from unspecified ones,
+// should never be answered.
+func TestBuildICMPErrorMulticast(t *testing.T) {
+	for _, addrs := range [][2]net.IP{
+		{net.IPv4(10, 0, 0, 1), net.IPv4(224, 0, 0, 251)},
+		{net.IPv4(10, 0, 0, 1), net.IPv4bcast},
+		{net.IPv4zero, net.IPv4(1, 2, 3, 4)},
+		{net.ParseIP("fd00::1"), net.ParseIP("ff02::fb")},
+	} {
+		pkt := echoRequestPacket(addrs[0], addrs[1], 1)
+		hop := net.IPv4(10, 255, 0, 1)
+		if addrs[1].To4() == nil {
+			hop = net.ParseIP("fd00::ff")
+		}
+		if reply := BuildTimeExceeded(pkt, hop); reply != nil {
+			t.Errorf("Time exceeded %x answering %v -> %v", reply, addrs[0], addrs[1])
+		}
+		if reply := BuildReject(pkt, AdminProhibited); reply != nil {
+			t.Errorf("Reject %x answering %v -> %v", reply, addrs[0], addrs[1])
+		}
+	}
+}
+
+type contextTCPHandler struct {
+	echoTCPHandler
+	handled chan *Metadata
+}
+
+func (h contextTCPHandler) HandleContext(ctx context.Context, conn net.Conn, meta *Metadata) error {
+	if MetadataFromContext(ctx) != meta {
+		panic("metadata not carried by the context")
+	}
+	go func() {
+		<-ctx.Done()
+		h.handled <- meta
+	}()
+	return nil
+}
+
+type contextUDPHandler struct {
+	fakeUDPHandler
+	connected chan *Metadata
+}
+
+func (h *contextUDPHandler) ConnectContext(ctx context.Context, conn UDPConn, meta *Metadata) error {
+	h.connected <- meta
+	return nil
+}
+
+// Context handlers should receive resolved metadata, and contexts which are
+// done once the stack is closed.
+func TestMetadata(t *testing.T) {
+	setupUDP(t)
+	s, err := NewLWIPStackWithOptions(StackOptions{Name: "tun-meta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterMetadataResolver(func(meta *Metadata) {
+		meta.Domain = "example.com"
+	})
+	s.RegisterMetadataResolver(func(meta *Metadata) {
+		if meta.Domain == "example.com" {
+			meta.UID = 1000
+		}
+	})
+	tcp := contextTCPHandler{handled: make(chan *Metadata, 1)}
+	udp := &contextUDPHandler{connected: make(chan *Metadata, 1)}
+	s.RegisterTCPConnHandler(tcp)
+	s.RegisterUDPConnHandler(udp)
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, ntp, t)
+	var udpMeta *Metadata
+	select {
+	case udpMeta = <-udp.connected:
+	case <-time.After(time.Second):
+		t.Fatal("UDP connection not handled")
+	}
+	if udpMeta.Network != "udp" || udpMeta.Source.String() != "100.106.65.0:123" || udpMeta.Destination.String() != "216.239.35.4:123" {
+		t.Errorf("Unexpected UDP metadata %+v", udpMeta)
+	}
+
+	write(s, decode(synHex), t)
+	synack := parseTestSegment(<-out)
+	write(s, tcpPacket(0x10, 2, synack.seq+1, nil), t)
+	s.Close()
+	var tcpMeta *Metadata
+	select {
+	case tcpMeta = <-tcp.handled:
+	case <-time.After(time.Second):
+		t.Fatal("TCP connection not handled, or context not done")
+	}
+	if tcpMeta.Network != "tcp" || tcpMeta.Source.String() != "10.0.0.1:12345" || tcpMeta.Destination.String() != "10.0.0.2:80" {
+		t.Errorf("Unexpected TCP metadata %+v", tcpMeta)
+	}
+
+	for _, meta := range []*Metadata{udpMeta, tcpMeta} {
+		if meta.Inbound != "tun-meta" || meta.Domain != "example.com" || meta.UID != 1000 || meta.Process != nil {
+			t.Errorf("Unexpected %v metadata %+v", meta.Network, meta)
+		}
+	}
+	if tcpMeta.ID == udpMeta.ID {
+		t.Errorf("Connections share ID %v", tcpMeta.ID)
+	}
+}
+
+// upperConn upper-cases data written.
+type upperConn struct {
+	TCPConn
+}
+
+func (c upperConn) Write(b []byte) (int, error) {
+	return c.TCPConn.Write(bytes.ToUpper(b))
+}
+
+// Handlers should receive connections wrapped by the registered wrappers.
+func TestTCPConnWrapper(t *testing.T) {
+	const psh, ack = 0x08, 0x10
+
+	s, err := NewLWIPStackWithOptions(StackOptions{Name: "tun-wrap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	wrapped := make(chan *Metadata, 1)
+	s.RegisterTCPConnWrapper(func(conn TCPConn, meta *Metadata) TCPConn {
+		select {
+		case wrapped <- meta:
+		default:
+		}
+		return upperConn{conn}
+	})
+	s.RegisterTCPConnHandler(echoTCPHandler{})
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, decode(synHex), t)
+	synack := parseTestSegment(<-out)
+	write(s, tcpPacket(ack, 2, synack.seq+1, nil), t)
+	select {
+	case meta := <-wrapped:
+		if meta.Network != "tcp" || meta.Destination.String() != "10.0.0.2:80" {
+			t.Errorf("Unexpected metadata %+v", meta)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connection not wrapped")
+	}
+	write(s, tcpPacket(psh|ack, 2, synack.seq+1, []byte("hello")), t)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case b := <-out:
+			if seg := parseTestSegment(b); len(seg.payload) > 0 {
+				assertEqual(seg.payload, []byte("HELLO"), t)
+				return
+			}
+		case <-timeout:
+			t.Fatal("Data not echoed")
+		}
+	}
+}
+
+// Connections should be listed until closed with CloseConnection, TCP ones
+// are reset.
+func TestListConnections(t *testing.T) {
+	const rst, ack = 0x04, 0x10
+
+	s, h := setupUDP(t)
+	defer s.Close()
+	s.RegisterTCPConnHandler(echoTCPHandler{})
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, ntp, t)
+	<-h.packets
+	write(s, decode(synHex), t)
+	synack := parseTestSegment(<-out)
+	write(s, tcpPacket(ack, 2, synack.seq+1, nil), t)
+
+	infos := s.ListConnections()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 connections, got %+v", infos)
+	}
+	udp, tcp := infos[0], infos[1]
+	if udp.Network != "udp" || udp.Source.String() != "100.106.65.0:123" || udp.Destination.String() != "216.239.35.4:123" {
+		t.Errorf("Unexpected UDP connection %+v", udp)
+	}
+	if tcp.Network != "tcp" || tcp.Source.String() != "10.0.0.1:12345" || tcp.Destination.String() != "10.0.0.2:80" || tcp.ID <= udp.ID {
+		t.Errorf("Unexpected TCP connection %+v", tcp)
+	}
+
+	if err := s.CloseConnection(tcp.ID); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(time.Second)
+	for reset := false; !reset; {
+		select {
+		case b := <-out:
+			reset = parseTestSegment(b).flags&rst != 0
+		case <-timeout:
+			t.Fatal("Connection not reset")
+		}
+	}
+	if err := s.CloseConnection(udp.ID); err != nil {
+		t.Fatal(err)
+	}
+	if infos := s.ListConnections(); len(infos) != 0 {
+		t.Errorf("Expected no connections, got %+v", infos)
+	}
+	if err := s.CloseConnection(tcp.ID); err != ErrConnNotFound {
+		t.Errorf("Expected ErrConnNotFound, got %v", err)
+	}
+}
+
+// This TCP handler hands connections over to tests.
+type acceptTCPHandler struct {
+	conns chan net.Conn
+}
+
+func (h *acceptTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+// acceptTCP opens a connection to a stack with an acceptTCPHandler, it
+// returns the connection and the next sequence numbers of both sides.
+func acceptTCP(s LWIPStack, out chan []byte, t *testing.T) (conn net.Conn, seq, rcvNxt uint32) {
+	const ack = 0x10
+
+	h := &acceptTCPHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	write(s, decode(synHex), t)
+	synack := parseTestSegment(<-out)
+	write(s, tcpPacket(ack, 2, synack.seq+1, nil), t)
+	select {
+	case conn = <-h.conns:
+	case <-time.After(time.Second):
+		t.Fatal("Connection not handled")
+	}
+	return conn, 2, synack.seq + 1
+}
+
+// Data not read by the handler should close the window rather than block
+// the stack, the window should be opened again once data is read.
+func TestTCPReceiveWindow(t *testing.T) {
+	const psh, ack = 0x08, 0x10
+	const segments, segmentLen = 12, 1024
+
+	s := NewLWIPStack()
+	defer s.Close()
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+	conn, seq, rcvNxt := acceptTCP(s, out, t)
+
+	window := func() uint16 {
+		var wnd uint16
+		for {
+			select {
+			case b := <-out:
+				wnd = binary.BigEndian.Uint16(b[ipv4Header+14:])
+			case <-time.After(300 * time.Millisecond):
+				return wnd
+			}
+		}
+	}
+	write(s, tcpPacket(psh|ack, seq, rcvNxt, make([]byte, segmentLen)), t)
+	seq += segmentLen
+	initial := window()
+	for i := 1; i < segments; i++ {
+		write(s, tcpPacket(psh|ack, seq, rcvNxt, make([]byte, segmentLen)), t)
+		seq += segmentLen
+	}
+	closed := window()
+	if closed >= initial {
+		t.Fatalf("Window not closed by unread data, %v then %v", initial, closed)
+	}
+
+	buf := make([]byte, segments*segmentLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if opened := window(); opened <= closed {
+		t.Errorf("Window not opened after reading, %v then %v", closed, opened)
+	}
+	conn.Close()
+}
+
+// Connections over the limits should be rejected, TCP ones with RST, until
+// connections are closed.
+func TestConnLimits(t *testing.T) {
+	const syn, rst, ack = 0x02, 0x04, 0x10
+
+	setupUDP(t)
+	s, err := NewLWIPStackWithOptions(StackOptions{MaxTCPConnsPerSource: 1, MaxUDPConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := &fakeUDPHandler{packets: make(chan []byte, 1)}
+	s.RegisterUDPConnHandler(h)
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+	conn, _, _ := acceptTCP(s, out, t)
+
+	// Another connection from the same source, its retransmitted SYN
+	// counts as the same rejection.
+	syn2 := synFrom(12346)
+	for i := 0; i < 2; i++ {
+		write(s, syn2, t)
+		if seg := parseTestSegment(<-out); seg.flags != rst|ack {
+			t.Errorf("Expected RST, got flags %x", seg.flags)
+		}
+	}
+
+	write(s, ntp, t)
+	<-h.packets
+	write(s, udp6, t)
+	write(s, udp6, t)
+	select {
+	case <-h.packets:
+		t.Error("UDP session over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	st := s.Stats()
+	if st.TCPConnsRejected != 1 || st.UDPConnsRejected != 1 {
+		t.Errorf("Expected 1 TCP and 1 UDP rejection, got %v and %v", st.TCPConnsRejected, st.UDPConnsRejected)
+	}
+
+	conn.(TCPConn).Abort()
+	for len(out) > 0 {
+		<-out
+	}
+	write(s, syn2, t)
+	if seg := parseTestSegment(<-out); seg.flags != syn|ack {
+		t.Errorf("Expected SYN-ACK after the connection closed, got flags %x", seg.flags)
+	}
+}
+
+// echoRequestPacket builds an ICMP or ICMPv6 echo request from src to dst.
+func echoRequestPacket(src, dst net.IP, seq uint16) []byte {
+	p, typ := proto_icmp, byte(8)
+	if dst.To4() == nil {
+		p, typ = proto_icmpv6, 128
+	}
+	hl := ipHeaderLen(dst)
+	pkt := make([]byte, hl+16)
+	msg := pkt[hl:]
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], 0x1234)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "abcdefgh")
+	if p == proto_icmp {
+		binary.BigEndian.PutUint16(msg[2:], ^checksum(0, msg))
+	} else {
+		binary.BigEndian.PutUint16(msg[2:], transportChecksum(src, dst, p, msg))
+	}
+	writeIPHeader(pkt, src, dst, p, len(msg))
+	return pkt
+}
+
+// checkEchoReply checks that reply answers req.
+func checkEchoReply(reply, req []byte, t *testing.T) {
+	t.Helper()
+	r, ok := parseICMPEcho(req)
+	if !ok {
+		t.Fatal("Invalid echo request")
+	}
+	hl := ipHeaderLen(r.dst)
+	if len(reply) != len(req) {
+		t.Fatalf("Expected a reply of %v bytes, got %v", len(req), len(reply))
+	}
+	var src, dst net.IP
+	var sum uint16
+	msg := reply[hl:]
+	if hl == ipv4Header {
+		src, dst = net.IP(reply[12:16]), net.IP(reply[16:20])
+		if msg[0] != 0 {
+			t.Errorf("Expected echo reply, got type %v", msg[0])
+		}
+		sum = ^checksum(0, msg)
+	} else {
+		src, dst = net.IP(reply[8:24]), net.IP(reply[24:40])
+		if msg[0] != 129 {
+			t.Errorf("Expected echo reply, got type %v", msg[0])
+		}
+		sum = transportChecksum(src, dst, proto_icmpv6, msg)
+	}
+	if !src.Equal(r.dst) || !dst.Equal(r.src) {
+		t.Errorf("Reply from %v to %v, expected from %v to %v", src, dst, r.dst, r.src)
+	}
+	if sum != 0 {
+		t.Errorf("Invalid checksum of the reply")
+	}
+	if !bytes.Equal(msg[4:], r.msg[4:]) {
+		t.Errorf("Reply carries % x, expected % x", msg[4:], r.msg[4:])
+	}
+}
+
+var (
+	echoSrc4 = net.IPv4(10, 0, 0, 1)
+	echoDst4 = net.IPv4(1, 2, 3, 4)
+	echoSrc6 = net.ParseIP("fd00::1")
+	echoDst6 = net.ParseIP("2001:db8::1")
+)
+
+// Echo requests to any destination should be answered, after the delay in
+// ICMPEchoDelay mode.
+func TestICMPEcho(t *testing.T) {
+	for _, opts := range []StackOptions{
+		{},
+		{ICMPEcho: ICMPEchoDelay, ICMPEchoDelay: 100 * time.Millisecond},
+	} {
+		s, err := NewLWIPStackWithOptions(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(chan []byte, 8)
+		s.RegisterOutputFn(func(b []byte) (int, error) {
+			out <- append([]byte(nil), b...)
+			return len(b), nil
+		})
+		for _, req := range [][]byte{
+			echoRequestPacket(echoSrc4, echoDst4, 1),
+			echoRequestPacket(echoSrc6, echoDst6, 2),
+		} {
+			start := time.Now()
+			write(s, req, t)
+			select {
+			case reply := <-out:
+				checkEchoReply(reply, req, t)
+			case <-time.After(time.Second):
+				t.Fatalf("No reply in %v mode", opts.ICMPEcho)
+			}
+			if rtt := time.Since(start); rtt < opts.ICMPEchoDelay {
+				t.Errorf("Replied in %v, expected a delay of %v", rtt, opts.ICMPEchoDelay)
+			}
+		}
+		s.Close()
+	}
+}
+
+// Echo requests should be answered once the handler has connected to the
+// destination in ICMPEchoProbe mode, and not if it fails to connect.
+func TestICMPEchoProbe(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(StackOptions{ICMPEcho: ICMPEchoProbe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := &connectTCPHandler{connects: make(chan error), connected: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	out := make(chan []byte, 8)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	// Both requests share a probe, a second Connect would block.
+	req1 := echoRequestPacket(echoSrc4, echoDst4, 1)
+	req2 := echoRequestPacket(echoSrc4, echoDst4, 2)
+	write(s, req1, t)
+	write(s, req2, t)
+	select {
+	case <-out:
+		t.Fatal("Replied before connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+	h.connects <- nil
+	checkEchoReply(<-out, req1, t)
+	checkEchoReply(<-out, req2, t)
+
+	write(s, echoRequestPacket(echoSrc6, echoDst6, 3), t)
+	h.connects <- errors.New("rejected")
+	req := echoRequestPacket(echoSrc6, net.ParseIP("2001:db8::2"), 4)
+	write(s, req, t)
+	h.connects <- &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}
+	icmp := <-out
+	if icmp[6] != 58 || icmp[ipv6Header] != 1 || icmp[ipv6Header+1] != 3 {
+		t.Errorf("Expected ICMPv6 address unreachable, got % x", icmp[:ipv6Header+2])
+	}
+	if !bytes.Equal(icmp[ipv6Header+8:], req) {
+		t.Error("ICMPv6 message does not carry the request")
+	}
+	select {
+	case pkt := <-out:
+		t.Errorf("Unexpected packet % x", pkt)
+	default:
+	}
+}
+
+// This TCP handler connects until the context is done.
+type ctxConnectTCPHandler struct {
+	connectTCPHandler
+	metas chan *Metadata
+	errs  chan error
+}
+
+func (h *ctxConnectTCPHandler) ConnectContext(ctx context.Context, meta *Metadata) (net.Conn, error) {
+	h.metas <- meta
+	<-ctx.Done()
+	h.errs <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (h *ctxConnectTCPHandler) HandleConnectedContext(ctx context.Context, conn net.Conn, upstream net.Conn, meta *Metadata) error {
+	return h.HandleConnected(conn, upstream)
+}
+
+// Probes should connect with the metadata of the destination, and be
+// cancelled when the stack is closed.
+func TestICMPEchoProbeContext(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(StackOptions{ICMPEcho: ICMPEchoProbe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &ctxConnectTCPHandler{metas: make(chan *Metadata, 1), errs: make(chan error, 1)}
+	s.RegisterTCPConnHandler(h)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		return len(b), nil
+	})
+
+	write(s, echoRequestPacket(echoSrc4, echoDst4, 1), t)
+	meta := <-h.metas
+	target, ok := meta.Destination.(*net.TCPAddr)
+	if !ok || !target.IP.Equal(echoDst4) || target.Port != defaultICMPProbePort {
+		t.Errorf("Unexpected destination %v", meta.Destination)
+	}
+	s.Close()
+	select {
+	case err := <-h.errs:
+		if err != context.Canceled {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Probe not cancelled on close")
+	}
+}
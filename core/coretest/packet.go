@@ -0,0 +1,301 @@
+package coretest
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	fragHeaderLen = 8
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+var errMalformed = errors.New("malformed packet")
+
+func checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoChecksum computes the checksum of a TCP, UDP or ICMPv6 segment with
+// the pseudo header, it's zero for a segment with a valid checksum.
+func pseudoChecksum(src, dst net.IP, proto byte, seg []byte) uint16 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum += uint32(checksum(0, src4)) + uint32(checksum(0, dst4))
+	} else {
+		sum += uint32(checksum(0, src.To16())) + uint32(checksum(0, dst.To16()))
+	}
+	sum += uint32(proto) + uint32(len(seg))
+	return ^checksum(sum, seg)
+}
+
+// buildPacket wraps payload, whose checksum is filled in, in an unfragmented
+// IP packet.
+func buildPacket(src, dst net.IP, proto byte, payload []byte, id uint16) []byte {
+	var pkt []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt = make([]byte, ipv4HeaderLen+len(payload))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], id)
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(0, pkt[:ipv4HeaderLen]))
+	} else {
+		pkt = make([]byte, ipv6HeaderLen+len(payload))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(payload)))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+	}
+	copy(pkt[len(pkt)-len(payload):], payload)
+
+	seg := pkt[len(pkt)-len(payload):]
+	switch proto {
+	case protoTCP:
+		seg[16], seg[17] = 0, 0
+		binary.BigEndian.PutUint16(seg[16:], pseudoChecksum(src, dst, proto, seg))
+	case protoUDP:
+		seg[6], seg[7] = 0, 0
+		binary.BigEndian.PutUint16(seg[6:], pseudoChecksum(src, dst, proto, seg))
+	}
+	return pkt
+}
+
+// packet is a parsed IP packet.
+type packet struct {
+	src, dst net.IP
+	proto    byte
+	payload  []byte
+}
+
+// fragment describes a fragment of an IP packet, offset is in bytes.
+type fragment struct {
+	key    fragKey
+	offset int
+	more   bool
+}
+
+type fragKey struct {
+	src, dst string
+	proto    byte
+	id       uint32
+}
+
+// parsePacket parses an IP packet, frag is not nil if it's a fragment.
+// Header checksums of IPv4 packets are verified.
+func parsePacket(b []byte) (pkt packet, frag *fragment, err error) {
+	if len(b) == 0 {
+		return pkt, nil, errMalformed
+	}
+	switch b[0] >> 4 {
+	case 4:
+		hl := int(b[0]&0x0f) * 4
+		if len(b) < ipv4HeaderLen || hl < ipv4HeaderLen || hl > len(b) {
+			return pkt, nil, errMalformed
+		}
+		total := int(binary.BigEndian.Uint16(b[2:4]))
+		if total < hl || total > len(b) || checksum(0, b[:hl]) != 0xffff {
+			return pkt, nil, errMalformed
+		}
+		pkt.src, pkt.dst = net.IP(b[12:16]), net.IP(b[16:20])
+		pkt.proto = b[9]
+		pkt.payload = b[hl:total]
+		flags := binary.BigEndian.Uint16(b[6:8])
+		if flags&0x3fff != 0 {
+			frag = &fragment{
+				key:    fragKey{string(pkt.src), string(pkt.dst), pkt.proto, uint32(binary.BigEndian.Uint16(b[4:6]))},
+				offset: int(flags&0x1fff) * 8,
+				more:   flags&0x2000 != 0,
+			}
+		}
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return pkt, nil, errMalformed
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+		if total > len(b) {
+			return pkt, nil, errMalformed
+		}
+		pkt.src, pkt.dst = net.IP(b[8:24]), net.IP(b[24:40])
+		pkt.proto = b[6]
+		pkt.payload = b[ipv6HeaderLen:total]
+		if pkt.proto == 44 {
+			h := pkt.payload
+			if len(h) < fragHeaderLen {
+				return pkt, nil, errMalformed
+			}
+			off := binary.BigEndian.Uint16(h[2:4])
+			pkt.proto = h[0]
+			pkt.payload = h[fragHeaderLen:]
+			frag = &fragment{
+				key:    fragKey{string(pkt.src), string(pkt.dst), pkt.proto, binary.BigEndian.Uint32(h[4:8])},
+				offset: int(off &^ 7),
+				more:   off&1 != 0,
+			}
+		}
+	default:
+		return pkt, nil, errMalformed
+	}
+	return pkt, frag, nil
+}
+
+// parseQuoted parses the packet quoted by an ICMP error message, which may
+// be truncated, the payload has at least the ports.
+func parseQuoted(b []byte) (pkt packet, ok bool) {
+	if len(b) == 0 {
+		return pkt, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		hl := int(b[0]&0x0f) * 4
+		if len(b) < ipv4HeaderLen || hl < ipv4HeaderLen || hl > len(b) {
+			return pkt, false
+		}
+		pkt.src, pkt.dst, pkt.proto, pkt.payload = net.IP(b[12:16]), net.IP(b[16:20]), b[9], b[hl:]
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return pkt, false
+		}
+		pkt.src, pkt.dst, pkt.proto, pkt.payload = net.IP(b[8:24]), net.IP(b[24:40]), b[6], b[ipv6HeaderLen:]
+	default:
+		return pkt, false
+	}
+	return pkt, len(pkt.payload) >= 4
+}
+
+// reassembly collects fragments of a packet.
+type reassembly struct {
+	parts map[int][]byte
+	total int // -1 until the last fragment arrives
+}
+
+// reassemble adds a fragment, it returns the payload of the packet once
+// all fragments have arrived.
+func (v *VirtualTUN) reassemble(frag *fragment, payload []byte) ([]byte, bool) {
+	r, ok := v.reass[frag.key]
+	if !ok {
+		r = &reassembly{parts: make(map[int][]byte), total: -1}
+		v.reass[frag.key] = r
+	}
+	r.parts[frag.offset] = append([]byte(nil), payload...)
+	if !frag.more {
+		r.total = frag.offset + len(payload)
+	}
+	if r.total < 0 {
+		return nil, false
+	}
+	data := make([]byte, 0, r.total)
+	for len(data) < r.total {
+		part, ok := r.parts[len(data)]
+		if !ok {
+			return nil, false
+		}
+		data = append(data, part...)
+	}
+	delete(v.reass, frag.key)
+	return data, true
+}
+
+// segment is a TCP segment.
+type segment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+	options          []byte
+	payload          []byte
+}
+
+func (s *segment) marshal() []byte {
+	hl := tcpHeaderLen + (len(s.options)+3)&^3
+	b := make([]byte, hl+len(s.payload))
+	binary.BigEndian.PutUint16(b[0:], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:], s.seq)
+	binary.BigEndian.PutUint32(b[8:], s.ack)
+	b[12] = byte(hl/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	copy(b[tcpHeaderLen:], s.options)
+	copy(b[hl:], s.payload)
+	return b
+}
+
+func parseSegment(b []byte) (segment, error) {
+	var s segment
+	if len(b) < tcpHeaderLen {
+		return s, errMalformed
+	}
+	hl := int(b[12]>>4) * 4
+	if hl < tcpHeaderLen || hl > len(b) {
+		return s, errMalformed
+	}
+	s.srcPort = binary.BigEndian.Uint16(b[0:])
+	s.dstPort = binary.BigEndian.Uint16(b[2:])
+	s.seq = binary.BigEndian.Uint32(b[4:])
+	s.ack = binary.BigEndian.Uint32(b[8:])
+	s.flags = b[13]
+	s.window = binary.BigEndian.Uint16(b[14:])
+	s.options = b[tcpHeaderLen:hl]
+	s.payload = b[hl:]
+	return s, nil
+}
+
+// synOptions returns the MSS and the window scale in SYN options, wscale is
+// -1 if absent.
+func synOptions(opts []byte) (mss, wscale int) {
+	wscale = -1
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return
+		}
+		switch {
+		case opts[0] == 2 && opts[1] == 4:
+			mss = int(binary.BigEndian.Uint16(opts[2:]))
+		case opts[0] == 3 && opts[1] == 3:
+			wscale = int(opts[2])
+		}
+		opts = opts[opts[1]:]
+	}
+	return
+}
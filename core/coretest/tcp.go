@@ -0,0 +1,500 @@
+package coretest
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+type tcpState int
+
+const (
+	tcpSynSent tcpState = iota
+	tcpEstablished
+	tcpClosed
+)
+
+// TCPConn is a TCP connection of a local client, opened by DialTCP. It
+// implements net.Conn, and CloseWrite for half-closing.
+type TCPConn struct {
+	v             *VirtualTUN
+	key           tcpKey
+	local, remote *net.TCPAddr
+
+	// Protected by the mu of v.
+	state tcpState
+	err   error // Set once the connection is reset or failed
+
+	iss, sndUna, sndNxt uint32
+	sndWnd              int // Scaled
+	sndScale, rcvScale  uint
+	mss                 int
+	sndBuf              []byte // Data from sndUna, unacknowledged or unsent
+	finQueued           bool
+	finSent, finAcked   bool
+
+	rcvNxt      uint32
+	rcvBuf      []byte
+	advertised  int // The window advertised last
+	finReceived bool
+	closed      bool // Close has been called, data received is discarded
+
+	timer         *time.Timer // Retransmission, or zero window probes
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// DialTCP opens a TCP connection to remote through the stack, it's reset
+// or failed if the stack answers with RST or ICMP unreachable. If local is
+// nil, or has no IP or port, the address of the local client and an unused
+// port are taken.
+func (v *VirtualTUN) DialTCP(local, remote *net.TCPAddr) (*TCPConn, error) {
+	v.mu.Lock()
+	if v.closed {
+		v.mu.Unlock()
+		return nil, opError("dial", "tcp", local, remote, errTUN)
+	}
+	laddr := &net.TCPAddr{IP: v.localIP(remote.IP)}
+	if local != nil {
+		laddr.Port = local.Port
+		if local.IP != nil {
+			laddr.IP = local.IP
+		}
+	}
+	if laddr.Port == 0 {
+		port, err := v.allocPort()
+		if err != nil {
+			v.mu.Unlock()
+			return nil, opError("dial", "tcp", laddr, remote, err)
+		}
+		laddr.Port = int(port)
+	}
+	key := tcpKey{uint16(laddr.Port), uint16(remote.Port), string(remote.IP.To16())}
+	if _, ok := v.tcpConns[key]; ok {
+		v.mu.Unlock()
+		return nil, opError("dial", "tcp", laddr, remote, syscall.EADDRINUSE)
+	}
+
+	c := &TCPConn{
+		v:      v,
+		key:    key,
+		local:  laddr,
+		remote: remote,
+		iss:    uint32(laddr.Port) << 16,
+		mss:    v.opts.MTU - ipv4HeaderLen - tcpHeaderLen,
+	}
+	if remote.IP.To4() == nil {
+		c.mss = v.opts.MTU - ipv6HeaderLen - tcpHeaderLen
+	}
+	for v.opts.TCPWindow>>c.rcvScale > 0xffff {
+		c.rcvScale++
+	}
+	c.sndUna, c.sndNxt = c.iss, c.iss+1
+	v.tcpConns[key] = c
+	c.sendSYN()
+	c.armTimer()
+
+	ok := v.waitDeadline(time.Now().Add(v.opts.DialTimeout), func() bool {
+		return c.state != tcpSynSent
+	})
+	if !ok {
+		c.fail(timeoutError{})
+	}
+	err := c.err
+	v.unlockAndFlush()
+	if err != nil {
+		return nil, opError("dial", "tcp", laddr, remote, err)
+	}
+	return c, nil
+}
+
+func (c *TCPConn) sendSYN() {
+	opts := []byte{2, 4, byte(c.mss >> 8), byte(c.mss)}
+	if c.rcvScale > 0 {
+		opts = append(opts, 1, 3, 3, byte(c.rcvScale))
+	}
+	window := c.v.opts.TCPWindow
+	if window > 0xffff {
+		window = 0xffff
+	}
+	c.v.send(c.local.IP, c.remote.IP, protoTCP, (&segment{
+		srcPort: uint16(c.local.Port),
+		dstPort: uint16(c.remote.Port),
+		seq:     c.iss,
+		flags:   tcpSYN,
+		window:  uint16(window),
+		options: opts,
+	}).marshal())
+}
+
+// window returns the receive window.
+func (c *TCPConn) window() int {
+	w := c.v.opts.TCPWindow - len(c.rcvBuf)
+	if max := 0xffff << c.rcvScale; w > max {
+		w = max
+	}
+	return w
+}
+
+// send queues a segment acknowledging the data received.
+func (c *TCPConn) send(flags byte, seq uint32, payload []byte) {
+	c.advertised = c.window()
+	c.v.send(c.local.IP, c.remote.IP, protoTCP, (&segment{
+		srcPort: uint16(c.local.Port),
+		dstPort: uint16(c.remote.Port),
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags | tcpACK,
+		window:  uint16(c.advertised >> c.rcvScale),
+		payload: payload,
+	}).marshal())
+}
+
+// inflight returns the number of bytes of sndBuf sent but not acknowledged.
+func (c *TCPConn) inflight() int {
+	n := int(c.sndNxt - c.sndUna)
+	if c.finSent && !c.finAcked {
+		n--
+	}
+	return n
+}
+
+// output sends data the peer has room for, and FIN after the data if
+// queued. It returns whether anything is sent.
+func (c *TCPConn) output() bool {
+	if c.state != tcpEstablished {
+		return false
+	}
+	sent := false
+	for {
+		inflight := c.inflight()
+		if unsent := len(c.sndBuf) - inflight; unsent > 0 {
+			n := c.sndWnd - inflight
+			if n <= 0 {
+				break
+			}
+			if n > unsent {
+				n = unsent
+			}
+			if n > c.mss {
+				n = c.mss
+			}
+			c.send(tcpPSH, c.sndNxt, c.sndBuf[inflight:inflight+n])
+			c.sndNxt += uint32(n)
+			sent = true
+			continue
+		}
+		if c.finQueued && !c.finSent {
+			c.send(tcpFIN, c.sndNxt, nil)
+			c.sndNxt++
+			c.finSent = true
+			sent = true
+		}
+		break
+	}
+	c.armTimer()
+	return sent
+}
+
+// armTimer starts the timer if there is data or FIN unacknowledged, or data
+// waiting for the window to open, and stops it otherwise.
+func (c *TCPConn) armTimer() {
+	pending := c.state != tcpClosed && (c.sndNxt != c.sndUna || len(c.sndBuf) > c.inflight())
+	if !pending {
+		if c.timer != nil {
+			c.timer.Stop()
+			c.timer = nil
+		}
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.v.opts.RTO, c.timeout)
+	}
+}
+
+// timeout retransmits unacknowledged data from sndUna, or probes the zero
+// window with a byte.
+func (c *TCPConn) timeout() {
+	v := c.v
+	v.mu.Lock()
+	c.timer = nil
+	switch {
+	case c.state == tcpClosed || v.closed:
+	case c.state == tcpSynSent:
+		c.sendSYN()
+	case c.sndNxt != c.sndUna:
+		c.sndNxt = c.sndUna
+		c.finSent = false
+		c.output()
+	case len(c.sndBuf) > 0 && c.sndWnd == 0:
+		c.send(tcpPSH, c.sndNxt, c.sndBuf[:1])
+		c.sndNxt++
+	}
+	c.armTimer()
+	v.unlockAndFlush()
+}
+
+// input handles a segment from the stack.
+func (c *TCPConn) input(seg *segment) {
+	if seg.flags&tcpRST != 0 {
+		switch {
+		case c.state == tcpSynSent && seg.flags&tcpACK != 0 && seg.ack == c.iss+1:
+			c.fail(syscall.ECONNREFUSED)
+		case c.state == tcpEstablished && seg.seq == c.rcvNxt:
+			c.fail(syscall.ECONNRESET)
+		}
+		return
+	}
+
+	if c.state == tcpSynSent {
+		if seg.flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK || seg.ack != c.iss+1 {
+			return
+		}
+		mss, wscale := synOptions(seg.options)
+		if mss > 0 && mss < c.mss {
+			c.mss = mss
+		}
+		if wscale >= 0 && c.rcvScale > 0 {
+			c.sndScale = uint(wscale)
+		} else {
+			c.rcvScale = 0
+		}
+		c.rcvNxt = seg.seq + 1
+		c.sndUna = seg.ack
+		c.sndWnd = int(seg.window)
+		c.state = tcpEstablished
+		c.send(0, c.sndNxt, nil)
+		c.armTimer()
+		c.v.cond.Broadcast()
+		return
+	}
+	if c.state != tcpEstablished {
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		// The ACK of the SYN-ACK is lost.
+		c.send(0, c.sndNxt, nil)
+		return
+	}
+
+	if seg.flags&tcpACK != 0 {
+		acked := int32(seg.ack - c.sndUna)
+		if acked > 0 && int32(seg.ack-c.sndNxt) <= 0 {
+			n := int(acked)
+			if c.finSent && seg.ack == c.sndNxt {
+				c.finAcked = true
+				n--
+			}
+			c.sndBuf = c.sndBuf[n:]
+			c.sndUna = seg.ack
+			if c.timer != nil {
+				// Restart the timer for the remaining data.
+				c.timer.Stop()
+				c.timer = nil
+			}
+			c.v.cond.Broadcast()
+		}
+		if acked >= 0 {
+			c.sndWnd = int(seg.window) << c.sndScale
+		}
+	}
+
+	ackNeeded := false
+	if len(seg.payload) > 0 || seg.flags&tcpFIN != 0 {
+		ackNeeded = true
+		if seg.seq == c.rcvNxt && !c.finReceived {
+			n := len(seg.payload)
+			if w := c.window(); n > w && !c.closed {
+				n = w
+			}
+			if !c.closed {
+				c.rcvBuf = append(c.rcvBuf, seg.payload[:n]...)
+			}
+			c.rcvNxt += uint32(n)
+			if seg.flags&tcpFIN != 0 && n == len(seg.payload) {
+				c.rcvNxt++
+				c.finReceived = true
+			}
+			c.v.cond.Broadcast()
+		}
+	}
+	if !c.output() && ackNeeded {
+		c.send(0, c.sndNxt, nil)
+	}
+	c.checkDone()
+}
+
+// checkDone removes the connection once FINs of both sides are
+// acknowledged.
+func (c *TCPConn) checkDone() {
+	if c.finAcked && c.finReceived {
+		c.state = tcpClosed
+		c.remove()
+	}
+}
+
+func (c *TCPConn) remove() {
+	if c.v.tcpConns[c.key] == c {
+		delete(c.v.tcpConns, c.key)
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.v.cond.Broadcast()
+}
+
+// fail closes the connection with err, caller is required to hold mu.
+func (c *TCPConn) fail(err error) {
+	if c.state == tcpClosed {
+		return
+	}
+	c.state = tcpClosed
+	c.err = err
+	c.remove()
+}
+
+// Read reads data received, it returns io.EOF once the stack has closed the
+// connection and all data is read.
+func (c *TCPConn) Read(b []byte) (int, error) {
+	v := c.v
+	v.mu.Lock()
+	v.waitDeadline(c.readDeadline, func() bool {
+		return len(c.rcvBuf) > 0 || c.finReceived || c.err != nil || c.closed
+	})
+	var n int
+	var err error
+	switch {
+	case c.closed:
+		err = errClosed
+	case len(c.rcvBuf) > 0:
+		n = copy(b, c.rcvBuf)
+		c.rcvBuf = c.rcvBuf[n:]
+		// Update the window once it has opened by an MSS or half.
+		threshold := c.mss
+		if half := v.opts.TCPWindow / 2; half < threshold {
+			threshold = half
+		}
+		if c.state == tcpEstablished && !c.finReceived && c.window()-c.advertised >= threshold {
+			c.send(0, c.sndNxt, nil)
+		}
+	case c.err != nil:
+		err = c.err
+	case c.finReceived:
+		err = io.EOF
+	default:
+		err = timeoutError{}
+	}
+	v.unlockAndFlush()
+	if err == io.EOF {
+		return n, err
+	}
+	return n, opError("read", "tcp", c.local, c.remote, err)
+}
+
+// Write writes data, blocking while the send buffer is full.
+func (c *TCPConn) Write(b []byte) (int, error) {
+	v := c.v
+	v.mu.Lock()
+	n := 0
+	var err error
+	for len(b) > 0 {
+		v.waitDeadline(c.writeDeadline, func() bool {
+			return len(c.sndBuf) < v.opts.TCPSendBuffer || c.err != nil || c.finQueued
+		})
+		if c.err != nil {
+			err = c.err
+			break
+		}
+		if c.finQueued {
+			err = errClosed
+			break
+		}
+		if len(c.sndBuf) >= v.opts.TCPSendBuffer {
+			err = timeoutError{}
+			break
+		}
+		m := v.opts.TCPSendBuffer - len(c.sndBuf)
+		if m > len(b) {
+			m = len(b)
+		}
+		c.sndBuf = append(c.sndBuf, b[:m]...)
+		b = b[m:]
+		n += m
+		c.output()
+		v.unlockAndFlush()
+		v.mu.Lock()
+	}
+	v.unlockAndFlush()
+	return n, opError("write", "tcp", c.local, c.remote, err)
+}
+
+// CloseWrite sends FIN after the data written.
+func (c *TCPConn) CloseWrite() error {
+	v := c.v
+	v.mu.Lock()
+	c.finQueued = true
+	c.output()
+	v.cond.Broadcast()
+	v.unlockAndFlush()
+	return nil
+}
+
+// Close sends FIN after the data written, data received afterwards is
+// acknowledged and discarded.
+func (c *TCPConn) Close() error {
+	v := c.v
+	v.mu.Lock()
+	if c.closed {
+		v.mu.Unlock()
+		return opError("close", "tcp", c.local, c.remote, errClosed)
+	}
+	c.closed = true
+	c.rcvBuf = nil
+	c.finQueued = true
+	c.output()
+	v.cond.Broadcast()
+	v.unlockAndFlush()
+	return nil
+}
+
+// Abort resets the connection.
+func (c *TCPConn) Abort() {
+	v := c.v
+	v.mu.Lock()
+	if c.state == tcpEstablished {
+		c.send(tcpRST, c.sndNxt, nil)
+	}
+	c.fail(syscall.ECONNRESET)
+	v.unlockAndFlush()
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.v.mu.Lock()
+	c.readDeadline = t
+	c.v.cond.Broadcast()
+	c.v.mu.Unlock()
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.v.mu.Lock()
+	c.writeDeadline = t
+	c.v.cond.Broadcast()
+	c.v.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,391 @@
+// Package coretest provides a virtual TUN for testing stacks and handlers
+// end to end in memory.
+//
+// A VirtualTUN plays the local clients behind TUN, it opens TCP connections
+// and UDP sockets through a stack with a userspace TCP/IP implementation,
+// writing the packets to the stack and consuming those it outputs:
+//
+//	s := core.NewLWIPStack()
+//	s.RegisterTCPConnHandler(handler)
+//	tun := coretest.New(s, coretest.Options{})
+//	defer tun.Close()
+//	conn, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+//
+// Nothing is lost or reordered between the stack and the VirtualTUN, so the
+// packets exchanged depend only on the stack and the calls of tests, timers
+// come into play only if the stack drops packets or closes its windows.
+package coretest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Options configures a VirtualTUN, zero values take the defaults.
+type Options struct {
+	// IP and IPv6 are the addresses of the local clients, 10.0.0.2 and
+	// fd00::2 by default.
+	IP   net.IP
+	IPv6 net.IP
+
+	// MTU is the MTU of TCP segments and UDP datagrams sent, 1500 by
+	// default. Larger packets from the stack are accepted.
+	MTU int
+
+	// TCPWindow is the receive window and TCPSendBuffer the send buffer
+	// of TCP connections in bytes, 65535 by default. Windows larger than
+	// 65535 bytes are scaled if the stack agrees on window scaling.
+	TCPWindow     int
+	TCPSendBuffer int
+
+	// RTO is the retransmission timeout of TCP connections, it's also the
+	// interval of zero window probes, 200ms by default.
+	RTO time.Duration
+
+	// DialTimeout bounds DialTCP, 5s by default.
+	DialTimeout time.Duration
+}
+
+func (o *Options) normalize() {
+	if o.IP == nil {
+		o.IP = net.IPv4(10, 0, 0, 2)
+	}
+	if o.IPv6 == nil {
+		o.IPv6 = net.ParseIP("fd00::2")
+	}
+	if o.MTU == 0 {
+		o.MTU = 1500
+	}
+	if o.TCPWindow == 0 {
+		o.TCPWindow = 0xffff
+	}
+	if o.TCPSendBuffer == 0 {
+		o.TCPSendBuffer = 0xffff
+	}
+	if o.RTO == 0 {
+		o.RTO = 200 * time.Millisecond
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+}
+
+var (
+	errClosed = errors.New("use of closed connection")
+	errTUN    = errors.New("virtual TUN closed")
+)
+
+// timeoutError is returned by I/O exceeding a deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// VirtualTUN is a set of local clients of a stack.
+type VirtualTUN struct {
+	stack core.LWIPStack
+	opts  Options
+
+	// mu protects the state of the VirtualTUN and its connections, cond
+	// is broadcast whenever the state changes.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	tcpConns map[tcpKey]*TCPConn
+	udpConns map[uint16]*UDPConn
+	reass    map[fragKey]*reassembly
+	out      [][]byte // Packets to write, see unlockAndFlush
+	lastPort uint16
+	lastID   uint16
+	dropped  int
+	closed   bool
+
+	// writeMu keeps packets written in order.
+	writeMu sync.Mutex
+
+	// Packets output by the stack waiting for input.
+	queueMu sync.Mutex
+	queue   [][]byte
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+type tcpKey struct {
+	localPort, remotePort uint16
+	remote                string // 16-byte IP
+}
+
+// New creates a VirtualTUN registering the output function of s, handlers
+// of s are left to tests.
+func New(s core.LWIPStack, opts Options) *VirtualTUN {
+	opts.normalize()
+	v := &VirtualTUN{
+		stack:    s,
+		opts:     opts,
+		tcpConns: make(map[tcpKey]*TCPConn),
+		udpConns: make(map[uint16]*UDPConn),
+		reass:    make(map[fragKey]*reassembly),
+		lastPort: 40000,
+		signal:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	v.cond = sync.NewCond(&v.mu)
+	s.RegisterOutputFn(v.output)
+	go v.loop()
+	return v
+}
+
+// Close fails all connections and stops consuming packets, the stack is
+// not closed.
+func (v *VirtualTUN) Close() error {
+	v.mu.Lock()
+	if v.closed {
+		v.mu.Unlock()
+		return nil
+	}
+	v.closed = true
+	for _, c := range v.tcpConns {
+		c.fail(errTUN)
+	}
+	for _, c := range v.udpConns {
+		c.closed = true
+	}
+	v.udpConns = make(map[uint16]*UDPConn)
+	v.cond.Broadcast()
+	v.mu.Unlock()
+	close(v.done)
+	return nil
+}
+
+// Dropped returns the number of packets from the stack which are malformed,
+// have invalid checksums, or belong to no connection.
+func (v *VirtualTUN) Dropped() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dropped
+}
+
+// output is the output function of the stack, which may hold its lock, so
+// packets are queued and handled by loop.
+func (v *VirtualTUN) output(b []byte) (int, error) {
+	pkt := append([]byte(nil), b...)
+	v.queueMu.Lock()
+	v.queue = append(v.queue, pkt)
+	v.queueMu.Unlock()
+	select {
+	case v.signal <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (v *VirtualTUN) loop() {
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-v.signal:
+		}
+		v.queueMu.Lock()
+		pkts := v.queue
+		v.queue = nil
+		v.queueMu.Unlock()
+		for _, pkt := range pkts {
+			v.mu.Lock()
+			v.input(pkt)
+			v.unlockAndFlush()
+		}
+	}
+}
+
+// unlockAndFlush releases mu and writes the packets queued in out to the
+// stack, in order.
+func (v *VirtualTUN) unlockAndFlush() {
+	pkts := v.out
+	v.out = nil
+	if v.closed {
+		pkts = nil
+	}
+	v.writeMu.Lock()
+	v.mu.Unlock()
+	defer v.writeMu.Unlock()
+	for _, pkt := range pkts {
+		v.stack.Write(pkt)
+	}
+}
+
+// send queues a packet to write, caller is required to hold mu.
+func (v *VirtualTUN) send(src, dst net.IP, proto byte, payload []byte) {
+	v.lastID++
+	v.out = append(v.out, buildPacket(src, dst, proto, payload, v.lastID))
+}
+
+// input handles a packet output by the stack, caller is required to hold
+// mu.
+func (v *VirtualTUN) input(b []byte) {
+	if v.closed {
+		return
+	}
+	pkt, frag, err := parsePacket(b)
+	if err != nil {
+		v.dropped++
+		return
+	}
+	if frag != nil {
+		payload, ok := v.reassemble(frag, pkt.payload)
+		if !ok {
+			return
+		}
+		pkt.payload = payload
+	}
+	switch pkt.proto {
+	case protoTCP:
+		seg, err := parseSegment(pkt.payload)
+		if err != nil || pseudoChecksum(pkt.src, pkt.dst, protoTCP, pkt.payload) != 0 {
+			v.dropped++
+			return
+		}
+		c, ok := v.tcpConns[tcpKey{seg.dstPort, seg.srcPort, string(pkt.src.To16())}]
+		if !ok || !c.local.IP.Equal(pkt.dst) {
+			v.dropped++
+			return
+		}
+		c.input(&seg)
+	case protoUDP:
+		if len(pkt.payload) < udpHeaderLen || pseudoChecksum(pkt.src, pkt.dst, protoUDP, pkt.payload) != 0 {
+			v.dropped++
+			return
+		}
+		c, ok := v.udpConns[uint16(pkt.payload[2])<<8|uint16(pkt.payload[3])]
+		if !ok || !c.accepts(pkt.dst) {
+			v.dropped++
+			return
+		}
+		c.input(pkt.src, pkt.payload)
+	case protoICMP, protoICMPv6:
+		v.inputICMP(&pkt)
+	default:
+		v.dropped++
+	}
+}
+
+// ICMP and ICMPv6 destination unreachable codes mapped to errors.
+var (
+	icmpUnreachableErrors = map[byte]error{
+		0:  syscall.ENETUNREACH,
+		1:  syscall.EHOSTUNREACH,
+		3:  syscall.ECONNREFUSED,
+		13: syscall.EACCES,
+	}
+	icmpv6UnreachableErrors = map[byte]error{
+		0: syscall.ENETUNREACH,
+		1: syscall.EACCES,
+		3: syscall.EHOSTUNREACH,
+		4: syscall.ECONNREFUSED,
+	}
+)
+
+// inputICMP fails the connection a destination unreachable message quotes
+// a packet of. Other messages are ignored.
+func (v *VirtualTUN) inputICMP(pkt *packet) {
+	msg := pkt.payload
+	if len(msg) < 8 {
+		v.dropped++
+		return
+	}
+	var err error
+	switch {
+	case pkt.proto == protoICMP && msg[0] == 3:
+		err = icmpUnreachableErrors[msg[1]]
+	case pkt.proto == protoICMPv6 && msg[0] == 1:
+		err = icmpv6UnreachableErrors[msg[1]]
+	default:
+		return
+	}
+	if err == nil {
+		err = syscall.EHOSTUNREACH
+	}
+	quoted, ok := parseQuoted(msg[8:])
+	if !ok {
+		return
+	}
+	srcPort := uint16(quoted.payload[0])<<8 | uint16(quoted.payload[1])
+	dstPort := uint16(quoted.payload[2])<<8 | uint16(quoted.payload[3])
+	switch quoted.proto {
+	case protoTCP:
+		if c, ok := v.tcpConns[tcpKey{srcPort, dstPort, string(quoted.dst.To16())}]; ok {
+			c.fail(err)
+		}
+	case protoUDP:
+		if c, ok := v.udpConns[srcPort]; ok {
+			c.err = err
+			v.cond.Broadcast()
+		}
+	}
+}
+
+// localIP returns the address of the local client in the family of remote.
+func (v *VirtualTUN) localIP(remote net.IP) net.IP {
+	if remote.To4() != nil {
+		return v.opts.IP.To4()
+	}
+	return v.opts.IPv6
+}
+
+// allocPort returns an unused local port, caller is required to hold mu.
+func (v *VirtualTUN) allocPort() (uint16, error) {
+	for i := 0; i < 0x10000; i++ {
+		v.lastPort++
+		if v.lastPort < 40000 {
+			v.lastPort = 40000
+		}
+		if !v.portInUse(v.lastPort) {
+			return v.lastPort, nil
+		}
+	}
+	return 0, errors.New("no free port")
+}
+
+func (v *VirtualTUN) portInUse(port uint16) bool {
+	if _, ok := v.udpConns[port]; ok {
+		return true
+	}
+	for key := range v.tcpConns {
+		if key.localPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// waitDeadline waits on cond until done returns true or t is exceeded, it
+// reports whether done returned true. Caller is required to hold mu.
+func (v *VirtualTUN) waitDeadline(t time.Time, done func() bool) bool {
+	if !t.IsZero() {
+		timer := time.AfterFunc(time.Until(t), func() {
+			v.mu.Lock()
+			v.cond.Broadcast()
+			v.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for !done() {
+		if !t.IsZero() && !time.Now().Before(t) {
+			return false
+		}
+		v.cond.Wait()
+	}
+	return true
+}
+
+func opError(op, network string, local, remote net.Addr, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &net.OpError{Op: op, Net: network, Source: local, Addr: remote, Err: err}
+}
@@ -0,0 +1,248 @@
+package coretest_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/core/coretest"
+)
+
+func newStack(t *testing.T, opts core.StackOptions) core.LWIPStack {
+	s, err := core.NewLWIPStackWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// This TCP handler sends the connections accepted to conns.
+type acceptHandler struct {
+	conns chan net.Conn
+}
+
+func (h *acceptHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// Data should flow both ways through the stack, and either side should be
+// able to half-close.
+func TestTCP(t *testing.T) {
+	for _, remote := range []*net.TCPAddr{
+		{IP: net.IPv4(1, 2, 3, 4), Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	} {
+		s := newStack(t, core.StackOptions{})
+		h := &acceptHandler{conns: make(chan net.Conn, 1)}
+		s.RegisterTCPConnHandler(h)
+		tun := coretest.New(s, coretest.Options{})
+
+		conn, err := tun.DialTCP(nil, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := <-h.conns
+		if !server.LocalAddr().(*net.TCPAddr).IP.Equal(conn.LocalAddr().(*net.TCPAddr).IP) {
+			t.Errorf("Handler got %v, expected %v", server.LocalAddr(), conn.LocalAddr())
+		}
+
+		up, down := testData(1<<20), testData(300000)
+		go func() {
+			conn.Write(up)
+			conn.CloseWrite()
+		}()
+		received, err := ioutil.ReadAll(server)
+		if err != nil || !bytes.Equal(received, up) {
+			t.Errorf("Handler read %v bytes, %v, expected %v bytes", len(received), err, len(up))
+		}
+
+		// The other way round after the client has half-closed.
+		go func() {
+			server.Write(down)
+			server.(core.TCPConn).CloseWrite()
+		}()
+		received, err = ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(received, down) {
+			t.Errorf("Client read %v bytes, %v, expected %v bytes", len(received), err, len(down))
+		}
+		conn.Close()
+		server.Close()
+		if n := tun.Dropped(); n != 0 {
+			t.Errorf("%v packets dropped", n)
+		}
+		tun.Close()
+		s.Close()
+	}
+}
+
+// Writes larger than 64 KiB should be delivered in full with a send buffer
+// larger than that.
+func TestTCPLargeSendBuffer(t *testing.T) {
+	s := newStack(t, core.StackOptions{TCPSendBuffer: 512 * 1024})
+	defer s.Close()
+	h := &acceptHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	conn, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-h.conns
+
+	data := testData(400000)
+	go func() {
+		if n, err := server.Write(data); n != len(data) || err != nil {
+			t.Errorf("Wrote %v bytes, %v", n, err)
+		}
+		server.(core.TCPConn).CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("Client read %v bytes, %v, expected %v bytes", len(received), err, len(data))
+	}
+	conn.Close()
+	server.Close()
+}
+
+// A client should be throttled while the handler is not reading.
+func TestTCPBackpressure(t *testing.T) {
+	s := newStack(t, core.StackOptions{TCPWindow: 16384})
+	defer s.Close()
+	h := &acceptHandler{conns: make(chan net.Conn, 1)}
+	s.RegisterTCPConnHandler(h)
+	tun := coretest.New(s, coretest.Options{TCPSendBuffer: 8192, RTO: 50 * time.Millisecond})
+	defer tun.Close()
+
+	conn, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-h.conns
+
+	data := testData(1 << 20)
+	conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := conn.Write(data)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected the write to time out, wrote %v bytes, %v", n, err)
+	}
+	// The window of the stack and the send buffer of the client.
+	if n > 16384+8192 {
+		t.Errorf("Wrote %v bytes while the handler is not reading", n)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+	go func() {
+		conn.Write(data[n:])
+		conn.Close()
+	}()
+	received, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("Handler read %v bytes, %v, expected %v bytes", len(received), err, len(data))
+	}
+}
+
+// This TCP handler fails to connect with err.
+type refuseHandler struct {
+	err error
+}
+
+func (h refuseHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return errors.New("not connected before accepted")
+}
+
+func (h refuseHandler) Connect(target *net.TCPAddr) (net.Conn, error) {
+	return nil, h.err
+}
+
+func (h refuseHandler) HandleConnected(conn net.Conn, upstream net.Conn) error {
+	return nil
+}
+
+// Dialing should fail as the handler fails to connect.
+func TestTCPRefused(t *testing.T) {
+	for _, expected := range []error{syscall.ECONNREFUSED, syscall.EHOSTUNREACH} {
+		s := newStack(t, core.StackOptions{ConnectBeforeAccept: true})
+		s.RegisterTCPConnHandler(refuseHandler{expected})
+		tun := coretest.New(s, coretest.Options{})
+		_, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected %v, got %v", expected, err)
+		}
+		tun.Close()
+		s.Close()
+	}
+}
+
+// This UDP handler echoes datagrams with the data repeated.
+type repeatUDPHandler struct {
+	times int
+}
+
+func (h repeatUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (h repeatUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	b := bytes.Repeat(data, h.times)
+	go conn.WriteFrom(b, addr)
+	return nil
+}
+
+// Datagrams should be exchanged through the stack, replies larger than the
+// MTU fragmented.
+func TestUDP(t *testing.T) {
+	s := newStack(t, core.StackOptions{})
+	defer s.Close()
+	s.RegisterUDPConnHandler(repeatUDPHandler{4})
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	conn, err := tun.ListenUDP(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, remote := range []*net.UDPAddr{
+		{IP: net.IPv4(8, 8, 8, 8), Port: 53},
+		{IP: net.ParseIP("2001:4860:4860::8888"), Port: 53},
+	} {
+		data := testData(1000)
+		if _, err := conn.WriteTo(data, remote); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 8192)
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.(*net.UDPAddr).IP.Equal(remote.IP) || addr.(*net.UDPAddr).Port != remote.Port {
+			t.Errorf("Reply from %v, expected %v", addr, remote)
+		}
+		if !bytes.Equal(b[:n], bytes.Repeat(data, 4)) {
+			t.Errorf("Reply of %v bytes, expected %v", n, 4*len(data))
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(make([]byte, 10)); err == nil || err == io.EOF {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package coretest
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const udpQueueLen = 256
+
+type datagram struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+// UDPConn is a UDP socket of a local client, opened by ListenUDP. It
+// implements net.PacketConn.
+type UDPConn struct {
+	v     *VirtualTUN
+	local *net.UDPAddr
+
+	// Protected by the mu of v.
+	queue        []datagram
+	err          error // Set by ICMP unreachable, returned by ReadFrom once
+	closed       bool
+	readDeadline time.Time
+}
+
+// ListenUDP opens a UDP socket, if local is nil, or has no port, an unused
+// port is taken. Without an IP the socket sends from the address of the
+// local client in the family of the destination.
+func (v *VirtualTUN) ListenUDP(local *net.UDPAddr) (*UDPConn, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return nil, opError("listen", "udp", local, nil, errTUN)
+	}
+	laddr := &net.UDPAddr{}
+	if local != nil {
+		laddr.IP, laddr.Port = local.IP, local.Port
+	}
+	if laddr.Port == 0 {
+		port, err := v.allocPort()
+		if err != nil {
+			return nil, opError("listen", "udp", laddr, nil, err)
+		}
+		laddr.Port = int(port)
+	} else if v.portInUse(uint16(laddr.Port)) {
+		return nil, opError("listen", "udp", laddr, nil, syscall.EADDRINUSE)
+	}
+	c := &UDPConn{v: v, local: laddr}
+	v.udpConns[uint16(laddr.Port)] = c
+	return c, nil
+}
+
+// accepts reports whether the socket receives datagrams to dst.
+func (c *UDPConn) accepts(dst net.IP) bool {
+	if c.local.IP == nil {
+		return dst.Equal(c.v.opts.IP) || dst.Equal(c.v.opts.IPv6)
+	}
+	return dst.Equal(c.local.IP)
+}
+
+// input queues a datagram from src, seg is the UDP segment.
+func (c *UDPConn) input(src net.IP, seg []byte) {
+	if len(c.queue) >= udpQueueLen {
+		c.v.dropped++
+		return
+	}
+	addr := &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(seg[0:2]))}
+	c.queue = append(c.queue, datagram{addr, append([]byte(nil), seg[udpHeaderLen:]...)})
+	c.v.cond.Broadcast()
+}
+
+// ReadFrom reads a datagram, or returns the error of an ICMP unreachable
+// message answering a datagram sent.
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	v := c.v
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.waitDeadline(c.readDeadline, func() bool {
+		return len(c.queue) > 0 || c.err != nil || c.closed
+	})
+	var err error
+	switch {
+	case c.closed:
+		err = errClosed
+	case c.err != nil:
+		err, c.err = c.err, nil
+	case len(c.queue) > 0:
+		d := c.queue[0]
+		c.queue = c.queue[1:]
+		return copy(b, d.data), d.addr, nil
+	default:
+		err = timeoutError{}
+	}
+	return 0, nil, opError("read", "udp", c.local, nil, err)
+}
+
+// WriteTo sends a datagram to addr, datagrams larger than the MTU are not
+// fragmented but failed.
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, opError("write", "udp", c.local, addr, errors.New("not a UDP address"))
+	}
+	v := c.v
+	v.mu.Lock()
+	if c.closed {
+		v.mu.Unlock()
+		return 0, opError("write", "udp", c.local, addr, errClosed)
+	}
+	src := c.local.IP
+	if src == nil {
+		src = v.localIP(raddr.IP)
+	}
+	hl := ipv4HeaderLen
+	if raddr.IP.To4() == nil {
+		hl = ipv6HeaderLen
+	}
+	if hl+udpHeaderLen+len(b) > v.opts.MTU {
+		v.mu.Unlock()
+		return 0, opError("write", "udp", c.local, addr, syscall.EMSGSIZE)
+	}
+	seg := make([]byte, udpHeaderLen+len(b))
+	binary.BigEndian.PutUint16(seg[0:], uint16(c.local.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(raddr.Port))
+	binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)))
+	copy(seg[udpHeaderLen:], b)
+	v.send(src, raddr.IP, protoUDP, seg)
+	v.unlockAndFlush()
+	return len(b), nil
+}
+
+// Close closes the socket, datagrams queued are dropped.
+func (c *UDPConn) Close() error {
+	v := c.v
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c.closed {
+		return opError("close", "udp", c.local, nil, errClosed)
+	}
+	c.closed = true
+	c.queue = nil
+	if v.udpConns[uint16(c.local.Port)] == c {
+		delete(v.udpConns, uint16(c.local.Port))
+	}
+	v.cond.Broadcast()
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.v.mu.Lock()
+	c.readDeadline = t
+	c.v.cond.Broadcast()
+	c.v.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
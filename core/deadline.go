@@ -0,0 +1,96 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is an abstraction for handling timeouts, it's modelled after the
+// one used by net.Pipe.
+type deadline struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	cancel   chan struct{} // Must be non-nil
+	onExpire func()        // Called after cancel is closed by the timer, can be nil
+}
+
+func newDeadline(onExpire func()) *deadline {
+	return &deadline{cancel: make(chan struct{}), onExpire: onExpire}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by closing the channel returned by wait.
+// Once a timeout has occurred, the deadline can be refreshed by specifying a
+// t value in the future.
+//
+// A zero value for t prevents timeout.
+func (d *deadline) set(t time.Time) {
+	if d.reset(t) && d.onExpire != nil {
+		// Called without holding the lock, onExpire may need to take
+		// other locks held by callers of wait.
+		d.onExpire()
+	}
+}
+
+// reset rearms the deadline, and reports whether it is exceeded right away.
+func (d *deadline) reset(t time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return false
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+			if d.onExpire != nil {
+				d.onExpire()
+			}
+		})
+		return false
+	}
+
+	// Time in the past, so close immediately.
+	if !closed {
+		close(d.cancel)
+		return true
+	}
+	return false
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// exceeded reports whether the deadline is exceeded.
+func (d *deadline) exceeded() bool {
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -58,3 +58,11 @@ func NewLWIPError(code int) error {
 func (e *lwipError) Error() string {
 	return "error code " + string(e.Code)
 }
+
+// timeoutError is returned when a deadline is exceeded, it implements
+// net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
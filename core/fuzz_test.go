@@ -0,0 +1,74 @@
+// +build go1.18
+
+package core
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// fuzzSeeds returns a packet of each kind the stack handles.
+func fuzzSeeds() [][]byte {
+	return [][]byte{
+		decode(ntpHex), decode(frag1Hex), decode(frag2Hex),
+		decode(udp6Hex), decode(frag6_1Hex), decode(frag6_2Hex),
+		decode(synHex),
+		tcpPacket(tcpACK|tcpPSH, 1, 1, []byte("data")),
+		echoRequestPacket(net.IPv4(10, 0, 0, 1), net.IPv4(1, 2, 3, 4), 1),
+		echoRequestPacket(net.ParseIP("fd00::1"), net.ParseIP("2001:db8::1"), 1),
+	}
+}
+
+// The stack should fail or drop malformed packets, but never panic.
+func FuzzWrite(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add(pkt)
+	}
+	s, err := NewLWIPStackWithOptions(StackOptions{ICMPEcho: ICMPEchoDelay})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer s.Close()
+	s.RegisterTCPConnHandler(echoTCPHandler{})
+	s.RegisterUDPConnHandler(failUDPHandler{syscall.ECONNREFUSED})
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		return len(b), nil
+	})
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		s.Write(pkt)
+	})
+}
+
+func FuzzParseICMPEcho(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add(pkt)
+	}
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		r, ok := parseICMPEcho(pkt)
+		if !ok {
+			return
+		}
+		r.reply(1280)
+		r.unreachable(HostUnreachable)
+	})
+}
+
+func FuzzBuildICMPUnreachable(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add(pkt, int(PortUnreachable))
+	}
+	f.Fuzz(func(t *testing.T, pkt []byte, code int) {
+		buildICMPUnreachable(pkt, UnreachableCode(code))
+		BuildReject(pkt, UnreachableCode(code))
+	})
+}
+
+func FuzzBuildTCPReset(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add(pkt)
+	}
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		buildTCPReset(pkt)
+	})
+}
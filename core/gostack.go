@@ -0,0 +1,363 @@
+// +build !cgo gostack
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits and defaults of StackOptions, the defaults are the same as lwIP's.
+const (
+	maxTCPMSS            = 0xffff - ipv4HeaderLen - tcpHeaderLen
+	defaultTCPWindow     = 32 * 1024
+	defaultTCPSendBuffer = 32 * 1024
+
+	// The largest receive window can be announced with window scaling.
+	maxTCPWindow = 0xffff << goTCPRcvScale
+)
+
+// goStack is a TCP/IP stack written in Go, it's used in place of lwIP when
+// cgo is not available.
+//
+// It implements just what tun2socks needs: IPv4 and IPv6 with reassembly
+// of fragmented packets, ICMP and ICMPv6 echo, UDP and passively opened TCP
+// connections.
+// Packets are handled synchronously in Write, timers run on Go timers.
+type goStack struct {
+	// Counters accessed atomically, kept first to be 64-bit aligned on
+	// 32-bit platforms. Conn counts and Pools are not used.
+	stats Stats
+
+	stackBase
+
+	lock     sync.Mutex // The stack lock
+	opts     StackOptions
+	tcpConns map[tcpConnID]*goTCPConn
+	reass    *reassembler
+	closed   bool
+}
+
+// NewLWIPStackWithOptions creates a stack, the name is kept for
+// compatibility with the lwIP backend.
+func NewLWIPStackWithOptions(opts StackOptions) (LWIPStack, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	s := &goStack{
+		opts:     opts,
+		tcpConns: make(map[tcpConnID]*goTCPConn),
+		reass:    newReassembler(),
+	}
+	s.stackBase = newStackBase(&s.lock, &opts)
+	s.write = s.Write
+	return s, nil
+}
+
+// Write writes IP packets to the stack.
+func (s *goStack) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.New("stack closed")
+	}
+	n, err := s.input(data)
+	if err != nil {
+		atomic.AddUint64(&s.stats.InputErrors, 1)
+	}
+	return n, err
+}
+
+// WriteBatch writes IP packets to the stack.
+func (s *goStack) WriteBatch(pkts [][]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.New("stack closed")
+	}
+	for i, pkt := range pkts {
+		if _, err := s.input(pkt); err != nil {
+			atomic.AddUint64(&s.stats.InputErrors, 1)
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// input handles a packet, the caller must hold the stack lock. Like lwIP,
+// packets which can not be handled are silently dropped.
+func (s *goStack) input(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	pkt, frag, err := parseIPPacket(data)
+	if err != nil {
+		if _, err := peekNextProto(ipver(data[0]>>4), data); err != nil {
+			return 0, err
+		}
+		st := s.ipStats(ipver(data[0] >> 4))
+		atomic.AddUint64(&st.LengthErrors, 1)
+		atomic.AddUint64(&st.Dropped, 1)
+		return len(data), nil
+	}
+	atomic.AddUint64(&s.ipStats(pkt.ver).Received, 1)
+	if frag != nil {
+		atomic.AddUint64(&s.fragStats(pkt.ver).Received, 1)
+		payload, done := s.reass.add(frag)
+		if !done {
+			return len(data), nil
+		}
+		if pkt.ver == ipv6 {
+			// Extension headers may follow the fragment header.
+			if frag, err := pkt.setIPv6Payload(byte(pkt.proto), payload); err != nil || frag != nil {
+				return len(data), nil
+			}
+		} else {
+			pkt.payload = payload
+		}
+	}
+
+	switch pkt.proto {
+	case proto_tcp:
+		s.inputTCP(pkt)
+	case proto_udp:
+		s.inputUDP(pkt)
+	default:
+		if (pkt.proto == proto_icmp && pkt.ver == ipv4) || (pkt.proto == proto_icmpv6 && pkt.ver == ipv6) {
+			s.inputICMP(pkt)
+			break
+		}
+		st := s.ipStats(pkt.ver)
+		atomic.AddUint64(&st.ProtocolErrors, 1)
+		atomic.AddUint64(&st.Dropped, 1)
+	}
+	return len(data), nil
+}
+
+// output writes packets with the output function, the caller must hold the
+// stack lock unless the packets are UDP ones. More than one packet are
+// fragments of a packet.
+func (s *goStack) output(pkts ...[]byte) {
+	fn := s.getOutputFn()
+	for _, pkt := range pkts {
+		ver := ipver(pkt[0] >> 4)
+		atomic.AddUint64(&s.ipStats(ver).Sent, 1)
+		if len(pkts) > 1 {
+			atomic.AddUint64(&s.fragStats(ver).Sent, 1)
+		}
+		fn(pkt)
+	}
+}
+
+func (s *goStack) ipStats(ver ipver) *ProtoStats {
+	if ver == ipv6 {
+		return &s.stats.IPv6
+	}
+	return &s.stats.IP
+}
+
+func (s *goStack) fragStats(ver ipver) *ProtoStats {
+	if ver == ipv6 {
+		return &s.stats.IPv6Frag
+	}
+	return &s.stats.IPFrag
+}
+
+func (s *goStack) inputUDP(pkt *ipPacket) {
+	b := pkt.payload
+	if len(b) < udpHeaderLen {
+		atomic.AddUint64(&s.stats.UDP.LengthErrors, 1)
+		atomic.AddUint64(&s.stats.UDP.Dropped, 1)
+		return
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < udpHeaderLen || length > len(b) {
+		atomic.AddUint64(&s.stats.UDP.LengthErrors, 1)
+		atomic.AddUint64(&s.stats.UDP.Dropped, 1)
+		return
+	}
+	atomic.AddUint64(&s.stats.UDP.Received, 1)
+	srcAddr := &net.UDPAddr{IP: pkt.src, Port: int(binary.BigEndian.Uint16(b[0:2]))}
+	dstAddr := &net.UDPAddr{IP: pkt.dst, Port: int(binary.BigEndian.Uint16(b[2:4]))}
+
+	conn, connId, found := s.lookupUDPConn(srcAddr.String(), dstAddr.String())
+	if !found {
+		handler := s.getUDPConnHandler()
+		if handler == nil {
+			panic("must register a UDP connection handler")
+		}
+		var err error
+		conn, err = newUDPConn(&s.stackBase,
+			connId,
+			s.newUDPSendFn(srcAddr),
+			handler,
+			srcAddr,
+			dstAddr)
+		if err != nil {
+			return
+		}
+		s.udpConns.Store(connId, conn)
+	}
+
+	conn.ReceiveTo(b[udpHeaderLen:length], dstAddr)
+}
+
+// newUDPSendFn returns a function sending UDP packets to the local client
+// at local. Like udp_sendto of lwIP, it doesn't take the stack lock, since
+// handlers may send packets from within ReceiveTo.
+func (s *goStack) newUDPSendFn(local *net.UDPAddr) udpSendFn {
+	return func(data []byte, addr *net.UDPAddr) error {
+		src := addr.IP
+		if local.IP.To4() != nil {
+			if src = src.To4(); src == nil {
+				return errors.New("address family mismatch")
+			}
+		}
+		n := udpHeaderLen + len(data)
+		if n > 0xffff {
+			return errors.New("UDP packet too large")
+		}
+		seg := make([]byte, n)
+		binary.BigEndian.PutUint16(seg[0:], uint16(addr.Port))
+		binary.BigEndian.PutUint16(seg[2:], uint16(local.Port))
+		binary.BigEndian.PutUint16(seg[4:], uint16(n))
+		copy(seg[udpHeaderLen:], data)
+		sum := transportChecksum(src, local.IP, proto_udp, seg)
+		if sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(seg[6:], sum)
+		atomic.AddUint64(&s.stats.UDP.Sent, 1)
+		s.output(buildIPPackets(src, local.IP, proto_udp, seg, s.opts.MTU)...)
+		return nil
+	}
+}
+
+// inputICMP answers ICMP and ICMPv6 echo requests on behalf of any address,
+// as lwIP does, unless the responder takes them over. Checksums are not
+// verified, also like lwIP.
+func (s *goStack) inputICMP(pkt *ipPacket) {
+	st := &s.stats.ICMP
+	if pkt.ver == ipv6 {
+		st = &s.stats.ICMPv6
+	}
+	atomic.AddUint64(&st.Received, 1)
+	if !isEchoRequest(pkt.proto, pkt.payload) || s.answerEcho(pkt.src, pkt.dst, pkt.payload) {
+		return
+	}
+	r := &echoRequest{src: pkt.src, dst: pkt.dst, msg: pkt.payload}
+	atomic.AddUint64(&st.Sent, 1)
+	s.output(r.reply(s.opts.MTU)...)
+}
+
+// Stats returns a snapshot of the stack statistics.
+func (s *goStack) Stats() Stats {
+	st := Stats{
+		IP:             loadProtoStats(&s.stats.IP),
+		IPFrag:         loadProtoStats(&s.stats.IPFrag),
+		ICMP:           loadProtoStats(&s.stats.ICMP),
+		IPv6:           loadProtoStats(&s.stats.IPv6),
+		IPv6Frag:       loadProtoStats(&s.stats.IPv6Frag),
+		ICMPv6:         loadProtoStats(&s.stats.ICMPv6),
+		TCP:            loadProtoStats(&s.stats.TCP),
+		UDP:            loadProtoStats(&s.stats.UDP),
+		TCPRetransmits: atomic.LoadUint64(&s.stats.TCPRetransmits),
+		InputErrors:    atomic.LoadUint64(&s.stats.InputErrors),
+		UDPConns:       countSyncMap(&s.udpConns),
+	}
+	st.TCPConnsRejected = s.tcpAdmission.rejections()
+	st.UDPConnsRejected = s.udpAdmission.rejections()
+	s.mu.Lock()
+	st.TCPConns = len(s.tcpConns)
+	s.mu.Unlock()
+	return st
+}
+
+func loadProtoStats(p *ProtoStats) ProtoStats {
+	return ProtoStats{
+		Sent:           atomic.LoadUint64(&p.Sent),
+		Received:       atomic.LoadUint64(&p.Received),
+		Forwarded:      atomic.LoadUint64(&p.Forwarded),
+		Dropped:        atomic.LoadUint64(&p.Dropped),
+		ChecksumErrors: atomic.LoadUint64(&p.ChecksumErrors),
+		LengthErrors:   atomic.LoadUint64(&p.LengthErrors),
+		MemoryErrors:   atomic.LoadUint64(&p.MemoryErrors),
+		RoutingErrors:  atomic.LoadUint64(&p.RoutingErrors),
+		ProtocolErrors: atomic.LoadUint64(&p.ProtocolErrors),
+		OptionErrors:   atomic.LoadUint64(&p.OptionErrors),
+		Errors:         atomic.LoadUint64(&p.Errors),
+	}
+}
+
+// RestartTimeouts does nothing, timers of the stack are Go timers, which
+// don't fire in bursts after the system wakes up.
+func (s *goStack) RestartTimeouts() {}
+
+// ListConnections returns infos of the TCP and UDP connections, ordered by
+// ID.
+func (s *goStack) ListConnections() []ConnInfo {
+	var infos []ConnInfo
+	now := time.Now()
+	s.mu.Lock()
+	for _, c := range s.tcpConns {
+		infos = append(infos, c.info(now))
+	}
+	s.mu.Unlock()
+	infos = s.udpConnInfos(infos)
+	sortConnInfos(infos)
+	return infos
+}
+
+// CloseConnection aborts the TCP connection with the ID, the local client
+// receives RST, or closes the UDP connection with the ID.
+func (s *goStack) CloseConnection(id uint64) error {
+	s.mu.Lock()
+	for _, c := range s.tcpConns {
+		if c.connID == id {
+			c.abort(io.ErrClosedPipe)
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	if s.closeUDPConn(id) {
+		return nil
+	}
+	return ErrConnNotFound
+}
+
+// Close closes the stack, existing connections will be closed.
+func (s *goStack) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	conns := make([]*goTCPConn, 0, len(s.tcpConns))
+	for _, c := range s.tcpConns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	// Abort and close all TCP and UDP connections.
+	for _, c := range conns {
+		c.Abort()
+	}
+	s.udpConns.Range(func(_, c interface{}) bool {
+		// Handlers implementing UDPConnCloseHandler are
+		// notified to close their UDP connections.
+		c.(*udpConn).Close()
+		return true
+	})
+
+	s.mu.Lock()
+	s.reass = newReassembler()
+	s.closePendingConns()
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,232 @@
+// +build !cgo gostack
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+var errMalformedPacket = errors.New("malformed IP packet")
+
+// ipPacket is a parsed IP packet, addresses are copies while data and
+// payload refer to the original buffer.
+type ipPacket struct {
+	ver     ipver
+	src     net.IP
+	dst     net.IP
+	proto   proto
+	data    []byte // The whole packet, or the last fragment if reassembled
+	payload []byte
+}
+
+// ipFragment is a fragment of an IP packet.
+type ipFragment struct {
+	key    fragKey
+	offset int
+	more   bool
+	data   []byte
+}
+
+// parseIPPacket parses an IPv4 or IPv6 packet, frag is set instead of
+// payload if the packet is a fragment.
+func parseIPPacket(b []byte) (pkt *ipPacket, frag *ipFragment, err error) {
+	ver, err := peekIPVer(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch ver {
+	case ipv4:
+		if len(b) < ipv4HeaderLen {
+			return nil, nil, errMalformedPacket
+		}
+		hl := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:4]))
+		if hl < ipv4HeaderLen || total < hl || total > len(b) {
+			return nil, nil, errMalformedPacket
+		}
+		b = b[:total]
+		pkt = &ipPacket{
+			ver:     ipv4,
+			src:     append(net.IP(nil), b[12:16]...),
+			dst:     append(net.IP(nil), b[16:20]...),
+			proto:   proto(b[9]),
+			data:    b,
+			payload: b[hl:],
+		}
+		flags := binary.BigEndian.Uint16(b[6:8])
+		if flags&0x2000 != 0 || flags&0x1fff != 0 {
+			frag = &ipFragment{
+				key:    newFragKey(pkt, uint32(binary.BigEndian.Uint16(b[4:6]))),
+				offset: int(flags&0x1fff) * 8,
+				more:   flags&0x2000 != 0,
+				data:   pkt.payload,
+			}
+			pkt.payload = nil
+		}
+		return pkt, frag, nil
+	case ipv6:
+		if len(b) < ipv6HeaderLen {
+			return nil, nil, errMalformedPacket
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(b[4:6]))
+		if total > len(b) || hasIPv4Mapped(b) {
+			return nil, nil, errMalformedPacket
+		}
+		b = b[:total]
+		pkt = &ipPacket{
+			ver:  ipv6,
+			src:  append(net.IP(nil), b[8:24]...),
+			dst:  append(net.IP(nil), b[24:40]...),
+			data: b,
+		}
+		frag, err = pkt.setIPv6Payload(b[6], b[ipv6HeaderLen:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return pkt, frag, nil
+	default:
+		return nil, nil, errors.New("unknown IP version")
+	}
+}
+
+// setIPv6Payload skips extension headers starting with next, a fragment is
+// returned if there is a fragment header.
+func (pkt *ipPacket) setIPv6Payload(next byte, b []byte) (*ipFragment, error) {
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DstOpts:
+			if len(b) < 8 {
+				return nil, errMalformedPacket
+			}
+			hl := (int(b[1]) + 1) * 8
+			if hl > len(b) {
+				return nil, errMalformedPacket
+			}
+			next, b = b[0], b[hl:]
+		case ipv6Fragment:
+			if len(b) < ipv6FragHeaderLen {
+				return nil, errMalformedPacket
+			}
+			pkt.proto = proto(b[0])
+			off := binary.BigEndian.Uint16(b[2:4])
+			return &ipFragment{
+				key:    newFragKey(pkt, binary.BigEndian.Uint32(b[4:8])),
+				offset: int(off &^ 7),
+				more:   off&1 != 0,
+				data:   b[ipv6FragHeaderLen:],
+			}, nil
+		default:
+			pkt.proto = proto(next)
+			pkt.payload = b
+			return nil, nil
+		}
+	}
+}
+
+// The maximum number of packets being reassembled, and how long fragments
+// of a packet are kept, the same as lwIP's.
+const (
+	maxReassPackets = 64
+	reassMaxAge     = 15 * time.Second
+)
+
+type fragKey struct {
+	ver      ipver
+	src, dst [16]byte
+	id       uint32
+	proto    proto
+}
+
+func newFragKey(pkt *ipPacket, id uint32) fragKey {
+	k := fragKey{ver: pkt.ver, id: id, proto: pkt.proto}
+	copy(k.src[:], pkt.src.To16())
+	copy(k.dst[:], pkt.dst.To16())
+	return k
+}
+
+type fragRange struct {
+	start, end int
+}
+
+type reassPacket struct {
+	buf     []byte
+	ranges  []fragRange
+	total   int // Length of the whole payload, -1 until the last fragment arrives
+	expires time.Time
+}
+
+// reassembler reassembles fragmented IP packets, it's protected by the stack
+// lock.
+type reassembler struct {
+	packets map[fragKey]*reassPacket
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{packets: make(map[fragKey]*reassPacket)}
+}
+
+// add adds a fragment, and returns the reassembled payload once all fragments
+// have arrived.
+func (r *reassembler) add(frag *ipFragment) ([]byte, bool) {
+	now := time.Now()
+	for k, p := range r.packets {
+		if now.After(p.expires) {
+			delete(r.packets, k)
+		}
+	}
+
+	end := frag.offset + len(frag.data)
+	if end > 0xffff || (frag.more && len(frag.data)%8 != 0) {
+		return nil, false
+	}
+
+	p, ok := r.packets[frag.key]
+	if !ok {
+		if len(r.packets) >= maxReassPackets {
+			return nil, false
+		}
+		p = &reassPacket{total: -1, expires: now.Add(reassMaxAge)}
+		r.packets[frag.key] = p
+	}
+	if !frag.more {
+		if p.total >= 0 && p.total != end {
+			delete(r.packets, frag.key)
+			return nil, false
+		}
+		p.total = end
+	}
+	if p.total >= 0 && end > p.total {
+		delete(r.packets, frag.key)
+		return nil, false
+	}
+
+	if end > len(p.buf) {
+		p.buf = append(p.buf, make([]byte, end-len(p.buf))...)
+	}
+	copy(p.buf[frag.offset:], frag.data)
+	p.ranges = append(p.ranges, fragRange{frag.offset, end})
+
+	if p.total < 0 || !p.complete() {
+		return nil, false
+	}
+	delete(r.packets, frag.key)
+	return p.buf[:p.total], true
+}
+
+// complete reports whether fragments cover the whole payload.
+func (p *reassPacket) complete() bool {
+	covered := 0
+	for progress := true; progress && covered < p.total; {
+		progress = false
+		for _, r := range p.ranges {
+			if r.start <= covered && r.end > covered {
+				covered = r.end
+				progress = true
+			}
+		}
+	}
+	return covered >= p.total
+}
@@ -0,0 +1,1010 @@
+// +build !cgo gostack
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type goTCPState uint8
+
+const (
+	goTCPSynReceived goTCPState = iota
+	goTCPEstablished
+	goTCPCloseWait
+	goTCPLastAck
+	goTCPFinWait1
+	goTCPFinWait2
+	goTCPClosing
+	goTCPTimeWait
+	goTCPClosed
+)
+
+func (st goTCPState) String() string {
+	switch st {
+	case goTCPSynReceived:
+		return "syn-received"
+	case goTCPEstablished:
+		return "established"
+	case goTCPCloseWait:
+		return "close-wait"
+	case goTCPLastAck:
+		return "last-ack"
+	case goTCPFinWait1:
+		return "fin-wait-1"
+	case goTCPFinWait2:
+		return "fin-wait-2"
+	case goTCPClosing:
+		return "closing"
+	case goTCPTimeWait:
+		return "time-wait"
+	case goTCPClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+const (
+	goTCPRcvScale   = 8   // Window scale announced to clients
+	goTCPDefaultMSS = 536 // MSS assumed if the client doesn't announce one
+
+	goTCPInitialRTO = time.Second
+	goTCPMinRTO     = 200 * time.Millisecond
+	goTCPMaxRTO     = 60 * time.Second
+
+	goTCPMaxSynRetries = 6
+	goTCPMaxRetries    = 12
+
+	goTCPTimeWaitTimeout = 30 * time.Second
+	goTCPFinWait2Timeout = 20 * time.Second
+)
+
+var errConnReset = errors.New("connection reset by peer")
+
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqGT(a, b uint32) bool  { return int32(a-b) > 0 }
+func seqGEQ(a, b uint32) bool { return int32(a-b) >= 0 }
+
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	wnd              uint16
+	mss              uint16 // Zero if absent
+	wscale           int    // -1 if absent
+	payload          []byte
+}
+
+func parseTCPSegment(b []byte) (*tcpSegment, bool) {
+	if len(b) < tcpHeaderLen {
+		return nil, false
+	}
+	hl := int(b[12]>>4) * 4
+	if hl < tcpHeaderLen || hl > len(b) {
+		return nil, false
+	}
+	seg := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		wnd:     binary.BigEndian.Uint16(b[14:16]),
+		wscale:  -1,
+		payload: b[hl:],
+	}
+	for opts := b[tcpHeaderLen:hl]; len(opts) > 0; {
+		switch opts[0] {
+		case 0: // End of option list
+			return seg, true
+		case 1: // No-operation
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return seg, true
+		}
+		switch {
+		case opts[0] == 2 && opts[1] == 4:
+			seg.mss = binary.BigEndian.Uint16(opts[2:4])
+		case opts[0] == 3 && opts[1] == 3:
+			seg.wscale = int(opts[2])
+			if seg.wscale > 14 {
+				seg.wscale = 14
+			}
+		}
+		opts = opts[opts[1]:]
+	}
+	return seg, true
+}
+
+// seqLen returns the length of the segment in sequence space.
+func (seg *tcpSegment) seqLen() uint32 {
+	n := uint32(len(seg.payload))
+	if seg.flags&tcpSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// goTCPConn is a TCP connection of the Go backend, it's driven by segments
+// and timers under the stack lock, while Read and Write are called by
+// handlers.
+type goTCPConn struct {
+	stack      *goStack
+	id         tcpConnID
+	localAddr  *net.TCPAddr   // The client
+	remoteAddr *net.TCPAddr   // The target
+	handler    TCPConnHandler // Set once established
+
+	// Fields below are protected by the stack lock.
+	state goTCPState
+	err   error // Set once the connection is reset or aborted
+
+	iss       uint32
+	sndUna    uint32
+	sndNxt    uint32
+	sndWnd    uint32
+	sndScale  uint8
+	sndBuf    []byte // Data from sndUna on, including unsent data
+	mss       int
+	finQueued bool // CloseWrite has been called
+	finSent   bool
+	probing   bool // A window probe is outstanding
+
+	wsOK       bool // Window scaling is agreed on
+	rcvScale   uint8
+	rcvNxt     uint32
+	rcvAdv     uint32 // Right edge of the announced window
+	rcvBuf     []byte
+	finRcvd    bool
+	readClosed bool
+
+	dupAcks    int
+	inRecovery bool
+	recover    uint32 // sndNxt when the loss recovery started
+
+	rto      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+	rttSeq   uint32
+	rttStart time.Time // Zero if no segment is being timed
+	retries  int
+
+	timer    *time.Timer
+	timerGen int // Invalidates fired timers which have been stopped
+	timerSet bool
+
+	readSignal  chan struct{} // Closed when data, FIN or an error arrives
+	writeSignal chan struct{} // Closed when send buffer space is available
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closeOnce     sync.Once
+
+	// Reported by ListConnections.
+	connID  uint64 // Also the ID in Metadata
+	created time.Time
+}
+
+// inputTCP handles a TCP segment, the caller must hold the stack lock.
+func (s *goStack) inputTCP(pkt *ipPacket) {
+	seg, ok := parseTCPSegment(pkt.payload)
+	if !ok {
+		atomic.AddUint64(&s.stats.TCP.LengthErrors, 1)
+		atomic.AddUint64(&s.stats.TCP.Dropped, 1)
+		return
+	}
+	atomic.AddUint64(&s.stats.TCP.Received, 1)
+	id := tcpConnID{srcPort: seg.srcPort, dstPort: seg.dstPort}
+	copy(id.src[:], pkt.src.To16())
+	copy(id.dst[:], pkt.dst.To16())
+
+	if c, ok := s.tcpConns[id]; ok {
+		c.input(pkt, seg)
+		return
+	}
+	switch {
+	case seg.flags&tcpRST != 0:
+	case seg.flags&(tcpSYN|tcpACK) == tcpSYN:
+		if s.admitSYN(pkt.data) && s.holdSYN(pkt.data) {
+			s.acceptTCP(id, pkt, seg)
+		}
+		return
+	default:
+		s.sendReset(pkt, seg)
+	}
+	atomic.AddUint64(&s.stats.TCP.ProtocolErrors, 1)
+	atomic.AddUint64(&s.stats.TCP.Dropped, 1)
+}
+
+// tcpMSS returns the MSS announced to clients.
+func (s *goStack) tcpMSS(ver ipver) int {
+	mss := s.opts.MTU - ipv4HeaderLen - tcpHeaderLen
+	if ver == ipv6 {
+		mss = s.opts.MTU - ipv6HeaderLen - tcpHeaderLen
+	}
+	if s.opts.TCPMSS != 0 && s.opts.TCPMSS < mss {
+		mss = s.opts.TCPMSS
+	}
+	return mss
+}
+
+func (s *goStack) acceptTCP(id tcpConnID, pkt *ipPacket, seg *tcpSegment) {
+	local := &net.TCPAddr{IP: pkt.src, Port: int(seg.srcPort)}
+	target := &net.TCPAddr{IP: pkt.dst, Port: int(seg.dstPort)}
+	if !s.admitTCPConn(local, target) {
+		s.sendReset(pkt, seg)
+		return
+	}
+	c := &goTCPConn{
+		stack:         s,
+		id:            id,
+		localAddr:     local,
+		remoteAddr:    target,
+		state:         goTCPSynReceived,
+		iss:           rand.Uint32(),
+		rcvNxt:        seg.seq + 1,
+		sndWnd:        uint32(seg.wnd),
+		mss:           s.tcpMSS(pkt.ver),
+		rto:           goTCPInitialRTO,
+		readSignal:    make(chan struct{}),
+		writeSignal:   make(chan struct{}),
+		readDeadline:  newDeadline(nil),
+		writeDeadline: newDeadline(nil),
+		connID:        newConnID(),
+		created:       time.Now(),
+	}
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.recover = c.sndNxt
+	switch {
+	case seg.mss == 0:
+		if c.mss > goTCPDefaultMSS {
+			c.mss = goTCPDefaultMSS
+		}
+	case int(seg.mss) < c.mss:
+		c.mss = int(seg.mss)
+	}
+	if seg.wscale >= 0 {
+		c.wsOK = true
+		c.sndScale = uint8(seg.wscale)
+		c.rcvScale = goTCPRcvScale
+	}
+
+	s.tcpConns[id] = c
+	c.sendSynAck()
+	c.setTimer(c.rto)
+}
+
+// sendReset answers a segment not belonging to any connection with RST.
+func (s *goStack) sendReset(pkt *ipPacket, seg *tcpSegment) {
+	if seg.flags&tcpRST != 0 {
+		return
+	}
+	if seg.flags&tcpACK != 0 {
+		s.outputTCP(pkt.dst, pkt.src, seg.dstPort, seg.srcPort, seg.ack, 0, tcpRST, 0, nil, nil)
+	} else {
+		s.outputTCP(pkt.dst, pkt.src, seg.dstPort, seg.srcPort, 0, seg.seq+seg.seqLen(), tcpRST|tcpACK, 0, nil, nil)
+	}
+}
+
+// outputTCP sends a TCP segment, opts must be padded to 4 bytes.
+func (s *goStack) outputTCP(src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, flags uint8, wnd uint16, opts, data []byte) {
+	hl := ipHeaderLen(dst)
+	tl := tcpHeaderLen + len(opts)
+	pkt := make([]byte, hl+tl+len(data))
+	seg := pkt[hl:]
+	binary.BigEndian.PutUint16(seg[0:], srcPort)
+	binary.BigEndian.PutUint16(seg[2:], dstPort)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = byte(tl/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], wnd)
+	copy(seg[tcpHeaderLen:], opts)
+	copy(seg[tl:], data)
+	binary.BigEndian.PutUint16(seg[16:], transportChecksum(src, dst, proto_tcp, seg))
+	writeIPHeader(pkt, src, dst, proto_tcp, tl+len(data))
+	atomic.AddUint64(&s.stats.TCP.Sent, 1)
+	s.output(pkt)
+}
+
+// Functions below must be called with the stack lock held.
+
+func (c *goTCPConn) sendSynAck() {
+	opts := []byte{2, 4, 0, 0}
+	binary.BigEndian.PutUint16(opts[2:], uint16(c.mss))
+	if c.wsOK {
+		opts = append(opts, 1, 3, 3, c.rcvScale)
+	}
+	wnd := c.stack.opts.TCPWindow
+	if wnd > 0xffff {
+		wnd = 0xffff
+	}
+	c.rcvAdv = c.rcvNxt + uint32(wnd)
+	c.stack.outputTCP(c.remoteAddr.IP, c.localAddr.IP, c.id.dstPort, c.id.srcPort,
+		c.iss, c.rcvNxt, tcpSYN|tcpACK, uint16(wnd), opts, nil)
+}
+
+// send sends a segment acknowledging received data with the window updated.
+func (c *goTCPConn) send(flags uint8, seq uint32, data []byte) {
+	wnd := c.stack.opts.TCPWindow - len(c.rcvBuf)
+	if !c.wsOK && wnd > 0xffff {
+		wnd = 0xffff
+	}
+	scaled := uint32(wnd) >> c.rcvScale
+	if edge := c.rcvNxt + scaled<<c.rcvScale; seqGT(edge, c.rcvAdv) {
+		c.rcvAdv = edge
+	}
+	// Segments sent before the loss recovery started are retransmissions.
+	if (len(data) > 0 || flags&tcpFIN != 0) && seqLT(seq, c.recover) {
+		atomic.AddUint64(&c.stack.stats.TCPRetransmits, 1)
+	}
+	c.stack.outputTCP(c.remoteAddr.IP, c.localAddr.IP, c.id.dstPort, c.id.srcPort,
+		seq, c.rcvNxt, flags|tcpACK, uint16(scaled), nil, data)
+}
+
+func (c *goTCPConn) sendAck() {
+	c.send(0, c.sndNxt, nil)
+}
+
+func (c *goTCPConn) setTimer(d time.Duration) {
+	c.timerGen++
+	c.timerSet = true
+	gen := c.timerGen
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(d, func() { c.onTimer(gen) })
+}
+
+func (c *goTCPConn) stopTimer() {
+	c.timerGen++
+	c.timerSet = false
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// notifyRead wakes up blocked Read calls.
+func (c *goTCPConn) notifyRead() {
+	close(c.readSignal)
+	c.readSignal = make(chan struct{})
+}
+
+// notifyWrite wakes up blocked Write calls.
+func (c *goTCPConn) notifyWrite() {
+	close(c.writeSignal)
+	c.writeSignal = make(chan struct{})
+}
+
+// destroy removes the connection from the stack.
+func (c *goTCPConn) destroy() {
+	if c.state == goTCPClosed {
+		return
+	}
+	c.state = goTCPClosed
+	c.stopTimer()
+	delete(c.stack.tcpConns, c.id)
+	c.stack.tcpAdmission.release(c.localAddr.IP)
+	c.notifyRead()
+	c.notifyWrite()
+}
+
+func (c *goTCPConn) input(pkt *ipPacket, seg *tcpSegment) {
+	if c.state == goTCPSynReceived {
+		switch {
+		case seg.flags&tcpRST != 0:
+			if seg.seq == c.rcvNxt {
+				c.destroy()
+			}
+			return
+		case seg.flags&tcpSYN != 0:
+			// The SYN-ACK has been lost.
+			if seg.seq+1 == c.rcvNxt {
+				c.sendSynAck()
+			}
+			return
+		case seg.flags&tcpACK == 0:
+			return
+		case seg.ack != c.sndNxt:
+			c.stack.sendReset(pkt, seg)
+			return
+		}
+		c.sndUna = seg.ack
+		c.sndWnd = uint32(seg.wnd) << c.sndScale
+		c.state = goTCPEstablished
+		c.retries = 0
+		c.stopTimer()
+
+		// Like lwIP, the handler is looked up once the connection is
+		// established.
+		c.handler = c.stack.getTCPConnHandler()
+		if c.handler == nil {
+			panic("must register a TCP connection handler")
+		}
+		pending := c.stack.takePendingConn(c.localAddr, c.remoteAddr)
+		go func() {
+			if err := c.stack.handleTCPConn(c.connID, c.handler, pending, c, c.remoteAddr); err != nil {
+				c.Abort()
+			}
+		}()
+	} else {
+		switch {
+		case seg.flags&tcpRST != 0:
+			if seg.seq == c.rcvNxt || (seqGT(seg.seq, c.rcvNxt) && seqLT(seg.seq, c.rcvAdv)) {
+				if c.state != goTCPTimeWait {
+					c.Err(errConnReset)
+				}
+				c.destroy()
+			}
+			return
+		case seg.flags&tcpSYN != 0:
+			if c.state == goTCPTimeWait && seqGT(seg.seq, c.rcvNxt) {
+				// A new connection reusing the tuple.
+				c.destroy()
+				c.stack.acceptTCP(c.id, pkt, seg)
+				return
+			}
+			// Challenge ACK.
+			c.sendAck()
+			return
+		case seg.flags&tcpACK == 0:
+			return
+		}
+		if !c.processAck(seg) {
+			return
+		}
+	}
+
+	if len(seg.payload) > 0 || seg.flags&tcpFIN != 0 {
+		c.receive(seg)
+	}
+	c.output()
+}
+
+// processAck handles the acknowledgment of a segment, it reports whether
+// the segment should be processed further.
+func (c *goTCPConn) processAck(seg *tcpSegment) bool {
+	if seqGT(seg.ack, c.sndNxt) {
+		c.sendAck()
+		return false
+	}
+	if seqLT(seg.ack, c.sndUna) {
+		return true
+	}
+
+	wnd := uint32(seg.wnd) << c.sndScale
+	if seg.ack == c.sndUna {
+		if c.probing {
+			if wnd > 0 {
+				// The probe has been dropped, resend it as normal data.
+				c.sndNxt = c.sndUna
+				c.probing = false
+				c.stopTimer()
+			} else {
+				// The client is alive, keep probing.
+				c.retries = 0
+			}
+		} else if c.sndNxt != c.sndUna && len(seg.payload) == 0 && seg.flags&tcpFIN == 0 && wnd == c.sndWnd {
+			c.dupAcks++
+			if c.dupAcks == 3 && !c.inRecovery {
+				c.inRecovery = true
+				c.recover = c.sndNxt
+				c.rttStart = time.Time{}
+				c.retransmit()
+			}
+		}
+		c.sndWnd = wnd
+		return true
+	}
+
+	acked := int(seg.ack - c.sndUna)
+	finAcked := c.finSent && seg.ack == c.sndNxt
+	if finAcked {
+		acked--
+	}
+	c.sndBuf = c.sndBuf[acked:]
+	if len(c.sndBuf) == 0 {
+		c.sndBuf = nil
+	}
+	c.sndUna = seg.ack
+	c.sndWnd = wnd
+	c.probing = false
+	c.dupAcks = 0
+	c.retries = 0
+
+	if !c.rttStart.IsZero() && seqGEQ(seg.ack, c.rttSeq) {
+		c.updateRTO(time.Since(c.rttStart))
+		c.rttStart = time.Time{}
+	}
+	if c.inRecovery {
+		if seqLT(seg.ack, c.recover) {
+			// Partial acknowledgment, the next hole is lost too.
+			c.retransmit()
+		} else {
+			c.inRecovery = false
+		}
+	}
+	if c.sndUna == c.sndNxt {
+		c.stopTimer()
+	} else {
+		c.setTimer(c.rto)
+	}
+	if acked > 0 {
+		if acked > 0xffff {
+			acked = 0xffff
+		}
+		c.Sent(uint16(acked))
+	}
+
+	if finAcked {
+		switch c.state {
+		case goTCPFinWait1:
+			c.state = goTCPFinWait2
+			if c.readClosed {
+				c.setTimer(goTCPFinWait2Timeout)
+			}
+		case goTCPClosing:
+			c.state = goTCPTimeWait
+			c.setTimer(goTCPTimeWaitTimeout)
+		case goTCPLastAck:
+			c.destroy()
+			return false
+		}
+	}
+	return true
+}
+
+// updateRTO updates the retransmission timeout with a RTT sample as
+// described in RFC 6298.
+func (c *goTCPConn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < goTCPMinRTO {
+		c.rto = goTCPMinRTO
+	}
+	if c.rto > goTCPMaxRTO {
+		c.rto = goTCPMaxRTO
+	}
+}
+
+// receive handles data and FIN of a segment.
+func (c *goTCPConn) receive(seg *tcpSegment) {
+	switch c.state {
+	case goTCPEstablished, goTCPFinWait1, goTCPFinWait2:
+	default:
+		// Retransmitted data or FIN.
+		c.sendAck()
+		return
+	}
+
+	seq, data, fin := seg.seq, seg.payload, seg.flags&tcpFIN != 0
+	if seqLT(seq, c.rcvNxt) {
+		off := int(c.rcvNxt - seq)
+		if off > len(data) || (off == len(data) && !fin) {
+			c.sendAck()
+			return
+		}
+		seq, data = c.rcvNxt, data[off:]
+	}
+	if seq != c.rcvNxt {
+		// Out of order, ask for the missing data.
+		c.sendAck()
+		return
+	}
+
+	if space := c.stack.opts.TCPWindow - len(c.rcvBuf); len(data) > space {
+		data, fin = data[:space], false
+	}
+	if len(data) > 0 {
+		c.rcvNxt += uint32(len(data))
+		c.Receive(data)
+	}
+	if fin {
+		c.rcvNxt++
+		c.LocalClosed()
+		switch c.state {
+		case goTCPEstablished:
+			c.state = goTCPCloseWait
+		case goTCPFinWait1:
+			c.state = goTCPClosing
+		case goTCPFinWait2:
+			c.state = goTCPTimeWait
+			c.setTimer(goTCPTimeWaitTimeout)
+		}
+	}
+	c.sendAck()
+}
+
+// output sends as much data as the send window allows, followed by FIN if
+// CloseWrite has been called.
+func (c *goTCPConn) output() {
+	switch c.state {
+	case goTCPEstablished, goTCPCloseWait:
+	default:
+		return
+	}
+
+	for !c.finSent && !c.probing {
+		off := int(c.sndNxt - c.sndUna)
+		if unsent := len(c.sndBuf) - off; unsent > 0 {
+			n := int(c.sndWnd) - off
+			if n <= 0 {
+				if c.sndWnd == 0 && !c.timerSet {
+					// Persist timer, probes the window once fired.
+					c.setTimer(c.rto)
+				}
+				break
+			}
+			if n > unsent {
+				n = unsent
+			}
+			if n > c.mss {
+				n = c.mss
+			}
+			flags := uint8(0)
+			if n == unsent {
+				flags = tcpPSH
+			}
+			c.send(flags, c.sndNxt, c.sndBuf[off:off+n])
+			// Retransmitted segments are not timed.
+			if c.rttStart.IsZero() && seqGEQ(c.sndNxt, c.recover) {
+				c.rttStart = time.Now()
+				c.rttSeq = c.sndNxt + uint32(n)
+			}
+			c.sndNxt += uint32(n)
+			continue
+		}
+		if c.finQueued {
+			c.send(tcpFIN, c.sndNxt, nil)
+			c.sndNxt++
+			c.finSent = true
+			if c.state == goTCPEstablished {
+				c.state = goTCPFinWait1
+			} else {
+				c.state = goTCPLastAck
+			}
+		}
+		break
+	}
+	if c.sndNxt != c.sndUna && !c.timerSet {
+		c.setTimer(c.rto)
+	}
+}
+
+// retransmit resends the first unacknowledged segment.
+func (c *goTCPConn) retransmit() {
+	n := int(c.sndNxt - c.sndUna)
+	if n > len(c.sndBuf) {
+		n = len(c.sndBuf)
+	}
+	if n > c.mss {
+		n = c.mss
+	}
+	if n > 0 {
+		c.send(tcpPSH, c.sndUna, c.sndBuf[:n])
+	} else if c.finSent {
+		c.send(tcpFIN, c.sndNxt-1, nil)
+	}
+}
+
+func (c *goTCPConn) onTimer(gen int) {
+	c.stack.mu.Lock()
+	defer c.stack.mu.Unlock()
+
+	if gen != c.timerGen || !c.timerSet {
+		return
+	}
+	c.timerSet = false
+
+	switch c.state {
+	case goTCPSynReceived:
+		if c.retries >= goTCPMaxSynRetries {
+			c.destroy()
+			return
+		}
+		c.retries++
+		c.backoff()
+		atomic.AddUint64(&c.stack.stats.TCPRetransmits, 1)
+		c.sendSynAck()
+		c.setTimer(c.rto)
+		return
+	case goTCPTimeWait:
+		c.destroy()
+		return
+	case goTCPFinWait2:
+		// The client never closes its side, while nobody reads it.
+		c.abort(io.ErrClosedPipe)
+		return
+	case goTCPClosed:
+		return
+	}
+
+	if c.sndNxt == c.sndUna {
+		if len(c.sndBuf) > 0 && c.sndWnd == 0 {
+			// Probe the zero window with one byte.
+			c.send(0, c.sndNxt, c.sndBuf[:1])
+			c.sndNxt++
+			c.probing = true
+			c.setTimer(c.rto)
+		}
+		return
+	}
+
+	if c.retries >= goTCPMaxRetries {
+		c.abort(timeoutError{})
+		return
+	}
+	c.retries++
+	c.backoff()
+	c.rttStart = time.Time{}
+	c.recover = c.sndNxt
+	c.dupAcks = 0
+	if c.finSent || c.probing {
+		c.inRecovery = !c.probing
+		c.retransmit()
+		c.setTimer(c.rto)
+		return
+	}
+
+	// Go back N, all data not acknowledged is sent again.
+	c.inRecovery = false
+	c.sndNxt = c.sndUna
+	c.output()
+}
+
+func (c *goTCPConn) backoff() {
+	c.rto *= 2
+	if c.rto > goTCPMaxRTO {
+		c.rto = goTCPMaxRTO
+	}
+}
+
+// info describes the connection, the caller must hold the stack lock.
+func (c *goTCPConn) info(now time.Time) ConnInfo {
+	return ConnInfo{
+		ID:           c.connID,
+		Network:      "tcp",
+		State:        c.state.String(),
+		Source:       c.localAddr,
+		Destination:  c.remoteAddr,
+		Age:          now.Sub(c.created),
+		RecvBuffered: len(c.rcvBuf),
+		SendBuffered: len(c.sndBuf),
+	}
+}
+
+// abort resets the connection, err is returned by subsequent operations.
+func (c *goTCPConn) abort(err error) {
+	if c.state == goTCPClosed {
+		return
+	}
+	c.send(tcpRST, c.sndNxt, nil)
+	c.Err(err)
+	c.destroy()
+}
+
+// Callbacks of TCPConn, they are called by the state machine with the stack
+// lock held.
+
+func (c *goTCPConn) Sent(len uint16) error {
+	c.notifyWrite()
+	return nil
+}
+
+func (c *goTCPConn) Receive(data []byte) error {
+	if !c.readClosed {
+		c.rcvBuf = append(c.rcvBuf, data...)
+		c.notifyRead()
+	}
+	return nil
+}
+
+func (c *goTCPConn) Err(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.notifyRead()
+	c.notifyWrite()
+}
+
+func (c *goTCPConn) LocalClosed() error {
+	c.finRcvd = true
+	c.notifyRead()
+	return nil
+}
+
+func (c *goTCPConn) Poll() error {
+	return nil
+}
+
+func (c *goTCPConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *goTCPConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *goTCPConn) Read(data []byte) (int, error) {
+	s := c.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if len(c.rcvBuf) > 0 {
+			n := copy(data, c.rcvBuf)
+			c.rcvBuf = c.rcvBuf[n:]
+			if len(c.rcvBuf) == 0 {
+				c.rcvBuf = nil
+			}
+			c.updateWindow()
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.finRcvd || c.readClosed {
+			return 0, io.EOF
+		}
+		if c.state == goTCPClosed {
+			return 0, io.ErrClosedPipe
+		}
+
+		signal := c.readSignal
+		s.mu.Unlock()
+		select {
+		case <-signal:
+			s.mu.Lock()
+		case <-c.readDeadline.wait():
+			s.mu.Lock()
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// updateWindow announces the window if it has grown noticeably since the
+// last announcement, the threshold is the same as lwIP's.
+func (c *goTCPConn) updateWindow() {
+	switch c.state {
+	case goTCPEstablished, goTCPFinWait1, goTCPFinWait2:
+	default:
+		return
+	}
+	threshold := c.stack.opts.TCPWindow / 4
+	if threshold > 4*c.mss {
+		threshold = 4 * c.mss
+	}
+	edge := c.rcvNxt + uint32(c.stack.opts.TCPWindow-len(c.rcvBuf))
+	if seqGT(edge, c.rcvAdv) && int(edge-c.rcvAdv) >= threshold {
+		c.sendAck()
+	}
+}
+
+func (c *goTCPConn) Write(data []byte) (int, error) {
+	s := c.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for once := true; once || len(data) > 0; once = false {
+		if c.err != nil {
+			return written, c.err
+		}
+		switch c.state {
+		case goTCPEstablished, goTCPCloseWait:
+		default:
+			return written, io.ErrClosedPipe
+		}
+		if c.finQueued {
+			return written, io.ErrClosedPipe
+		}
+
+		n := s.opts.TCPSendBuffer - len(c.sndBuf)
+		if n > len(data) {
+			n = len(data)
+		}
+		if n > 0 {
+			c.sndBuf = append(c.sndBuf, data[:n]...)
+			data = data[n:]
+			written += n
+			c.output()
+			continue
+		}
+		if len(data) == 0 {
+			break
+		}
+
+		signal := c.writeSignal
+		s.mu.Unlock()
+		select {
+		case <-signal:
+			s.mu.Lock()
+		case <-c.writeDeadline.wait():
+			s.mu.Lock()
+			return written, timeoutError{}
+		}
+	}
+	return written, nil
+}
+
+func (c *goTCPConn) CloseWrite() error {
+	c.stack.mu.Lock()
+	defer c.stack.mu.Unlock()
+
+	if c.finQueued || c.state == goTCPClosed {
+		return nil
+	}
+	c.finQueued = true
+	c.output()
+	return nil
+}
+
+func (c *goTCPConn) CloseRead() error {
+	c.stack.mu.Lock()
+	defer c.stack.mu.Unlock()
+
+	if c.readClosed {
+		return nil
+	}
+	c.readClosed = true
+	c.rcvBuf = nil
+	c.notifyRead()
+	c.updateWindow()
+	if c.state == goTCPFinWait2 {
+		c.setTimer(goTCPFinWait2Timeout)
+	}
+	return nil
+}
+
+func (c *goTCPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.CloseRead()
+		c.CloseWrite()
+	})
+	return nil
+}
+
+func (c *goTCPConn) Abort() {
+	c.stack.mu.Lock()
+	c.abort(io.ErrClosedPipe)
+	c.stack.mu.Unlock()
+}
+
+func (c *goTCPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *goTCPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *goTCPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
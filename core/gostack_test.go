@@ -0,0 +1,79 @@
+// +build !cgo gostack
+
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// Large UDP packets sent to clients should be fragmented to fit in the MTU,
+// and reassembled by the receiving stack.
+func TestGoStackUDPFragmentation(t *testing.T) {
+	for _, c := range []struct{ local, remote string }{
+		{"10.0.0.1:1234", "10.0.0.2:53"},
+		{"[fd00::1]:1234", "[fd00::2]:53"},
+	} {
+		local, _ := net.ResolveUDPAddr("udp", c.local)
+		remote, _ := net.ResolveUDPAddr("udp", c.remote)
+		s := NewLWIPStack().(*goStack)
+		var pkts [][]byte
+		s.RegisterOutputFn(func(b []byte) (int, error) {
+			pkts = append(pkts, append([]byte(nil), b...))
+			return len(b), nil
+		})
+		data := bytes.Repeat([]byte{1, 2, 3}, 1000)
+		if err := s.newUDPSendFn(local)(data, remote); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		if len(pkts) != 3 {
+			t.Fatalf("Expected 3 fragments, got %v", len(pkts))
+		}
+		for _, pkt := range pkts {
+			if len(pkt) > defaultMTU {
+				t.Errorf("Fragment of %v bytes exceeds the MTU", len(pkt))
+			}
+		}
+
+		r, h := setupUDP(t)
+		for i := len(pkts) - 1; i >= 0; i-- {
+			write(r, pkts[i], t)
+		}
+		assertEqual(<-h.packets, data, t)
+		r.Close()
+	}
+}
+
+// Data lost on the way to the client should be retransmitted.
+func TestGoStackTCPRetransmit(t *testing.T) {
+	const ack = 0x10
+
+	s := NewLWIPStack()
+	defer s.Close()
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	conn, seq, rcvNxt := acceptTCP(s, out, t)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the first transmission.
+	lost := parseTestSegment(<-out)
+	select {
+	case b := <-out:
+		seg := parseTestSegment(b)
+		if seg.seq != lost.seq || !bytes.Equal(seg.payload, []byte("hello")) {
+			t.Fatalf("Unexpected segment seq %v %q", seg.seq, seg.payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Data not retransmitted")
+	}
+	write(s, tcpPacket(ack, seq, rcvNxt+5, nil), t)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"net"
 )
 
@@ -10,22 +11,173 @@ type TCPConnHandler interface {
 	Handle(conn net.Conn, target *net.TCPAddr) error
 }
 
+// TCPConnectHandler is an optional interface a TCPConnHandler may implement
+// to connect to the target before the connection from TUN is accepted, it's
+// used by stacks with StackOptions.ConnectBeforeAccept enabled.
+//
+// The SYN of the connection is held while Connect is running, the connection
+// is accepted only if it succeeds, and then handled by HandleConnected
+// instead of Handle. Otherwise the SYN is answered with ICMP unreachable if
+// the error selects a code other than PortUnreachable (see UnreachableError),
+// or RST.
+type TCPConnectHandler interface {
+	TCPConnHandler
+
+	// Connect connects to target, the returned connection is closed by
+	// the stack if the connection from TUN is never accepted.
+	Connect(target *net.TCPAddr) (net.Conn, error)
+
+	// HandleConnected handles the conn accepted after Connect returned
+	// upstream, upstream is owned by the handler from then on.
+	HandleConnected(conn net.Conn, upstream net.Conn) error
+}
+
+// TCPConnectContextHandler is an optional interface a TCPConnectHandler may
+// implement to receive the metadata of connections connected before they are
+// accepted, ConnectContext and HandleConnectedContext are called instead of
+// Connect and HandleConnected then. The metadata is resolved once the SYN
+// arrives, its ID is set only when the connection is accepted. The context
+// carries meta as well, and is done when the stack is closed.
+type TCPConnectContextHandler interface {
+	TCPConnectHandler
+
+	// ConnectContext connects to meta.Destination, like Connect.
+	ConnectContext(ctx context.Context, meta *Metadata) (net.Conn, error)
+
+	// HandleConnectedContext handles the conn for meta, like
+	// HandleConnected.
+	HandleConnectedContext(ctx context.Context, conn net.Conn, upstream net.Conn, meta *Metadata) error
+}
+
+// tcpConnectAdapter lets stacks call the context methods of any
+// TCPConnectHandler.
+type tcpConnectAdapter struct {
+	TCPConnectHandler
+}
+
+func (a tcpConnectAdapter) ConnectContext(ctx context.Context, meta *Metadata) (net.Conn, error) {
+	return a.Connect(meta.Destination.(*net.TCPAddr))
+}
+
+func (a tcpConnectAdapter) HandleConnectedContext(ctx context.Context, conn net.Conn, upstream net.Conn, meta *Metadata) error {
+	return a.HandleConnected(conn, upstream)
+}
+
+func tcpConnectContextHandler(h TCPConnectHandler) TCPConnectContextHandler {
+	if ch, ok := h.(TCPConnectContextHandler); ok {
+		return ch
+	}
+	return tcpConnectAdapter{h}
+}
+
+// TCPConnContextHandler is an optional interface a TCPConnHandler may
+// implement to receive the metadata of connections, HandleContext is called
+// instead of Handle then. The context carries meta as well, and is done when
+// the stack is closed.
+//
+// Connections accepted after TCPConnectHandler.Connect are still handled by
+// HandleConnected, see TCPConnectContextHandler.
+type TCPConnContextHandler interface {
+	TCPConnHandler
+
+	// HandleContext handles the conn for meta.Destination.
+	HandleContext(ctx context.Context, conn net.Conn, meta *Metadata) error
+}
+
+// tcpHandlerAdapter lets stacks call HandleContext of any TCPConnHandler.
+type tcpHandlerAdapter struct {
+	TCPConnHandler
+}
+
+func (a tcpHandlerAdapter) HandleContext(ctx context.Context, conn net.Conn, meta *Metadata) error {
+	return a.Handle(conn, meta.Destination.(*net.TCPAddr))
+}
+
+func tcpContextHandler(h TCPConnHandler) TCPConnContextHandler {
+	if ch, ok := h.(TCPConnContextHandler); ok {
+		return ch
+	}
+	return tcpHandlerAdapter{h}
+}
+
 // UDPConnHandler handles UDP connections comming from TUN.
 type UDPConnHandler interface {
 	// Connect connects the proxy server. Note that target can be nil.
+	//
+	// If it fails, packets of conn are answered with ICMP port unreachable,
+	// or the message selected by the error, see UnreachableError.
 	Connect(conn UDPConn, target *net.UDPAddr) error
 
 	// ReceiveTo will be called when data arrives from TUN.
 	ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error
 }
 
+// UDPConnContextHandler is an optional interface a UDPConnHandler may
+// implement to receive the metadata of connections, ConnectContext is called
+// instead of Connect then. The context carries meta as well, and is done when
+// the stack is closed.
+type UDPConnContextHandler interface {
+	UDPConnHandler
+
+	// ConnectContext connects the proxy server for meta.Destination, which
+	// can be nil. Errors are handled the same as those of Connect.
+	ConnectContext(ctx context.Context, conn UDPConn, meta *Metadata) error
+}
+
+// udpHandlerAdapter lets stacks call ConnectContext of any UDPConnHandler.
+type udpHandlerAdapter struct {
+	UDPConnHandler
+}
+
+func (a udpHandlerAdapter) ConnectContext(ctx context.Context, conn UDPConn, meta *Metadata) error {
+	target, _ := meta.Destination.(*net.UDPAddr)
+	return a.Connect(conn, target)
+}
+
+func udpContextHandler(h UDPConnHandler) UDPConnContextHandler {
+	if ch, ok := h.(UDPConnContextHandler); ok {
+		return ch
+	}
+	return udpHandlerAdapter{h}
+}
+
+// UDPConnCloseHandler is an optional interface a UDPConnHandler may implement
+// to be notified when a UDP connection is closed, e.g. it has been idle for
+// longer than the UDP timeout of the stack, or the stack is closed. Handlers
+// should release resources associated with conn in Closed. It's also called
+// when the handler closes conn itself, so it must be safe to call Close on
+// conn again there.
+type UDPConnCloseHandler interface {
+	Closed(conn UDPConn)
+}
+
+// Default handlers, they are used by stacks which have no handlers
+// registered on their own.
 var tcpConnHandler TCPConnHandler
 var udpConnHandler UDPConnHandler
 
+// RegisterTCPConnHandler registers the default TCP connection handler for
+// all stacks, use LWIPStack.RegisterTCPConnHandler to set one for a
+// particular stack.
 func RegisterTCPConnHandler(h TCPConnHandler) {
 	tcpConnHandler = h
 }
 
+// DefaultTCPConnHandler returns the default TCP connection handler, see
+// RegisterTCPConnHandler.
+func DefaultTCPConnHandler() TCPConnHandler {
+	return tcpConnHandler
+}
+
+// RegisterUDPConnHandler registers the default UDP connection handler for
+// all stacks, use LWIPStack.RegisterUDPConnHandler to set one for a
+// particular stack.
 func RegisterUDPConnHandler(h UDPConnHandler) {
 	udpConnHandler = h
 }
+
+// TCPConnWrapper wraps a TCP connection before it's handed over to the
+// handler, e.g. to shape its traffic. It returns conn itself, or a TCPConn
+// calling the methods of conn, which the stack keeps calling internally.
+// See LWIPStack.RegisterTCPConnWrapper.
+type TCPConnWrapper func(conn TCPConn, meta *Metadata) TCPConn
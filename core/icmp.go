@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// UnreachableCode is the reason of an ICMP or ICMPv6 destination unreachable
+// message, it's mapped to the code of the respective protocol.
+type UnreachableCode int
+
+const (
+	NetUnreachable UnreachableCode = iota
+	HostUnreachable
+	PortUnreachable
+	AdminProhibited
+)
+
+// UnreachableError may be returned by handlers failing to connect, to select
+// the ICMP or ICMPv6 destination unreachable message answering the packets
+// of the local client.
+type UnreachableError struct {
+	Code UnreachableCode
+	Err  error // The underlying error, may be nil
+}
+
+func (e *UnreachableError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return "destination unreachable"
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// unreachableCodeOf returns the code selected by an error of a handler, it
+// may be an UnreachableError, or wrap a syscall error or a timeout.
+func unreachableCodeOf(err error) (UnreachableCode, bool) {
+	var uerr *UnreachableError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &uerr):
+		return uerr.Code, true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return PortUnreachable, true
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetUnreachable, true
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &nerr) && nerr.Timeout():
+		return HostUnreachable, true
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return AdminProhibited, true
+	}
+	return 0, false
+}
+
+var (
+	icmpUnreachableCodes   = [...]byte{0, 1, 3, 13}
+	icmpv6UnreachableCodes = [...]byte{0, 3, 4, 1}
+)
+
+// Messages carry as much of the original packet as possible without making
+// the reply larger than the minimum MTU, as suggested by RFC 1812 and 4443.
+const (
+	icmpMaxReplyLen   = 576
+	icmpv6MaxReplyLen = 1280
+)
+
+// buildICMPUnreachable builds a destination unreachable message answering
+// pkt, which is sent on behalf of the destination of pkt. It returns nil if
+// pkt is not a valid IP packet, or code is unknown.
+func buildICMPUnreachable(pkt []byte, code UnreachableCode) []byte {
+	if code < 0 || int(code) >= len(icmpUnreachableCodes) {
+		return nil
+	}
+	return buildICMPError(pkt, nil, [2]byte{3, icmpUnreachableCodes[code]}, [2]byte{1, icmpv6UnreachableCodes[code]})
+}
+
+// BuildTimeExceeded builds a time exceeded in transit message answering pkt,
+// which is sent by from, an address of the family of pkt, as if pkt had run
+// out of TTL or hop limit there. It returns nil if pkt is not a valid IP
+// packet, must not be answered (see BuildReject), or from is of another
+// family.
+func BuildTimeExceeded(pkt []byte, from net.IP) []byte {
+	return buildICMPError(pkt, from, [2]byte{11, 0}, [2]byte{3, 0})
+}
+
+// buildICMPError builds an ICMP or ICMPv6 error message answering pkt, with
+// the type and the code of msg4 or msg6, and from as source, or the
+// destination of pkt if nil.
+func buildICMPError(pkt []byte, from net.IP, msg4, msg6 [2]byte) []byte {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return nil
+	}
+	var src, dst net.IP
+	var p proto
+	var msgType, msgCode byte
+	var maxLen int
+	switch ipv {
+	case ipv4:
+		if len(pkt) < ipv4HeaderLen {
+			return nil
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		p, msgType, msgCode, maxLen = proto_icmp, msg4[0], msg4[1], icmpMaxReplyLen
+	case ipv6:
+		if len(pkt) < ipv6HeaderLen || hasIPv4Mapped(pkt) {
+			return nil
+		}
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		p, msgType, msgCode, maxLen = proto_icmpv6, msg6[0], msg6[1], icmpv6MaxReplyLen
+	default:
+		return nil
+	}
+	if !answerable(src, dst) {
+		return nil
+	}
+	if from != nil {
+		if (from.To4() != nil) != (ipv == ipv4) {
+			return nil
+		}
+		dst = from
+	}
+
+	hl := ipHeaderLen(dst)
+	n := len(pkt)
+	if hl+8+n > maxLen {
+		n = maxLen - hl - 8
+	}
+	reply := make([]byte, hl+8+n)
+	msg := reply[hl:]
+	msg[0], msg[1] = msgType, msgCode
+	copy(msg[8:], pkt[:n])
+	if p == proto_icmp {
+		binary.BigEndian.PutUint16(msg[2:], ^checksum(0, msg))
+	} else {
+		binary.BigEndian.PutUint16(msg[2:], transportChecksum(dst, src, p, msg))
+	}
+	writeIPHeader(reply, dst, src, p, len(msg))
+	return reply
+}
+
+// answerable reports whether a packet from src to dst may be answered with
+// an ICMP error message or a RST. Packets to multicast or broadcast
+// addresses, or from addresses not identifying a single host, are never
+// answered, as RFC 1122 and 4443 require.
+func answerable(src, dst net.IP) bool {
+	return !dst.IsMulticast() && !dst.Equal(net.IPv4bcast) &&
+		!src.IsUnspecified() && !src.IsMulticast() && !src.Equal(net.IPv4bcast)
+}
+
+// BuildReject builds the packet rejecting pkt on behalf of its destination,
+// a RST if pkt is a TCP segment, or a destination unreachable message with
+// code otherwise. It returns nil if pkt must not be answered, i.e. it's a
+// RST, an ICMP or ICMPv6 error message, a fragment but the first, or sent
+// to a multicast or broadcast address, or if pkt is not a valid IP packet.
+func BuildReject(pkt []byte, code UnreachableCode) []byte {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return nil
+	}
+	p, err := peekNextProto(ipv, pkt)
+	if err != nil || fragOffset(ipv, pkt) > 0 {
+		return nil
+	}
+	switch p {
+	case proto_tcp:
+		return buildTCPReset(pkt)
+	case proto_icmp, proto_icmpv6:
+		if isICMPError(ipv, pkt) {
+			return nil
+		}
+	}
+	return buildICMPUnreachable(pkt, code)
+}
+
+// isICMPError reports whether pkt, which has passed peekNextProto, carries
+// an ICMP or ICMPv6 error message, or is too short to tell.
+func isICMPError(ipv ipver, pkt []byte) bool {
+	if ipv == ipv4 {
+		hl := int(pkt[0]&0x0f) * 4
+		if hl < ipv4HeaderLen || hl >= len(pkt) {
+			return true
+		}
+		switch pkt[hl] {
+		case 3, 4, 5, 11, 12:
+			return true
+		}
+		return false
+	}
+	// Error messages of ICMPv6 have types below 128.
+	return len(pkt) <= ipv6HeaderLen || pkt[ipv6HeaderLen] < 128
+}
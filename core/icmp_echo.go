@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ICMPEchoMode is how a stack answers ICMP and ICMPv6 echo requests, which
+// are answered on behalf of any destination.
+type ICMPEchoMode int
+
+const (
+	// ICMPEchoDefault answers echo requests immediately.
+	ICMPEchoDefault ICMPEchoMode = iota
+
+	// ICMPEchoDelay answers echo requests after StackOptions.ICMPEchoDelay.
+	ICMPEchoDelay
+
+	// ICMPEchoProbe answers echo requests once the TCP handler has
+	// connected to the destination at StackOptions.ICMPProbePort, so that
+	// round-trip times reflect the latency through the proxy. Requests are
+	// not answered if the handler fails to connect, or answered with
+	// destination unreachable if the error selects a code (see
+	// UnreachableError). Concurrent requests to a destination share a
+	// probe. It falls back to ICMPEchoDelay with handlers not implementing
+	// TCPConnectHandler.
+	ICMPEchoProbe
+)
+
+const (
+	defaultICMPProbePort = 443
+
+	// echoProbeTimeout bounds how long a probe waits for the handler to
+	// connect, requests are not answered if it times out.
+	echoProbeTimeout = 10 * time.Second
+)
+
+func (m ICMPEchoMode) String() string {
+	switch m {
+	case ICMPEchoDefault:
+		return "default"
+	case ICMPEchoDelay:
+		return "delay"
+	case ICMPEchoProbe:
+		return "probe"
+	}
+	return fmt.Sprintf("ICMPEchoMode(%d)", int(m))
+}
+
+// echoResponder answers echo requests in the ICMPEchoDelay and ICMPEchoProbe
+// modes, a nil echoResponder leaves them to the backend.
+type echoResponder struct {
+	mode      ICMPEchoMode
+	delay     time.Duration
+	probePort int
+	mtu       int
+
+	mu     sync.Mutex
+	probes map[string][]*echoRequest // Requests waiting for probes, keyed by destination
+}
+
+func newEchoResponder(opts *StackOptions) *echoResponder {
+	if opts.ICMPEcho == ICMPEchoDefault {
+		return nil
+	}
+	return &echoResponder{
+		mode:      opts.ICMPEcho,
+		delay:     opts.ICMPEchoDelay,
+		probePort: opts.ICMPProbePort,
+		mtu:       opts.MTU,
+		probes:    make(map[string][]*echoRequest),
+	}
+}
+
+// echoRequest is an ICMP or ICMPv6 echo request, msg starts with the ICMP
+// header.
+type echoRequest struct {
+	src, dst net.IP
+	msg      []byte
+}
+
+func (r *echoRequest) proto() proto {
+	if r.dst.To4() != nil {
+		return proto_icmp
+	}
+	return proto_icmpv6
+}
+
+// reply builds the echo reply, fragmented if it's larger than mtu.
+func (r *echoRequest) reply(mtu int) [][]byte {
+	p := r.proto()
+	msg := append([]byte(nil), r.msg...)
+	msg[2], msg[3] = 0, 0
+	if p == proto_icmp {
+		msg[0] = 0
+		binary.BigEndian.PutUint16(msg[2:], ^checksum(0, msg))
+	} else {
+		msg[0] = 129
+		binary.BigEndian.PutUint16(msg[2:], transportChecksum(r.dst, r.src, p, msg))
+	}
+	return buildIPPackets(r.dst, r.src, p, msg, mtu)
+}
+
+// unreachable builds a destination unreachable message answering the
+// request.
+func (r *echoRequest) unreachable(code UnreachableCode) []byte {
+	hl := ipHeaderLen(r.dst)
+	pkt := make([]byte, hl+len(r.msg))
+	copy(pkt[hl:], r.msg)
+	writeIPHeader(pkt, r.src, r.dst, r.proto(), len(r.msg))
+	return buildICMPUnreachable(pkt, code)
+}
+
+// parseICMPEcho returns the echo request carried by an unfragmented IP
+// packet, IPv6 extension headers are not supported.
+func parseICMPEcho(pkt []byte) (*echoRequest, bool) {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return nil, false
+	}
+	r := &echoRequest{}
+	switch ipv {
+	case ipv4:
+		if len(pkt) < ipv4HeaderLen || proto(pkt[9]) != proto_icmp || moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0 {
+			return nil, false
+		}
+		hl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if hl < ipv4HeaderLen || total < hl || total > len(pkt) {
+			return nil, false
+		}
+		r.src = append(net.IP(nil), pkt[12:16]...)
+		r.dst = append(net.IP(nil), pkt[16:20]...)
+		r.msg = pkt[hl:total]
+	case ipv6:
+		if len(pkt) < ipv6HeaderLen || proto(pkt[6]) != proto_icmpv6 || hasIPv4Mapped(pkt) {
+			return nil, false
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if total > len(pkt) {
+			return nil, false
+		}
+		r.src = append(net.IP(nil), pkt[8:24]...)
+		r.dst = append(net.IP(nil), pkt[24:40]...)
+		r.msg = pkt[ipv6HeaderLen:total]
+	default:
+		return nil, false
+	}
+	if !isEchoRequest(r.proto(), r.msg) {
+		return nil, false
+	}
+	return r, true
+}
+
+func isEchoRequest(p proto, msg []byte) bool {
+	if len(msg) < 8 {
+		return false
+	}
+	if p == proto_icmp {
+		return msg[0] == 8
+	}
+	return msg[0] == 128
+}
+
+// answerEcho takes over an echo request if the stack has a responder, it
+// reports whether the request is taken over. Caller is required to hold the
+// stack lock, msg is copied.
+func (s *stackBase) answerEcho(src, dst net.IP, msg []byte) bool {
+	e := s.echo
+	if e == nil {
+		return false
+	}
+	r := &echoRequest{src: src, dst: dst, msg: append([]byte(nil), msg...)}
+	if e.mode == ICMPEchoProbe {
+		if h, ok := s.getTCPConnHandler().(TCPConnectHandler); ok {
+			s.probeEcho(h, r)
+			return true
+		}
+	}
+	if e.delay <= 0 {
+		s.sendEcho(r.reply(e.mtu), false)
+		return true
+	}
+	time.AfterFunc(e.delay, func() {
+		s.sendEcho(r.reply(e.mtu), true)
+	})
+	return true
+}
+
+// probeEcho answers r once h has connected to its destination, starting a
+// probe unless one is running for the destination.
+func (s *stackBase) probeEcho(h TCPConnectHandler, r *echoRequest) {
+	e := s.echo
+	key := r.dst.String()
+	e.mu.Lock()
+	waiting, running := e.probes[key]
+	e.probes[key] = append(waiting, r)
+	e.mu.Unlock()
+	if running {
+		return
+	}
+
+	target := &net.TCPAddr{IP: r.dst, Port: e.probePort}
+	go func() {
+		// The context is also done when the stack is closed.
+		ctx, meta := s.newMetadata(0, "tcp", &net.TCPAddr{IP: r.src}, target)
+		ctx, cancel := context.WithTimeout(ctx, echoProbeTimeout)
+		upstream, err := tcpConnectContextHandler(h).ConnectContext(ctx, meta)
+		cancel()
+		if upstream != nil {
+			upstream.Close()
+		}
+
+		e.mu.Lock()
+		rs := e.probes[key]
+		delete(e.probes, key)
+		e.mu.Unlock()
+
+		var pkts [][]byte
+		for _, r := range rs {
+			if err == nil {
+				pkts = append(pkts, r.reply(e.mtu)...)
+			} else if code, ok := unreachableCodeOf(err); ok {
+				if pkt := r.unreachable(code); pkt != nil {
+					pkts = append(pkts, pkt)
+				}
+			}
+		}
+		s.sendEcho(pkts, true)
+	}()
+}
+
+// sendEcho writes answers of echo requests with the output function, taking
+// the stack lock if lock is true. They are dropped if the stack is closed.
+func (s *stackBase) sendEcho(pkts [][]byte, lock bool) {
+	if lock {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.ctx.Err() != nil {
+		return
+	}
+	output := s.getOutputFn()
+	for _, pkt := range pkts {
+		output(pkt)
+	}
+}
@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -5,89 +7,75 @@ package core
 #include "lwip/pbuf.h"
 #include "lwip/tcp.h"
 
+// Inputs a packet to netif, doing the allocation in the same cgo call.
 err_t
-input(struct pbuf *p)
+input(struct netif *netif, void *data, u16_t len, u8_t copy)
 {
-	return (*netif_list).input(p, netif_list);
+	struct pbuf *p;
+	err_t err;
+
+	if (copy) {
+		// Allocating from PBUF_POOL results in a pbuf chain that may
+		// contain multiple pbufs.
+		p = pbuf_alloc(PBUF_RAW, len, PBUF_POOL);
+		if (p == NULL) {
+			return ERR_MEM;
+		}
+		pbuf_take(p, data, len);
+	} else {
+		p = pbuf_alloc_reference(data, len, PBUF_REF);
+		if (p == NULL) {
+			return ERR_MEM;
+		}
+	}
+
+	err = netif->input(p, netif);
+	if (err != ERR_OK) {
+		pbuf_free(p);
+	}
+	return err;
 }
 */
 import "C"
 import (
-	"encoding/binary"
 	"errors"
 	"unsafe"
 )
 
-type ipver byte
-
-const (
-	ipv4 ipver = 4
-	ipv6 ipver = 6
-)
-
-type proto byte
-
-const (
-	proto_icmp proto = 1
-	proto_tcp  proto = 6
-	proto_udp  proto = 17
-)
-
-func peekIPVer(p []byte) (ipver, error) {
-	if len(p) < 1 {
-		return 0, errors.New("short IP packet")
-	}
-	return ipver((p[0] & 0xf0) >> 4), nil
-}
-
-func moreFrags(ipv ipver, p []byte) bool {
-	switch ipv {
-	case ipv4:
-		if (p[6] & 0x20) > 0 /* has MF (More Fragments) bit set */ {
-			return true
-		}
-	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning true simply indicate do the copy anyway.
-		return true
-	}
-	return false
-}
+// inputPacket is the packet being inputted to lwIP, it's protected by
+// lwipMutex.
+var inputPacket []byte
 
-func fragOffset(ipv ipver, p []byte) uint16 {
-	switch ipv {
-	case ipv4:
-		return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
-	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning a value greater than 0 simply indicate do the
-		// copy anyway.
-		return 1
-	}
-	return 0
+func input(s *lwipStack, pkt []byte) (int, error) {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	defer checkTimers()
+	return inputLocked(s, pkt)
 }
 
-func peekNextProto(ipv ipver, p []byte) (proto, error) {
-	switch ipv {
-	case ipv4:
-		if len(p) < 9 {
-			return 0, errors.New("short IPv4 packet")
-		}
-		return proto(p[9]), nil
-	case ipv6:
-		if len(p) < 6 {
-			return 0, errors.New("short IPv6 packet")
+// inputBatch inputs packets in order under a single lock acquisition. It
+// stops at the first packet failed to input and returns the number of
+// packets inputted.
+func inputBatch(s *lwipStack, pkts [][]byte) (int, error) {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	defer checkTimers()
+	for i, pkt := range pkts {
+		if _, err := inputLocked(s, pkt); err != nil {
+			return i, err
 		}
-		return proto(p[6]), nil
-	default:
-		return 0, errors.New("unknown IP version")
 	}
+	return len(pkts), nil
 }
 
-func input(pkt []byte) (int, error) {
+// Caller is required to lock lwipMutex.
+func inputLocked(s *lwipStack, pkt []byte) (int, error) {
 	if len(pkt) == 0 {
 		return 0, nil
 	}
+	if len(pkt) > 0xffff {
+		return 0, errors.New("packet too large")
+	}
 
 	ipv, err := peekIPVer(pkt)
 	if err != nil {
@@ -98,29 +86,30 @@ func input(pkt []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if ipv == ipv6 && hasIPv4Mapped(pkt) {
+		return len(pkt), nil
+	}
 
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
-
-	var buf *C.struct_pbuf
+	if s.echo != nil && (nextProto == proto_icmp || nextProto == proto_icmpv6) {
+		if r, ok := parseICMPEcho(pkt); ok && s.answerEcho(r.src, r.dst, r.msg) {
+			return len(pkt), nil
+		}
+	}
 
-	if nextProto == proto_udp && !(moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0) {
-		// Copying data is not necessary for unfragmented UDP packets, and we would like to
-		// have all data in one pbuf.
-		buf = C.pbuf_alloc_reference(unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)), C.PBUF_REF)
-	} else {
-		// TODO Copy the data only when lwip need to keep it, e.g. in
-		// case we are returning ERR_CONN in tcpRecvFn.
-		//
-		// Allocating from PBUF_POOL results in a pbuf chain that may
-		// contain multiple pbufs.
-		buf = C.pbuf_alloc(C.PBUF_RAW, C.u16_t(len(pkt)), C.PBUF_POOL)
-		C.pbuf_take(buf, unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)))
+	// Copying data is not necessary for unfragmented UDP packets, and we
+	// would like to have all data in one pbuf.
+	//
+	// TODO Copy the data only when lwip need to keep it, e.g. in
+	// case we are returning ERR_CONN in tcpRecvFn.
+	var copyData C.u8_t = 1
+	if isUnfragmentedUDP(ipv, pkt) {
+		copyData = 0
 	}
 
-	ierr := C.input(buf)
+	inputPacket = pkt
+	ierr := C.input(s.netif, unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)), copyData)
+	inputPacket = nil
 	if ierr != C.ERR_OK {
-		C.pbuf_free(buf)
 		return 0, errors.New("packet not handled")
 	}
 	return len(pkt), nil
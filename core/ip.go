@@ -0,0 +1,169 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+type ipver byte
+
+const (
+	ipv4 ipver = 4
+	ipv6 ipver = 6
+)
+
+type proto byte
+
+const (
+	proto_icmp   proto = 1
+	proto_tcp    proto = 6
+	proto_udp    proto = 17
+	proto_icmpv6 proto = 58
+)
+
+func peekIPVer(p []byte) (ipver, error) {
+	if len(p) < 1 {
+		return 0, errors.New("short IP packet")
+	}
+	return ipver((p[0] & 0xf0) >> 4), nil
+}
+
+const (
+	ipv6HeaderLen     = 40
+	ipv6FragHeaderLen = 8
+)
+
+// IPv6 extension headers skipped when looking for the upper-layer protocol.
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DstOpts  = 60
+)
+
+// moreFrags and fragOffset are to be called on packets passed through
+// peekNextProto.
+func moreFrags(ipv ipver, p []byte) bool {
+	switch ipv {
+	case ipv4:
+		if (p[6] & 0x20) > 0 /* has MF (More Fragments) bit set */ {
+			return true
+		}
+	case ipv6:
+		if fh := ipv6FragHeader(p); fh != nil && fh[3]&0x01 > 0 /* M flag */ {
+			return true
+		}
+	}
+	return false
+}
+
+// fragOffset returns the fragment offset in 8-byte units.
+func fragOffset(ipv ipver, p []byte) uint16 {
+	switch ipv {
+	case ipv4:
+		return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
+	case ipv6:
+		if fh := ipv6FragHeader(p); fh != nil {
+			return binary.BigEndian.Uint16(fh[2:4]) >> 3
+		}
+	}
+	return 0
+}
+
+// ipv6FragHeader returns the Fragment extension header of an IPv6 packet,
+// or nil if there is none. Hop-by-Hop, Routing and Destination Options
+// headers may precede it.
+func ipv6FragHeader(p []byte) []byte {
+	if len(p) < ipv6HeaderLen {
+		return nil
+	}
+	next, b := p[6], p[ipv6HeaderLen:]
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DstOpts:
+			if len(b) < 8 {
+				return nil
+			}
+			hl := (int(b[1]) + 1) * 8
+			if hl > len(b) {
+				return nil
+			}
+			next, b = b[0], b[hl:]
+		case ipv6Fragment:
+			if len(b) < ipv6FragHeaderLen {
+				return nil
+			}
+			return b[:ipv6FragHeaderLen]
+		default:
+			return nil
+		}
+	}
+}
+
+// isUnfragmentedUDP reports whether p is a UDP packet which is not a
+// fragment, IPv6 extension headers are skipped. Others, including IPv6
+// packets with a Fragment header, are to be copied before input.
+func isUnfragmentedUDP(ipv ipver, p []byte) bool {
+	switch ipv {
+	case ipv4:
+		return proto(p[9]) == proto_udp && !moreFrags(ipv, p) && fragOffset(ipv, p) == 0
+	case ipv6:
+		next, _, ok := ipv6UpperLayer(p)
+		return ok && next == proto_udp
+	}
+	return false
+}
+
+// ipv6UpperLayer returns the upper-layer protocol and payload of an IPv6
+// packet, which is at least as long as the fixed header, skipping
+// Hop-by-Hop, Routing and Destination Options headers. It fails on
+// fragments and truncated headers.
+func ipv6UpperLayer(p []byte) (proto, []byte, bool) {
+	next, b := p[6], p[ipv6HeaderLen:]
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DstOpts:
+			if len(b) < 8 {
+				return 0, nil, false
+			}
+			hl := (int(b[1]) + 1) * 8
+			if hl > len(b) {
+				return 0, nil, false
+			}
+			next, b = b[0], b[hl:]
+		case ipv6Fragment:
+			return 0, nil, false
+		default:
+			return proto(next), b, true
+		}
+	}
+}
+
+// hasIPv4Mapped reports whether an IPv6 packet, which is at least as long
+// as the fixed header, has an IPv4-mapped source or destination. Such
+// packets are invalid on the wire, and replies to them would be built as
+// IPv4 ones, so they are dropped.
+func hasIPv4Mapped(p []byte) bool {
+	return net.IP(p[8:24]).To4() != nil || net.IP(p[24:40]).To4() != nil
+}
+
+// peekNextProto returns the protocol field of the IP header, packets
+// shorter than the fixed header are failed, so fields of the header are
+// safe to read afterwards.
+func peekNextProto(ipv ipver, p []byte) (proto, error) {
+	switch ipv {
+	case ipv4:
+		if len(p) < ipv4HeaderLen {
+			return 0, errors.New("short IPv4 packet")
+		}
+		return proto(p[9]), nil
+	case ipv6:
+		if len(p) < ipv6HeaderLen {
+			return 0, errors.New("short IPv6 packet")
+		}
+		return proto(p[6]), nil
+	default:
+		return 0, errors.New("unknown IP version")
+	}
+}
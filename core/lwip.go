@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -5,39 +7,109 @@ package core
 #include "lwip/tcp.h"
 #include "lwip/udp.h"
 #include "lwip/timeouts.h"
+#include "lwip/ip4_frag.h"
+#include "lwip/ip6_frag.h"
+#include "lwip/priv/tcp_priv.h"
+
+// Returns the time left before the next timeout is due, or
+// SYS_TIMEOUTS_SLEEPTIME_INFINITE if no timeouts are needed. Cyclic timers
+// other than the TCP one have nothing to do while no datagrams are being
+// reassembled, and the TCP one stops itself once there are no pcbs.
+static u32_t
+lwip_timers_sleeptime(void)
+{
+	if (tcp_active_pcbs == NULL && tcp_tw_pcbs == NULL && !ip_reass_pending() && !ip6_reass_pending()) {
+		return SYS_TIMEOUTS_SLEEPTIME_INFINITE;
+	}
+	return sys_timeouts_sleeptime();
+}
 */
 import "C"
 import (
-	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-const CHECK_TIMEOUTS_INTERVAL = 250 // in millisecond
-const TCP_POLL_INTERVAL = 8         // poll every 4 seconds
-
-type LWIPStack interface {
-	Write([]byte) (int, error)
-	Close() error
-	RestartTimeouts()
-}
+const TCP_POLL_INTERVAL = 8 // poll every 4 seconds
 
 // lwIP runs in a single thread, locking is needed in Go runtime.
+//
+// Note that lwIP keeps its pcb lists and timers in C globals, which are
+// shared by all stacks, so there is only one lock for all of them.
 var lwipMutex = &sync.Mutex{}
 
+// stacks holds all running stacks, keyed by stack ID.
+var stacks sync.Map
+
+var lastStackID uint32
+
+// The timer loop takes the system as having been suspended if the wall
+// clock runs ahead of the monotonic clock by more than this.
+const maxTimersLag = 5 * time.Second
+
+var (
+	// timersWakeup wakes up the timer loop, e.g. an input has armed a
+	// timeout earlier than the loop is sleeping until.
+	timersWakeup = make(chan struct{}, 1)
+
+	// timersDue is when the timer loop is going to wake up, zero if it's
+	// sleeping until woken up. It's protected by lwipMutex.
+	timersDue time.Time
+)
+
 type lwipStack struct {
-	tpcb *C.struct_tcp_pcb
-	upcb *C.struct_udp_pcb
+	// Accessed atomically, kept first to be 64-bit aligned on 32-bit
+	// platforms.
+	inputErrors uint64
+
+	id     uint32
+	keyArg unsafe.Pointer
+	netif  *C.struct_netif
+	tpcb   *C.struct_tcp_pcb
+	upcb   *C.struct_udp_pcb
 
-	ctx    context.Context
-	cancel context.CancelFunc
+	stackBase
+
+	tcpConns sync.Map
 }
 
-// NewLWIPStack listens for any incoming connections/packets and registers
-// corresponding accept/recv callback functions.
-func NewLWIPStack() LWIPStack {
+// Limits and defaults of StackOptions.
+const (
+	maxTCPMSS            = C.TCP_MSS
+	defaultTCPWindow     = C.TCP_WND
+	defaultTCPSendBuffer = C.TCP_SND_BUF
+
+	// The largest receive window can be announced with window scaling.
+	maxTCPWindow = 0xffff << C.TCP_RCV_SCALE
+)
+
+// NewLWIPStackWithOptions creates a network interface for the stack, listens
+// for any incoming connections/packets on it and registers corresponding
+// accept/recv callback functions.
+func NewLWIPStackWithOptions(opts StackOptions) (LWIPStack, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+
+	s := &lwipStack{
+		id:        atomic.AddUint32(&lastStackID, 1),
+		keyArg:    newConnKeyArg(),
+		stackBase: newStackBase(lwipMutex, &opts),
+	}
+	s.write = s.Write
+	setConnKeyVal(s.keyArg, s.id, 0)
+
+	s.netif = newNetif(s.keyArg, &opts)
+	if s.netif == nil {
+		panic("can not allocate netif")
+	}
+
 	tcpPCB := C.tcp_new()
 	if tcpPCB == nil {
 		panic("tcp_new return nil")
@@ -56,46 +128,121 @@ func NewLWIPStack() LWIPStack {
 		panic("unknown tcp_bind return value")
 	}
 
+	// Only accept connections comming from the netif of this stack.
+	C.tcp_bind_netif(tcpPCB, s.netif)
+
 	tcpPCB = C.tcp_listen_with_backlog(tcpPCB, C.TCP_DEFAULT_LISTEN_BACKLOG)
 	if tcpPCB == nil {
 		panic("can not allocate tcp pcb")
 	}
 
+	C.tcp_arg(tcpPCB, s.keyArg)
 	setTCPAcceptCallback(tcpPCB)
+	setTCPSynCallback(tcpPCB)
 
 	udpPCB := C.udp_new()
 	if udpPCB == nil {
 		panic("could not allocate udp pcb")
 	}
 
-	err = C.udp_bind(udpPCB, C.IP_ADDR_ANY, 0)
+	// Bound to any type, or datagrams to IPv6 clients are refused by
+	// udp_sendto.
+	err = C.udp_bind(udpPCB, C.IP_ANY_TYPE, 0)
 	if err != C.ERR_OK {
 		panic("address already in use")
 	}
 
-	setUDPRecvCallback(udpPCB, nil)
+	C.udp_bind_netif(udpPCB, s.netif)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	setUDPRecvCallback(udpPCB, s.keyArg)
 
-	go func() {
-		for {
-			select {
-			case <-time.After(CHECK_TIMEOUTS_INTERVAL * time.Millisecond):
-				lwipMutex.Lock()
-				C.sys_check_timeouts()
-				lwipMutex.Unlock()
-			case <-ctx.Done():
-				return
+	s.tpcb = tcpPCB
+	s.upcb = udpPCB
+
+	stacks.Store(s.id, s)
+
+	return s, nil
+}
+
+// timersSleepTime returns how long until the next lwIP timeout is due, or
+// a negative value if there are no timeouts needed. Caller is required to
+// lock lwipMutex.
+func timersSleepTime() time.Duration {
+	ms := C.lwip_timers_sleeptime()
+	if ms == C.SYS_TIMEOUTS_SLEEPTIME_INFINITE {
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// checkTimers wakes up the timer loop if a timeout is due earlier than the
+// loop is going to wake up. Caller is required to lock lwipMutex.
+func checkTimers() {
+	sleep := timersSleepTime()
+	if sleep < 0 {
+		return
+	}
+	if timersDue.IsZero() || time.Now().Add(sleep).Before(timersDue) {
+		select {
+		case timersWakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runTimers calls lwIP timeout handlers when they are due. lwIP timers are
+// shared by all stacks, so there is only one loop for all of them.
+//
+// The loop sleeps until the next timeout, or until woken up by an input if
+// no timeouts are needed, so it doesn't wake up the system while idle.
+func runTimers() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	restart := false
+
+	for {
+		lwipMutex.Lock()
+		if restart {
+			C.sys_restart_timeouts()
+		}
+		C.sys_check_timeouts()
+		sleep := timersSleepTime()
+		start := time.Now()
+		if sleep >= 0 {
+			timersDue = start.Add(sleep)
+			timer.Reset(sleep)
+		} else {
+			timersDue = time.Time{}
+		}
+		lwipMutex.Unlock()
+
+		select {
+		case <-timer.C:
+		case <-timersWakeup:
+			if !timer.Stop() && sleep >= 0 {
+				<-timer.C
 			}
 		}
-	}()
 
-	return &lwipStack{
-		tpcb:   tcpPCB,
-		upcb:   udpPCB,
-		ctx:    ctx,
-		cancel: cancel,
+		// The monotonic clock doesn't advance while the system is
+		// suspended, but the wall clock lwIP timeouts are based on does.
+		// Rebase timeouts after a suspend, instead of firing all of them
+		// at once.
+		lag := time.Now().Round(0).Sub(start.Round(0)) - time.Since(start)
+		restart = sleep >= 0 && lag > maxTimersLag
+	}
+}
+
+// lookupStack finds the stack identified by a key arg.
+func lookupStack(arg unsafe.Pointer) (*lwipStack, bool) {
+	if arg == nil {
+		return nil, false
+	}
+	s, ok := stacks.Load(getConnKeyStack(arg))
+	if !ok {
+		return nil, false
 	}
+	return s.(*lwipStack), true
 }
 
 // Write writes IP packets to the stack.
@@ -104,15 +251,71 @@ func (s *lwipStack) Write(data []byte) (int, error) {
 	case <-s.ctx.Done():
 		return 0, errors.New("stack closed")
 	default:
-		return input(data)
+		n, err := input(s, data)
+		if err != nil {
+			atomic.AddUint64(&s.inputErrors, 1)
+		}
+		return n, err
 	}
 }
 
+// WriteBatch writes IP packets to the stack.
+func (s *lwipStack) WriteBatch(pkts [][]byte) (int, error) {
+	select {
+	case <-s.ctx.Done():
+		return 0, errors.New("stack closed")
+	default:
+		n, err := inputBatch(s, pkts)
+		if err != nil {
+			atomic.AddUint64(&s.inputErrors, 1)
+		}
+		return n, err
+	}
+}
+
+// ListConnections returns infos of the TCP and UDP connections, ordered by
+// ID.
+func (s *lwipStack) ListConnections() []ConnInfo {
+	var infos []ConnInfo
+	now := time.Now()
+	lwipMutex.Lock()
+	s.tcpConns.Range(func(_, c interface{}) bool {
+		infos = append(infos, c.(*tcpConn).info(now))
+		return true
+	})
+	lwipMutex.Unlock()
+	infos = s.udpConnInfos(infos)
+	sortConnInfos(infos)
+	return infos
+}
+
+// CloseConnection aborts the TCP connection with the ID, the local client
+// receives RST, or closes the UDP connection with the ID.
+func (s *lwipStack) CloseConnection(id uint64) error {
+	var found *tcpConn
+	s.tcpConns.Range(func(_, c interface{}) bool {
+		if c.(*tcpConn).connID == id {
+			found = c.(*tcpConn)
+			return false
+		}
+		return true
+	})
+	if found != nil {
+		found.Abort()
+		return nil
+	}
+	if s.closeUDPConn(id) {
+		return nil
+	}
+	return ErrConnNotFound
+}
+
 // RestartTimeouts rebases the timeout times to the current time.
 //
 // This is necessary if sys_check_timeouts() hasn't been called for a long
 // time (e.g. while saving energy) to prevent all timer functions of that
-// period being called.
+// period being called. It's done automatically after the system wakes up
+// from suspend, there is no need to call it anymore.
 func (s *lwipStack) RestartTimeouts() {
 	lwipMutex.Lock()
 	C.sys_restart_timeouts()
@@ -121,23 +324,22 @@ func (s *lwipStack) RestartTimeouts() {
 
 // Close closes the stack.
 //
-// Timer events will be canceled and existing connections will be closed.
-// Note this function will not free objects allocated in lwIP initialization
-// stage, e.g. the loop interface.
+// Further inputs will be rejected and existing connections will be closed,
+// the network interface of the stack will be removed. Note this function
+// will not free objects allocated in lwIP initialization stage, e.g. the
+// loop interface.
 func (s *lwipStack) Close() error {
-	// Stop firing timer events.
+	// Reject further inputs.
 	s.cancel()
 
 	// Abort and close all TCP and UDP connections.
-	tcpConns.Range(func(_, c interface{}) bool {
+	s.tcpConns.Range(func(_, c interface{}) bool {
 		c.(*tcpConn).Abort()
 		return true
 	})
-	udpConns.Range(func(_, c interface{}) bool {
-		// This only closes UDP connections in the core,
-		// UDP connections in the handler will wait till
-		// timeout, they are not closed immediately for
-		// now.
+	s.udpConns.Range(func(_, c interface{}) bool {
+		// Handlers implementing UDPConnCloseHandler are
+		// notified to close their UDP connections.
 		c.(*udpConn).Close()
 		return true
 	})
@@ -148,6 +350,10 @@ func (s *lwipStack) Close() error {
 	C.udp_recv(s.upcb, nil, nil)
 	C.tcp_close(s.tpcb) // FIXME handle error
 	C.udp_remove(s.upcb)
+	s.closePendingConns()
+	freeNetif(s.netif)
+	stacks.Delete(s.id)
+	freeConnKeyArg(s.keyArg)
 	lwipMutex.Unlock()
 
 	return nil
@@ -156,15 +362,11 @@ func (s *lwipStack) Close() error {
 func init() {
 	// Initialize lwIP.
 	//
-	// There is a little trick here, a loop interface (127.0.0.1)
-	// is created in the initialization stage due to the option
-	// `#define LWIP_HAVE_LOOPIF 1` in `lwipopts.h`, so we need
-	// not create our own interface.
-	//
-	// Now the loop interface is just the first element in
-	// `C.netif_list`, i.e. `*C.netif_list`.
+	// A loop interface (127.0.0.1) is created in the initialization
+	// stage due to the option `#define LWIP_HAVE_LOOPIF 1` in
+	// `lwipopts.h`, it's not used by stacks, each stack creates its
+	// own interface.
 	lwipInit()
 
-	// Set MTU.
-	C.netif_list.mtu = 1500
+	go runTimers()
 }
@@ -1,4 +1,5 @@
 // +build linux darwin
+// +build !gostack
 
 package core
 
@@ -0,0 +1,81 @@
+// +build !gostack
+
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/stats.h"
+#include "lwip/memp.h"
+
+static const char *memp_names[] = {
+#define LWIP_MEMPOOL(name,num,size,desc) #name,
+#include "lwip/priv/memp_std.h"
+};
+
+static const char *
+memp_name(int i)
+{
+	return memp_names[i];
+}
+*/
+import "C"
+import (
+	"sync/atomic"
+)
+
+func protoStats(p *C.struct_stats_proto) ProtoStats {
+	return ProtoStats{
+		Sent:           uint64(p.xmit),
+		Received:       uint64(p.recv),
+		Forwarded:      uint64(p.fw),
+		Dropped:        uint64(p.drop),
+		ChecksumErrors: uint64(p.chkerr),
+		LengthErrors:   uint64(p.lenerr),
+		MemoryErrors:   uint64(p.memerr),
+		RoutingErrors:  uint64(p.rterr),
+		ProtocolErrors: uint64(p.proterr),
+		OptionErrors:   uint64(p.opterr),
+		Errors:         uint64(p.err),
+	}
+}
+
+// lwipStats copies the counters of lwIP. Caller is required to lock
+// lwipMutex.
+func lwipStats() Stats {
+	st := Stats{
+		IP:             protoStats(&C.lwip_stats.ip),
+		IPFrag:         protoStats(&C.lwip_stats.ip_frag),
+		ICMP:           protoStats(&C.lwip_stats.icmp),
+		IPv6:           protoStats(&C.lwip_stats.ip6),
+		IPv6Frag:       protoStats(&C.lwip_stats.ip6_frag),
+		ICMPv6:         protoStats(&C.lwip_stats.icmp6),
+		TCP:            protoStats(&C.lwip_stats.tcp),
+		UDP:            protoStats(&C.lwip_stats.udp),
+		TCPRetransmits: uint64(C.lwip_stats.mib2.tcpretranssegs),
+		Pools:          make(map[string]PoolStats, C.MEMP_MAX),
+	}
+	for i := 0; i < C.MEMP_MAX; i++ {
+		m := C.lwip_stats.memp[i]
+		st.Pools[C.GoString(C.memp_name(C.int(i)))] = PoolStats{
+			Used:   uint64(m.used),
+			Max:    uint64(m.max),
+			Errors: uint64(m.err),
+		}
+	}
+	return st
+}
+
+// Stats returns a snapshot of the stack statistics, protocol and pool stats
+// are shared by all lwIP stacks.
+func (s *lwipStack) Stats() Stats {
+	lwipMutex.Lock()
+	st := lwipStats()
+	lwipMutex.Unlock()
+
+	st.InputErrors = atomic.LoadUint64(&s.inputErrors)
+	st.TCPConnsRejected = s.tcpAdmission.rejections()
+	st.UDPConnsRejected = s.udpAdmission.rejections()
+	st.TCPConns = countSyncMap(&s.tcpConns)
+	st.UDPConns = countSyncMap(&s.udpConns)
+	return st
+}
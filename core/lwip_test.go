@@ -0,0 +1,71 @@
+// +build cgo,!gostack
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A blocked read should be interrupted by the read deadline.
+func TestTCPReadDeadline(t *testing.T) {
+	const psh, ack = 0x08, 0x10
+
+	s := NewLWIPStack()
+	defer s.Close()
+	out := make(chan []byte, 64)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+	conn, seq, rcvNxt := acceptTCP(s, out, t)
+	buf := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	write(s, tcpPacket(psh|ack, seq, rcvNxt, []byte{1}), t)
+	if n, err := conn.Read(buf); n != 1 || err != nil {
+		t.Fatalf("Read failed after clearing the deadline: %v", err)
+	}
+	conn.Close()
+}
+
+// lwIP timers should fire without further inputs, e.g. to retransmit the
+// SYN-ACK not acknowledged.
+func TestTimersWithoutInput(t *testing.T) {
+	s := NewLWIPStack()
+	defer s.Close()
+	out := make(chan []byte, 8)
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		out <- append([]byte(nil), b...)
+		return len(b), nil
+	})
+
+	write(s, decode(synHex), t)
+	<-out
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SYN-ACK not retransmitted")
+	}
+}
+
+// Pool usage should reveal pcbs held by connections.
+func TestStatsPools(t *testing.T) {
+	s := NewLWIPStack()
+	s.RegisterOutputFn(func(b []byte) (int, error) {
+		return len(b), nil
+	})
+	before := s.Stats().Pools["TCP_PCB"].Used
+	write(s, decode(synHex), t)
+	if used := s.Stats().Pools["TCP_PCB"].Used; used != before+1 {
+		t.Errorf("Expected %v TCP pcbs used, got %v", before+1, used)
+	}
+	s.Close()
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// Metadata describes a connection handed over to handlers, see
+// TCPConnContextHandler and UDPConnContextHandler.
+type Metadata struct {
+	// ID identifies the connection, it's unique in the process. It's zero
+	// until the connection is accepted, see TCPConnectContextHandler.
+	ID uint64
+
+	// Network is "tcp" or "udp".
+	Network string
+
+	// Source is the address of the local client, Destination is the target
+	// address, it may be nil for UDP connections.
+	Source      net.Addr
+	Destination net.Addr
+
+	// Domain is the domain name Destination has been resolved from, e.g.
+	// by fake DNS, it's empty if unknown.
+	Domain string
+
+	// Process is the name of the process owning the connection, followed
+	// by names of its ancestors, it's nil if unknown.
+	Process []string
+
+	// UID is the user ID of the owning process, -1 if unknown.
+	UID int
+
+	// Inbound is the name of the TUN device the connection comes from, see
+	// StackOptions.Name.
+	Inbound string
+}
+
+// MetadataResolver fills in fields of metadata which are not known by the
+// stack, e.g. Domain, Process and UID. Resolvers are called in registration
+// order before the connection is handed over to the handler, they may block
+// but delay the connection meanwhile. See LWIPStack.RegisterMetadataResolver.
+type MetadataResolver func(meta *Metadata)
+
+var lastConnID uint64
+
+// newConnID returns the ID of a new connection.
+func newConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+type metadataKey struct{}
+
+// MetadataFromContext returns the metadata of the connection the context is
+// passed to handlers for, or nil.
+func MetadataFromContext(ctx context.Context) *Metadata {
+	meta, _ := ctx.Value(metadataKey{}).(*Metadata)
+	return meta
+}
+
+// newMetadata resolves the metadata of a new connection and returns it with
+// a context carrying it, the context is done when the stack is closed. It
+// runs resolvers, so never call it with the stack lock held.
+func (s *stackBase) newMetadata(id uint64, network string, src, dst net.Addr) (context.Context, *Metadata) {
+	meta := &Metadata{
+		ID:          id,
+		Network:     network,
+		Source:      src,
+		Destination: dst,
+		UID:         -1,
+		Inbound:     s.name,
+	}
+	s.mu.Lock()
+	rs := s.resolvers
+	s.mu.Unlock()
+	for _, r := range rs {
+		r(meta)
+	}
+	return context.WithValue(s.ctx, metadataKey{}, meta), meta
+}
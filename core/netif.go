@@ -0,0 +1,93 @@
+// +build !gostack
+
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/netif.h"
+#include "lwip/ip.h"
+#include "lwip/priv/tcp_priv.h"
+#include <stdlib.h>
+
+extern err_t output_ip4(struct netif *netif, struct pbuf *p, const ip4_addr_t *ipaddr);
+extern err_t output_ip6(struct netif *netif, struct pbuf *p, const ip6_addr_t *ipaddr);
+
+static err_t
+tun_netif_init(struct netif *netif)
+{
+	netif->name[0] = 't';
+	netif->name[1] = 'n';
+	netif->output = output_ip4;
+	netif->output_ip6 = output_ip6;
+	return ERR_OK;
+}
+
+struct netif*
+new_tun_netif(void *state, u16_t mtu, u16_t tcp_mss, u32_t tcp_wnd, u32_t tcp_snd_buf)
+{
+	struct netif *netif = calloc(1, sizeof(struct netif));
+	if (netif == NULL) {
+		return NULL;
+	}
+	if (netif_add_noaddr(netif, state, tun_netif_init, ip_input) == NULL) {
+		free(netif);
+		return NULL;
+	}
+	netif->mtu = mtu;
+#if LWIP_ND6_ALLOW_RA_UPDATES
+	netif->mtu6 = mtu;
+#endif
+	netif->tcp_mss = tcp_mss;
+	netif->tcp_wnd = tcp_wnd;
+	netif->tcp_snd_buf = tcp_snd_buf;
+	netif_set_link_up(netif);
+	netif_set_up(netif);
+	return netif;
+}
+
+void
+free_tun_netif(struct netif *netif)
+{
+	// Abort pcbs left behind on the interface, e.g. connections not yet
+	// accepted, otherwise they may be routed to an interface reusing the
+	// same index.
+	u8_t idx = netif_get_index(netif);
+	struct tcp_pcb *pcb = tcp_active_pcbs;
+	while (pcb != NULL) {
+		struct tcp_pcb *next = pcb->next;
+		if (pcb->netif_idx == idx) {
+			tcp_abort(pcb);
+		}
+		pcb = next;
+	}
+	netif_remove(netif);
+	free(netif);
+}
+*/
+import "C"
+import (
+	"unsafe"
+)
+
+// newNetif creates and brings up a network interface for a stack, state
+// is a key arg identifying the stack, outputs from this interface will be
+// delivered to the output function of that stack. TCP connections accepted
+// on the interface take the TCP settings in opts.
+//
+// Since all packets are accepted by whatever interface they are inputted
+// to, the interface need not to be configured with any address. Caller is
+// required to lock lwipMutex.
+func newNetif(state unsafe.Pointer, opts *StackOptions) *C.struct_netif {
+	return C.new_tun_netif(
+		state,
+		C.u16_t(opts.MTU),
+		C.u16_t(opts.TCPMSS),
+		C.u32_t(opts.TCPWindow),
+		C.u32_t(opts.TCPSendBuffer),
+	)
+}
+
+// Caller is required to lock lwipMutex.
+func freeNetif(netif *C.struct_netif) {
+	C.free_tun_netif(netif)
+}
@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -10,18 +12,23 @@ import (
 )
 
 //export output
-func output(p *C.struct_pbuf) C.err_t {
+func output(netif *C.struct_netif, p *C.struct_pbuf) C.err_t {
+	outputFn := OutputFn
+	if s, ok := lookupStack(netif.state); ok {
+		outputFn = s.getOutputFn()
+	}
+
 	// In most case, all data are in the same pbuf struct, data copying can be avoid by
 	// backing Go slice with C array. Buf if there are multiple pbuf structs holding the
 	// data, we must copy data for sending them in one pass.
 	totlen := int(p.tot_len)
 	if p.tot_len == p.len {
 		buf := (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
-		OutputFn(buf[:totlen])
+		outputFn(buf[:totlen])
 	} else {
 		buf := NewBytes(totlen)
 		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0) // data copy here!
-		OutputFn(buf[:totlen])
+		outputFn(buf[:totlen])
 		FreeBytes(buf)
 	}
 	return C.ERR_OK
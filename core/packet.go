@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+
+	defaultTTL      = 64
+	defaultHopLimit = 255
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+func ipHeaderLen(ip net.IP) int {
+	if ip.To4() != nil {
+		return ipv4HeaderLen
+	}
+	return ipv6HeaderLen
+}
+
+var lastIPID uint32
+
+// writeIPHeader writes the IP header at the beginning of pkt, which has
+// room for the header and n bytes of payload.
+func writeIPHeader(pkt []byte, src, dst net.IP, p proto, n int) {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		writeIPv4Header(pkt, src4, dst4, p, n, uint16(atomic.AddUint32(&lastIPID, 1)), 0)
+		return
+	}
+	writeIPv6Header(pkt, src, dst, byte(p), n)
+}
+
+func writeIPv4Header(pkt []byte, src, dst net.IP, p proto, n int, id uint16, frag uint16) {
+	pkt[0] = 0x45
+	pkt[1] = 0
+	binary.BigEndian.PutUint16(pkt[2:], uint16(ipv4HeaderLen+n))
+	binary.BigEndian.PutUint16(pkt[4:], id)
+	binary.BigEndian.PutUint16(pkt[6:], frag)
+	pkt[8] = defaultTTL
+	pkt[9] = byte(p)
+	pkt[10], pkt[11] = 0, 0
+	copy(pkt[12:16], src)
+	copy(pkt[16:20], dst)
+	binary.BigEndian.PutUint16(pkt[10:], ^checksum(0, pkt[:ipv4HeaderLen]))
+}
+
+func writeIPv6Header(pkt []byte, src, dst net.IP, next byte, n int) {
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x60, 0, 0, 0
+	binary.BigEndian.PutUint16(pkt[4:], uint16(n))
+	pkt[6] = next
+	pkt[7] = defaultHopLimit
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+}
+
+// buildIPPackets wraps payload in IP packets not larger than mtu, payload is
+// fragmented if necessary.
+func buildIPPackets(src, dst net.IP, p proto, payload []byte, mtu int) [][]byte {
+	hl := ipHeaderLen(dst)
+	if hl+len(payload) <= mtu {
+		pkt := make([]byte, hl+len(payload))
+		copy(pkt[hl:], payload)
+		writeIPHeader(pkt, src, dst, p, len(payload))
+		return [][]byte{pkt}
+	}
+
+	id := atomic.AddUint32(&lastIPID, 1)
+	if hl == ipv6HeaderLen {
+		hl += ipv6FragHeaderLen
+	}
+	chunk := (mtu - hl) &^ 7
+	var pkts [][]byte
+	for off := 0; off < len(payload); off += chunk {
+		end := off + chunk
+		more := uint16(1)
+		if end >= len(payload) {
+			end = len(payload)
+			more = 0
+		}
+		pkt := make([]byte, hl+end-off)
+		copy(pkt[hl:], payload[off:end])
+		if hl == ipv4HeaderLen {
+			writeIPv4Header(pkt, src.To4(), dst.To4(), p, end-off, uint16(id), more<<13|uint16(off/8))
+		} else {
+			writeIPv6Header(pkt, src, dst, ipv6Fragment, ipv6FragHeaderLen+end-off)
+			fh := pkt[ipv6HeaderLen:]
+			fh[0], fh[1] = byte(p), 0
+			binary.BigEndian.PutUint16(fh[2:], uint16(off)|more)
+			binary.BigEndian.PutUint32(fh[4:], id)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts
+}
+
+// checksum adds b to the one's complement sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// transportChecksum computes the checksum of a TCP, UDP or ICMPv6 segment
+// with the pseudo header, the checksum field of seg must be zeroed.
+func transportChecksum(src, dst net.IP, p proto, seg []byte) uint16 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum += uint32(checksum(0, src4)) + uint32(checksum(0, dst4))
+	} else {
+		sum += uint32(checksum(0, src.To16())) + uint32(checksum(0, dst.To16()))
+	}
+	sum += uint32(p) + uint32(len(seg))
+	return ^checksum(sum, seg)
+}
+
+// buildUDPPacket builds an unfragmented UDP packet, it's used to quote
+// packets which are not kept in ICMP messages.
+func buildUDPPacket(src, dst *net.UDPAddr, data []byte) []byte {
+	srcIP, dstIP := src.IP, dst.IP
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		srcIP, dstIP = src4, dst4
+	}
+	hl := ipHeaderLen(dstIP)
+	n := udpHeaderLen + len(data)
+	if hl+n > 0xffff {
+		n = 0xffff - hl
+	}
+	pkt := make([]byte, hl+n)
+	seg := pkt[hl:]
+	binary.BigEndian.PutUint16(seg[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(seg[4:], uint16(n))
+	copy(seg[udpHeaderLen:], data)
+	binary.BigEndian.PutUint16(seg[6:], transportChecksum(srcIP, dstIP, proto_udp, seg))
+	writeIPHeader(pkt, srcIP, dstIP, proto_udp, n)
+	return pkt
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LWIPStack is a TCP/IP stack processing IP packets comming from TUN.
+//
+// Two backends implement it, lwIP by default, or a pure Go one if built
+// with the `gostack` tag or without cgo, stacks of both backends behave
+// the same to handlers.
+type LWIPStack interface {
+	Write([]byte) (int, error)
+
+	// WriteBatch writes IP packets to the stack under a single lock
+	// acquisition, see BatchWriter.
+	WriteBatch(pkts [][]byte) (int, error)
+
+	Close() error
+	RestartTimeouts()
+
+	// RegisterTCPConnHandler registers a TCP connection handler for this
+	// stack, it takes precedence over the default one.
+	RegisterTCPConnHandler(h TCPConnHandler)
+
+	// RegisterUDPConnHandler registers a UDP connection handler for this
+	// stack, it takes precedence over the default one.
+	RegisterUDPConnHandler(h UDPConnHandler)
+
+	// RegisterOutputFn registers an output function for this stack, it
+	// takes precedence over the default one.
+	RegisterOutputFn(fn func([]byte) (int, error))
+
+	// RegisterMetadataResolver registers a resolver for connections of
+	// this stack, see MetadataResolver.
+	RegisterMetadataResolver(r MetadataResolver)
+
+	// RegisterTCPConnWrapper registers a wrapper for TCP connections of
+	// this stack, wrappers are applied in the order registered.
+	RegisterTCPConnWrapper(w TCPConnWrapper)
+
+	// SetUDPSessionMode sets how UDP packets are mapped to UDPConns, and
+	// whether UDPConns accept packets from any remote address (endpoint-
+	// independent filtering) or only from remote addresses the local client
+	// has sent packets to. It only affects UDPConns created afterwards.
+	SetUDPSessionMode(mode UDPSessionMode, endpointIndependentFiltering bool)
+
+	// SetUDPTimeout sets the idle timeout of UDP connections, a connection
+	// is closed if no data is sent or received for that long, a zero value
+	// disables the timeout. It only affects UDPConns created afterwards.
+	SetUDPTimeout(timeout time.Duration)
+
+	// Stats returns a snapshot of the stack statistics.
+	Stats() Stats
+
+	// ListConnections returns infos of the TCP and UDP connections,
+	// ordered by ID.
+	ListConnections() []ConnInfo
+
+	// CloseConnection aborts the TCP connection with the ID, the local
+	// client receives RST, or closes the UDP connection with the ID. It
+	// returns ErrConnNotFound if there is no such connection.
+	CloseConnection(id uint64) error
+}
+
+const defaultMTU = 1500
+
+// StackOptions configures the network interface and TCP connections of a
+// stack, zero values take the defaults.
+type StackOptions struct {
+	// MTU is the MTU of the network interface, it should be the same as
+	// the MTU of the TUN device. Defaults to 1500.
+	MTU int
+
+	// TCPMSS caps the maximum segment size of TCP connections, the MSS is
+	// derived from MTU by default. It can not be larger than the limit of
+	// the backend, the compile-time TCP_MSS for lwIP.
+	TCPMSS int
+
+	// TCPWindow is the receive window of TCP connections in bytes, windows
+	// larger than 65535 bytes take effect only if the client agrees on
+	// window scaling. Defaults to the compile-time TCP_WND for lwIP.
+	TCPWindow int
+
+	// TCPSendBuffer is the send buffer size of TCP connections in bytes.
+	// Defaults to the compile-time TCP_SND_BUF for lwIP.
+	TCPSendBuffer int
+
+	// Name is the name of the TUN device, it's passed to handlers as
+	// Metadata.Inbound.
+	Name string
+
+	// MaxTCPConns and MaxUDPConns limit the number of concurrent TCP
+	// connections and UDP sessions, MaxTCPConnsPerSource and
+	// MaxUDPConnsPerSource limit them per source IP, zero values mean no
+	// limit. SYNs over the limits are answered with RST, packets of new
+	// UDP sessions over the limits are dropped. Connections connected
+	// before accepted count from their SYNs, see ConnectBeforeAccept.
+	MaxTCPConns          int
+	MaxTCPConnsPerSource int
+	MaxUDPConns          int
+	MaxUDPConnsPerSource int
+
+	// ConnectBeforeAccept holds SYNs of new TCP connections until the
+	// handler has connected to the target, so that clients see failed
+	// connections refused rather than accepted and then reset. It takes
+	// effect with handlers implementing TCPConnectHandler.
+	ConnectBeforeAccept bool
+
+	// ICMPEcho selects how echo requests are answered, ICMPEchoDelay is
+	// the synthetic round-trip time of ICMPEchoDelay mode, ICMPProbePort
+	// is the port connected to in ICMPEchoProbe mode, it defaults to 443.
+	ICMPEcho      ICMPEchoMode
+	ICMPEchoDelay time.Duration
+	ICMPProbePort int
+}
+
+// normalize fills in the defaults and validates the options.
+func (o *StackOptions) normalize() error {
+	if o.MTU == 0 {
+		o.MTU = defaultMTU
+	}
+	if o.MTU < 576 || o.MTU > 0xffff {
+		return fmt.Errorf("invalid MTU %v", o.MTU)
+	}
+	if o.MaxTCPConns < 0 || o.MaxTCPConnsPerSource < 0 || o.MaxUDPConns < 0 || o.MaxUDPConnsPerSource < 0 {
+		return errors.New("invalid connection limits, must not be negative")
+	}
+	if o.ICMPEcho < ICMPEchoDefault || o.ICMPEcho > ICMPEchoProbe {
+		return fmt.Errorf("invalid ICMP echo mode %v", o.ICMPEcho)
+	}
+	if o.ICMPEchoDelay < 0 {
+		return fmt.Errorf("invalid ICMP echo delay %v", o.ICMPEchoDelay)
+	}
+	if o.ICMPProbePort == 0 {
+		o.ICMPProbePort = defaultICMPProbePort
+	}
+	if o.ICMPProbePort < 0 || o.ICMPProbePort > 0xffff {
+		return fmt.Errorf("invalid ICMP probe port %v", o.ICMPProbePort)
+	}
+	if o.TCPMSS < 0 || o.TCPMSS > maxTCPMSS {
+		return fmt.Errorf("invalid TCP MSS %v, must not exceed %v", o.TCPMSS, maxTCPMSS)
+	}
+
+	// The largest MSS a connection may end up with, the IPv4 one.
+	mss := o.MTU - 40
+	if mss > maxTCPMSS {
+		mss = maxTCPMSS
+	}
+	if o.TCPMSS != 0 && o.TCPMSS < mss {
+		mss = o.TCPMSS
+	}
+
+	if o.TCPWindow == 0 {
+		o.TCPWindow = defaultTCPWindow
+	}
+	if o.TCPWindow < mss || o.TCPWindow > maxTCPWindow {
+		return fmt.Errorf("invalid TCP window %v, must be between MSS (%v) and %v", o.TCPWindow, mss, maxTCPWindow)
+	}
+	if o.TCPSendBuffer == 0 {
+		o.TCPSendBuffer = defaultTCPSendBuffer
+	}
+	if o.TCPSendBuffer < 2*mss || o.TCPSendBuffer > maxTCPWindow {
+		return fmt.Errorf("invalid TCP send buffer %v, must be between 2 * MSS (%v) and %v", o.TCPSendBuffer, 2*mss, maxTCPWindow)
+	}
+	return nil
+}
+
+// NewLWIPStack creates a stack with default options, see
+// NewLWIPStackWithOptions.
+func NewLWIPStack() LWIPStack {
+	s, err := NewLWIPStackWithOptions(StackOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// stackBase holds the handlers and settings shared by stacks of both
+// backends.
+type stackBase struct {
+	mu *sync.Mutex // The stack lock, lwipMutex for lwIP stacks
+
+	// Done when the stack is closed, the parent of contexts passed to
+	// handlers.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	name string // StackOptions.Name
+
+	tcpAdmission *admission
+	udpAdmission *admission
+
+	echo *echoResponder
+
+	udpConns sync.Map
+
+	tcpHandler TCPConnHandler
+	udpHandler UDPConnHandler
+	output     func([]byte) (int, error)
+	resolvers  []MetadataResolver
+	wrappers   []TCPConnWrapper
+
+	udpMode    UDPSessionMode
+	udpEIF     bool
+	udpTimeout time.Duration
+
+	// Connect-before-accept, see holdSYN.
+	connectBeforeAccept bool
+	pendingConns        map[tcpConnID]*pendingTCPConn
+	write               func([]byte) (int, error) // Write of the stack
+}
+
+func newStackBase(mu *sync.Mutex, opts *StackOptions) stackBase {
+	ctx, cancel := context.WithCancel(context.Background())
+	return stackBase{
+		mu:                  mu,
+		ctx:                 ctx,
+		cancel:              cancel,
+		name:                opts.Name,
+		tcpAdmission:        newAdmission(opts.MaxTCPConns, opts.MaxTCPConnsPerSource),
+		udpAdmission:        newAdmission(opts.MaxUDPConns, opts.MaxUDPConnsPerSource),
+		echo:                newEchoResponder(opts),
+		udpEIF:              true,
+		connectBeforeAccept: opts.ConnectBeforeAccept,
+		pendingConns:        make(map[tcpConnID]*pendingTCPConn),
+	}
+}
+
+func (s *stackBase) RegisterTCPConnHandler(h TCPConnHandler) {
+	s.mu.Lock()
+	s.tcpHandler = h
+	s.mu.Unlock()
+}
+
+func (s *stackBase) RegisterUDPConnHandler(h UDPConnHandler) {
+	s.mu.Lock()
+	s.udpHandler = h
+	s.mu.Unlock()
+}
+
+func (s *stackBase) RegisterOutputFn(fn func([]byte) (int, error)) {
+	s.mu.Lock()
+	s.output = fn
+	s.mu.Unlock()
+}
+
+func (s *stackBase) RegisterMetadataResolver(r MetadataResolver) {
+	s.mu.Lock()
+	s.resolvers = append(s.resolvers, r)
+	s.mu.Unlock()
+}
+
+func (s *stackBase) RegisterTCPConnWrapper(w TCPConnWrapper) {
+	s.mu.Lock()
+	s.wrappers = append(s.wrappers, w)
+	s.mu.Unlock()
+}
+
+func (s *stackBase) SetUDPSessionMode(mode UDPSessionMode, endpointIndependentFiltering bool) {
+	s.mu.Lock()
+	s.udpMode = mode
+	s.udpEIF = endpointIndependentFiltering
+	s.mu.Unlock()
+}
+
+func (s *stackBase) SetUDPTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	s.udpTimeout = timeout
+	s.mu.Unlock()
+}
+
+// Never call these functions without holding the stack lock.
+
+func (s *stackBase) getTCPConnHandler() TCPConnHandler {
+	if s.tcpHandler != nil {
+		return s.tcpHandler
+	}
+	return tcpConnHandler
+}
+
+func (s *stackBase) getUDPConnHandler() UDPConnHandler {
+	if s.udpHandler != nil {
+		return s.udpHandler
+	}
+	return udpConnHandler
+}
+
+func (s *stackBase) getOutputFn() func([]byte) (int, error) {
+	if s.output != nil {
+		return s.output
+	}
+	return OutputFn
+}
+
+// OutputFn is the default output function, it's used by stacks which have
+// no output function registered on their own.
+var OutputFn func([]byte) (int, error)
+
+// RegisterOutputFn registers the default output function for all stacks,
+// use LWIPStack.RegisterOutputFn to set one for a particular stack.
+func RegisterOutputFn(fn func([]byte) (int, error)) {
+	OutputFn = fn
+}
+
+func init() {
+	OutputFn = func(data []byte) (int, error) {
+		return 0, errors.New("output function not set")
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import "sync"
+
+// Stats holds counters and gauges of a stack, see LWIPStack.Stats.
+//
+// lwIP keeps its counters in C globals shared by all stacks, so with the
+// lwIP backend, protocol and pool stats are totals of all stacks in the
+// process. Connection counts and input errors are always per stack.
+type Stats struct {
+	IP       ProtoStats
+	IPFrag   ProtoStats
+	ICMP     ProtoStats
+	IPv6     ProtoStats
+	IPv6Frag ProtoStats
+	ICMPv6   ProtoStats
+	TCP      ProtoStats
+	UDP      ProtoStats
+
+	// TCPRetransmits is the number of TCP segments retransmitted.
+	TCPRetransmits uint64
+
+	// TCPConnsRejected and UDPConnsRejected count connections rejected
+	// for being over the limits of StackOptions. Retransmitted SYNs of a
+	// TCP connection and further packets of a UDP session rejected don't
+	// count again.
+	TCPConnsRejected uint64
+	UDPConnsRejected uint64
+
+	// InputErrors is the number of packets Write or WriteBatch of the
+	// stack failed to input.
+	InputErrors uint64
+
+	// Pools holds usage of lwIP memory pools keyed by pool name, e.g.
+	// TCP_PCB and PBUF_POOL, it's nil for the Go backend.
+	Pools map[string]PoolStats
+
+	// TCPConns and UDPConns are the numbers of active connections.
+	TCPConns int
+	UDPConns int
+}
+
+// ProtoStats holds counters of a protocol, in packets or segments.
+type ProtoStats struct {
+	Sent           uint64
+	Received       uint64
+	Forwarded      uint64
+	Dropped        uint64
+	ChecksumErrors uint64
+	LengthErrors   uint64
+	MemoryErrors   uint64
+	RoutingErrors  uint64
+	ProtocolErrors uint64
+	OptionErrors   uint64
+	Errors         uint64 // Miscellaneous errors
+}
+
+// PoolStats holds usage of a memory pool, in elements.
+type PoolStats struct {
+	Used   uint64
+	Max    uint64 // High watermark of Used
+	Errors uint64 // Allocation failures
+}
+
+// countSyncMap returns the number of entries of a sync.Map.
+func countSyncMap(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
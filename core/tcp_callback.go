@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -11,6 +13,13 @@ set_tcp_accept_callback(struct tcp_pcb *pcb) {
 	tcp_accept(pcb, tcpAcceptFn);
 }
 
+extern u8_t tcpSynFn(void *arg);
+
+void
+set_tcp_syn_callback(struct tcp_pcb *pcb) {
+	tcp_syn(pcb, tcpSynFn);
+}
+
 extern err_t tcpRecvFn(void *arg, struct tcp_pcb *tpcb, struct pbuf *p, err_t err);
 
 void
@@ -45,6 +54,10 @@ func setTCPAcceptCallback(pcb *C.struct_tcp_pcb) {
 	C.set_tcp_accept_callback(pcb)
 }
 
+func setTCPSynCallback(pcb *C.struct_tcp_pcb) {
+	C.set_tcp_syn_callback(pcb)
+}
+
 func setTCPRecvCallback(pcb *C.struct_tcp_pcb) {
 	C.set_tcp_recv_callback(pcb)
 }
@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -23,11 +25,18 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 		return err
 	}
 
-	if tcpConnHandler == nil {
+	s, ok := lookupStack(arg)
+	if !ok {
+		C.tcp_abort(newpcb)
+		return C.ERR_ABRT
+	}
+
+	handler := s.getTCPConnHandler()
+	if handler == nil {
 		panic("must register a TCP connection handler")
 	}
 
-	if _, nerr := newTCPConn(newpcb, tcpConnHandler); nerr != nil {
+	if _, nerr := newTCPConn(s, newpcb, handler); nerr != nil {
 		switch nerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -41,6 +50,15 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 	return C.ERR_OK
 }
 
+//export tcpSynFn
+func tcpSynFn(arg unsafe.Pointer) C.u8_t {
+	s, ok := lookupStack(arg)
+	if !ok || (s.admitSYN(inputPacket) && s.holdSYN(inputPacket)) {
+		return 1
+	}
+	return 0
+}
+
 //export tcpRecvFn
 func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err C.err_t) C.err_t {
 	if err != C.ERR_OK && err != C.ERR_ABRT {
@@ -56,7 +74,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 		}
 	}()
 
-	conn, ok := tcpConns.Load(getConnKeyVal(arg))
+	conn, ok := lookupTCPConn(arg)
 	if !ok {
 		// The connection does not exists.
 		C.tcp_abort(tpcb)
@@ -65,7 +83,7 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 
 	if p == nil {
 		// Peer closed, EOF.
-		err := conn.(TCPConn).LocalClosed()
+		err := conn.LocalClosed()
 		switch err.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -76,22 +94,14 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 		}
 	}
 
-	var buf []byte
-	var totlen = int(p.tot_len)
-	if p.tot_len == p.len {
-		buf = (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
-	} else {
-		buf = NewBytes(totlen)
-		defer FreeBytes(buf)
-		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
-	}
-
-	rerr := conn.(TCPConn).Receive(buf[:totlen])
+	// The pbuf is queued as is for the handler to read.
+	rerr := conn.receive(p)
 	if rerr != nil {
 		switch rerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
 		case LWIP_ERR_OK:
+			shouldFreePbuf = false
 			return C.ERR_OK
 		case LWIP_ERR_CONN:
 			shouldFreePbuf = false
@@ -114,8 +124,8 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 
 //export tcpSentFn
 func tcpSentFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, len C.u16_t) C.err_t {
-	if conn, ok := tcpConns.Load(getConnKeyVal(arg)); ok {
-		err := conn.(TCPConn).Sent(uint16(len))
+	if conn, ok := lookupTCPConn(arg); ok {
+		err := conn.Sent(uint16(len))
 		switch err.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -132,24 +142,24 @@ func tcpSentFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, len C.u16_t) C.err_t
 
 //export tcpErrFn
 func tcpErrFn(arg unsafe.Pointer, err C.err_t) {
-	if conn, ok := tcpConns.Load(getConnKeyVal(arg)); ok {
+	if conn, ok := lookupTCPConn(arg); ok {
 		switch err {
 		case C.ERR_ABRT:
 			// Aborted through tcp_abort or by a TCP timer
-			conn.(TCPConn).Err(errors.New("connection aborted"))
+			conn.Err(errors.New("connection aborted"))
 		case C.ERR_RST:
 			// The connection was reset by the remote host
-			conn.(TCPConn).Err(errors.New("connection reseted"))
+			conn.Err(errors.New("connection reseted"))
 		default:
-			conn.(TCPConn).Err(errors.New(fmt.Sprintf("lwip error code %v", int(err))))
+			conn.Err(errors.New(fmt.Sprintf("lwip error code %v", int(err))))
 		}
 	}
 }
 
 //export tcpPollFn
 func tcpPollFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb) C.err_t {
-	if conn, ok := tcpConns.Load(getConnKeyVal(arg)); ok {
-		err := conn.(TCPConn).Poll()
+	if conn, ok := lookupTCPConn(arg); ok {
+		err := conn.Poll()
 		switch err.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
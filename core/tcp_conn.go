@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -55,9 +57,34 @@ const (
 	tcpErrored
 )
 
+func (st tcpConnState) String() string {
+	switch st {
+	case tcpNewConn:
+		return "new"
+	case tcpConnecting:
+		return "connecting"
+	case tcpConnected:
+		return "connected"
+	case tcpWriteClosed:
+		return "write-closed"
+	case tcpReceiveClosed:
+		return "receive-closed"
+	case tcpClosing:
+		return "closing"
+	case tcpAborting:
+		return "aborting"
+	case tcpClosed:
+		return "closed"
+	case tcpErrored:
+		return "errored"
+	}
+	return "unknown"
+}
+
 type tcpConn struct {
 	sync.Mutex
 
+	stack         *lwipStack
 	pcb           *C.struct_tcp_pcb
 	handler       TCPConnHandler
 	remoteAddr    *net.TCPAddr
@@ -66,16 +93,35 @@ type tcpConn struct {
 	connKey       uint32
 	canWrite      *sync.Cond // Condition variable to implement TCP backpressure.
 	state         tcpConnState
-	sndPipeReader *io.PipeReader
-	sndPipeWriter *io.PipeWriter
+	rcvBuf        recvBuffer    // Protected by lwipMutex
+	readClosed    bool          // CloseRead has been called, protected by lwipMutex
+	readable      chan struct{} // Signaled when data, FIN or an error arrives
+	readDeadline  *deadline
+	writeDeadline *deadline
 	closeOnce     sync.Once
 	closeErr      error
+
+	// Reported by ListConnections.
+	connID  uint64 // Also the ID in Metadata
+	created time.Time
 }
 
-func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
+func newTCPConn(s *lwipStack, pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
+	localAddr := ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port))
+	remoteAddr := ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port))
+	if localAddr == nil || remoteAddr == nil {
+		C.tcp_abort(pcb)
+		return nil, NewLWIPError(LWIP_ERR_ABRT)
+	}
+	// The limits may have been reached during the handshake.
+	if !s.admitTCPConn(localAddr, remoteAddr) {
+		C.tcp_abort(pcb)
+		return nil, NewLWIPError(LWIP_ERR_ABRT)
+	}
+
 	connKeyArg := newConnKeyArg()
 	connKey := rand.Uint32()
-	setConnKeyVal(unsafe.Pointer(connKeyArg), connKey)
+	setConnKeyVal(unsafe.Pointer(connKeyArg), s.id, connKey)
 
 	// Pass the key as arg for subsequent tcp callbacks.
 	C.tcp_arg(pcb, unsafe.Pointer(connKeyArg))
@@ -86,22 +132,33 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	setTCPErrCallback(pcb)
 	setTCPPollCallback(pcb, C.u8_t(TCP_POLL_INTERVAL))
 
-	pipeReader, pipeWriter := io.Pipe()
 	conn := &tcpConn{
-		pcb:           pcb,
-		handler:       handler,
-		localAddr:     ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
-		remoteAddr:    ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
-		connKeyArg:    connKeyArg,
-		connKey:       connKey,
-		canWrite:      sync.NewCond(&sync.Mutex{}),
-		state:         tcpNewConn,
-		sndPipeReader: pipeReader,
-		sndPipeWriter: pipeWriter,
+		stack:        s,
+		pcb:          pcb,
+		handler:      handler,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		connKeyArg:   connKeyArg,
+		connKey:      connKey,
+		canWrite:     sync.NewCond(&sync.Mutex{}),
+		state:        tcpNewConn,
+		readable:     make(chan struct{}, 1),
+		readDeadline: newDeadline(nil),
+		connID:       newConnID(),
+		created:      time.Now(),
 	}
+	conn.writeDeadline = newDeadline(func() {
+		// Wake up the blocked writer.
+		conn.canWrite.L.Lock()
+		conn.canWrite.Broadcast()
+		conn.canWrite.L.Unlock()
+	})
+
+	// Associate conn with key and save to the map of the stack.
+	s.tcpConns.Store(connKey, conn)
 
-	// Associate conn with key and save to the global map.
-	tcpConns.Store(connKey, conn)
+	// The handler may have connected before the connection is accepted.
+	pending := s.takePendingConn(conn.localAddr, conn.remoteAddr)
 
 	// Connecting remote host could take some time, do it in another goroutine
 	// to prevent blocking the lwip thread.
@@ -109,7 +166,7 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	conn.state = tcpConnecting
 	conn.Unlock()
 	go func() {
-		err := handler.Handle(TCPConn(conn), conn.remoteAddr)
+		err := s.handleTCPConn(conn.connID, handler, pending, TCPConn(conn), conn.remoteAddr)
 		if err != nil {
 			conn.Abort()
 		} else {
@@ -132,6 +189,30 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	return conn, NewLWIPError(LWIP_ERR_OK)
 }
 
+// info describes the connection, caller is required to lock lwipMutex, so
+// that the pcb is valid as long as the connection is in the connection
+// table of the stack.
+func (conn *tcpConn) info(now time.Time) ConnInfo {
+	conn.Lock()
+	info := ConnInfo{
+		ID:          conn.connID,
+		Network:     "tcp",
+		State:       conn.state.String(),
+		Source:      conn.localAddr,
+		Destination: conn.remoteAddr,
+		Age:         now.Sub(conn.created),
+	}
+	conn.Unlock()
+	info.RecvBuffered = conn.rcvBuf.n
+	if _, ok := conn.stack.tcpConns.Load(conn.connKey); ok {
+		if conn.pcb.refused_data != nil {
+			info.RecvBuffered += int(conn.pcb.refused_data.tot_len)
+		}
+		info.SendBuffered = int(conn.pcb.snd_lbb - conn.pcb.lastack)
+	}
+	return info
+}
+
 func (conn *tcpConn) RemoteAddr() net.Addr {
 	return conn.remoteAddr
 }
@@ -141,12 +222,18 @@ func (conn *tcpConn) LocalAddr() net.Addr {
 }
 
 func (conn *tcpConn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	conn.writeDeadline.set(t)
 	return nil
 }
+
 func (conn *tcpConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
 	return nil
 }
+
 func (conn *tcpConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
 	return nil
 }
 
@@ -180,43 +267,116 @@ func (conn *tcpConn) receiveCheck() error {
 	return nil
 }
 
+// Receive queues a copy of data for Read, tcpRecvFn queues pbufs without
+// copying them instead.
 func (conn *tcpConn) Receive(data []byte) error {
+	p := C.pbuf_alloc(C.PBUF_RAW, C.u16_t(len(data)), C.PBUF_RAM)
+	if p == nil {
+		// Try again later.
+		return NewLWIPError(LWIP_ERR_CONN)
+	}
+	if len(data) > 0 {
+		C.pbuf_take(p, unsafe.Pointer(&data[0]), C.u16_t(len(data)))
+	}
+	err := conn.receive(p)
+	if err.(*lwipError).Code != LWIP_ERR_OK {
+		C.pbuf_free(p)
+	}
+	return err
+}
+
+// receive queues p for Read, the connection owns p if it returns ERR_OK.
+// The window is not opened until data is read.
+func (conn *tcpConn) receive(p *C.struct_pbuf) error {
 	if err := conn.receiveCheck(); err != nil {
 		return err
 	}
-	n, err := conn.sndPipeWriter.Write(data)
-	if err != nil {
+	if conn.readClosed {
 		return NewLWIPError(LWIP_ERR_CLSD)
 	}
-	C.tcp_recved(conn.pcb, C.u16_t(n))
+	conn.rcvBuf.push(p)
+	conn.notifyRead()
 	return NewLWIPError(LWIP_ERR_OK)
 }
 
-func (conn *tcpConn) Read(data []byte) (int, error) {
+// notifyRead wakes up a blocked reader.
+func (conn *tcpConn) notifyRead() {
+	select {
+	case conn.readable <- struct{}{}:
+	default:
+	}
+}
+
+// recved opens the window by n bytes read by the handler, and closes the
+// connection if it's waiting for buffered data to be read. Caller is
+// required to lock lwipMutex.
+func (conn *tcpConn) recved(n int) {
 	conn.Lock()
-	if conn.state == tcpReceiveClosed {
-		conn.Unlock()
-		return 0, io.EOF
+	valid := conn.state < tcpClosed
+	conn.Unlock()
+	if !valid {
+		return
 	}
-	if conn.state >= tcpClosing {
-		conn.Unlock()
-		return 0, io.ErrClosedPipe
+	for n > 0 {
+		nr := n
+		if nr > 0xffff {
+			nr = 0xffff
+		}
+		C.tcp_recved(conn.pcb, C.u16_t(nr))
+		n -= nr
 	}
-	conn.Unlock()
+	if conn.rcvBuf.n == 0 {
+		conn.checkClosing()
+	}
+}
 
-	// Handler should get EOF.
-	n, err := conn.sndPipeReader.Read(data)
-	if err == io.ErrClosedPipe {
-		err = io.EOF
+// Read reads data buffered by Receive, it returns EOF once buffered data is
+// read out after the local client has closed its side.
+func (conn *tcpConn) Read(data []byte) (int, error) {
+	for {
+		if conn.readDeadline.exceeded() {
+			return 0, timeoutError{}
+		}
+
+		lwipMutex.Lock()
+		if conn.readClosed {
+			lwipMutex.Unlock()
+			return 0, io.EOF
+		}
+		n := conn.rcvBuf.read(data)
+		if n > 0 || len(data) == 0 {
+			conn.recved(n)
+			lwipMutex.Unlock()
+			return n, nil
+		}
+		conn.Lock()
+		state := conn.state
+		conn.Unlock()
+		lwipMutex.Unlock()
+
+		if state == tcpReceiveClosed {
+			return 0, io.EOF
+		}
+		if state >= tcpClosing {
+			return 0, io.ErrClosedPipe
+		}
+		select {
+		case <-conn.readable:
+		case <-conn.readDeadline.wait():
+			return 0, timeoutError{}
+		}
 	}
-	return n, err
 }
 
 // writeInternal enqueues data to snd_buf, and treats ERR_MEM returned by tcp_write not an error,
 // but instead tells the caller that data is not successfully enqueued, and should try
-// again another time. By calling this function, the lwIP thread is assumed to be already
+// again another time. At most 0xffff bytes are enqueued at once, as the length passed to
+// tcp_write is 16 bits. By calling this function, the lwIP thread is assumed to be already
 // locked by the caller.
 func (conn *tcpConn) writeInternal(data []byte) (int, error) {
+	if len(data) > 0xffff {
+		data = data[:0xffff]
+	}
 	err := C.tcp_write(conn.pcb, unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.TCP_WRITE_FLAG_COPY)
 	if err == C.ERR_OK {
 		C.tcp_output(conn.pcb)
@@ -264,20 +424,26 @@ func (conn *tcpConn) Write(data []byte) (int, error) {
 		if err := conn.writeCheck(); err != nil {
 			return totalWritten, err
 		}
+		if conn.writeDeadline.exceeded() {
+			return totalWritten, timeoutError{}
+		}
 
 		lwipMutex.Lock()
-		toWrite := len(data)
-		if toWrite > int(conn.pcb.snd_buf) {
-			// Write at most the size of the LWIP buffer.
-			toWrite = int(conn.pcb.snd_buf)
-		}
-		if toWrite > 0 {
+		for len(data) > 0 && conn.pcb.snd_buf > 0 {
+			toWrite := len(data)
+			if toWrite > int(conn.pcb.snd_buf) {
+				// Write at most the size of the LWIP buffer.
+				toWrite = int(conn.pcb.snd_buf)
+			}
 			written, err := conn.writeInternal(data[0:toWrite])
 			totalWritten += written
 			if err != nil {
 				lwipMutex.Unlock()
 				return totalWritten, err
 			}
+			if written == 0 {
+				break // Out of memory, wait for data to be acknowledged.
+			}
 			data = data[written:len(data)]
 		}
 		lwipMutex.Unlock()
@@ -312,7 +478,16 @@ func (conn *tcpConn) CloseWrite() error {
 }
 
 func (conn *tcpConn) CloseRead() error {
-	return conn.sndPipeReader.Close()
+	lwipMutex.Lock()
+	if !conn.readClosed {
+		conn.readClosed = true
+		// Dropped data is treated as read, so that the connection
+		// is closed gracefully rather than reset.
+		conn.recved(conn.rcvBuf.clear())
+		conn.notifyRead()
+	}
+	lwipMutex.Unlock()
+	return nil
 }
 
 func (conn *tcpConn) Sent(len uint16) error {
@@ -324,7 +499,9 @@ func (conn *tcpConn) checkClosing() error {
 	conn.Lock()
 	defer conn.Unlock()
 
-	if conn.state == tcpClosing {
+	// Closing waits for buffered data to be read, tcp_close resets
+	// connections with unread data.
+	if conn.state == tcpClosing && conn.rcvBuf.n == 0 {
 		conn.closeInternal()
 		return NewLWIPError(LWIP_ERR_OK)
 	}
@@ -394,8 +571,8 @@ func (conn *tcpConn) setLocalClosed() error {
 		return nil
 	}
 
-	// Causes the read half of the pipe returns.
-	conn.sndPipeWriter.Close()
+	// Readers get EOF once buffered data is read out.
+	conn.notifyRead()
 
 	if conn.state == tcpWriteClosed {
 		conn.state = tcpClosing
@@ -460,12 +637,13 @@ func (conn *tcpConn) LocalClosed() error {
 }
 
 func (conn *tcpConn) release() {
-	if _, found := tcpConns.Load(conn.connKey); found {
+	if _, found := conn.stack.tcpConns.Load(conn.connKey); found {
 		freeConnKeyArg(conn.connKeyArg)
-		tcpConns.Delete(conn.connKey)
+		conn.stack.tcpConns.Delete(conn.connKey)
+		conn.stack.tcpAdmission.release(conn.localAddr.IP)
 	}
-	conn.sndPipeWriter.Close()
-	conn.sndPipeReader.Close()
+	conn.rcvBuf.clear()
+	conn.notifyRead()
 	conn.state = tcpClosed
 }
 
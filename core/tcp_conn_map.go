@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -5,10 +7,15 @@ package core
 #include "lwip/tcp.h"
 #include <stdlib.h>
 
+typedef struct {
+	uint32_t stack;
+	uint32_t conn;
+} conn_key_t;
+
 void*
 new_conn_key_arg()
 {
-	return malloc(sizeof(uint32_t));
+	return malloc(sizeof(conn_key_t));
 }
 
 void
@@ -18,25 +25,29 @@ free_conn_key_arg(void *arg)
 }
 
 void
-set_conn_key_val(void *arg, uint32_t val)
+set_conn_key_val(void *arg, uint32_t stack, uint32_t conn)
+{
+	((conn_key_t*)arg)->stack = stack;
+	((conn_key_t*)arg)->conn = conn;
+}
+
+uint32_t
+get_conn_key_stack(void *arg)
 {
-	*((uint32_t*)arg) = val;
+	return ((conn_key_t*)arg)->stack;
 }
 
 uint32_t
 get_conn_key_val(void *arg)
 {
-	return *((uint32_t*)arg);
+	return ((conn_key_t*)arg)->conn;
 }
 */
 import "C"
 import (
-	"sync"
 	"unsafe"
 )
 
-var tcpConns sync.Map
-
 // We need such a key-value mechanism because when passing a Go pointer
 // to C, the Go pointer will only be valid during the call.
 // If we pass a Go pointer to tcp_arg(), this pointer will not be usable
@@ -46,6 +57,9 @@ var tcpConns sync.Map
 // the memory in C and return its pointer to Go code. After the connection
 // end, the memory should be freed manually.
 //
+// The key also carries the ID of the stack owning the pcb, so that callbacks
+// can find the right connection table when multiple stacks are running.
+//
 // See also:
 // https://github.com/golang/go/issues/12416
 func newConnKeyArg() unsafe.Pointer {
@@ -56,10 +70,28 @@ func freeConnKeyArg(p unsafe.Pointer) {
 	C.free_conn_key_arg(p)
 }
 
-func setConnKeyVal(p unsafe.Pointer, val uint32) {
-	C.set_conn_key_val(p, C.uint32_t(val))
+func setConnKeyVal(p unsafe.Pointer, stackID, val uint32) {
+	C.set_conn_key_val(p, C.uint32_t(stackID), C.uint32_t(val))
+}
+
+func getConnKeyStack(p unsafe.Pointer) uint32 {
+	return uint32(C.get_conn_key_stack(p))
 }
 
 func getConnKeyVal(p unsafe.Pointer) uint32 {
 	return uint32(C.get_conn_key_val(p))
 }
+
+// lookupTCPConn finds the connection identified by a key arg in the
+// connection table of the owning stack.
+func lookupTCPConn(arg unsafe.Pointer) (*tcpConn, bool) {
+	s, ok := lookupStack(arg)
+	if !ok {
+		return nil, false
+	}
+	conn, ok := s.tcpConns.Load(getConnKeyVal(arg))
+	if !ok {
+		return nil, false
+	}
+	return conn.(*tcpConn), true
+}
@@ -0,0 +1,66 @@
+// +build !gostack
+
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/pbuf.h"
+*/
+import "C"
+import (
+	"unsafe"
+)
+
+// recvBuffer holds pbufs received on a TCP connection until the handler
+// reads them, data is copied once, from the pbufs to the buffer passed to
+// Read. It's bounded by the receive window, which is opened again with
+// tcp_recved only as data is read, so a slow reader throttles the local
+// client instead of blocking the lwIP thread.
+//
+// Pbufs are kept in a slice rather than chained, since tot_len of a chain
+// can not exceed 65535 bytes while scaled windows can. Caller is required
+// to lock lwipMutex.
+type recvBuffer struct {
+	pbufs []*C.struct_pbuf
+	off   int // Bytes of pbufs[0] already read
+	n     int // Bytes not yet read
+}
+
+// push appends p to the buffer, which owns the reference to p afterwards.
+func (b *recvBuffer) push(p *C.struct_pbuf) {
+	b.pbufs = append(b.pbufs, p)
+	b.n += int(p.tot_len)
+}
+
+// read copies buffered data to data, pbufs are freed as they are read out.
+func (b *recvBuffer) read(data []byte) int {
+	n := 0
+	for n < len(data) && len(b.pbufs) > 0 {
+		p := b.pbufs[0]
+		nc := int(p.tot_len) - b.off
+		if nc > len(data)-n {
+			nc = len(data) - n
+		}
+		C.pbuf_copy_partial(p, unsafe.Pointer(&data[n]), C.u16_t(nc), C.u16_t(b.off))
+		n += nc
+		b.off += nc
+		if b.off == int(p.tot_len) {
+			C.pbuf_free(p)
+			b.pbufs[0] = nil
+			b.pbufs = b.pbufs[1:]
+			b.off = 0
+		}
+	}
+	b.n -= n
+	return n
+}
+
+// clear frees all pbufs and returns the number of bytes dropped.
+func (b *recvBuffer) clear() int {
+	for _, p := range b.pbufs {
+		C.pbuf_free(p)
+	}
+	n := b.n
+	*b = recvBuffer{}
+	return n
+}
@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -13,9 +15,26 @@ set_udp_recv_callback(struct udp_pcb *pcb, void *recv_arg) {
 */
 import "C"
 import (
+	"net"
 	"unsafe"
 )
 
 func setUDPRecvCallback(pcb *C.struct_udp_pcb, recvArg unsafe.Pointer) {
 	C.set_udp_recv_callback(pcb, recvArg)
 }
+
+// newUDPSendFn returns a function sending UDP packets to the local client
+// at localIP:localPort via pcb.
+func newUDPSendFn(pcb *C.struct_udp_pcb, localIP C.ip_addr_t, localPort C.u16_t) udpSendFn {
+	return func(data []byte, addr *net.UDPAddr) error {
+		// FIXME any memory leaks?
+		cremoteIP := C.struct_ip_addr{}
+		if err := ipAddrATON(addr.IP.String(), &cremoteIP); err != nil {
+			return err
+		}
+		buf := C.pbuf_alloc_reference(unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.PBUF_ROM)
+		defer C.pbuf_free(buf)
+		C.udp_sendto(pcb, buf, &localIP, localPort, &cremoteIP, C.u16_t(addr.Port))
+		return nil
+	}
+}
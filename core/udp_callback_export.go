@@ -1,3 +1,5 @@
+// +build !gostack
+
 package core
 
 /*
@@ -21,31 +23,34 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 		return
 	}
 
+	s, ok := lookupStack(arg)
+	if !ok {
+		return
+	}
+
 	srcAddr := ParseUDPAddr(ipAddrNTOA(*addr), uint16(port))
 	dstAddr := ParseUDPAddr(ipAddrNTOA(*destAddr), uint16(destPort))
 	if srcAddr == nil || dstAddr == nil {
-		panic("invalid UDP address")
+		return
 	}
 
-	connId := udpConnId{
-		src: srcAddr.String(),
-	}
-	conn, found := udpConns.Load(connId)
+	conn, connId, found := s.lookupUDPConn(srcAddr.String(), dstAddr.String())
 	if !found {
-		if udpConnHandler == nil {
+		handler := s.getUDPConnHandler()
+		if handler == nil {
 			panic("must register a UDP connection handler")
 		}
 		var err error
-		conn, err = newUDPConn(pcb,
-			udpConnHandler,
-			*addr,
-			port,
+		conn, err = newUDPConn(&s.stackBase,
+			connId,
+			newUDPSendFn(pcb, *addr, port),
+			handler,
 			srcAddr,
 			dstAddr)
 		if err != nil {
 			return
 		}
-		udpConns.Store(connId, conn)
+		s.udpConns.Store(connId, conn)
 	}
 
 	var buf []byte
@@ -58,5 +63,5 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
 	}
 
-	conn.(UDPConn).ReceiveTo(buf[:totlen], dstAddr)
+	conn.ReceiveTo(buf[:totlen], dstAddr)
 }
@@ -1,16 +1,12 @@
 package core
 
-/*
-#cgo CFLAGS: -I./c/include
-#include "lwip/udp.h"
-*/
-import "C"
 import (
 	"errors"
 	"fmt"
 	"net"
 	"sync"
-	"unsafe"
+	"sync/atomic"
+	"time"
 )
 
 type udpConnState uint
@@ -26,26 +22,58 @@ type udpPacket struct {
 	addr *net.UDPAddr
 }
 
+// udpSendFn sends data to the local client, with addr as the source
+// address, it's provided by the backend.
+type udpSendFn func(data []byte, addr *net.UDPAddr) error
+
 type udpConn struct {
+	// Unix time in nanoseconds of the last activity, it must be the first
+	// field to be 64-bit aligned for atomic operations.
+	lastActive int64
+
 	sync.Mutex
 
-	pcb       *C.struct_udp_pcb
+	stack     *stackBase
+	id        udpConnId
+	send      udpSendFn
 	handler   UDPConnHandler
 	localAddr *net.UDPAddr
-	localIP   C.ip_addr_t
-	localPort C.u16_t
 	state     udpConnState
 	pending   chan *udpPacket
+	mode      UDPSessionMode
+	eif       bool                // Endpoint-independent filtering
+	peers     map[string]struct{} // Remote addresses the local client has sent packets to
+	timeout   time.Duration       // Idle timeout, zero means no timeout
+	idleTimer *time.Timer
+
+	// Reported by ListConnections.
+	connID       uint64 // Also the ID in Metadata
+	created      time.Time
+	target       *net.UDPAddr // Destination of the first packet, may be nil
+	pendingBytes int          // Bytes of packets in pending
 }
 
-func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+// newUDPConn creates a connection and connects it with the handler, caller
+// is required to hold the stack lock.
+func newUDPConn(s *stackBase, id udpConnId, send udpSendFn, handler UDPConnHandler, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+	if !s.udpAdmission.acquire(localAddr.IP) {
+		s.udpAdmission.reject(id)
+		return nil, errors.New("too many UDP connections")
+	}
 	conn := &udpConn{
+		stack:     s,
+		id:        id,
+		connID:    newConnID(),
+		created:   time.Now(),
+		target:    remoteAddr,
+		send:      send,
 		handler:   handler,
-		pcb:       pcb,
 		localAddr: localAddr,
-		localIP:   localIP,
-		localPort: localPort,
 		state:     udpConnecting,
+		mode:      s.udpMode,
+		eif:       s.udpEIF,
+		peers:     make(map[string]struct{}),
+		timeout:   s.udpTimeout,
 
 		// It's quite common to see applications sending multiple
 		// DNS queries (A,AAAA) at the same time, we should keep them all
@@ -53,26 +81,39 @@ func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr
 		pending: make(chan *udpPacket, 64),
 	}
 
+	conn.touch()
+	if conn.timeout > 0 {
+		conn.Lock()
+		conn.idleTimer = time.AfterFunc(conn.timeout, conn.checkIdle)
+		conn.Unlock()
+	}
+
 	go func() {
-		err := handler.Connect(conn, remoteAddr)
+		var target net.Addr
+		if remoteAddr != nil {
+			target = remoteAddr
+		}
+		ctx, meta := s.newMetadata(conn.connID, "udp", localAddr, target)
+		err := udpContextHandler(handler).ConnectContext(ctx, conn, meta)
 		if err != nil {
 			conn.Close()
+			conn.unreachable(remoteAddr, err)
 		} else {
 			conn.Lock()
+			if conn.state == udpClosed {
+				// Closed while connecting, let the handler release
+				// what it has allocated in Connect.
+				conn.Unlock()
+				conn.notifyClosed()
+				return
+			}
 			conn.state = udpConnected
 			conn.Unlock()
 			// Once connected, send all pending data.
-		DrainPending:
-			for {
-				select {
-				case pkt := <-conn.pending:
-					err := conn.handler.ReceiveTo(conn, pkt.data, pkt.addr)
-					if err != nil {
-						break DrainPending
-					}
-					continue DrainPending
-				default:
-					break DrainPending
+			for pkt := conn.takePending(); pkt != nil; pkt = conn.takePending() {
+				err := conn.handler.ReceiveTo(conn, pkt.data, pkt.addr)
+				if err != nil {
+					break
 				}
 			}
 		}
@@ -81,10 +122,83 @@ func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr
 	return conn, nil
 }
 
+// unreachable answers packets of the local client with ICMP unreachable
+// after the handler failed to connect, the code is selected by err.
+func (conn *udpConn) unreachable(target *net.UDPAddr, err error) {
+	code, ok := unreachableCodeOf(err)
+	if !ok {
+		code = PortUnreachable
+	}
+
+	// Packets are not kept as they were sent, rebuild them to be quoted.
+	var pkts [][]byte
+	for pkt := conn.takePending(); pkt != nil; pkt = conn.takePending() {
+		pkts = append(pkts, buildUDPPacket(conn.localAddr, pkt.addr, pkt.data))
+	}
+	if len(pkts) == 0 && target != nil {
+		pkts = append(pkts, buildUDPPacket(conn.localAddr, target, nil))
+	}
+
+	conn.stack.mu.Lock()
+	defer conn.stack.mu.Unlock()
+	output := conn.stack.getOutputFn()
+	for _, pkt := range pkts {
+		if reply := buildICMPUnreachable(pkt, code); reply != nil {
+			output(reply)
+		}
+	}
+}
+
 func (conn *udpConn) LocalAddr() *net.UDPAddr {
 	return conn.localAddr
 }
 
+// touch records an activity on the connection.
+func (conn *udpConn) touch() {
+	atomic.StoreInt64(&conn.lastActive, time.Now().UnixNano())
+}
+
+// checkIdle closes the connection if it has been idle for longer than the
+// timeout, otherwise it reschedules the check.
+func (conn *udpConn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastActive)))
+	if idle >= conn.timeout {
+		conn.Close()
+		return
+	}
+	conn.Lock()
+	if conn.state != udpClosed {
+		conn.idleTimer.Reset(conn.timeout - idle)
+	}
+	conn.Unlock()
+}
+
+func (conn *udpConn) SessionMode() UDPSessionMode {
+	return conn.mode
+}
+
+// addPeer remembers addr as a remote address the local client has sent
+// packets to.
+func (conn *udpConn) addPeer(addr *net.UDPAddr) {
+	if conn.eif {
+		return
+	}
+	conn.Lock()
+	conn.peers[addr.String()] = struct{}{}
+	conn.Unlock()
+}
+
+// isFiltered reports whether packets from addr should be dropped.
+func (conn *udpConn) isFiltered(addr *net.UDPAddr) bool {
+	if conn.eif {
+		return false
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	_, found := conn.peers[addr.String()]
+	return !found
+}
+
 func (conn *udpConn) checkState() error {
 	conn.Lock()
 	defer conn.Unlock()
@@ -110,6 +224,7 @@ func (conn *udpConn) enqueueEarlyPacket(data []byte, addr *net.UDPAddr) bool {
 		select {
 		// Data will be dropped if pending is full.
 		case conn.pending <- pkt:
+			conn.pendingBytes += len(data)
 			return true
 		default:
 		}
@@ -117,7 +232,22 @@ func (conn *udpConn) enqueueEarlyPacket(data []byte, addr *net.UDPAddr) bool {
 	return false
 }
 
+// takePending dequeues a packet held while connecting, or returns nil.
+func (conn *udpConn) takePending() *udpPacket {
+	select {
+	case pkt := <-conn.pending:
+		conn.Lock()
+		conn.pendingBytes -= len(pkt.data)
+		conn.Unlock()
+		return pkt
+	default:
+		return nil
+	}
+}
+
 func (conn *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	conn.touch()
+	conn.addPeer(addr)
 	if conn.enqueueEarlyPacket(data, addr) {
 		return nil
 	}
@@ -138,24 +268,35 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	if err := conn.checkState(); err != nil {
 		return 0, err
 	}
-	// FIXME any memory leaks?
-	cremoteIP := C.struct_ip_addr{}
-	if err := ipAddrATON(addr.IP.String(), &cremoteIP); err != nil {
+	if conn.isFiltered(addr) {
+		return 0, nil
+	}
+	conn.touch()
+	if err := conn.send(data, addr); err != nil {
 		return 0, err
 	}
-	buf := C.pbuf_alloc_reference(unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.PBUF_ROM)
-	defer C.pbuf_free(buf)
-	C.udp_sendto(conn.pcb, buf, &conn.localIP, conn.localPort, &cremoteIP, C.u16_t(addr.Port))
 	return len(data), nil
 }
 
 func (conn *udpConn) Close() error {
-	connId := udpConnId{
-		src: conn.LocalAddr().String(),
-	}
 	conn.Lock()
+	if conn.state == udpClosed {
+		conn.Unlock()
+		return nil
+	}
 	conn.state = udpClosed
+	if conn.idleTimer != nil {
+		conn.idleTimer.Stop()
+	}
 	conn.Unlock()
-	udpConns.Delete(connId)
+	conn.stack.udpConns.Delete(conn.id)
+	conn.stack.udpAdmission.release(conn.localAddr.IP)
+	conn.notifyClosed()
 	return nil
 }
+
+func (conn *udpConn) notifyClosed() {
+	if h, ok := conn.handler.(UDPConnCloseHandler); ok {
+		h.Closed(conn)
+	}
+}
@@ -1,11 +1,55 @@
 package core
 
-import (
-	"sync"
+// UDPSessionMode determines how UDP packets comming from TUN are mapped to
+// UDPConns, that is, the NAT mapping behaviour of the stack.
+type UDPSessionMode uint8
+
+const (
+	// UDPFullCone maps all packets sent from the same source address to
+	// one UDPConn, regardless of their destinations (endpoint-independent
+	// mapping). This is the default mode.
+	UDPFullCone UDPSessionMode = iota
+
+	// UDPSymmetric maps packets to one UDPConn for each source and
+	// destination pair (endpoint-dependent mapping).
+	UDPSymmetric
 )
 
-var udpConns sync.Map
+func (m UDPSessionMode) String() string {
+	switch m {
+	case UDPFullCone:
+		return "full-cone"
+	case UDPSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
 
+// udpConnId identifies a UDPConn in the connection table of a stack, dst
+// is only set in UDPSymmetric mode.
 type udpConnId struct {
 	src string
+	dst string
+}
+
+func newUDPConnId(mode UDPSessionMode, src, dst string) udpConnId {
+	if mode == UDPSymmetric {
+		return udpConnId{src: src, dst: dst}
+	}
+	return udpConnId{src: src}
+}
+
+// lookupUDPConn returns the UDPConn packets from src to dst are mapped to,
+// sessions match in the mode they have been created in, so that changing
+// the mode only affects new sessions. If not found, it returns the id of a
+// new session in the current mode. Caller is required to hold the stack
+// lock.
+func (s *stackBase) lookupUDPConn(src, dst string) (UDPConn, udpConnId, bool) {
+	for _, mode := range []UDPSessionMode{UDPSymmetric, UDPFullCone} {
+		if conn, ok := s.udpConns.Load(newUDPConnId(mode, src, dst)); ok {
+			return conn.(UDPConn), udpConnId{}, true
+		}
+	}
+	return nil, newUDPConnId(s.udpMode, src, dst), false
 }
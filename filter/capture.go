@@ -0,0 +1,330 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	defaultCaptureSnapLen = 65535
+	captureQueueLen       = 1024
+	captureWriteTimeout   = time.Second
+)
+
+// CaptureOptions configures a Capture, at least one of Path and Listen is
+// required.
+type CaptureOptions struct {
+	// Path is the pcapng file packets are written to. If MaxFileSize is
+	// not zero, the file is rotated once it has grown larger, the current
+	// one is renamed to Path.1, Path.1 to Path.2 and so on, and up to
+	// MaxFiles rotated files are kept, 1 by default.
+	Path        string
+	MaxFileSize int64
+	MaxFiles    int
+
+	// Listen is a local address pcapng streams are served on, each client
+	// connected receives packets from then on, e.g. for
+	// `nc 127.0.0.1 9000 | wireshark -k -i -`. It's a TCP address, or a
+	// Unix socket path prefixed with "unix:". Slow clients are dropped.
+	Listen string
+
+	// Match is a capture expression selecting the packets to capture, see
+	// compileMatch, all packets are captured if empty, including those
+	// which are not valid IP packets.
+	Match string
+
+	// SnapLen is the number of bytes of each packet to capture, 65535 by
+	// default.
+	SnapLen int
+
+	// Name is the name of the interface written to the capture.
+	Name string
+}
+
+// Capture captures IP packets of both directions between TUN and the stack
+// in pcapng format, packets from TUN are marked inbound. Packets are queued
+// and written in a separate goroutine, and dropped if the queue is full, so
+// that capturing never blocks the stack.
+type Capture struct {
+	dropped uint64 // Accessed atomically, kept first to be 64-bit aligned
+
+	opts   CaptureOptions
+	match  matcher // Nil if all packets are captured, even those not parsed
+	header []byte
+
+	mu      sync.RWMutex // Protects closed against the queue being closed
+	closed  bool
+	packets chan []byte // Encoded enhanced packet blocks
+	done    chan struct{}
+
+	file     *os.File
+	fileBuf  *bufio.Writer
+	fileSize int64
+
+	ln        net.Listener
+	clientsMu sync.Mutex
+	clients   map[net.Conn]bool // Whether the header has been written, nil once closed
+}
+
+// NewCapture creates a Capture, opening the file and the listener.
+func NewCapture(opts CaptureOptions) (*Capture, error) {
+	if opts.Path == "" && opts.Listen == "" {
+		return nil, errors.New("capture needs a path or a listen address")
+	}
+	if opts.SnapLen == 0 {
+		opts.SnapLen = defaultCaptureSnapLen
+	}
+	if opts.SnapLen < 0 || opts.MaxFileSize < 0 || opts.MaxFiles < 0 {
+		return nil, errors.New("invalid capture options, must not be negative")
+	}
+	if opts.MaxFiles == 0 {
+		opts.MaxFiles = 1
+	}
+	var match matcher
+	var err error
+	if strings.TrimSpace(opts.Match) != "" {
+		if match, err = compileMatch(opts.Match); err != nil {
+			return nil, err
+		}
+	}
+	c := &Capture{
+		opts:    opts,
+		match:   match,
+		header:  appendPcapngHeader(nil, opts.Name, opts.SnapLen),
+		packets: make(chan []byte, captureQueueLen),
+		done:    make(chan struct{}),
+		clients: make(map[net.Conn]bool),
+	}
+	if opts.Path != "" {
+		if err := c.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Listen != "" {
+		network, addr := "tcp", opts.Listen
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		c.ln, err = net.Listen(network, addr)
+		if err != nil {
+			if c.file != nil {
+				c.file.Close()
+			}
+			return nil, err
+		}
+		go c.serve()
+	}
+	go c.loop()
+	return c, nil
+}
+
+// Dropped returns the number of packets dropped since the queue was full.
+func (c *Capture) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Close stops capturing, flushing the packets queued.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.packets)
+	c.mu.Unlock()
+	<-c.done
+
+	var err error
+	if c.ln != nil {
+		err = c.ln.Close()
+	}
+	c.clientsMu.Lock()
+	for conn := range c.clients {
+		conn.Close()
+	}
+	c.clients = nil
+	c.clientsMu.Unlock()
+	if c.file != nil {
+		if ferr := c.closeFile(); ferr != nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// Output wraps an output function of stacks, capturing the packets sent to
+// TUN.
+func (c *Capture) Output(fn func([]byte) (int, error)) func([]byte) (int, error) {
+	return func(pkt []byte) (int, error) {
+		c.capture(pkt, false)
+		return fn(pkt)
+	}
+}
+
+// capture queues pkt if it matches.
+func (c *Capture) capture(pkt []byte, inbound bool) {
+	if c.match != nil {
+		info, ok := parsePacketInfo(pkt)
+		if !ok || !c.match(&info) {
+			return
+		}
+	}
+	data := pkt
+	if len(data) > c.opts.SnapLen {
+		data = data[:c.opts.SnapLen]
+	}
+	block := appendPcapngPacket(nil, time.Now(), data, len(pkt), inbound)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.packets <- block:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// loop writes queued packets, the file is flushed whenever the queue is
+// drained.
+func (c *Capture) loop() {
+	defer close(c.done)
+	for block := range c.packets {
+		if c.file != nil {
+			// The file is closed if it fails to rotate.
+			c.writeFile(block)
+		}
+		if c.file != nil && len(c.packets) == 0 {
+			c.fileBuf.Flush()
+		}
+		c.writeClients(block)
+	}
+}
+
+func (c *Capture) openFile() error {
+	f, err := os.OpenFile(c.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	c.file, c.fileBuf, c.fileSize = f, bufio.NewWriter(f), 0
+	c.writeFile(c.header)
+	return nil
+}
+
+func (c *Capture) closeFile() error {
+	err := c.fileBuf.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.fileBuf = nil, nil
+	return err
+}
+
+func (c *Capture) writeFile(b []byte) {
+	if c.opts.MaxFileSize > 0 && c.fileSize > int64(len(c.header)) && c.fileSize+int64(len(b)) > c.opts.MaxFileSize {
+		if err := c.rotate(); err != nil {
+			log.Errorf("failed to rotate capture file: %v", err)
+			return
+		}
+	}
+	n, err := c.fileBuf.Write(b)
+	c.fileSize += int64(n)
+	if err != nil {
+		log.Errorf("failed to write capture file: %v", err)
+	}
+}
+
+// rotate renames the current file and its rotated files, and opens a new
+// one.
+func (c *Capture) rotate() error {
+	if err := c.closeFile(); err != nil {
+		log.Errorf("failed to close capture file: %v", err)
+	}
+	path := c.opts.Path
+	for i := c.opts.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+	return c.openFile()
+}
+
+// serve accepts clients until the listener is closed.
+func (c *Capture) serve() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			return
+		}
+		c.clientsMu.Lock()
+		if c.clients == nil {
+			// The capture has been closed.
+			conn.Close()
+		} else {
+			c.clients[conn] = false // Header not yet written
+		}
+		c.clientsMu.Unlock()
+	}
+}
+
+// writeClients writes b to each client, a client is dropped if it fails to
+// receive in time. The header is written before the first packet.
+func (c *Capture) writeClients(b []byte) {
+	c.clientsMu.Lock()
+	defer c.clientsMu.Unlock()
+	for conn, started := range c.clients {
+		conn.SetWriteDeadline(time.Now().Add(captureWriteTimeout))
+		if !started {
+			if _, err := conn.Write(c.header); err != nil {
+				conn.Close()
+				delete(c.clients, conn)
+				continue
+			}
+			c.clients[conn] = true
+		}
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			delete(c.clients, conn)
+		}
+	}
+}
+
+type captureFilter struct {
+	writer  io.Writer
+	capture *Capture
+}
+
+// NewCaptureFilter creates a filter capturing the packets written to w, i.e.
+// packets from TUN.
+func NewCaptureFilter(w io.Writer, c *Capture) Filter {
+	return &captureFilter{writer: w, capture: c}
+}
+
+func (w *captureFilter) Write(buf []byte) (int, error) {
+	w.capture.capture(buf, true)
+	return w.writer.Write(buf)
+}
+
+func (w *captureFilter) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(w.writer, pkts, w.intercept)
+}
+
+// intercept captures a packet, it never consumes it.
+func (w *captureFilter) intercept(buf []byte) bool {
+	w.capture.capture(buf, true)
+	return false
+}
@@ -0,0 +1,282 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// packetInfo holds the fields of an IP packet capture expressions match.
+type packetInfo struct {
+	ver      int
+	proto    byte
+	src, dst net.IP
+	ports    bool // Whether srcPort and dstPort are known
+	srcPort  uint16
+	dstPort  uint16
+	payload  []byte // Nil for non-first fragments
+}
+
+// parsePacketInfo parses the IP header and the ports of TCP and UDP packets,
+// skipping IPv6 extension headers, ports of non-first fragments are unknown.
+func parsePacketInfo(pkt []byte) (packetInfo, bool) {
+	var info packetInfo
+	if len(pkt) == 0 {
+		return info, false
+	}
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		hl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || hl < 20 || hl > len(pkt) {
+			return info, false
+		}
+		info.ver, info.proto = 4, pkt[9]
+		info.src, info.dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			payload = pkt[hl:]
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return info, false
+		}
+		info.ver = 6
+		info.src, info.dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		info.proto, payload = skipIPv6ExtHeaders(pkt[6], pkt[40:])
+	default:
+		return info, false
+	}
+	if (info.proto == protoTCP || info.proto == protoUDP) && len(payload) >= 4 {
+		info.ports = true
+		info.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		info.dstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+	info.payload = payload
+	return info, true
+}
+
+// skipIPv6ExtHeaders returns the upper-layer protocol and payload following
+// the extension headers of an IPv6 packet, the payload is nil for non-first
+// fragments, or if the headers are truncated.
+func skipIPv6ExtHeaders(next byte, payload []byte) (byte, []byte) {
+	for {
+		var n int
+		switch next {
+		case 0, 43, 60: // Hop-by-hop, routing and destination options
+			if len(payload) < 2 {
+				return next, nil
+			}
+			n = (int(payload[1]) + 1) * 8
+		case 44: // Fragment
+			if len(payload) < 8 {
+				return next, nil
+			}
+			if binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return payload[0], nil
+			}
+			n = 8
+		case 51: // Authentication header
+			if len(payload) < 2 {
+				return next, nil
+			}
+			n = (int(payload[1]) + 2) * 4
+		default:
+			return next, payload
+		}
+		if n > len(payload) {
+			return next, nil
+		}
+		next, payload = payload[0], payload[n:]
+	}
+}
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// matcher reports whether a packet matches a capture expression.
+type matcher func(info *packetInfo) bool
+
+// compileMatch compiles a capture expression, a subset of the tcpdump
+// syntax. Primitives are
+//
+//	ip, ip6, tcp, udp, icmp, icmp6
+//	[src|dst] host ADDR
+//	[src|dst] net CIDR
+//	[src|dst] port PORT
+//
+// combined with `and` (`&&`), `or` (`||`), `not` (`!`) and parentheses,
+// adjacent primitives are combined with `and`, e.g. `tcp port 443`. An empty
+// expression matches any packet.
+func compileMatch(expr string) (matcher, error) {
+	p := &matchParser{tokens: tokenizeMatch(expr)}
+	if len(p.tokens) == 0 {
+		return func(*packetInfo) bool { return true }, nil
+	}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in capture expression", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+func tokenizeMatch(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||", "!"} {
+		expr = strings.Replace(expr, op, " "+op+" ", -1)
+	}
+	return strings.Fields(expr)
+}
+
+type matchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *matchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *matchParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *matchParser) parseOr() (matcher, error) {
+	m, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "or" || t == "||"; t = p.peek() {
+		p.next()
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs := m
+		m = func(info *packetInfo) bool { return lhs(info) || rhs(info) }
+	}
+	return m, nil
+}
+
+func (p *matchParser) parseAnd() (matcher, error) {
+	m, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "", ")", "or", "||":
+			return m, nil
+		case "and", "&&":
+			p.next()
+		}
+		rhs, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		lhs := m
+		m = func(info *packetInfo) bool { return lhs(info) && rhs(info) }
+	}
+}
+
+func (p *matchParser) parseNot() (matcher, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		m, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(info *packetInfo) bool { return !m(info) }, nil
+	case "(":
+		p.next()
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in capture expression")
+		}
+		return m, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *matchParser) parsePrimitive() (matcher, error) {
+	t := p.next()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of capture expression")
+	case "ip":
+		return func(info *packetInfo) bool { return info.ver == 4 }, nil
+	case "ip6":
+		return func(info *packetInfo) bool { return info.ver == 6 }, nil
+	case "tcp":
+		return protoMatcher(protoTCP), nil
+	case "udp":
+		return protoMatcher(protoUDP), nil
+	case "icmp":
+		return protoMatcher(protoICMP), nil
+	case "icmp6":
+		return protoMatcher(protoICMPv6), nil
+	}
+
+	src, dst := true, true
+	switch t {
+	case "src":
+		dst = false
+		t = p.next()
+	case "dst":
+		src = false
+		t = p.next()
+	}
+	arg := p.next()
+	if arg == "" {
+		return nil, fmt.Errorf("missing argument of %q in capture expression", t)
+	}
+	switch t {
+	case "host":
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q in capture expression", arg)
+		}
+		return func(info *packetInfo) bool {
+			return (src && info.src.Equal(ip)) || (dst && info.dst.Equal(ip))
+		}, nil
+	case "net":
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q in capture expression", arg)
+		}
+		return func(info *packetInfo) bool {
+			return (src && n.Contains(info.src)) || (dst && n.Contains(info.dst))
+		}, nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in capture expression", arg)
+		}
+		return func(info *packetInfo) bool {
+			return info.ports && ((src && info.srcPort == uint16(port)) || (dst && info.dstPort == uint16(port)))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q in capture expression", t)
+}
+
+func protoMatcher(proto byte) matcher {
+	return func(info *packetInfo) bool { return info.proto == proto }
+}
@@ -0,0 +1,267 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// testPacket builds an IPv4 or IPv6 packet with a TCP or UDP header.
+func testPacket(src, dst string, proto byte, srcPort, dstPort uint16, n int) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	var pkt []byte
+	if srcIP.To4() != nil {
+		pkt = make([]byte, 20+n)
+		pkt[0], pkt[9] = 0x45, proto
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		copy(pkt[12:], srcIP.To4())
+		copy(pkt[16:], dstIP.To4())
+		binary.BigEndian.PutUint16(pkt[20:], srcPort)
+		binary.BigEndian.PutUint16(pkt[22:], dstPort)
+		return pkt
+	}
+	pkt = make([]byte, 40+n)
+	pkt[0], pkt[6] = 0x60, proto
+	binary.BigEndian.PutUint16(pkt[4:], uint16(n))
+	copy(pkt[8:], srcIP)
+	copy(pkt[24:], dstIP)
+	binary.BigEndian.PutUint16(pkt[40:], srcPort)
+	binary.BigEndian.PutUint16(pkt[42:], dstPort)
+	return pkt
+}
+
+func TestCaptureMatch(t *testing.T) {
+	tcp4 := testPacket("10.0.0.1", "1.2.3.4", protoTCP, 40000, 443, 20)
+	udp6 := testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 53, 8)
+	for _, c := range []struct {
+		expr       string
+		tcp4, udp6 bool
+	}{
+		{"", true, true},
+		{"tcp", true, false},
+		{"ip6 and udp", false, true},
+		{"tcp port 443", true, false},
+		{"dst port 40000", false, false},
+		{"src port 40000 && !udp", true, false},
+		{"host 1.2.3.4 or dst net 2001:db8::/32", true, true},
+		{"not (src net 10.0.0.0/8 || port 53)", false, false},
+		{"icmp or icmp6", false, false},
+	} {
+		m, err := compileMatch(c.expr)
+		if err != nil {
+			t.Errorf("Failed to compile %q: %v", c.expr, err)
+			continue
+		}
+		for _, p := range []struct {
+			pkt      []byte
+			expected bool
+		}{{tcp4, c.tcp4}, {udp6, c.udp6}} {
+			info, _ := parsePacketInfo(p.pkt)
+			if m(&info) != p.expected {
+				t.Errorf("%q matched %v, expected %v", c.expr, !p.expected, p.expected)
+			}
+		}
+	}
+
+	for _, expr := range []string{"tcp and", "(udp", "port http", "host example.com", "frob"} {
+		if _, err := compileMatch(expr); err == nil {
+			t.Errorf("Expected error for %q", expr)
+		}
+	}
+}
+
+// readPcapng returns the blocks of a pcapng stream by type.
+func readPcapng(b []byte, t *testing.T) (types []uint32, bodies [][]byte) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("Truncated block of %v bytes", len(b))
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n%4 != 0 || n > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != uint32(n) {
+			t.Fatalf("Invalid block length %v", n)
+		}
+		types = append(types, binary.LittleEndian.Uint32(b))
+		bodies = append(bodies, b[8:n-4])
+		b = b[n:]
+	}
+	return types, bodies
+}
+
+// Packets of both directions should be written to the file, truncated to
+// the snap length.
+func TestCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tun.pcapng")
+	c, err := NewCapture(CaptureOptions{Path: path, Match: "tcp", SnapLen: 64, Name: "tun1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := testPacket("10.0.0.1", "1.2.3.4", protoTCP, 40000, 443, 100)
+	out := testPacket("1.2.3.4", "10.0.0.1", protoTCP, 443, 40000, 20)
+	var written [][]byte
+	f := NewCaptureFilter(writerFunc(func(b []byte) (int, error) {
+		written = append(written, b)
+		return len(b), nil
+	}), c)
+	core.WriteBatch(f, [][]byte{in, testPacket("10.0.0.1", "1.2.3.4", protoUDP, 40000, 53, 8)})
+	c.Output(func(b []byte) (int, error) { return len(b), nil })(out)
+	if len(written) != 2 {
+		t.Errorf("Expected 2 packets passed through, got %v", len(written))
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, bodies := readPcapng(b, t)
+	if len(types) != 4 || types[0] != pcapngSectionHeader || types[1] != pcapngInterfaceDesc {
+		t.Fatalf("Expected a header and 2 packets, got blocks %x", types)
+	}
+	if snapLen := binary.LittleEndian.Uint32(bodies[1][4:]); snapLen != 64 {
+		t.Errorf("Snap length %v, expected 64", snapLen)
+	}
+	for i, p := range []struct {
+		pkt   []byte
+		flags uint32
+	}{{in, pcapngFlagInbound}, {out, pcapngFlagOutbound}} {
+		body := bodies[2+i]
+		capLen := int(binary.LittleEndian.Uint32(body[12:]))
+		origLen := int(binary.LittleEndian.Uint32(body[16:]))
+		expected := p.pkt
+		if len(expected) > 64 {
+			expected = expected[:64]
+		}
+		if origLen != len(p.pkt) || !bytes.Equal(body[20:20+capLen], expected) {
+			t.Errorf("Packet %v captured %v of %v bytes, expected %v of %v", i, capLen, origLen, len(expected), len(p.pkt))
+		}
+		opt := body[20+pad4(capLen):]
+		if code := binary.LittleEndian.Uint16(opt); code != pcapngOptEPBFlags || binary.LittleEndian.Uint32(opt[4:]) != p.flags {
+			t.Errorf("Packet %v has flags % x, expected %v", i, opt[:8], p.flags)
+		}
+	}
+}
+
+// Packets which are not valid IP packets should be captured only without a
+// capture expression.
+func TestCaptureUnparsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bad := []byte{0x45, 0, 0}
+	for _, c := range []struct {
+		match   string
+		packets int
+	}{{"", 2}, {" ", 2}, {"udp", 1}} {
+		path := filepath.Join(dir, "tun.pcapng")
+		capture, err := NewCapture(CaptureOptions{Path: path, Match: c.match})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := capture.Output(func(b []byte) (int, error) { return len(b), nil })
+		output(bad)
+		output(testPacket("1.2.3.4", "10.0.0.1", protoUDP, 53, 40000, 8))
+		capture.Close()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if types, _ := readPcapng(b, t); len(types) != 2+c.packets {
+			t.Errorf("%q captured blocks %x, expected %v packets", c.match, types, c.packets)
+		}
+		os.Remove(path)
+	}
+}
+
+// The file should be rotated once it has grown larger than MaxFileSize.
+func TestCaptureRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tun.pcapng")
+	c, err := NewCapture(CaptureOptions{Path: path, MaxFileSize: 500, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := c.Output(func(b []byte) (int, error) { return len(b), nil })
+	for i := 0; i < 20; i++ {
+		output(testPacket("1.2.3.4", "10.0.0.1", protoUDP, 53, 40000, 100))
+		time.Sleep(time.Millisecond) // Not to overflow the queue
+	}
+	c.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 500 {
+			t.Errorf("%v has %v bytes, larger than the limit", name, len(b))
+		}
+		if types, _ := readPcapng(b, t); len(types) < 3 || types[0] != pcapngSectionHeader {
+			t.Errorf("%v has blocks %x, expected a header and packets", name, types)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files")
+	}
+}
+
+// Clients connected to the listener should receive the header and packets.
+func TestCaptureListen(t *testing.T) {
+	c, err := NewCapture(CaptureOptions{Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := net.Dial("tcp", c.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pkt := testPacket("10.0.0.1", "1.2.3.4", protoTCP, 40000, 443, 20)
+	f := NewCaptureFilter(writerFunc(func(b []byte) (int, error) { return len(b), nil }), c)
+	expected := len(appendPcapngHeader(nil, "", defaultCaptureSnapLen)) + len(appendPcapngPacket(nil, time.Now(), pkt, len(pkt), true))
+	for accepted := false; !accepted; time.Sleep(10 * time.Millisecond) {
+		c.clientsMu.Lock()
+		accepted = len(c.clients) == 1
+		c.clientsMu.Unlock()
+	}
+	f.Write(pkt)
+	b := make([]byte, expected)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if types, _ := readPcapng(b, t); len(types) != 3 || types[2] != pcapngEnhancedPacket {
+		t.Errorf("Expected a header and a packet, got blocks %x", types)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
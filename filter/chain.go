@@ -0,0 +1,474 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/shaping"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Action is what a rule of a Chain does with the packets it matches.
+type Action int
+
+const (
+	// Accept passes packets on to the stack, skipping the next rules.
+	Accept Action = iota
+	// Drop discards packets silently.
+	Drop
+	// Reject discards packets, answering TCP segments with a RST, and
+	// other packets with an ICMP or ICMPv6 administratively prohibited
+	// message.
+	Reject
+	// Mirror copies packets to a capture and goes on with the next rules.
+	Mirror
+	// RateLimit drops packets exceeding a rate and goes on with the next
+	// rules for the others.
+	RateLimit
+)
+
+var actionNames = []string{"accept", "drop", "reject", "mirror", "rateLimit"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+// ParseAction parses the name of an action, case-insensitively.
+func ParseAction(s string) (Action, error) {
+	for i, name := range actionNames {
+		if strings.EqualFold(s, name) {
+			return Action(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// terminal reports whether the action ends the traversal of a chain.
+func (a Action) terminal() bool {
+	return a == Accept || a == Drop || a == Reject
+}
+
+// PortRange is an inclusive range of TCP or UDP ports.
+type PortRange struct {
+	First, Last uint16
+}
+
+// ParsePortRanges parses a comma-separated list of ports and port ranges,
+// e.g. "135-139,445".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		first, last := f, f
+		if i := strings.IndexByte(f, '-'); i >= 0 {
+			first, last = f[:i], f[i+1:]
+		}
+		a, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q", f)
+		}
+		b, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+		if err != nil || b < a {
+			return nil, fmt.Errorf("invalid port range %q", f)
+		}
+		ranges = append(ranges, PortRange{uint16(a), uint16(b)})
+	}
+	return ranges, nil
+}
+
+// ParseProtocols parses a comma-separated list of IP protocols, names among
+// tcp, udp, icmp and icmp6, or numbers.
+func ParseProtocols(s string) ([]byte, error) {
+	var protos []byte
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch strings.ToLower(f) {
+		case "tcp":
+			protos = append(protos, protoTCP)
+		case "udp":
+			protos = append(protos, protoUDP)
+		case "icmp":
+			protos = append(protos, protoICMP)
+		case "icmp6", "icmpv6":
+			protos = append(protos, protoICMPv6)
+		default:
+			n, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid protocol %q", f)
+			}
+			protos = append(protos, byte(n))
+		}
+	}
+	return protos, nil
+}
+
+// Rule matches packets by all of its conditions which are set, a condition
+// with several values matches any of them. Packets without ports, i.e. not
+// TCP or UDP, or fragments but the first, never match port conditions.
+type Rule struct {
+	Name   string
+	Action Action
+
+	// Version is the IP version, 4 or 6, zero for both.
+	Version int
+
+	// Protocols are IP protocol numbers.
+	Protocols []byte
+
+	// Src and Dst are networks source and destination addresses belong
+	// to.
+	Src, Dst []*net.IPNet
+
+	SrcPorts, DstPorts []PortRange
+
+	// Rate is the number of packets per second RateLimit rules let pass,
+	// with bursts of up to Burst packets, Rate rounded up by default.
+	Rate  float64
+	Burst int
+
+	// Mirror is the capture Mirror rules copy packets to, closed with the
+	// chain.
+	Mirror *Capture
+}
+
+func (r *Rule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Action.String()
+}
+
+func (r *Rule) validate() error {
+	switch {
+	case r.Version != 0 && r.Version != 4 && r.Version != 6:
+		return fmt.Errorf("invalid IP version %v", r.Version)
+	case r.Action < Accept || r.Action > RateLimit:
+		return fmt.Errorf("invalid action %v", r.Action)
+	case r.Action == RateLimit && r.Rate <= 0:
+		return errors.New("rate required")
+	case r.Action == Mirror && r.Mirror == nil:
+		return errors.New("capture required")
+	}
+	return nil
+}
+
+func (r *Rule) match(info *packetInfo) bool {
+	if r.Version != 0 && r.Version != info.ver {
+		return false
+	}
+	if len(r.Protocols) > 0 && !matchProto(r.Protocols, info.proto) {
+		return false
+	}
+	if len(r.Src) > 0 && !matchNets(r.Src, info.src) {
+		return false
+	}
+	if len(r.Dst) > 0 && !matchNets(r.Dst, info.dst) {
+		return false
+	}
+	if len(r.SrcPorts) > 0 && (!info.ports || !matchPorts(r.SrcPorts, info.srcPort)) {
+		return false
+	}
+	if len(r.DstPorts) > 0 && (!info.ports || !matchPorts(r.DstPorts, info.dstPort)) {
+		return false
+	}
+	return true
+}
+
+func matchProto(protos []byte, p byte) bool {
+	for _, proto := range protos {
+		if proto == p {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPorts(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// Chain applies ordered rules to packets from TUN. Each packet goes through
+// the rules it matches until one with a terminal action, accept, drop or
+// reject, or the default action if none. Packets which are not valid IP
+// packets are passed on to the stack, which fails them.
+type Chain struct {
+	writer  io.Writer
+	reply   func([]byte) (int, error)
+	rules   []Rule
+	def     Action
+	buckets []*shaping.Bucket // Indexed as rules, for RateLimit rules
+	hits    []uint64          // Accessed atomically, indexed as rules
+}
+
+// NewChain creates a Chain writing the packets accepted to w, and the
+// packets rejecting others with reply, usually the output function of the
+// stack. The default action def is one of accept, drop and reject.
+func NewChain(w io.Writer, reply func([]byte) (int, error), rules []Rule, def Action) (*Chain, error) {
+	if !def.terminal() {
+		return nil, fmt.Errorf("invalid default action %v", def)
+	}
+	c := &Chain{
+		writer:  w,
+		reply:   reply,
+		rules:   rules,
+		def:     def,
+		buckets: make([]*shaping.Bucket, len(rules)),
+		hits:    make([]uint64, len(rules)),
+	}
+	for i := range rules {
+		r := &rules[i]
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d (%v): %v", i, r, err)
+		}
+		if r.Action == RateLimit {
+			c.buckets[i] = shaping.NewBucket(r.Rate, r.Burst)
+		}
+	}
+	return c, nil
+}
+
+func (c *Chain) Write(buf []byte) (int, error) {
+	if c.intercept(buf) {
+		return len(buf), nil
+	}
+	return c.writer.Write(buf)
+}
+
+func (c *Chain) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(c.writer, pkts, c.intercept)
+}
+
+// Hits returns the number of packets each rule has matched, rate-limited
+// packets included.
+func (c *Chain) Hits() []uint64 {
+	hits := make([]uint64, len(c.hits))
+	for i := range c.hits {
+		hits[i] = atomic.LoadUint64(&c.hits[i])
+	}
+	return hits
+}
+
+// Close closes the captures of Mirror rules.
+func (c *Chain) Close() error {
+	var err error
+	for i := range c.rules {
+		if m := c.rules[i].Mirror; m != nil {
+			if e := m.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// intercept consumes the packets dropped or rejected.
+func (c *Chain) intercept(pkt []byte) bool {
+	info, ok := parsePacketInfo(pkt)
+	if !ok {
+		return false
+	}
+	for i := range c.rules {
+		r := &c.rules[i]
+		if !r.match(&info) {
+			continue
+		}
+		atomic.AddUint64(&c.hits[i], 1)
+		switch r.Action {
+		case Mirror:
+			r.Mirror.capture(pkt, true)
+		case RateLimit:
+			if !c.buckets[i].Allow(time.Now(), 1) {
+				return true
+			}
+		default:
+			return c.apply(r.Action, pkt)
+		}
+	}
+	return c.apply(c.def, pkt)
+}
+
+// apply applies a terminal action.
+func (c *Chain) apply(a Action, pkt []byte) bool {
+	switch a {
+	case Accept:
+		return false
+	case Reject:
+		if reply := core.BuildReject(pkt, core.AdminProhibited); reply != nil && c.reply != nil {
+			c.reply(reply)
+		}
+	}
+	return true
+}
+
+// ChainConfig is the configuration of a Chain in JSON, e.g. blocking SMB
+// and NetBIOS:
+//
+//	{
+//		"default": "accept",
+//		"rules": [
+//			{"name": "smb", "protocol": "tcp", "dstPorts": "139,445", "action": "reject"},
+//			{"name": "netbios", "protocol": "udp", "dstPorts": "137-138", "action": "drop"},
+//			{"protocol": "icmp,icmp6", "action": "rateLimit", "rate": 10, "burst": 20},
+//			{"dst": ["10.0.0.0/8"], "action": "mirror", "mirror": {"path": "lan.pcapng"}}
+//		]
+//	}
+type ChainConfig struct {
+	Default string       `json:"default"`
+	Rules   []RuleConfig `json:"rules"`
+}
+
+// RuleConfig is the configuration of a Rule, Src and Dst are CIDR networks
+// or addresses, Protocol is parsed by ParseProtocols, SrcPorts and DstPorts
+// by ParsePortRanges. Mirror has the fields of CaptureOptions, the name of
+// the interface is the name of the rule by default.
+type RuleConfig struct {
+	Name     string          `json:"name"`
+	Action   string          `json:"action"`
+	Version  int             `json:"version"`
+	Protocol string          `json:"protocol"`
+	Src      []string        `json:"src"`
+	Dst      []string        `json:"dst"`
+	SrcPorts string          `json:"srcPorts"`
+	DstPorts string          `json:"dstPorts"`
+	Rate     float64         `json:"rate"`
+	Burst    int             `json:"burst"`
+	Mirror   *CaptureOptions `json:"mirror"`
+}
+
+// LoadChainConfig reads a ChainConfig from a JSON file.
+func LoadChainConfig(path string) (*ChainConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := new(ChainConfig)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid filter rules %v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// NewChainFromConfig is like NewChain with the rules and the default
+// action, accept if empty, of cfg. Captures of Mirror rules are started.
+func NewChainFromConfig(w io.Writer, reply func([]byte) (int, error), cfg *ChainConfig) (*Chain, error) {
+	def := Accept
+	if cfg.Default != "" {
+		var err error
+		if def, err = ParseAction(cfg.Default); err != nil {
+			return nil, err
+		}
+	}
+	rules := make([]Rule, 0, len(cfg.Rules))
+	closeMirrors := func() {
+		for _, r := range rules {
+			if r.Mirror != nil {
+				r.Mirror.Close()
+			}
+		}
+	}
+	for i := range cfg.Rules {
+		r, err := cfg.Rules[i].rule()
+		if err != nil {
+			closeMirrors()
+			return nil, fmt.Errorf("rule %d (%v): %v", i, cfg.Rules[i].Name, err)
+		}
+		rules = append(rules, r)
+	}
+	c, err := NewChain(w, reply, rules, def)
+	if err != nil {
+		closeMirrors()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (rc *RuleConfig) rule() (Rule, error) {
+	r := Rule{Name: rc.Name, Version: rc.Version, Rate: rc.Rate, Burst: rc.Burst}
+	var err error
+	if r.Action, err = ParseAction(rc.Action); err != nil {
+		return r, err
+	}
+	if rc.Protocol != "" {
+		if r.Protocols, err = ParseProtocols(rc.Protocol); err != nil {
+			return r, err
+		}
+	}
+	if r.Src, err = parseNets(rc.Src); err != nil {
+		return r, err
+	}
+	if r.Dst, err = parseNets(rc.Dst); err != nil {
+		return r, err
+	}
+	if rc.SrcPorts != "" {
+		if r.SrcPorts, err = ParsePortRanges(rc.SrcPorts); err != nil {
+			return r, err
+		}
+	}
+	if rc.DstPorts != "" {
+		if r.DstPorts, err = ParsePortRanges(rc.DstPorts); err != nil {
+			return r, err
+		}
+	}
+	if rc.Mirror != nil {
+		opts := *rc.Mirror
+		if opts.Name == "" {
+			opts.Name = rc.Name
+		}
+		if r.Mirror, err = NewCapture(opts); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// parseNets parses CIDR networks, or addresses as networks of their own.
+func parseNets(ss []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
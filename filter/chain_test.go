@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tcpSYN returns a TCP SYN packet, which can be answered with a RST.
+func tcpSYN(src, dst string, srcPort, dstPort uint16) []byte {
+	pkt := testPacket(src, dst, protoTCP, srcPort, dstPort, 20)
+	tcp := pkt[len(pkt)-20:]
+	tcp[12], tcp[13] = 5<<4, 0x02
+	return pkt
+}
+
+// withHopByHop inserts an empty hop-by-hop options header in an IPv6 packet.
+func withHopByHop(pkt []byte) []byte {
+	b := make([]byte, len(pkt)+8)
+	copy(b, pkt[:40])
+	copy(b[48:], pkt[40:])
+	b[5] += 8
+	b[6], b[40] = 0, pkt[6]
+	return b
+}
+
+// Each packet should go through the rules until a terminal one, rejected
+// ones answered.
+func TestChain(t *testing.T) {
+	cfg := &ChainConfig{
+		Default: "drop",
+		Rules: []RuleConfig{
+			{Name: "smb", Action: "reject", Protocol: "tcp", DstPorts: "139,445"},
+			{Name: "netbios", Action: "reject", Protocol: "udp", DstPorts: "137-138"},
+			{Name: "v6", Action: "accept", Version: 6, Src: []string{"fd00::/8"}},
+			{Name: "lan", Action: "drop", Dst: []string{"192.168.0.0/16", "1.2.3.4"}},
+			{Name: "tcp", Action: "accept", Protocol: "tcp,icmp", Src: []string{"10.0.0.0/8"}},
+		},
+	}
+	var written, replies [][]byte
+	c, err := NewChainFromConfig(writerFunc(func(b []byte) (int, error) {
+		written = append(written, b)
+		return len(b), nil
+	}), func(b []byte) (int, error) {
+		replies = append(replies, b)
+		return len(b), nil
+	}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, p := range []struct {
+		pkt    []byte
+		passed bool
+		reply  byte // IP protocol of the reply, if any
+	}{
+		{tcpSYN("10.0.0.1", "5.6.7.8", 40000, 445), false, protoTCP},
+		{tcpSYN("fd00::1", "2001:db8::1", 40000, 139), false, protoTCP},
+		{testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 137, 8), false, protoICMP},
+		{testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 138, 8), false, protoICMPv6},
+		{withHopByHop(testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 138, 8)), false, protoICMPv6},
+		{testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 53, 8), true, 0},
+		{testPacket("fe80::1", "2001:db8::1", protoUDP, 40000, 53, 8), false, 0},
+		{tcpSYN("10.0.0.1", "192.168.1.1", 40000, 80), false, 0},
+		{tcpSYN("10.0.0.1", "1.2.3.4", 40000, 80), false, 0},
+		{tcpSYN("10.0.0.1", "1.2.3.5", 40000, 80), true, 0},
+		{testPacket("10.0.0.1", "1.2.3.5", protoUDP, 40000, 53, 8), false, 0},
+		{testPacket("10.0.0.1", "1.2.3.5", protoICMP, 0x0800, 0, 8), true, 0},
+	} {
+		written, replies = nil, nil
+		c.WriteBatch([][]byte{p.pkt})
+		info, _ := parsePacketInfo(p.pkt)
+		if passed := len(written) == 1; passed != p.passed {
+			t.Errorf("Packet %+v passed %v, expected %v", info, passed, p.passed)
+		}
+		if p.reply == 0 {
+			if len(replies) != 0 {
+				t.Errorf("Packet %+v answered", info)
+			}
+			continue
+		}
+		if len(replies) != 1 {
+			t.Errorf("Packet %+v answered %v times, expected once", info, len(replies))
+			continue
+		}
+		if reply, _ := parsePacketInfo(replies[0]); reply.proto != p.reply || !reply.src.Equal(info.dst) || !reply.dst.Equal(info.src) {
+			t.Errorf("Packet %+v answered with %+v", info, reply)
+		}
+	}
+	if hits := c.Hits(); hits[0] != 2 || hits[1] != 3 || hits[4] != 2 {
+		t.Errorf("Unexpected hits %v", hits)
+	}
+}
+
+// Packets over the rate should be dropped, the others go on through the
+// next rules.
+func TestChainRateLimit(t *testing.T) {
+	var written int
+	c, err := NewChain(writerFunc(func(b []byte) (int, error) {
+		written++
+		return len(b), nil
+	}), nil, []Rule{
+		{Action: RateLimit, Protocols: []byte{protoICMP}, Rate: 0.001, Burst: 3},
+		{Action: Accept, Protocols: []byte{protoICMP}},
+	}, Drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := testPacket("10.0.0.1", "1.2.3.4", protoICMP, 0x0800, 0, 8)
+	udp := testPacket("10.0.0.1", "1.2.3.4", protoUDP, 40000, 53, 8)
+	n, err := c.WriteBatch([][]byte{echo, udp, echo, echo, echo, echo, udp})
+	if n != 7 || err != nil {
+		t.Errorf("Wrote %v packets, %v", n, err)
+	}
+	if written != 3 {
+		t.Errorf("%v packets passed, expected 3", written)
+	}
+	if hits := c.Hits(); hits[0] != 5 || hits[1] != 3 {
+		t.Errorf("Unexpected hits %v", hits)
+	}
+}
+
+func TestChainConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+
+	for _, c := range []struct {
+		config string
+		valid  bool
+	}{
+		{`{"rules": [{"name": "smb", "protocol": "tcp", "dstPorts": "139,445", "action": "reject"}]}`, true},
+		{`{"default": "reject", "rules": [{"src": ["fd00::/8", "10.0.0.1"], "action": "Accept"}]}`, true},
+		{`{"rules": [{"protocol": "icmp,58", "action": "rateLimit", "rate": 10}]}`, true},
+		{`{"rules": [{"action": "mirror", "mirror": {"path": "` + filepath.ToSlash(filepath.Join(dir, "m.pcapng")) + `"}}]}`, true},
+		{`{"default": "mirror"}`, false},
+		{`{"rules": [{"action": "rateLimit"}]}`, false},
+		{`{"rules": [{"action": "mirror"}]}`, false},
+		{`{"rules": [{"action": "pass"}]}`, false},
+		{`{"rules": [{"action": "drop", "version": 5}]}`, false},
+		{`{"rules": [{"action": "drop", "protocol": "sctp"}]}`, false},
+		{`{"rules": [{"action": "drop", "dst": ["10.0.0.0/33"]}]}`, false},
+		{`{"rules": [{"action": "drop", "dstPorts": "445-139"}]}`, false},
+		{`{"rules": [{"action": "drop", "dstPort": "445"}]}`, false},
+	} {
+		if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadChainConfig(path)
+		var chain *Chain
+		if err == nil {
+			chain, err = NewChainFromConfig(ioutil.Discard, nil, cfg)
+		}
+		if (err == nil) != c.valid {
+			t.Errorf("Config %s, got %v", c.config, err)
+		}
+		if chain != nil {
+			chain.Close()
+		}
+	}
+}
@@ -2,9 +2,35 @@ package filter
 
 import (
 	"io"
+
+	"github.com/eycorsican/go-tun2socks/core"
 )
 
 // Filter is used for filtering IP packets comming from TUN.
 type Filter interface {
 	io.Writer
 }
+
+// writeBatch writes packets to w in batches, except those intercepted,
+// which are consumed by the filter and counted as written. Packets before
+// one are written before it's passed to intercept, so that packets are
+// intercepted in order and none after a failed write.
+func writeBatch(w io.Writer, pkts [][]byte, intercept func([]byte) bool) (int, error) {
+	start := 0
+	for i, pkt := range pkts {
+		if start < i {
+			if n, err := core.WriteBatch(w, pkts[start:i]); err != nil {
+				return start + n, err
+			}
+			start = i
+		}
+		if intercept(pkt) {
+			start = i + 1
+		}
+	}
+	if start == len(pkts) {
+		return start, nil
+	}
+	n, err := core.WriteBatch(w, pkts[start:])
+	return start + n, err
+}
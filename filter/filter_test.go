@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"errors"
+	"testing"
+)
+
+// Packets should be written before the next one is passed to intercept,
+// and none should be intercepted after a failed write.
+func TestWriteBatch(t *testing.T) {
+	var events []string
+	w := writerFunc(func(b []byte) (int, error) {
+		if b[0] == 'f' {
+			return 0, errors.New("failed")
+		}
+		events = append(events, "write "+string(b))
+		return len(b), nil
+	})
+	intercept := func(b []byte) bool {
+		events = append(events, "intercept "+string(b))
+		return b[0] == 'x'
+	}
+
+	n, err := writeBatch(w, [][]byte{[]byte("a"), []byte("x"), []byte("b")}, intercept)
+	if n != 3 || err != nil {
+		t.Errorf("Wrote %v packets, %v", n, err)
+	}
+	expected := []string{"intercept a", "write a", "intercept x", "intercept b", "write b"}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events %q", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Unexpected events %q", events)
+		}
+	}
+
+	events = nil
+	n, err = writeBatch(w, [][]byte{[]byte("f"), []byte("x")}, intercept)
+	if n != 0 || err == nil {
+		t.Errorf("Wrote %v packets, %v", n, err)
+	}
+	if len(events) != 1 || events[0] != "intercept f" {
+		t.Errorf("Unexpected events %q", events)
+	}
+}
@@ -0,0 +1,44 @@
+// +build go1.18
+
+package filter
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func fuzzSeeds() [][]byte {
+	icmp := testPacket("10.0.0.1", "1.2.3.4", protoICMP, 0x0800, 0, 8)
+	return [][]byte{
+		testPacket("10.0.0.1", "1.2.3.4", protoTCP, 40000, 443, 20),
+		testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 53, 8),
+		icmp,
+		icmp[:10],
+	}
+}
+
+// Malformed packets should be passed through the filter to the stack.
+func FuzzICMPEchoFilter(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add(pkt)
+	}
+	w := NewICMPEchoFilter(ioutil.Discard, 0)
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		w.Write(pkt)
+	})
+}
+
+func FuzzCaptureMatch(f *testing.F) {
+	for _, pkt := range fuzzSeeds() {
+		f.Add("tcp port 443 or (ip6 and not dst net 10.0.0.0/8)", pkt)
+	}
+	f.Fuzz(func(t *testing.T, expr string, pkt []byte) {
+		m, err := compileMatch(expr)
+		if err != nil {
+			return
+		}
+		if info, ok := parsePacketInfo(pkt); ok {
+			m(&info)
+		}
+	})
+}
@@ -18,18 +18,30 @@ func NewICMPEchoFilter(w io.Writer, delay int) Filter {
 }
 
 func (w *icmpEchoFilter) Write(buf []byte) (int, error) {
-	if uint8(buf[9]) == packet.PROTOCOL_ICMP {
-		payload := make([]byte, len(buf))
-		copy(payload, buf)
-		go func(data []byte) {
-			time.Sleep(time.Duration(w.delay) * time.Millisecond)
-			_, err := w.writer.Write(data)
-			if err != nil {
-				log.Fatalf("failed to input data to the stack: %v", err)
-			}
-		}(payload)
+	if w.intercept(buf) {
 		return len(buf), nil
-	} else {
-		return w.writer.Write(buf)
 	}
+	return w.writer.Write(buf)
+}
+
+func (w *icmpEchoFilter) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(w.writer, pkts, w.intercept)
+}
+
+// intercept writes ICMP packets after a delay, it reports whether buf is
+// an ICMP packet.
+func (w *icmpEchoFilter) intercept(buf []byte) bool {
+	if packet.PeekIPVersion(buf) != packet.IPVERSION_4 || packet.PeekProtocol(buf) != "icmp" {
+		return false
+	}
+	payload := make([]byte, len(buf))
+	copy(payload, buf)
+	go func(data []byte) {
+		time.Sleep(time.Duration(w.delay) * time.Millisecond)
+		_, err := w.writer.Write(data)
+		if err != nil {
+			log.Fatalf("failed to input data to the stack: %v", err)
+		}
+	}(payload)
+	return true
 }
@@ -1,9 +1,11 @@
 package filter
 
 import (
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
-	"runtime"
+	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -11,118 +13,389 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/common/packet"
-	"github.com/eycorsican/go-tun2socks/core"
 )
 
+const (
+	// How long relayed echo requests wait for their replies.
+	icmpRelayTimeout = 10 * time.Second
+
+	// Number of times sending is retried if the socket is out of buffers.
+	icmpRelaySendRetries = 3
+)
+
+var errICMPRelayClosed = errors.New("ICMP relay closed")
+
 type icmpRelayFilter struct {
 	writer      io.Writer
 	tunDev      io.Writer
 	sendThrough string
 	privileged  bool
+	id          uint16 // ID of the echo requests relayed
+
+	mu     sync.Mutex
+	closed bool
+	relays [2]*icmpRelay // For IPv4 and IPv6, opened on demand
 }
 
+// NewICMPRelayFilter creates a filter relaying ICMP packets and ICMPv6 echo
+// requests from TUN through sockets bound to sendThrough, raw sockets if
+// privileged, or unprivileged ping sockets otherwise. Replies to echo
+// requests are written to tunDev. The filter is an io.Closer closing the
+// sockets.
 func NewICMPRelayFilter(w io.Writer, tunDev io.Writer, sendThrough string, privileged bool) Filter {
-	return &icmpRelayFilter{writer: w, tunDev: tunDev, sendThrough: sendThrough, privileged: privileged}
+	return &icmpRelayFilter{
+		writer:      w,
+		tunDev:      tunDev,
+		sendThrough: sendThrough,
+		privileged:  privileged,
+		id:          uint16(os.Getpid()),
+	}
 }
 
 func (w *icmpRelayFilter) Write(buf []byte) (int, error) {
-	if uint8(buf[9]) == packet.PROTOCOL_ICMP &&
-		packet.IPVERSION_4 == packet.PeekIPVersion(buf) {
+	if w.intercept(buf) {
+		return len(buf), nil
+	}
+	return w.writer.Write(buf)
+}
+
+func (w *icmpRelayFilter) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(w.writer, pkts, w.intercept)
+}
+
+// Close closes the sockets of the relay, packets are dropped from then on.
+func (w *icmpRelayFilter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	relays := w.relays
+	w.relays = [2]*icmpRelay{}
+	w.mu.Unlock()
+	for _, r := range relays {
+		if r != nil {
+			r.conn.Close()
+		}
+	}
+	return nil
+}
+
+// intercept relays ICMP packets and ICMPv6 echo requests, it reports whether
+// buf is one of them. Other ICMPv6 messages, e.g. neighbor discovery, and
+// echo requests behind extension headers are left to the stack.
+func (w *icmpRelayFilter) intercept(buf []byte) bool {
+	switch packet.PeekIPVersion(buf) {
+	case packet.IPVERSION_4:
+		if packet.PeekProtocol(buf) != "icmp" {
+			return false
+		}
 		packet := gopacket.NewPacket(buf, layers.LayerTypeIPv4, gopacket.Default) // copy
 		if ip4Layer := packet.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
 			if ip4, ok := ip4Layer.(*layers.IPv4); ok {
-				go w.relayICMPv4(ip4.Payload, ip4.SrcIP, ip4.DstIP)
+				w.relayICMP(ip4.Payload, ip4.SrcIP, ip4.DstIP)
 			} else {
 				log.Errorf("error convert IPv4 layer")
 			}
 		}
-		return len(buf), nil
-	} else {
-		return w.writer.Write(buf)
+		return true
+	case packet.IPVERSION_6:
+		if len(buf) <= 40 || buf[6] != protoICMPv6 || buf[40] != byte(layers.ICMPv6TypeEchoRequest) {
+			return false
+		}
+		packet := gopacket.NewPacket(buf, layers.LayerTypeIPv6, gopacket.Default) // copy
+		if ip6Layer := packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+			if ip6, ok := ip6Layer.(*layers.IPv6); ok {
+				w.relayICMP(ip6.Payload, ip6.SrcIP, ip6.DstIP)
+			} else {
+				log.Errorf("error convert IPv6 layer")
+			}
+		}
+		return true
 	}
+	return false
 }
 
-func (w *icmpRelayFilter) relayICMPv4(data []byte, srcIP, dstIP net.IP) {
-	var network string
-	var dstAddr net.Addr
-
-	if w.privileged {
-		network = "ip4:icmp"
-		dstAddr = &net.IPAddr{IP: dstIP}
-	} else {
-		network = "udp4"
-		dstAddr = &net.UDPAddr{IP: dstIP}
+// listenAddr returns the address ICMP sockets of the family of ip are bound
+// to, sendThrough if it belongs to the family, or the unspecified address.
+func (w *icmpRelayFilter) listenAddr(ip net.IP) string {
+	through := net.ParseIP(w.sendThrough)
+	if ip.To4() != nil {
+		if through != nil && through.To4() == nil {
+			return "0.0.0.0"
+		}
+		return w.sendThrough
 	}
+	if through == nil || through.To4() != nil {
+		return "::"
+	}
+	return w.sendThrough
+}
 
-	conn, err := icmp.ListenPacket(network, w.sendThrough)
+// relayICMP relays an ICMP or ICMPv6 message from srcIP to dstIP.
+func (w *icmpRelayFilter) relayICMP(data []byte, srcIP, dstIP net.IP) {
+	r, err := w.relay(dstIP)
 	if err != nil {
 		log.Errorf("listen ICMP failed: %v", err)
 		return
 	}
-	defer conn.Close()
+	r.send(data, srcIP, dstIP)
+}
 
-	wg := new(sync.WaitGroup)
+// relay returns the relay of the family of ip, opening it if needed.
+func (w *icmpRelayFilter) relay(ip net.IP) (*icmpRelay, error) {
+	v6 := ip.To4() == nil
+	i := 0
+	if v6 {
+		i = 1
+	}
 
-	if runtime.GOOS == "windows" {
-		wg.Add(1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, errICMPRelayClosed
+	}
+	if w.relays[i] != nil {
+		return w.relays[i], nil
+	}
 
-		go func() {
-			defer wg.Done()
+	var network string
+	switch {
+	case w.privileged && !v6:
+		network = "ip4:icmp"
+	case w.privileged:
+		network = "ip6:ipv6-icmp"
+	case !v6:
+		network = "udp4"
+	default:
+		network = "udp6"
+	}
+	conn, err := icmp.ListenPacket(network, w.listenAddr(ip))
+	if err != nil {
+		return nil, err
+	}
+	if w.privileged && v6 {
+		// Raw ICMPv6 sockets receive neighbor discovery and the like.
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		conn.IPv6PacketConn().SetICMPFilter(&f)
+	}
+	r := &icmpRelay{filter: w, v6: v6, conn: conn, pending: make(map[uint16]*icmpEcho)}
+	w.relays[i] = r
+	go r.loop()
+	return r, nil
+}
 
-			buf := core.NewBytes(core.BufSize)
-			defer core.FreeBytes(buf)
+// remove forgets a relay whose socket has failed, so that the next packet
+// opens another one.
+func (w *icmpRelayFilter) remove(r *icmpRelay) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.relays {
+		if w.relays[i] == r {
+			w.relays[i] = nil
+		}
+	}
+}
 
-			conn.SetReadDeadline(time.Now().Add(4 * time.Second))
-			n, _, err := conn.ReadFrom(buf)
-			if err != nil {
-				log.Debugf("read remote failed: %v", err)
-				return
-			}
+// icmpRelay is a long-lived ICMP or ICMPv6 socket the echo requests of all
+// clients are relayed through. Each request is given the ID of the filter
+// and a sequence number of the socket, replies are matched to requests by
+// them and the remote address, then given back the ID and the sequence
+// number of the request.
+type icmpRelay struct {
+	filter *icmpRelayFilter
+	v6     bool
+	conn   *icmp.PacketConn
 
-			ip := &layers.IPv4{
-				Version:  4,
-				IHL:      5,
-				Length:   uint16(20 + n),
-				TTL:      64,
-				Id:       2048,
-				SrcIP:    dstIP,
-				DstIP:    srcIP,
-				Protocol: layers.IPProtocolICMPv4,
-			}
-			pktbuf := gopacket.NewSerializeBuffer()
-			opts := gopacket.SerializeOptions{ComputeChecksums: true}
-			err = gopacket.SerializeLayers(pktbuf, opts, ip, gopacket.Payload(buf[:n]))
-			if err != nil {
-				log.Debugf("serialize packet failed: %v", err)
-				return
-			}
+	mu      sync.Mutex
+	seq     uint16
+	pending map[uint16]*icmpEcho // By sequence number, bounded by their range
+}
 
-			w.tunDev.Write(pktbuf.Bytes())
-		}()
+// icmpEcho is an echo request waiting for its reply.
+type icmpEcho struct {
+	src, dst net.IP
+	id, seq  uint16
+	expires  time.Time
+}
+
+func (r *icmpRelay) echoTypes() (request, reply byte) {
+	if r.v6 {
+		return byte(layers.ICMPv6TypeEchoRequest), byte(layers.ICMPv6TypeEchoReply)
+	}
+	return layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply
+}
+
+// send sends a message, echo requests are tracked and rewritten.
+func (r *icmpRelay) send(msg []byte, srcIP, dstIP net.IP) {
+	if request, _ := r.echoTypes(); len(msg) >= 8 && msg[0] == request {
+		r.track(msg, srcIP, dstIP)
+	}
+
+	var dstAddr net.Addr = &net.IPAddr{IP: dstIP}
+	if !r.filter.privileged {
+		dstAddr = &net.UDPAddr{IP: dstIP}
+	}
+	for i := 0; ; i++ {
+		_, err := r.conn.WriteTo(msg, dstAddr)
+		if err == nil {
+			return
+		}
+		if neterr, ok := err.(*net.OpError); ok && neterr.Err == syscall.ENOBUFS && i < icmpRelaySendRetries {
+			continue
+		}
+		log.Debugf("failed to send ICMP packet: %v", err)
+		return
 	}
+}
 
-	wg.Add(1)
+// track records an echo request, and gives it the ID of the filter and the
+// next sequence number.
+func (r *icmpRelay) track(msg []byte, srcIP, dstIP net.IP) {
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+	r.pending[seq] = &icmpEcho{
+		src:     srcIP,
+		dst:     dstIP,
+		id:      binary.BigEndian.Uint16(msg[4:]),
+		seq:     binary.BigEndian.Uint16(msg[6:]),
+		expires: time.Now().Add(icmpRelayTimeout),
+	}
+	r.mu.Unlock()
+	r.rewrite(msg, r.filter.id, seq)
+}
 
-	go func() {
-		defer wg.Done()
+// rewrite sets the ID and the sequence number of an echo message. Checksums
+// of ICMPv6 messages are computed by the kernel when sent, or by
+// buildICMPPacket.
+func (r *icmpRelay) rewrite(msg []byte, id, seq uint16) {
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	if !r.v6 {
+		msg[2], msg[3] = 0, 0
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+}
 
-		for {
-			conn.SetWriteDeadline(time.Now().Add(2 * time.Millisecond))
-			if _, err := conn.WriteTo(data, dstAddr); err != nil {
-				if neterr, ok := err.(*net.OpError); ok {
-					if neterr.Err == syscall.ENOBUFS {
-						log.Debugf("failed to send ICMP packet: %v", err)
-						continue
-					}
-				}
-				log.Debugf("failed to send ICMP packet: %v", err)
+// loop reads replies until the socket is closed or fails.
+func (r *icmpRelay) loop() {
+	defer r.conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			r.filter.remove(r)
+			r.filter.mu.Lock()
+			closed := r.filter.closed
+			r.filter.mu.Unlock()
+			if !closed {
+				log.Errorf("read ICMP failed: %v", err)
 			}
 			return
 		}
-	}()
+		var from net.IP
+		switch a := peer.(type) {
+		case *net.IPAddr:
+			from = a.IP
+		case *net.UDPAddr:
+			from = a.IP
+		}
+		r.reply(buf[:n], from)
+	}
+}
+
+// reply writes an echo reply to TUN if it matches a request.
+func (r *icmpRelay) reply(msg []byte, from net.IP) {
+	if _, reply := r.echoTypes(); len(msg) < 8 || msg[0] != reply {
+		return
+	}
+	// Raw sockets receive the replies to any socket, while the kernel
+	// gives unprivileged ping sockets IDs of its own.
+	if r.filter.privileged && binary.BigEndian.Uint16(msg[4:]) != r.filter.id {
+		return
+	}
+	seq := binary.BigEndian.Uint16(msg[6:])
+	r.mu.Lock()
+	e := r.pending[seq]
+	if e == nil || !e.dst.Equal(from) {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.pending, seq)
+	r.mu.Unlock()
+	if time.Now().After(e.expires) {
+		return
+	}
+
+	r.rewrite(msg, e.id, e.seq)
+	pkt, err := buildICMPPacket(msg, e.dst, e.src)
+	if err != nil {
+		log.Debugf("serialize packet failed: %v", err)
+		return
+	}
+	if _, err := r.filter.tunDev.Write(pkt); err != nil {
+		log.Debugf("failed to write ICMP reply: %v", err)
+	}
+}
+
+// icmpChecksum returns the checksum of an ICMP message whose checksum field
+// is zero.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for ; len(msg) >= 2; msg = msg[2:] {
+		sum += uint32(msg[0])<<8 | uint32(msg[1])
+	}
+	if len(msg) == 1 {
+		sum += uint32(msg[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// buildICMPPacket builds the IPv4 or IPv6 packet carrying an ICMP or ICMPv6
+// message from srcIP to dstIP. Checksums of ICMPv6 messages cover the
+// addresses, so they are computed again.
+func buildICMPPacket(msg []byte, srcIP, dstIP net.IP) ([]byte, error) {
+	pktbuf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if srcIP.To4() != nil {
+		ip := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			Length:   uint16(20 + len(msg)),
+			TTL:      64,
+			Id:       2048,
+			SrcIP:    srcIP,
+			DstIP:    dstIP,
+			Protocol: layers.IPProtocolICMPv4,
+		}
+		if err := gopacket.SerializeLayers(pktbuf, opts, ip, gopacket.Payload(msg)); err != nil {
+			return nil, err
+		}
+		return pktbuf.Bytes(), nil
+	}
 
-	wg.Wait()
+	if len(msg) < 4 {
+		return nil, errors.New("ICMPv6 message too short")
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		Length:     uint16(len(msg)),
+		HopLimit:   64,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+		NextHeader: layers.IPProtocolICMPv6,
+	}
+	icmp6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(msg[0], msg[1])}
+	icmp6.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(pktbuf, opts, ip, icmp6, gopacket.Payload(msg[4:])); err != nil {
+		return nil, err
+	}
+	return pktbuf.Bytes(), nil
 }
@@ -0,0 +1,162 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// checksum returns the one's complement sum of b.
+func checksum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
+
+// Replies should be carried by packets of the family of the addresses,
+// with checksums valid for the new addresses.
+func TestBuildICMPPacket(t *testing.T) {
+	// An echo reply with a checksum for other addresses.
+	msg := []byte{0, 0, 0xde, 0xad, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+
+	pkt, err := buildICMPPacket(msg, net.ParseIP("1.2.3.4"), net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := parsePacketInfo(pkt)
+	if !ok || info.ver != 4 || info.proto != protoICMP || !info.src.Equal(net.ParseIP("1.2.3.4")) || !info.dst.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unexpected packet %+v", info)
+	}
+	if checksum(0, pkt[:20]) != 0xffff || !bytes.Equal(pkt[20:], msg) {
+		t.Errorf("Unexpected packet % x", pkt)
+	}
+
+	msg[0] = 129
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("fd00::1")
+	pkt, err = buildICMPPacket(msg, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok = parsePacketInfo(pkt)
+	if !ok || info.ver != 6 || info.proto != protoICMPv6 || !info.src.Equal(src) || !info.dst.Equal(dst) {
+		t.Errorf("Unexpected packet %+v", info)
+	}
+	if len(pkt) != 40+len(msg) || binary.BigEndian.Uint16(pkt[4:]) != uint16(len(msg)) || !bytes.Equal(pkt[44:], msg[4:]) {
+		t.Fatalf("Unexpected packet % x", pkt)
+	}
+	pseudo := make([]byte, 40)
+	copy(pseudo, src)
+	copy(pseudo[16:], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(msg)))
+	pseudo[39] = protoICMPv6
+	if checksum(checksum(0, pseudo), pkt[40:]) != 0xffff {
+		t.Errorf("Invalid ICMPv6 checksum % x", pkt[42:44])
+	}
+
+	if _, err := buildICMPPacket(msg[:3], src, dst); err == nil {
+		t.Error("Expected an error for a short message")
+	}
+}
+
+// echoRequest returns an ICMP or ICMPv6 echo request packet.
+func echoRequest(src, dst string, id, seq uint16) []byte {
+	proto, typ := byte(protoICMP), byte(8)
+	if net.ParseIP(dst).To4() == nil {
+		proto, typ = protoICMPv6, 128
+	}
+	pkt := testPacket(src, dst, proto, 0, 0, 16)
+	msg := pkt[len(pkt)-16:]
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "relayed!")
+	if proto == protoICMP {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	return pkt
+}
+
+// Echo requests should be relayed through a shared socket, and the replies
+// written back with the ID and the sequence number of the requests.
+func TestICMPRelay(t *testing.T) {
+	for _, c := range []struct {
+		network string
+		local   string
+		src     string
+	}{
+		{"ip4:icmp", "127.0.0.1", "10.0.0.1"},
+		{"ip6:ipv6-icmp", "::1", "fd00::1"},
+	} {
+		privileged := true
+		conn, err := icmp.ListenPacket(c.network, c.local)
+		if err == nil {
+			conn.Close()
+		} else {
+			privileged = false
+			network := "udp4"
+			if c.network == "ip6:ipv6-icmp" {
+				network = "udp6"
+			}
+			if conn, err = icmp.ListenPacket(network, c.local); err != nil {
+				t.Logf("Skipped %v, no ICMP sockets: %v", c.local, err)
+				continue
+			}
+			conn.Close()
+		}
+
+		replies := make(chan []byte, 10)
+		f := NewICMPRelayFilter(ioutil.Discard, writerFunc(func(b []byte) (int, error) {
+			replies <- append([]byte(nil), b...)
+			return len(b), nil
+		}), "", privileged)
+		// Two of the requests have the same ID and sequence number.
+		core.WriteBatch(f, [][]byte{echoRequest(c.src, c.local, 0x1234, 1), echoRequest(c.src, c.local, 0x1234, 2)})
+		f.Write(echoRequest(c.src, c.local, 0x1234, 1))
+
+		seqs := map[uint16]int{}
+		for i := 0; i < 3; i++ {
+			var pkt []byte
+			select {
+			case pkt = <-replies:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Received %v replies from %v, expected 3", i, c.local)
+			}
+			info, ok := parsePacketInfo(pkt)
+			if !ok || !info.src.Equal(net.ParseIP(c.local)) || !info.dst.Equal(net.ParseIP(c.src)) {
+				t.Errorf("Unexpected reply %+v", info)
+				continue
+			}
+			hl := 20
+			if info.ver == 6 {
+				hl = 40
+			}
+			msg := pkt[hl:]
+			if id := binary.BigEndian.Uint16(msg[4:]); id != 0x1234 || !bytes.Equal(msg[8:], []byte("relayed!")) {
+				t.Errorf("Unexpected reply % x", msg)
+			}
+			if info.ver == 4 && icmpChecksum(msg) != 0 {
+				t.Errorf("Invalid checksum of % x", msg)
+			}
+			seqs[binary.BigEndian.Uint16(msg[6:])]++
+		}
+		if seqs[1] != 2 || seqs[2] != 1 {
+			t.Errorf("Replies with sequence numbers %v", seqs)
+		}
+		f.(io.Closer).Close()
+	}
+}
@@ -0,0 +1,109 @@
+package filter
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterfaceDesc  = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEnd         = 0
+	pcapngOptIfName      = 2
+	pcapngOptEPBFlags    = 2
+	pcapngLinkTypeRaw    = 101 // Raw IPv4 or IPv6 packets
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+	pcapngBlockOverhead  = 12 // Block type and the two block lengths
+	pcapngEPBFixedLen    = 20
+	pcapngEPBFlagsLen    = 8
+	pcapngOptEndLen      = 4
+)
+
+// Blocks are written in little-endian, readers detect the byte order with
+// the magic of the section header.
+var pcapngOrder = binary.LittleEndian
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// appendPcapngHeader appends a section header block and an interface
+// description block for raw IP packets captured on the interface name.
+func appendPcapngHeader(b []byte, name string, snapLen int) []byte {
+	// Section header without options, the section length is unspecified.
+	b = appendUint32(b, pcapngSectionHeader)
+	b = appendUint32(b, 28)
+	b = appendUint32(b, pcapngByteOrderMagic)
+	b = appendUint16(b, 1)
+	b = appendUint16(b, 0)
+	b = appendUint32(b, 0xffffffff)
+	b = appendUint32(b, 0xffffffff)
+	b = appendUint32(b, 28)
+
+	n := pcapngBlockOverhead + 8 + pcapngOptEndLen
+	if name != "" {
+		n += 4 + pad4(len(name))
+	}
+	b = appendUint32(b, pcapngInterfaceDesc)
+	b = appendUint32(b, uint32(n))
+	b = appendUint16(b, pcapngLinkTypeRaw)
+	b = appendUint16(b, 0)
+	b = appendUint32(b, uint32(snapLen))
+	if name != "" {
+		b = appendOption(b, pcapngOptIfName, []byte(name))
+	}
+	b = appendUint32(b, pcapngOptEnd)
+	b = appendUint32(b, uint32(n))
+	return b
+}
+
+// appendPcapngPacket appends an enhanced packet block of a packet captured
+// at t, data is the packet truncated to the snap length, origLen is its
+// length on the wire.
+func appendPcapngPacket(b []byte, t time.Time, data []byte, origLen int, inbound bool) []byte {
+	n := pcapngBlockOverhead + pcapngEPBFixedLen + pad4(len(data)) + pcapngEPBFlagsLen + pcapngOptEndLen
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	flags := uint32(pcapngFlagOutbound)
+	if inbound {
+		flags = pcapngFlagInbound
+	}
+	b = appendUint32(b, pcapngEnhancedPacket)
+	b = appendUint32(b, uint32(n))
+	b = appendUint32(b, 0) // Interface ID
+	b = appendUint32(b, uint32(ts>>32))
+	b = appendUint32(b, uint32(ts))
+	b = appendUint32(b, uint32(len(data)))
+	b = appendUint32(b, uint32(origLen))
+	b = append(b, data...)
+	b = append(b, make([]byte, pad4(len(data))-len(data))...)
+	var v [4]byte
+	pcapngOrder.PutUint32(v[:], flags)
+	b = appendOption(b, pcapngOptEPBFlags, v[:])
+	b = appendUint32(b, pcapngOptEnd)
+	b = appendUint32(b, uint32(n))
+	return b
+}
+
+func appendOption(b []byte, code uint16, v []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	return append(b, make([]byte, pad4(len(v))-len(v))...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	pcapngOrder.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	pcapngOrder.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
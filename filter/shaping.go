@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"io"
+
+	"github.com/eycorsican/go-tun2socks/common/shaping"
+)
+
+type shapingFilter struct {
+	writer io.Writer
+	shaper *shaping.Shaper
+}
+
+// NewShapingFilter creates a filter dropping packets from TUN over the
+// upload limits of s. TCP segments are passed through, as TCP connections
+// are shaped once accepted by the stack, see shaping.Shaper.WrapTCPConn.
+func NewShapingFilter(w io.Writer, s *shaping.Shaper) Filter {
+	return &shapingFilter{writer: w, shaper: s}
+}
+
+func (w *shapingFilter) Write(buf []byte) (int, error) {
+	if w.intercept(buf) {
+		return len(buf), nil
+	}
+	return w.writer.Write(buf)
+}
+
+func (w *shapingFilter) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(w.writer, pkts, w.intercept)
+}
+
+// intercept consumes the packets dropped.
+func (w *shapingFilter) intercept(buf []byte) bool {
+	return !allowPacket(w.shaper, shaping.Upload, buf)
+}
+
+// NewShapingOutput returns an output function of the stack writing packets
+// with fn, and dropping those over the download limits of s but TCP
+// segments, like NewShapingFilter.
+func NewShapingOutput(fn func([]byte) (int, error), s *shaping.Shaper) func([]byte) (int, error) {
+	return func(pkt []byte) (int, error) {
+		if !allowPacket(s, shaping.Download, pkt) {
+			return len(pkt), nil
+		}
+		return fn(pkt)
+	}
+}
+
+// allowPacket reports whether a packet from or to a local client is within
+// the limits of s, packets which are not valid IP packets and TCP segments
+// are always allowed. Processes of non-first fragments are unknown.
+func allowPacket(s *shaping.Shaper, dir shaping.Direction, pkt []byte) bool {
+	info, ok := parsePacketInfo(pkt)
+	if !ok || info.proto == protoTCP {
+		return true
+	}
+	ip, port := info.src, info.srcPort
+	if dir == shaping.Download {
+		ip, port = info.dst, info.dstPort
+	}
+	network := ""
+	if info.proto == protoUDP && info.ports {
+		network = "udp"
+	} else {
+		port = 0
+	}
+	return s.AllowPacket(dir, network, ip, port, len(pkt))
+}
@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/common/shaping"
+)
+
+// Packets should be dropped over the limits but TCP segments.
+func TestShapingFilter(t *testing.T) {
+	s, err := shaping.New(shaping.Options{PerSource: shaping.Limits{Upload: 1000, Download: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written, output int
+	f := NewShapingFilter(writerFunc(func(b []byte) (int, error) {
+		written++
+		return len(b), nil
+	}), s)
+	out := NewShapingOutput(func(b []byte) (int, error) {
+		output++
+		return len(b), nil
+	}, s)
+
+	for _, pkt := range [][]byte{
+		testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 53, 600),
+		testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 53, 600),
+		testPacket("10.0.0.2", "5.6.7.8", protoUDP, 40000, 53, 600),
+		tcpSYN("10.0.0.1", "5.6.7.8", 40000, 80),
+	} {
+		if n, err := f.Write(pkt); n != len(pkt) || err != nil {
+			t.Fatalf("Wrote %v bytes, %v", n, err)
+		}
+	}
+	if written != 3 {
+		t.Errorf("Wrote %v packets, expected 3", written)
+	}
+
+	// Downloads of the first source are limited apart from uploads.
+	for _, pkt := range [][]byte{
+		testPacket("5.6.7.8", "10.0.0.1", protoUDP, 53, 40000, 600),
+		testPacket("5.6.7.8", "10.0.0.1", protoICMP, 0, 0, 600),
+		tcpSYN("5.6.7.8", "10.0.0.1", 80, 40000),
+	} {
+		if n, err := out(pkt); n != len(pkt) || err != nil {
+			t.Fatalf("Wrote %v bytes, %v", n, err)
+		}
+	}
+	if output != 2 {
+		t.Errorf("Output %v packets, expected 2", output)
+	}
+}
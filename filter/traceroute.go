@@ -0,0 +1,114 @@
+package filter
+
+import (
+	"io"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const (
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+
+	// UDP probes of traceroute are sent to ports in this range.
+	tracerouteMinPort = 33434
+	tracerouteMaxPort = 33534
+)
+
+type tracerouteFilter struct {
+	writer       io.Writer
+	reply        func([]byte) (int, error)
+	hops4, hops6 []net.IP
+}
+
+// NewTracerouteFilter creates a filter answering traceroute probes from TUN,
+// UDP datagrams, ICMP and ICMPv6 echo requests and TCP SYNs, so that the
+// path to any destination looks like hops followed by the destination, e.g.
+// the gateway of TUN and the proxy server. Probes are answered with reply,
+// those of each family by the hops of the family in order: probes whose TTL
+// or hop limit is at most the number of hops with time exceeded messages
+// from the respective hops, UDP probes to traceroute ports (33434 to 33534)
+// with the next TTL with port unreachable messages on behalf of the
+// destination, as the proxy never relays them. Other packets, including
+// probes with higher TTLs and those of families without hops, are written to
+// w, and answered by the stack or the proxy as the destination.
+func NewTracerouteFilter(w io.Writer, reply func([]byte) (int, error), hops []net.IP) Filter {
+	f := &tracerouteFilter{writer: w, reply: reply}
+	for _, hop := range hops {
+		if hop4 := hop.To4(); hop4 != nil {
+			f.hops4 = append(f.hops4, hop4)
+		} else {
+			f.hops6 = append(f.hops6, hop)
+		}
+	}
+	return f
+}
+
+func (w *tracerouteFilter) Write(buf []byte) (int, error) {
+	if w.intercept(buf) {
+		return len(buf), nil
+	}
+	return w.writer.Write(buf)
+}
+
+func (w *tracerouteFilter) WriteBatch(pkts [][]byte) (int, error) {
+	return writeBatch(w.writer, pkts, w.intercept)
+}
+
+// intercept answers probes which don't reach the destination, or are UDP
+// probes to traceroute ports.
+func (w *tracerouteFilter) intercept(pkt []byte) bool {
+	info, ok := parsePacketInfo(pkt)
+	if !ok {
+		return false
+	}
+	var ttl int
+	hops := w.hops4
+	if info.ver == 4 {
+		ttl = int(pkt[8])
+	} else {
+		ttl, hops = int(pkt[7]), w.hops6
+	}
+	if len(hops) == 0 || ttl > len(hops)+1 || !isProbe(&info) {
+		return false
+	}
+
+	var reply []byte
+	switch {
+	case ttl <= len(hops):
+		if ttl < 1 {
+			ttl = 1
+		}
+		reply = core.BuildTimeExceeded(pkt, hops[ttl-1])
+	case info.proto == protoUDP && info.dstPort >= tracerouteMinPort && info.dstPort <= tracerouteMaxPort:
+		reply = core.BuildReject(pkt, core.PortUnreachable)
+	}
+	if reply == nil {
+		return false
+	}
+	if _, err := w.reply(reply); err != nil {
+		log.Debugf("failed to answer traceroute probe: %v", err)
+	}
+	return true
+}
+
+// isProbe reports whether a packet may be a traceroute probe.
+func isProbe(info *packetInfo) bool {
+	p := info.payload
+	switch info.proto {
+	case protoUDP:
+		return info.ports
+	case protoTCP:
+		return len(p) >= 14 && p[13]&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN
+	case protoICMP:
+		return info.ver == 4 && len(p) >= 8 && p[0] == icmpEchoRequest
+	case protoICMPv6:
+		return info.ver == 6 && len(p) >= 8 && p[0] == icmpv6EchoRequest
+	}
+	return false
+}
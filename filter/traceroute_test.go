@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// withTTL sets the TTL or the hop limit of a packet.
+func withTTL(pkt []byte, ttl byte) []byte {
+	if pkt[0]>>4 == 4 {
+		pkt[8] = ttl
+	} else {
+		pkt[7] = ttl
+	}
+	return pkt
+}
+
+// Probes should be answered by the hops then the destination, other packets
+// passed through.
+func TestTracerouteFilter(t *testing.T) {
+	gw, proxy, gw6 := net.ParseIP("10.255.0.1"), net.ParseIP("1.2.3.4"), net.ParseIP("fd00::ff")
+	var written, replies [][]byte
+	w := writerFunc(func(b []byte) (int, error) {
+		written = append(written, b)
+		return len(b), nil
+	})
+	answer := func(b []byte) (int, error) {
+		replies = append(replies, b)
+		return len(b), nil
+	}
+	f := NewTracerouteFilter(w, answer, []net.IP{gw, proxy, gw6})
+
+	udp := func(ttl byte) []byte {
+		return withTTL(testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 33434, 8), ttl)
+	}
+	udp6 := func(ttl byte) []byte {
+		return withTTL(testPacket("fd00::1", "2001:db8::1", protoUDP, 40000, 33434, 8), ttl)
+	}
+	syn := func(ttl byte) []byte {
+		return withTTL(tcpSYN("10.0.0.1", "5.6.7.8", 40000, 80), ttl)
+	}
+	ack := withTTL(tcpSYN("10.0.0.1", "5.6.7.8", 40000, 80), 1)
+	ack[20+13] = tcpFlagACK
+	echo := func(ttl byte) []byte {
+		return withTTL(echoRequest("10.0.0.1", "5.6.7.8", 1, 1), ttl)
+	}
+	echo6 := func(ttl byte) []byte {
+		return withTTL(echoRequest("fd00::1", "2001:db8::1", 1, 1), ttl)
+	}
+	for _, c := range []struct {
+		pkt  []byte
+		from net.IP // Source of the reply, nil if passed
+		typ  byte   // ICMP type of the reply
+	}{
+		{udp(1), gw, 11},
+		{udp(2), proxy, 11},
+		{udp(3), net.ParseIP("5.6.7.8"), 3},
+		{udp(64), nil, 0},
+		{withTTL(testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 53, 8), 3), nil, 0},
+		{withTTL(testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 33534, 8), 3), net.ParseIP("5.6.7.8"), 3},
+		{withTTL(testPacket("10.0.0.1", "5.6.7.8", protoUDP, 40000, 33535, 8), 3), nil, 0},
+		{udp6(1), gw6, 3},
+		{udp6(2), net.ParseIP("2001:db8::1"), 1},
+		{udp6(3), nil, 0},
+		{syn(0), gw, 11},
+		{syn(2), proxy, 11},
+		{syn(3), nil, 0},
+		{ack, nil, 0},
+		{echo(1), gw, 11},
+		{echo(3), nil, 0},
+		{echo6(1), gw6, 3},
+		{echo6(2), nil, 0},
+	} {
+		written, replies = nil, nil
+		core.WriteBatch(f, [][]byte{c.pkt})
+		info, _ := parsePacketInfo(c.pkt)
+		if c.from == nil {
+			if len(written) != 1 || len(replies) != 0 {
+				t.Errorf("Packet %+v answered", info)
+			}
+			continue
+		}
+		if len(written) != 0 || len(replies) != 1 {
+			t.Errorf("Packet %+v passed, expected a reply from %v", info, c.from)
+			continue
+		}
+		reply, _ := parsePacketInfo(replies[0])
+		if !reply.src.Equal(c.from) || !reply.dst.Equal(info.src) || len(reply.payload) < 8 || reply.payload[0] != c.typ {
+			t.Errorf("Packet %+v answered with %+v, expected type %v from %v", info, reply, c.typ, c.from)
+		}
+	}
+
+	// Packets of families without hops should be passed whatever their TTLs.
+	f = NewTracerouteFilter(w, answer, []net.IP{gw})
+	for _, pkt := range [][]byte{udp6(1), udp6(2), echo6(1)} {
+		written, replies = nil, nil
+		f.Write(pkt)
+		if len(written) != 1 || len(replies) != 0 {
+			info, _ := parsePacketInfo(pkt)
+			t.Errorf("Packet %+v answered without IPv6 hops", info)
+		}
+	}
+
+	// Multicast and broadcast packets should never be answered, but passed.
+	for _, dst := range []string{"224.0.0.251", "255.255.255.255"} {
+		written, replies = nil, nil
+		for ttl := byte(1); ttl <= 2; ttl++ {
+			f.Write(withTTL(testPacket("10.0.0.1", dst, protoUDP, 40000, 33434, 8), ttl))
+		}
+		if len(replies) != 0 || len(written) != 2 {
+			t.Errorf("Packets to %v answered or dropped", dst)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package d
 
 import (
+	"context"
 	"io"
 	"net"
-	"strconv"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/common/proc"
@@ -71,11 +71,22 @@ func (h *tcpHandler) relay(lhs, rhs net.Conn) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	cmd, err := proc.GetCommandNameBySocket("tcp", localHost, uint16(localPortInt))
-	if err != nil {
-		cmd = "unknown process"
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: target, UID: -1}
+	return h.HandleContext(context.Background(), conn, meta)
+}
+
+// HandleContext connects directly if the process of meta is an exception
+// app, otherwise conn is handed over to the proxy handler.
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, meta *core.Metadata) error {
+	target := meta.Destination.(*net.TCPAddr)
+	processes := meta.Process
+	if len(processes) == 0 {
+		// Not resolved by the stack.
+		processes, _ = proc.GetProcessesByAddr(conn.LocalAddr())
+	}
+	cmd := "unknown process"
+	if len(processes) != 0 {
+		cmd = processes[0]
 	}
 
 	if h.isExceptionApp(cmd) {
@@ -90,6 +101,8 @@ func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 		log.Access(cmd, "direct", target.Network(), conn.LocalAddr().String(), target.String())
 
 		return nil
+	} else if ch, ok := h.proxyHandler.(core.TCPConnContextHandler); ok {
+		return ch.HandleContext(ctx, conn, meta)
 	} else {
 		return h.proxyHandler.Handle(conn, target)
 	}
@@ -1,8 +1,8 @@
 package d
 
 import (
+	"context"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
@@ -63,11 +63,25 @@ func (h *udpHandler) handleInput(conn core.UDPConn, pc *net.UDPConn) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	cmd, err := proc.GetCommandNameBySocket("udp", localHost, uint16(localPortInt))
-	if err != nil {
-		cmd = "unknown process"
+	meta := &core.Metadata{Network: "udp", Source: conn.LocalAddr(), UID: -1}
+	if target != nil {
+		meta.Destination = target
+	}
+	return h.ConnectContext(context.Background(), conn, meta)
+}
+
+// ConnectContext binds a direct socket if the process of meta is an
+// exception app, otherwise conn is handed over to the proxy handler.
+func (h *udpHandler) ConnectContext(ctx context.Context, conn core.UDPConn, meta *core.Metadata) error {
+	target, _ := meta.Destination.(*net.UDPAddr)
+	processes := meta.Process
+	if len(processes) == 0 {
+		// Not resolved by the stack.
+		processes, _ = proc.GetProcessesByAddr(conn.LocalAddr())
+	}
+	cmd := "unknown process"
+	if len(processes) != 0 {
+		cmd = processes[0]
 	}
 
 	if h.isExceptionApp(cmd) {
@@ -88,6 +102,8 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 		log.Access(cmd, "direct", target.Network(), conn.LocalAddr().String(), target.String())
 
 		return nil
+	} else if ch, ok := h.proxyHandler.(core.UDPConnContextHandler); ok {
+		return ch.ConnectContext(ctx, conn, meta)
 	} else {
 		return h.proxyHandler.Connect(conn, target)
 	}
@@ -119,3 +135,11 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 		delete(h.exceptionConns, conn)
 	}
 }
+
+// Closed releases resources associated with conn when it's closed by core.
+func (h *udpHandler) Closed(conn core.UDPConn) {
+	h.Close(conn)
+	if closeHandler, ok := h.proxyHandler.(core.UDPConnCloseHandler); ok {
+		closeHandler.Closed(conn)
+	}
+}
@@ -1,6 +1,7 @@
 package redirect
 
 import (
+	"context"
 	"io"
 	"net"
 
@@ -76,12 +77,32 @@ func (h *tcpHandler) handleOutput(conn net.Conn, output io.WriteCloser) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	c, err := net.Dial("tcp", h.target)
+	c, err := h.Connect(target)
 	if err != nil {
 		return err
 	}
-	go h.handleInput(conn, c)
-	go h.handleOutput(conn, c)
+	return h.HandleConnected(conn, c)
+}
+
+// HandleContext is like Handle, but gives up connecting once the stack is
+// closed.
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, meta *core.Metadata) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", h.target)
+	if err != nil {
+		return err
+	}
+	return h.HandleConnected(conn, c)
+}
+
+func (h *tcpHandler) Connect(target *net.TCPAddr) (net.Conn, error) {
+	return net.Dial("tcp", h.target)
+}
+
+func (h *tcpHandler) HandleConnected(conn net.Conn, upstream net.Conn) error {
+	go h.handleInput(conn, upstream)
+	go h.handleOutput(conn, upstream)
+	target := conn.RemoteAddr()
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
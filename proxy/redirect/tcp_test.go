@@ -0,0 +1,61 @@
+package redirect
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/core/coretest"
+)
+
+// Connections should be redirected to the target whatever their
+// destination, with half-closes passed through both ways.
+func TestTCPHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Echo until the client half-closes.
+			go func() {
+				io.Copy(c, c)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	s := core.NewLWIPStack()
+	defer s.Close()
+	s.RegisterTCPConnHandler(NewTCPHandler(ln.Addr().String()))
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	for _, remote := range []*net.TCPAddr{
+		{IP: net.IPv4(1, 2, 3, 4), Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	} {
+		conn, err := tun.DialTCP(nil, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("redirect"), 100000)
+		go func() {
+			conn.Write(data)
+			conn.CloseWrite()
+		}()
+		received, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("Read %v bytes from %v, %v, expected %v bytes", len(received), remote, err, len(data))
+		}
+		conn.Close()
+	}
+}
@@ -1,6 +1,7 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -53,33 +54,77 @@ func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
 	if target == nil {
 		log.Fatalf("unexpected nil target")
 	}
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: target, UID: -1}
+	return h.HandleContext(context.Background(), conn, meta)
+}
 
-	// Connect the relay server.
-	rc, err := net.Dial("tcp", h.server)
+// HandleContext connects the relay server for meta.Destination and relays
+// conn.
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, meta *core.Metadata) error {
+	rc, err := h.ConnectContext(ctx, meta)
 	if err != nil {
-		return errors.New(fmt.Sprintf("dial remote server failed: %v", err))
+		return err
 	}
-	rc = h.cipher.StreamConn(rc)
+	return h.HandleConnectedContext(ctx, conn, rc, meta)
+}
 
-	// Replace with a domain name if target address IP is a fake IP.
-	var targetHost string
-	if h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
+// dest returns the address of the target sent to the relay server, the
+// domain name the target has been resolved from if known.
+func (h *tcpHandler) dest(meta *core.Metadata) string {
+	target, ok := meta.Destination.(*net.TCPAddr)
+	if !ok {
+		return meta.Destination.String()
+	}
+	targetHost := meta.Domain
+	if targetHost == "" && h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
 		targetHost = h.fakeDns.QueryDomain(target.IP)
-	} else {
+	}
+	if targetHost == "" {
 		targetHost = target.IP.String()
 	}
-	dest := net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
+	return net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
+}
+
+// Connect connects the relay server and sends it the address of target.
+func (h *tcpHandler) Connect(target *net.TCPAddr) (net.Conn, error) {
+	meta := &core.Metadata{Network: "tcp", Destination: target, UID: -1}
+	return h.ConnectContext(context.Background(), meta)
+}
+
+// ConnectContext connects the relay server and sends it the address of
+// meta.Destination.
+func (h *tcpHandler) ConnectContext(ctx context.Context, meta *core.Metadata) (net.Conn, error) {
+	// Connect the relay server.
+	var d net.Dialer
+	rc, err := d.DialContext(ctx, "tcp", h.server)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("dial remote server failed: %v", err))
+	}
+	rc = h.cipher.StreamConn(rc)
 
 	// Write target address.
-	tgt := sssocks.ParseAddr(dest)
+	tgt := sssocks.ParseAddr(h.dest(meta))
 	_, err = rc.Write(tgt)
 	if err != nil {
-		return fmt.Errorf("send target address failed: %v", err)
+		rc.Close()
+		return nil, fmt.Errorf("send target address failed: %v", err)
 	}
+	return rc, nil
+}
+
+// HandleConnected relays conn through rc, which is connected to the target
+// of conn.
+func (h *tcpHandler) HandleConnected(conn net.Conn, rc net.Conn) error {
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: conn.RemoteAddr(), UID: -1}
+	return h.HandleConnectedContext(context.Background(), conn, rc, meta)
+}
 
+// HandleConnectedContext relays conn through rc, which is connected to
+// meta.Destination.
+func (h *tcpHandler) HandleConnectedContext(ctx context.Context, conn net.Conn, rc net.Conn, meta *core.Metadata) error {
 	go h.handleInput(conn, rc)
 	go h.handleOutput(conn, rc)
 
-	log.Infof("new proxy connection for target: %s:%s", target.Network(), dest)
+	log.Infof("new proxy connection for target: tcp:%s", h.dest(meta))
 	return nil
 }
@@ -0,0 +1,87 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	sscore "github.com/shadowsocks/go-shadowsocks2/core"
+	sssocks "github.com/shadowsocks/go-shadowsocks2/socks"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/core/coretest"
+)
+
+const (
+	testCipher   = "AEAD_CHACHA20_POLY1305"
+	testPassword = "password"
+)
+
+// Connections should be relayed through the relay server, requesting domain
+// names resolved by the stack instead of fake IPs.
+func TestTCPHandler(t *testing.T) {
+	ciph, err := sscore.PickCipher(testCipher, nil, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dests := make(chan string, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Echo until the client closes.
+			go func() {
+				defer c.Close()
+				sc := ciph.StreamConn(c)
+				addr, err := sssocks.ReadAddr(sc)
+				if err != nil {
+					return
+				}
+				dests <- addr.String()
+				io.Copy(sc, sc)
+			}()
+		}
+	}()
+
+	s := core.NewLWIPStack()
+	defer s.Close()
+	s.RegisterMetadataResolver(func(meta *core.Metadata) {
+		if meta.Destination.(*net.TCPAddr).IP.Equal(net.IPv4(198, 18, 0, 1)) {
+			meta.Domain = "example.com"
+		}
+	})
+	s.RegisterTCPConnHandler(NewTCPHandler(ln.Addr().String(), testCipher, testPassword, nil))
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	for _, c := range []struct {
+		remote *net.TCPAddr
+		dest   string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 80}, "example.com:80"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "[2001:db8::1]:443"},
+	} {
+		conn, err := tun.DialTCP(nil, c.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("shadowsocks"), 50000)
+		go conn.Write(data)
+		received := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, received); err != nil || !bytes.Equal(received, data) {
+			t.Errorf("Read from %v failed: %v", c.remote, err)
+		}
+		conn.Close()
+		if dest := <-dests; dest != c.dest {
+			t.Errorf("Requested %v for %v, expected %v", dest, c.remote, c.dest)
+		}
+	}
+}
@@ -170,3 +170,8 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 		delete(h.conns, conn)
 	}
 }
+
+// Closed releases resources associated with conn when it's closed by core.
+func (h *udpHandler) Closed(conn core.UDPConn) {
+	h.Close(conn)
+}
@@ -1,6 +1,8 @@
 package socks
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -21,8 +23,8 @@ type tcpHandler struct {
 
 	proxyHost string
 	proxyPort uint16
+	fakeDns   dns.FakeDns
 
-	fakeDns       dns.FakeDns
 	sessionStater stats.SessionStater
 }
 
@@ -145,54 +147,101 @@ func (h *tcpHandler) relay(lhs, rhs net.Conn, sess *stats.Session) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: target, UID: -1}
+	return h.HandleContext(context.Background(), conn, meta)
+}
+
+// HandleContext connects meta.Destination through the SOCKS5 proxy and
+// relays conn.
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, meta *core.Metadata) error {
+	c, err := h.ConnectContext(ctx, meta)
 	if err != nil {
-		log.Warnf("failed to create SOCKS5 dialer: %v", err)
 		return err
 	}
+	return h.HandleConnectedContext(ctx, conn, c, meta)
+}
 
-	// Replace with a domain name if target address IP is a fake IP.
-	var targetHost string
-	if h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
+// dest returns the address of the target sent to the proxy, the domain name
+// the target has been resolved from if known.
+func (h *tcpHandler) dest(meta *core.Metadata) string {
+	target, ok := meta.Destination.(*net.TCPAddr)
+	if !ok {
+		return meta.Destination.String()
+	}
+	targetHost := meta.Domain
+	if targetHost == "" && h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
 		targetHost = h.fakeDns.QueryDomain(target.IP)
-	} else {
+	}
+	if targetHost == "" {
 		targetHost = target.IP.String()
 	}
-	dest := net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
+	return net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
+}
+
+// Connect connects target through the SOCKS5 proxy.
+func (h *tcpHandler) Connect(target *net.TCPAddr) (net.Conn, error) {
+	meta := &core.Metadata{Network: "tcp", Destination: target, UID: -1}
+	return h.ConnectContext(context.Background(), meta)
+}
 
-	c, err := dialer.Dial(target.Network(), dest)
+// ConnectContext connects meta.Destination through the SOCKS5 proxy.
+func (h *tcpHandler) ConnectContext(ctx context.Context, meta *core.Metadata) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	if err != nil {
+		log.Warnf("failed to create SOCKS5 dialer: %v", err)
+		return nil, err
+	}
+
+	// Unlike DialContext, Dial returns the TCP connection itself, which
+	// can be half-closed.
+	c, err := dialer.Dial("tcp", h.dest(meta))
 	if err != nil {
 		log.Warnf("failed to dial SOCKS5: %v", err)
-		return err
+		return nil, err
+	}
+	return c, nil
+}
+
+// HandleConnected relays conn through upstream, which is connected to the
+// target of conn.
+func (h *tcpHandler) HandleConnected(conn net.Conn, upstream net.Conn) error {
+	target, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		upstream.Close()
+		return errors.New("unexpected target address")
+	}
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: target, UID: -1}
+	return h.HandleConnectedContext(context.Background(), conn, upstream, meta)
+}
+
+// HandleConnectedContext relays conn through upstream, which is connected
+// to meta.Destination.
+func (h *tcpHandler) HandleConnectedContext(ctx context.Context, conn net.Conn, upstream net.Conn, meta *core.Metadata) error {
+	dest := h.dest(meta)
+	processes := meta.Process
+	if len(processes) == 0 && h.sessionStater != nil {
+		// Not resolved by the stack, look it up for the session.
+		processes, _ = proc.GetProcessesByAddr(conn.LocalAddr())
+	}
+	if len(processes) == 0 {
+		processes = []string{"unknown process"}
 	}
 
-	var process string
 	var sess *stats.Session
 	if h.sessionStater != nil {
-		// Get name of the process.
-		localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-		localPortInt, _ := strconv.Atoi(localPortStr)
-		process, err = proc.GetCommandNameBySocket(target.Network(), localHost, uint16(localPortInt))
-		if err != nil {
-			process = "unknown process"
-		}
-
 		sess = &stats.Session{
-			process,
-			target.Network(),
-			conn.LocalAddr().String(),
-			dest,
-			0,
-			0,
-			time.Now(),
-			"",
+			Processes:    processes,
+			Network:      meta.Network,
+			LocalAddr:    conn.LocalAddr().String(),
+			RemoteAddr:   dest,
+			SessionStart: time.Now(),
 		}
 		h.sessionStater.AddSession(conn, sess)
 	}
 
-	go h.relay(conn, c, sess)
+	go h.relay(conn, upstream, sess)
 
-	log.Access(process, "proxy", target.Network(), conn.LocalAddr().String(), dest)
+	log.Access(processes[0], "proxy", meta.Network, conn.LocalAddr().String(), dest)
 
 	return nil
 }
@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/core/coretest"
+)
+
+// serveSOCKS5 serves SOCKS5 CONNECT requests without authentication on ln,
+// the addresses requested are sent to dests. Requests for refused are
+// refused, other connections are echoed until the client half-closes.
+func serveSOCKS5(ln net.Listener, refused string, dests chan<- string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, MaxAddrLen)
+			// VER NMETHODS METHODS
+			if _, err := io.ReadFull(c, buf[:2]); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+				return
+			}
+			c.Write([]byte{5, 0})
+			// VER CMD RSV DST.ADDR DST.PORT
+			if _, err := io.ReadFull(c, buf[:3]); err != nil || buf[1] != socks5Connect {
+				return
+			}
+			addr, err := readAddr(c, buf)
+			if err != nil {
+				return
+			}
+			dests <- addr.String()
+			if addr.String() == refused {
+				c.Write([]byte{5, 5, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			c.Write([]byte{5, 0, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+			io.Copy(c, c)
+			c.(*net.TCPConn).CloseWrite()
+		}()
+	}
+}
+
+func newSOCKS5Server(t *testing.T, refused string) (host string, port uint16, dests chan string, ln net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dests = make(chan string, 4)
+	go serveSOCKS5(ln, refused, dests)
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), uint16(addr.Port), dests, ln
+}
+
+// Connections should be relayed through the proxy, requesting domain names
+// resolved by the stack instead of fake IPs.
+func TestTCPHandler(t *testing.T) {
+	host, port, dests, ln := newSOCKS5Server(t, "")
+	defer ln.Close()
+
+	s := core.NewLWIPStack()
+	defer s.Close()
+	s.RegisterMetadataResolver(func(meta *core.Metadata) {
+		if meta.Destination.(*net.TCPAddr).IP.Equal(net.IPv4(198, 18, 0, 1)) {
+			meta.Domain = "example.com"
+		}
+	})
+	s.RegisterTCPConnHandler(NewTCPHandler(host, port, nil, nil))
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	for _, c := range []struct {
+		remote *net.TCPAddr
+		dest   string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 80}, "example.com:80"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "[2001:db8::1]:443"},
+	} {
+		conn, err := tun.DialTCP(nil, c.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("socks"), 100000)
+		go func() {
+			conn.Write(data)
+			conn.CloseWrite()
+		}()
+		received, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("Read %v bytes from %v, %v, expected %v bytes", len(received), c.remote, err, len(data))
+		}
+		conn.Close()
+		if dest := <-dests; dest != c.dest {
+			t.Errorf("Requested %v for %v, expected %v", dest, c.remote, c.dest)
+		}
+	}
+}
+
+// With connect-before-accept, connections should be refused if the proxy
+// refuses to connect the target.
+func TestTCPHandlerConnectBeforeAccept(t *testing.T) {
+	host, port, dests, ln := newSOCKS5Server(t, "1.2.3.4:81")
+	defer ln.Close()
+
+	s, err := core.NewLWIPStackWithOptions(core.StackOptions{ConnectBeforeAccept: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RegisterTCPConnHandler(NewTCPHandler(host, port, nil, nil))
+	tun := coretest.New(s, coretest.Options{})
+	defer tun.Close()
+
+	if conn, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 81}); err == nil {
+		conn.Close()
+		t.Error("Connection accepted while the proxy refused it")
+	}
+	<-dests
+
+	conn, err := tun.DialTCP(nil, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-dests
+	conn.Write([]byte("hello"))
+	conn.CloseWrite()
+	if received, err := ioutil.ReadAll(conn); err != nil || string(received) != "hello" {
+		t.Errorf("Read %q, %v", received, err)
+	}
+}
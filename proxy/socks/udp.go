@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ type udpHandler struct {
 	udpConns    map[core.UDPConn]net.PacketConn
 	tcpConns    map[core.UDPConn]net.Conn
 	remoteAddrs map[core.UDPConn]*net.UDPAddr // UDP relay server addresses
+	metas       map[core.UDPConn]*core.Metadata
 	timeout     time.Duration
 
 	dnsCache      dns.DnsCache
@@ -38,6 +40,7 @@ func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration, dn
 		udpConns:      make(map[core.UDPConn]net.PacketConn, 8),
 		tcpConns:      make(map[core.UDPConn]net.Conn, 8),
 		remoteAddrs:   make(map[core.UDPConn]*net.UDPAddr, 8),
+		metas:         make(map[core.UDPConn]*core.Metadata, 8),
 		dnsCache:      dnsCache,
 		fakeDns:       fakeDns,
 		timeout:       timeout,
@@ -111,19 +114,31 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	meta := &core.Metadata{Network: "udp", Source: conn.LocalAddr(), UID: -1}
+	if target != nil {
+		meta.Destination = target
+	}
+	return h.ConnectContext(context.Background(), conn, meta)
+}
+
+// ConnectContext associates conn with the SOCKS5 proxy, the domain name
+// meta.Destination has been resolved from is sent instead of it if known.
+func (h *udpHandler) ConnectContext(ctx context.Context, conn core.UDPConn, meta *core.Metadata) error {
+	h.Lock()
+	h.metas[conn] = meta
+	h.Unlock()
+
+	target, _ := meta.Destination.(*net.UDPAddr)
 	if target == nil {
 		return h.connectInternal(conn, "")
 	}
 
-	// Replace with a domain name if target address IP is a fake IP.
-	targetHost := target.IP.String()
-	if h.fakeDns != nil {
-		if target.Port == dns.COMMON_DNS_PORT {
-			return nil // skip dns
-		}
-		if h.fakeDns.IsFakeIP(target.IP) {
-			targetHost = h.fakeDns.QueryDomain(target.IP)
-		}
+	if h.fakeDns != nil && target.Port == dns.COMMON_DNS_PORT {
+		return nil // skip dns
+	}
+	targetHost := meta.Domain
+	if targetHost == "" {
+		targetHost = target.IP.String()
 	}
 	dest := net.JoinHostPort(targetHost, strconv.Itoa(target.Port))
 
@@ -179,34 +194,34 @@ func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
 	h.tcpConns[conn] = c
 	h.udpConns[conn] = pc
 	h.remoteAddrs[conn] = resolvedRemoteAddr
+	meta := h.metas[conn]
 	h.Unlock()
 
 	go h.fetchUDPInput(conn, pc)
 
 	if len(dest) != 0 {
-		var process string
+		var processes []string
+		if meta != nil {
+			processes = meta.Process
+		}
+		if len(processes) == 0 && h.sessionStater != nil {
+			// Not resolved by the stack, look it up for the session.
+			processes, _ = proc.GetProcessesByAddr(conn.LocalAddr())
+		}
+		if len(processes) == 0 {
+			processes = []string{"unknown process"}
+		}
 		if h.sessionStater != nil {
-			// Get name of the process.
-			localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-			localPortInt, _ := strconv.Atoi(localPortStr)
-			process, err = proc.GetCommandNameBySocket(conn.LocalAddr().Network(), localHost, uint16(localPortInt))
-			if err != nil {
-				process = "unknown process"
-			}
-
 			sess := &stats.Session{
-				process,
-				conn.LocalAddr().Network(),
-				conn.LocalAddr().String(),
-				dest,
-				0,
-				0,
-				time.Now(),
-				"",
+				Processes:    processes,
+				Network:      conn.LocalAddr().Network(),
+				LocalAddr:    conn.LocalAddr().String(),
+				RemoteAddr:   dest,
+				SessionStart: time.Now(),
 			}
 			h.sessionStater.AddSession(conn, sess)
 		}
-		log.Access(process, "proxy", "udp", conn.LocalAddr().String(), dest)
+		log.Access(processes[0], "proxy", "udp", conn.LocalAddr().String(), dest)
 	}
 	return nil
 }
@@ -294,8 +309,14 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 		delete(h.udpConns, conn)
 	}
 	delete(h.remoteAddrs, conn)
+	delete(h.metas, conn)
 
 	if h.sessionStater != nil {
 		h.sessionStater.RemoveSession(conn)
 	}
 }
+
+// Closed releases resources associated with conn when it's closed by core.
+func (h *udpHandler) Closed(conn core.UDPConn) {
+	h.Close(conn)
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
@@ -77,27 +76,36 @@ func NewTCPHandler(instance *vcore.Instance, sniffing *vproxyman.SniffingConfig,
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	meta := &core.Metadata{Network: "tcp", Source: conn.LocalAddr(), Destination: target, UID: -1}
+	return h.HandleContext(context.Background(), conn, meta)
+}
+
+// HandleContext dials meta.Destination through V2Ray, using the domain name
+// it has been resolved from if known.
+func (h *tcpHandler) HandleContext(_ context.Context, conn net.Conn, meta *core.Metadata) error {
+	target := meta.Destination.(*net.TCPAddr)
 	dest := vnet.DestinationFromAddr(target)
 
 	// Replace with a domain name if target address IP is a fake IP.
 	var shouldSniffDomain = false
-	if h.fakeDns != nil {
-		if h.fakeDns.IsFakeIP(target.IP) {
-			domain := h.fakeDns.QueryDomain(target.IP)
-			if len(domain) == 0 {
-				shouldSniffDomain = true
-				dest.Address = vnet.IPAddress([]byte{1, 2, 3, 4})
-			} else {
-				dest.Address = vnet.DomainAddress(domain)
-			}
+	domain := meta.Domain
+	if len(domain) == 0 && h.fakeDns != nil && h.fakeDns.IsFakeIP(target.IP) {
+		domain = h.fakeDns.QueryDomain(target.IP)
+		if len(domain) == 0 {
+			shouldSniffDomain = true
+			dest.Address = vnet.IPAddress([]byte{1, 2, 3, 4})
 		}
 	}
+	if len(domain) != 0 {
+		dest.Address = vnet.DomainAddress(domain)
+	}
 
 	var err error
 	var processes = []string{"unknown process"}
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	if list, err := proc.GetProcessesBySocket(target.Network(), localHost, uint16(localPortInt)); err == nil {
+	if len(meta.Process) != 0 {
+		processes = meta.Process
+	} else if list, err := proc.GetProcessesByAddr(conn.LocalAddr()); err == nil {
+		// Not resolved by the stack.
 		processes = list
 	}
 
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
@@ -90,16 +89,27 @@ func NewUDPHandler(instance *vcore.Instance, sniffing *vproxyman.SniffingConfig,
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	meta := &core.Metadata{Network: "udp", Source: conn.LocalAddr(), UID: -1}
+	if target != nil {
+		meta.Destination = target
+	}
+	return h.ConnectContext(context.Background(), conn, meta)
+}
+
+// ConnectContext dials V2Ray for conn, with the processes of meta as the
+// application of the session.
+func (h *udpHandler) ConnectContext(_ context.Context, conn core.UDPConn, meta *core.Metadata) error {
+	target, _ := meta.Destination.(*net.UDPAddr)
 	if target == nil {
 		return errors.New("nil target is not allowed")
 	}
 
 	var err error
 	var processes = []string{"unknown process"}
-	// Get name of the process.
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	if list, err := proc.GetProcessesBySocket(target.Network(), localHost, uint16(localPortInt)); err == nil {
+	if len(meta.Process) != 0 {
+		processes = meta.Process
+	} else if list, err := proc.GetProcessesByAddr(conn.LocalAddr()); err == nil {
+		// Not resolved by the stack.
 		processes = list
 	}
 
@@ -217,6 +227,11 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 	delete(h.conns, conn)
 }
 
+// Closed releases resources associated with conn when it's closed by core.
+func (h *udpHandler) Closed(conn core.UDPConn) {
+	h.Close(conn)
+}
+
 func (h *udpHandler) CloseNolog(conn core.UDPConn) {
 	conn.Close()
 